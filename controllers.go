@@ -33,21 +33,36 @@ func healthController(w http.ResponseWriter, r *http.Request) {
 	health := GetHealthStats()
 	body, _ := json.Marshal(health)
 	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	_, _ = w.Write(body)
 }
 
 func imageController(o ServerOptions, operation Operation) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		var imageSource = MatchSource(req)
-		if imageSource == nil {
-			ErrorReply(req, w, ErrMissingImageSource, o)
+		// A JSON request is translated into query params, and may carry the image
+		spec, buf, ok, err := readImageRequest(req, o)
+		if err != nil {
+			ErrorReply(req, w, ToError(err, BadRequest), o)
 			return
 		}
+		if ok {
+			req = spec
+		}
 
-		buf, err := imageSource.GetImage(req)
-		if err != nil {
-			ErrorReply(req, w, NewError(err.Error(), BadRequest), o)
-			return
+		if buf == nil {
+			imageSource, err := MatchSource(req)
+			if err != nil {
+				ErrorReply(req, w, ToError(err, BadRequest), o)
+				return
+			}
+
+			buf, err = imageSource.GetImage(req)
+			if err != nil {
+				ErrorReply(req, w, ToError(err, BadRequest), o)
+				return
+			}
 		}
 
 		if len(buf) == 0 {
@@ -101,13 +116,28 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation
 		return
 	}
 
-	opts, err := buildParamsFromQuery(r.URL.Query())
+	// A preset replaces the operation of the endpoint with its pipeline
+	query := r.URL.Query()
+	vary := ""
+	if name := query.Get("preset"); name != "" {
+		var negotiated bool
+		var err error
+		if query, negotiated, err = applyPreset(name, query, r.Header.Get("Accept")); err != nil {
+			ErrorReply(r, w, ToError(err, BadRequest), o)
+			return
+		}
+		if negotiated {
+			vary = "Accept"
+		}
+		operation = Pipeline
+	}
+
+	opts, err := buildParamsFromQuery(query)
 	if err != nil {
 		ErrorReply(r, w, NewError("Error while processing parameters, "+err.Error(), BadRequest), o)
 		return
 	}
 
-	vary := ""
 	if opts.Type == "auto" {
 		opts.Type = determineAcceptMimeType(r.Header.Get("Accept"))
 		vary = "Accept" // Ensure caches behave correctly for negotiated content
@@ -116,16 +146,40 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation
 		return
 	}
 
+	sink, err := MatchSink(r)
+	if err != nil {
+		ErrorReply(r, w, ToError(err, BadRequest), o)
+		return
+	}
+
+	if len(opts.Outputs) > 0 {
+		if !isPipeline(operation) {
+			ErrorReply(r, w, ErrOutputsNotSupported, o)
+			return
+		}
+		if err := checkPipelineOutputs(r, opts.Outputs, sink); err != nil {
+			ErrorReply(r, w, ToError(err, BadRequest), o)
+			return
+		}
+	}
+
 	if r.URL.Path == "/watermarkimagesvg" {
 		var data []byte
 		var err error
 
 		switch {
+		case parseStorageProfile(r) != "":
+			var profile *StorageProfile
+			if profile, err = GetStorageProfile(parseStorageProfile(r)); err == nil {
+				data, err = profile.Download(r.Context(), parseStorageContainer(r), opts.Image, o.MaxAllowedSize)
+			}
 		case len(parseS3Key(r)) != 0:
 			s := S3Source{
 				Zone: parseS3Region(r),
 			}
-			data, err = s.DownloadImage(parseS3Bucket(r), opts.Image)
+			if err = CheckStorageRead(string(ImageSourceTypeS3), parseS3Bucket(r), opts.Image); err == nil {
+				data, err = s.DownloadImage(parseS3Bucket(r), opts.Image)
+			}
 		case parseAzureSASToken(r) != "" && len(parseAzureBlobKey(r)) != 0:
 			s := &AzureSASSource{
 				SASToken:    parseAzureSASToken(r),
@@ -135,11 +189,13 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation
 			data, err = s.DownloadImage(parseAzureContainer(r), opts.Image)
 		case len(parseAzureBlobKey(r)) != 0:
 			s := NewAzureImageSource(nil).(ImageDownUploader)
-			data, err = s.DownloadImage(parseAzureContainer(r), opts.Image)
+			if err = CheckStorageRead(string(ImageSourceTypeAzure), parseAzureContainer(r), opts.Image); err == nil {
+				data, err = s.DownloadImage(parseAzureContainer(r), opts.Image)
+			}
 		}
 
 		if err != nil {
-			ErrorReply(r, w, NewError("Error while downloading svg: "+err.Error(), BadRequest), o)
+			ErrorReply(r, w, NewError("Error while downloading svg: "+err.Error(), ToError(err, BadRequest).Code), o)
 			return
 		}
 
@@ -152,78 +208,28 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation
 		return
 	}
 
-	if len(parseS3Key(r)) != 0 {
-		if err := uploadBufferToS3(
-			image.Body,
-			parseS3OutputKey(r),
-			parseS3Bucket(r),
-			parseS3Region(r),
-		); err != nil {
-			ErrorReply(
-				r, w,
-				NewError(
-					fmt.Sprintf("Error while processing the s3 image: %s", err),
-					InternalError,
-				), o,
-			)
-			return
-		}
-
-		w.WriteHeader(http.StatusOK)
+	if len(image.Outputs) > 0 {
+		replyWithOutputs(w, r, image, opts.Outputs, sink, o)
 		return
 	}
 
-	if parseAzureSASToken(r) == "" && len(parseAzureBlobKey(r)) != 0 {
-		if err := uploadBufferToAzure(
-			image.Body,
-			parseAzureBlobOutputKey(r),
-			parseAzureContainer(r),
-		); err != nil {
-			ErrorReply(
-				r, w,
-				NewError(
-					fmt.Sprintf("Error while processing the azure image: %s", err),
-					InternalError,
-				), o,
-			)
-			return
-		}
-
-		w.WriteHeader(http.StatusOK)
-		return
-	} else if sasToken := parseAzureSASToken(r); len(sasToken) != 0 {
-		url, err := assebleBlobURL(
-			sasToken,
-			os.Getenv("AZURE_ACCOUNT_NAME"),
-			parseAzureContainer(r),
-			parseAzureBlobOutputKey(r),
-		)
+	if sink != nil {
+		result, err := sink.Upload(r, image)
 		if err != nil {
-			ErrorReply(
-				r, w,
-				NewError(
-					fmt.Sprintf("Error while assembling azure url: %s", err),
-					InternalError,
-				), o,
-			)
+			e := ToError(err, InternalError)
+			ErrorReply(r, w, NewError("Error while uploading the image: "+e.Message, e.Code), o)
 			return
 		}
 
-		if err := uploadBufferToAzureSAS(
-			image.Body,
-			url,
-		); err != nil {
-			ErrorReply(
-				r, w,
-				NewError(
-					fmt.Sprintf("Error while processing the azure sas image: %s", err),
-					InternalError,
-				), o,
-			)
-			return
+		result.Size = len(image.Body)
+		result.Mime = image.Mime
+		if size, err := bimg.Size(image.Body); err == nil {
+			result.Width, result.Height = size.Width, size.Height
 		}
 
-		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(result)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
 		return
 	}
 
@@ -286,6 +292,7 @@ func DZSave(w http.ResponseWriter, r *http.Request) {
 
 	req := struct {
 		Provider string `json:"provider"` // azure ||  s3 || azureSAS
+		Profile  string `json:"profile"`  // storage profile name
 
 		ImageKey      string `json:"imageKey"`
 		Container     string `json:"container"`
@@ -295,6 +302,11 @@ func DZSave(w http.ResponseWriter, r *http.Request) {
 
 		SASToken    string `json:"sasToken"`    // sas token for azure
 		AccountName string `json:"accountName"` // account name which is used in conjunction with sas token
+
+		CallbackURL    string `json:"callbackUrl"`    // notified once the files are uploaded
+		CallbackSecret string `json:"callbackSecret"` // signs the callback body
+
+		DZSaveOptions
 	}{}
 
 	data, err := ioutil.ReadAll(r.Body)
@@ -325,27 +337,36 @@ func DZSave(w http.ResponseWriter, r *http.Request) {
 		req.TempContainer = req.Container
 	}
 
-	if req.Provider == "" {
+	if req.Provider == "" && req.Profile == "" {
 		req.Provider = "azure"
 	}
 
-	if err := UploadDZFiles(DZFilesConfig{
+	job, err := UploadDZFiles(DZFilesConfig{
 		Provider:      req.Provider,
+		Profile:       req.Profile,
 		ImageKey:      req.ImageKey,
 		Container:     req.Container,
 		TempContainer: req.TempContainer,
 		ContainerZone: req.ContainerZone,
 		SASToken:      req.SASToken,
 		AccountName:   req.AccountName,
-	}); err != nil {
+		Options:       req.DZSaveOptions,
+	}, req.CallbackURL, req.CallbackSecret)
+	if err != nil {
 		ErrorReply(r, w,
 			NewError(
 				fmt.Sprintf("controllers: uploading dz files error: %s", err),
-				InternalError,
+				ToError(err, InternalError).Code,
 			),
 			ServerOptions{},
 		)
 		return
 	}
 
+	body, _ := json.Marshal(job)
+	w.Header().Set("Content-Type", "application/json")
+	// Relative to the dzsave route, so it honors the path prefix
+	w.Header().Set("Location", strings.TrimPrefix(JobsPrefix, "/")+"/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(body)
 }
@@ -1,35 +1,30 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
-func init() {
-	// TODO: since we are using rand, we need this seed somewhere better
-	rand.Seed(time.Now().UnixNano())
-}
-
-// Make sure that all implementations implement ImageDownUploader
-var (
-	_ ImageDownUploader = (*AzureSASSource)(nil)
-	_ ImageDownUploader = (*AzureImageSource)(nil)
-	_ ImageDownUploader = (*S3Source)(nil)
-)
+// JobTypeDZSave is the job type generating the Deep Zoom files of an image.
+const JobTypeDZSave = "dzsave"
 
-type ImageDownUploader interface {
-	DownloadImage(container, imageKey string) ([]byte, error)
-	UploadImage(data []byte, fileKey, container string) error
+func init() {
+	RegisterJobHandler(JobTypeDZSave, runDZFilesJob)
 }
 
 func initDownloadUploader(dzConf DZFilesConfig) (ImageDownUploader, error) {
+	if dzConf.Profile != "" {
+		return GetStorageProfile(dzConf.Profile)
+	}
+
 	switch dzConf.Provider {
 	case "azure":
 		source := NewAzureImageSource(nil).(ImageDownUploader)
@@ -48,8 +43,34 @@ func initDownloadUploader(dzConf DZFilesConfig) (ImageDownUploader, error) {
 	return nil, fmt.Errorf("dzfiles: unknown provider")
 }
 
+// checkDZFilesAccess checks the source image and the prefix of the generated
+// files against the storage allowlists. SAS uploads carry their own
+// authorization and are not checked.
+func checkDZFilesAccess(dzConf DZFilesConfig, keyPrefix string) error {
+	if dzConf.Profile != "" {
+		profile, err := GetStorageProfile(dzConf.Profile)
+		if err != nil {
+			return err
+		}
+		if err := profile.checkRead(dzConf.Container, dzConf.ImageKey); err != nil {
+			return err
+		}
+		return profile.checkWrite(dzConf.TempContainer, keyPrefix)
+	}
+
+	if dzConf.Provider != "azure" && dzConf.Provider != "s3" {
+		return nil
+	}
+
+	if err := CheckStorageRead(dzConf.Provider, dzConf.Container, dzConf.ImageKey); err != nil {
+		return err
+	}
+	return CheckStorageWrite(dzConf.Provider, dzConf.TempContainer, keyPrefix)
+}
+
 type DZFilesConfig struct {
 	Provider string // azure || azureSAS ||  s3
+	Profile  string // storage profile, takes precedence over Provider
 
 	ImageKey      string
 	Container     string
@@ -59,142 +80,239 @@ type DZFilesConfig struct {
 
 	SASToken    string // sas token for azure
 	AccountName string // account name which is used in conjunction with sas token
+
+	Options DZSaveOptions
+}
+
+// DZFilesResult represents the outcome of a dzsave job.
+type DZFilesResult struct {
+	Container string   `json:"container"`
+	Keys      []string `json:"keys"` // descriptors, archives and tile directories
+	Files     int      `json:"files"`
+	Tiles     int      `json:"tiles"`
 }
 
-func UploadDZFiles(dzConf DZFilesConfig) error {
+// UploadDZFiles checks the request and queues the generation of the Deep Zoom
+// files, returning the job which tracks it. The callback URL, if any, is
+// notified once the job is finished.
+func UploadDZFiles(dzConf DZFilesConfig, callbackURL, callbackSecret string) (Job, error) {
+	if _, err := initDownloadUploader(dzConf); err != nil {
+		return Job{}, fmt.Errorf("dzfiles: error getting source: %w", err)
+	}
+
+	keyDir, imageName := splitDZImageKey(dzConf.ImageKey)
+	if err := checkDZFilesAccess(dzConf, filepath.Join(keyDir, imageName)); err != nil {
+		return Job{}, err
+	}
+
+	dzConf.Options = dzConf.Options.WithDefaults()
+	if err := dzConf.Options.Validate(); err != nil {
+		return Job{}, err
+	}
+
+	if jobQueue == nil {
+		return Job{}, NewError("dzfiles: job queue is not started", InternalError)
+	}
+
+	callback, err := NewJobCallback(callbackURL, callbackSecret, jobQueue.opts.CallbackOrigins)
+	if err != nil {
+		return Job{}, err
+	}
+	return jobQueue.Submit(JobTypeDZSave, dzConf, callback)
+}
+
+// splitDZImageKey returns the directory of the image key and the image name
+// without extension.
+func splitDZImageKey(imageKey string) (string, string) {
+	keyDir, imageName := filepath.Split(imageKey)
+	return keyDir, imageName[:len(imageName)-len(filepath.Ext(imageName))]
+}
+
+// DZUploadOptions represents the settings of the generated files uploads.
+type DZUploadOptions struct {
+	Workers  int
+	Attempts int
+	Backoff  time.Duration
+}
+
+var dzUploadOptions = DZUploadOptions{Workers: 16, Attempts: 3, Backoff: time.Second}
+
+// ConfigureDZUploads configures the uploads of the generated files.
+func ConfigureDZUploads(o DZUploadOptions) error {
+	if o.Workers < 1 {
+		return fmt.Errorf("dzfiles: invalid number of upload workers: %d", o.Workers)
+	}
+	if o.Attempts < 1 {
+		return fmt.Errorf("dzfiles: invalid number of upload attempts: %d", o.Attempts)
+	}
+	dzUploadOptions = o
+	return nil
+}
+
+// runDZFilesJob generates the Deep Zoom files of an image and uploads them
+// next to it. The files and the manifest of the uploaded ones are kept in
+// the job work directory, so a retried job only uploads the missing files.
+// The progress counts the uploaded files.
+func runDZFilesJob(ctx context.Context, params json.RawMessage, progress func(done, total int)) (interface{}, error) {
+	var dzConf DZFilesConfig
+	if err := json.Unmarshal(params, &dzConf); err != nil {
+		return nil, NewError(fmt.Sprintf("dzfiles: invalid job params: %s", err), BadRequest)
+	}
+
 	downUploader, err := initDownloadUploader(dzConf)
 	if err != nil {
-		return fmt.Errorf("dzfiles: error getting source: %w", err)
-	}
-
-	keyDir, imageName := filepath.Split(dzConf.ImageKey)
-	fileExtension := filepath.Ext(imageName)
-	imageName = imageName[:len(imageName)-len(fileExtension)]
-	if err := downUploader.UploadImage(
-		[]byte("pending"),
-		filepath.Join(keyDir, imageName+".txt"),
-		dzConf.TempContainer,
-	); err != nil {
-		return fmt.Errorf("dzfiles: error creating txt file: %w", err)
-	}
-
-	// TODO: this is just an ugly hack which is terrible, this needs to be solved with
-	// async task.
-	go func() (err error) {
-		// TODO: hack to defer error
-		defer func() {
-			if err != nil {
-				downUploader.UploadImage(
-					[]byte(err.Error()),
-					filepath.Join(keyDir, imageName+".txt"),
-					dzConf.TempContainer,
-				)
-				fmt.Printf("dzfiles: error: %s", err)
-			}
-		}()
+		return nil, NewError(fmt.Sprintf("dzfiles: error getting source: %s", err), BadRequest)
+	}
 
-		localDirPath := fmt.Sprintf("/tmp/dzFiles-%d", rand.Uint64())
-		if err := os.Mkdir(localDirPath, 0777); err != nil {
-			return fmt.Errorf("dzfiles: error creating tmp dir: %w", err)
-		}
-		defer os.RemoveAll(localDirPath)
+	keyDir, imageName := splitDZImageKey(dzConf.ImageKey)
+
+	workDir, err := JobWorkDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	localDirPath := filepath.Join(workDir, "files")
+
+	if err := generateDZFiles(downUploader, dzConf, workDir, filepath.Join(localDirPath, imageName)); err != nil {
+		return nil, err
+	}
+
+	result := DZFilesResult{Container: dzConf.TempContainer}
+	tileExt := dzFormats[dzConf.Options.Format]
 
-		data, err := downUploader.DownloadImage(dzConf.Container, dzConf.ImageKey)
+	var files []string
+	if err := filepath.Walk(localDirPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return fmt.Errorf("dzfiles: error downloading image: %w", err)
+			return err
 		}
-
-		if err := generateDZFiles(localDirPath, data, imageName, fileExtension); err != nil {
-			return fmt.Errorf("dzfiles: error generating dz files: %w", err)
+		if path == localDirPath {
+			return nil
 		}
 
-		var g errgroup.Group
-		g.Go(func() error {
-			data, err := ioutil.ReadFile(filepath.Join(localDirPath, imageName+".dzi"))
-			if err != nil {
-				return fmt.Errorf("dzfiles: error reading index file: %w", err)
+		key := keyDir + path[len(localDirPath)+1:] // +1 -> for slash "/",
+		if filepath.Dir(path) == localDirPath {
+			if info.IsDir() {
+				key += "/"
+			}
+			result.Keys = append(result.Keys, key)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			if filepath.Ext(path) == tileExt {
+				result.Tiles++
 			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("dzfiles: error walking dir path: %w", err)
+	}
+	result.Files = len(files)
 
-			if err := downUploader.UploadImage(
-				data,
-				filepath.Join(keyDir, imageName+".dzi"),
-				dzConf.TempContainer,
-			); err != nil {
-				return fmt.Errorf("dzfiles: error uploading index file: %w", err)
+	manifest, err := OpenUploadManifest(filepath.Join(workDir, "manifest"))
+	if err != nil {
+		return nil, err
+	}
+	defer manifest.Close()
+
+	done := int32(manifest.Len())
+	progress(int(done), len(files))
+
+	// A bounded number of workers read and upload one file at a time
+	paths := make(chan string)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(paths)
+		for _, path := range files {
+			select {
+			case paths <- path:
+			case <-gctx.Done():
+				return gctx.Err()
 			}
+		}
+		return nil
+	})
 
+	for i := 0; i < dzUploadOptions.Workers; i++ {
+		g.Go(func() error {
+			for path := range paths {
+				key := keyDir + path[len(localDirPath)+1:] // +1 -> for slash "/",
+				if manifest.Uploaded(key) {
+					continue
+				}
+
+				if err := uploadDZFile(gctx, downUploader, path, key, dzConf.TempContainer); err != nil {
+					return err
+				}
+				if err := manifest.Add(key); err != nil {
+					return err
+				}
+
+				progress(int(atomic.AddInt32(&done, 1)), len(files))
+			}
 			return nil
 		})
+	}
 
-		if err := filepath.Walk(
-			filepath.Join(localDirPath, imageName+"_files"),
-			filepath.WalkFunc(
-				func(path string, info os.FileInfo, err error) error {
-					if err != nil {
-						return err
-					}
-
-					if info.IsDir() {
-						return nil
-					}
-
-					g.Go(func() error {
-						data, err := ioutil.ReadFile(path)
-						if err != nil {
-							return fmt.Errorf("dzfiles: error reading file: %s: %w", path, err)
-						}
-
-						if err := downUploader.UploadImage(
-							data,
-							keyDir+path[len(localDirPath)+1:], // +1 -> for slash "/",
-							dzConf.TempContainer,
-						); err != nil {
-							return fmt.Errorf("dzfiles: error uploading file: %s: %w", path, err)
-						}
-
-						return nil
-					})
-
-					return nil
-				},
-			),
-		); err != nil {
-			return fmt.Errorf("dzfiles: error walking dir path: %w", err)
-		}
-
-		if err := g.Wait(); err != nil {
-			return err
-		}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
-		if err := downUploader.UploadImage(
-			[]byte("ok"),
-			filepath.Join(keyDir, imageName+".txt"),
-			dzConf.TempContainer,
-		); err != nil {
-			return fmt.Errorf("dzfiles: error creating ok txt file: %s", err)
-		}
+	debug("DZfiles upload for: %s", filepath.Join(keyDir, imageName))
 
-		fmt.Printf("DZfiles upload for: %s\n", filepath.Join(keyDir, imageName))
+	return result, nil
+}
 
+// generateDZFiles downloads the image and generates its files, unless a
+// previous attempt of the job already did.
+func generateDZFiles(downUploader ImageDownUploader, dzConf DZFilesConfig, workDir, name string) error {
+	generated := filepath.Join(workDir, "generated")
+	if _, err := os.Stat(generated); err == nil {
 		return nil
-	}()
-
-	return nil
-}
+	}
 
-// generateDZFiles generates dz files in given dir with same image name, just changed
-// extension.
-func generateDZFiles(dirPath string, data []byte, imageName string, fileExtension string,) error {
-	imagePath := fmt.Sprintf("%s/%s", dirPath, imageName)
+	if err := os.RemoveAll(filepath.Dir(name)); err != nil {
+		return fmt.Errorf("dzfiles: error cleaning dir: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return fmt.Errorf("dzfiles: error creating dir: %w", err)
+	}
 
-	tiffImagePath := imagePath + fileExtension
-	if err := ioutil.WriteFile(tiffImagePath, data, 0777); err != nil {
-		return fmt.Errorf("dzfiles: error saving tiff image to disk: %w", err)
+	data, err := downUploader.DownloadImage(dzConf.Container, dzConf.ImageKey)
+	if err != nil {
+		return fmt.Errorf("dzfiles: error downloading image: %w", err)
 	}
 
-	if err := exec.Command("vips", "dzsave", tiffImagePath, imagePath).Run(); err != nil {
-		return fmt.Errorf("dzfiles: error creating dz files: %w", err)
+	if err := dzSave(data, name, dzConf.Options); err != nil {
+		// The image cannot be processed, a retry would fail the same way
+		return NewError(fmt.Sprintf("dzfiles: error generating dz files: %s", err), BadRequest)
 	}
 
+	if err := ioutil.WriteFile(generated, nil, 0600); err != nil {
+		return fmt.Errorf("dzfiles: error writing marker: %w", err)
+	}
 	return nil
 }
+
+// uploadDZFile uploads a generated file, retrying with an exponential
+// backoff unless the error is caused by the request.
+func uploadDZFile(ctx context.Context, uploader ImageDownUploader, path, key, container string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("dzfiles: error reading file: %s: %w", path, err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = uploader.UploadImage(data, key, container)
+		if err == nil {
+			return nil
+		}
+		if attempt >= dzUploadOptions.Attempts || !retryableJobError(err) {
+			return fmt.Errorf("dzfiles: error uploading file: %s: %w", key, err)
+		}
+
+		select {
+		case <-time.After(dzUploadOptions.Backoff << uint(attempt-1)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
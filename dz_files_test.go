@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDownUploader fails the first uploads with the given error.
+type testDownUploader struct {
+	*MemoryStorage
+	failures int
+	err      error
+}
+
+func (u *testDownUploader) UploadImage(data []byte, fileKey, container string) error {
+	if u.failures > 0 {
+		u.failures--
+		return u.err
+	}
+	return u.MemoryStorage.UploadImage(data, fileKey, container)
+}
+
+func TestUploadDZFileRetries(t *testing.T) {
+	defer func(o DZUploadOptions) { dzUploadOptions = o }(dzUploadOptions)
+	if err := ConfigureDZUploads(DZUploadOptions{Workers: 1, Attempts: 3, Backoff: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "imaginary-dzfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "0_0.jpeg")
+	if err := ioutil.WriteFile(path, []byte("tile"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := &testDownUploader{MemoryStorage: NewMemoryStorage(), failures: 2, err: errors.New("timeout")}
+	if err := uploadDZFile(context.Background(), uploader, path, "image_files/0/0_0.jpeg", "tiles"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := uploader.DownloadImage("tiles", "image_files/0/0_0.jpeg"); err != nil || string(data) != "tile" {
+		t.Errorf("Invalid upload: %q %v", data, err)
+	}
+
+	uploader = &testDownUploader{MemoryStorage: NewMemoryStorage(), failures: 3, err: errors.New("timeout")}
+	if err := uploadDZFile(context.Background(), uploader, path, "image_files/0/0_0.jpeg", "tiles"); err == nil {
+		t.Error("Expected error once the attempts are exhausted")
+	}
+
+	uploader = &testDownUploader{MemoryStorage: NewMemoryStorage(), failures: 1, err: NewError("access denied", Forbidden)}
+	if err := uploadDZFile(context.Background(), uploader, path, "image_files/0/0_0.jpeg", "tiles"); err == nil || uploader.failures != 0 {
+		t.Errorf("Request errors must not be retried: %v", err)
+	}
+
+	if err := ConfigureDZUploads(DZUploadOptions{Workers: 0, Attempts: 1}); err == nil {
+		t.Error("Expected error for invalid workers")
+	}
+}
+
+func TestDZFilesJobMemoryStorage(t *testing.T) {
+	defer func(p map[string]*StorageProfile) { storageProfiles = p }(storageProfiles)
+	profile := &StorageProfile{Provider: StorageProviderMemory, Containers: []string{"images", "tiles"}}
+	if err := profile.init("memory"); err != nil {
+		t.Fatal(err)
+	}
+	storageProfiles = map[string]*StorageProfile{"memory": profile}
+
+	// Files generated and partly uploaded by a previous attempt
+	workDir, err := ioutil.TempDir("", "imaginary-dzfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	files := map[string]string{
+		"image.dzi":                       "<Image/>",
+		"image_files/0/0_0.jpeg":          "tile 0",
+		"image_files/1/0_0.jpeg":          "tile 1",
+		"image_files/vips-properties.xml": "<properties/>",
+	}
+	for name, data := range files {
+		path := filepath.Join(workDir, "files", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(workDir, "generated"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workDir, "manifest"), []byte("photos/image.dzi\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	params, _ := json.Marshal(DZFilesConfig{
+		Profile:       "memory",
+		ImageKey:      "photos/image.jpg",
+		Container:     "images",
+		TempContainer: "tiles",
+		Options:       DZSaveOptions{}.WithDefaults(),
+	})
+	ctx := context.WithValue(context.Background(), jobWorkDirKey{}, workDir)
+	var mu sync.Mutex
+	var done, total int
+	result, err := runDZFilesJob(ctx, params, func(d, t int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d > done {
+			done, total = d, t
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := result.(DZFilesResult); r.Files != 4 || r.Tiles != 2 || len(r.Keys) != 2 {
+		t.Errorf("Invalid result: %+v", r)
+	}
+	if done != 4 || total != 4 {
+		t.Errorf("Invalid progress: %d/%d", done, total)
+	}
+
+	objects, err := profile.List("tiles", "photos/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The descriptor recorded in the manifest is not uploaded again
+	if len(objects) != 3 || objects[0].Key != "photos/image_files/0/0_0.jpeg" {
+		t.Fatalf("Invalid uploaded objects: %+v", objects)
+	}
+	if data, err := profile.DownloadImage("tiles", "photos/image_files/1/0_0.jpeg"); err != nil || string(data) != "tile 1" {
+		t.Errorf("Invalid uploaded tile: %q %v", data, err)
+	}
+}
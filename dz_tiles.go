@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DeepZoomPrefix is the route serving Deep Zoom images generated on the fly.
+	DeepZoomPrefix    = "/dz"
+	deepZoomNamespace = "http://schemas.microsoft.com/deepzoom/2008"
+	deepZoomMime      = "application/xml"
+)
+
+// deepZoomFormats maps the tile file extensions to the image types.
+var deepZoomFormats = map[string]string{
+	"jpeg": "jpeg",
+	"jpg":  "jpeg",
+	"png":  "png",
+	"webp": "webp",
+}
+
+// DeepZoomOptions represents the configuration of the Deep Zoom route.
+type DeepZoomOptions struct {
+	Source   string
+	TileSize int
+	Overlap  int
+	Format   string
+	Cache    *OriginCache
+}
+
+// DeepZoomImage represents the .dzi descriptor of an image.
+type DeepZoomImage struct {
+	XMLName  xml.Name     `xml:"Image"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Format   string       `xml:"Format,attr"`
+	Overlap  int          `xml:"Overlap,attr"`
+	TileSize int          `xml:"TileSize,attr"`
+	Size     DeepZoomSize `xml:"Size"`
+}
+
+// DeepZoomSize represents the size of a Deep Zoom image.
+type DeepZoomSize struct {
+	Width  int `xml:"Width,attr"`
+	Height int `xml:"Height,attr"`
+}
+
+// DeepZoomTile identifies a tile of a Deep Zoom image.
+type DeepZoomTile struct {
+	Level, Column, Row int
+	Type               string
+}
+
+// Validate checks the Deep Zoom options given by the command-line flags. An
+// empty source disables the route.
+func (o DeepZoomOptions) Validate() error {
+	if o.Source != "" {
+		if _, err := parseIdentifierSource(o.Source); err != nil {
+			return err
+		}
+	}
+	if o.TileSize <= 0 {
+		return fmt.Errorf("deep zoom: invalid tile size: %d", o.TileSize)
+	}
+	if o.Overlap < 0 || o.Overlap >= o.TileSize {
+		return fmt.Errorf("deep zoom: invalid overlap: %d", o.Overlap)
+	}
+	if _, ok := deepZoomFormats[o.Format]; !ok {
+		return fmt.Errorf("deep zoom: unsupported format: %s", o.Format)
+	}
+	return nil
+}
+
+// deepZoomController serves Deep Zoom images, extracting and scaling the
+// region of each tile from the source image on demand:
+//
+//	/dz/{image}.dzi
+//	/dz/{image}_files/{level}/{col}_{row}.{format}
+func deepZoomController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	prefix := join(o, DeepZoomPrefix) + "/"
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			ErrorReply(r, w, ErrMethodNotAllowed, o)
+			return
+		}
+
+		p, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+		if err != nil {
+			ErrorReply(r, w, ErrNotFound, o)
+			return
+		}
+
+		identifier, tile, err := parseDeepZoomPath(p)
+		if err != nil {
+			ErrorReply(r, w, ToError(err, NotFound), o)
+			return
+		}
+
+		mime := deepZoomMime
+		if tile != nil {
+			mime = GetImageMimeType(ImageType(tile.Type))
+		}
+
+		dz := o.DeepZoom
+		key := deepZoomCacheKey(dz, p)
+		if dz.Cache != nil {
+			if entry, ok := dz.Cache.Lookup(key); ok && entry.Fresh(dz.Cache.MaxAge()) {
+				if buf, err := dz.Cache.Read(key); err == nil {
+					writeDeepZoomResponse(w, mime, buf)
+					return
+				}
+			}
+		}
+
+		buf, err := readIdentifierImage(r, dz.Source, identifier)
+		if err != nil {
+			ErrorReply(r, w, ToError(err, BadRequest), o)
+			return
+		}
+
+		width, height, err := orientedImageSize(buf)
+		if err != nil {
+			ErrorReply(r, w, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest), o)
+			return
+		}
+
+		var body []byte
+		if tile == nil {
+			body, err = newDeepZoomImage(dz, width, height)
+		} else {
+			body, err = renderDeepZoomTile(dz, buf, width, height, *tile)
+		}
+		if err != nil {
+			ErrorReply(r, w, ToError(err, BadRequest), o)
+			return
+		}
+
+		if dz.Cache != nil {
+			if err := dz.Cache.Store(key, r.URL.Path, body, http.Header{}); err != nil {
+				debug("deep zoom: error caching %s: %s", r.URL.Path, err)
+			}
+		}
+
+		writeDeepZoomResponse(w, mime, body)
+	}
+}
+
+func writeDeepZoomResponse(w http.ResponseWriter, mime string, body []byte) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	_, _ = w.Write(body)
+}
+
+// parseDeepZoomPath returns the image identifier and the requested tile,
+// which is nil for the .dzi descriptor.
+func parseDeepZoomPath(p string) (string, *DeepZoomTile, error) {
+	if strings.HasSuffix(p, ".dzi") {
+		identifier := strings.TrimSuffix(p, ".dzi")
+		if identifier == "" {
+			return "", nil, ErrNotFound
+		}
+		return identifier, nil, nil
+	}
+
+	i := strings.LastIndex(p, "_files/")
+	if i <= 0 {
+		return "", nil, ErrNotFound
+	}
+
+	parts := strings.Split(p[i+len("_files/"):], "/")
+	if len(parts) != 2 {
+		return "", nil, ErrNotFound
+	}
+
+	name := parts[1]
+	ext := strings.LastIndex(name, ".")
+	if ext < 0 {
+		return "", nil, ErrNotFound
+	}
+	coords := strings.Split(name[:ext], "_")
+	if len(coords) != 2 {
+		return "", nil, ErrNotFound
+	}
+
+	var tile DeepZoomTile
+	var ok bool
+	if tile.Type, ok = deepZoomFormats[name[ext+1:]]; !ok {
+		return "", nil, ErrNotFound
+	}
+
+	values := []*int{&tile.Level, &tile.Column, &tile.Row}
+	for j, value := range []string{parts[0], coords[0], coords[1]} {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return "", nil, ErrNotFound
+		}
+		*values[j] = n
+	}
+
+	return p[:i], &tile, nil
+}
+
+func newDeepZoomImage(o DeepZoomOptions, width, height int) ([]byte, error) {
+	body, err := xml.Marshal(DeepZoomImage{
+		Xmlns:    deepZoomNamespace,
+		Format:   o.Format,
+		Overlap:  o.Overlap,
+		TileSize: o.TileSize,
+		Size:     DeepZoomSize{Width: width, Height: height},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// deepZoomMaxLevel returns the level where the image has its full size. The
+// size is halved at each lower level, down to a single pixel at level 0.
+func deepZoomMaxLevel(width, height int) int {
+	size := width
+	if height > size {
+		size = height
+	}
+
+	level := 0
+	for 1<<uint(level) < size {
+		level++
+	}
+	return level
+}
+
+// deepZoomTileRegion returns the region of the source image covered by a
+// tile, and the size of the tile.
+func deepZoomTileRegion(o DeepZoomOptions, width, height int, tile DeepZoomTile) (IIIFImageRequest, error) {
+	maxLevel := deepZoomMaxLevel(width, height)
+	if tile.Level > maxLevel {
+		return IIIFImageRequest{}, ErrNotFound
+	}
+
+	scale := 1 << uint(maxLevel-tile.Level)
+	levelWidth, levelHeight := (width+scale-1)/scale, (height+scale-1)/scale
+
+	x0, x1, ok := deepZoomTileBounds(tile.Column, o.TileSize, o.Overlap, levelWidth)
+	if !ok {
+		return IIIFImageRequest{}, ErrNotFound
+	}
+	y0, y1, ok := deepZoomTileBounds(tile.Row, o.TileSize, o.Overlap, levelHeight)
+	if !ok {
+		return IIIFImageRequest{}, ErrNotFound
+	}
+
+	req := IIIFImageRequest{
+		Left:       x0 * scale,
+		Top:        y0 * scale,
+		AreaWidth:  minInt(x1*scale, width) - x0*scale,
+		AreaHeight: minInt(y1*scale, height) - y0*scale,
+		Width:      x1 - x0,
+		Height:     y1 - y0,
+		Quality:    "default",
+		Type:       tile.Type,
+	}
+	req.FullRegion = req.AreaWidth == width && req.AreaHeight == height
+
+	return req, nil
+}
+
+// deepZoomTileBounds returns the bounds of a tile along one axis of a level,
+// including the overlap with the adjacent tiles.
+func deepZoomTileBounds(index, tileSize, overlap, size int) (int, int, bool) {
+	start := index * tileSize
+	if start >= size {
+		return 0, 0, false
+	}
+
+	end := minInt(start+tileSize+overlap, size)
+	if index > 0 {
+		start -= overlap
+	}
+	return start, end, true
+}
+
+// renderDeepZoomTile processes a tile like an IIIF region request.
+func renderDeepZoomTile(o DeepZoomOptions, buf []byte, width, height int, tile DeepZoomTile) ([]byte, error) {
+	req, err := deepZoomTileRegion(o, width, height, tile)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := req.Process(buf)
+	if err != nil {
+		return nil, NewError("Error while processing the image: "+err.Error(), BadRequest)
+	}
+	return image.Body, nil
+}
+
+// deepZoomCacheKey builds the result cache key of a request path, which
+// depends on the source and the tiling options.
+func deepZoomCacheKey(o DeepZoomOptions, p string) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\n%d\n%d\n%s\n%s", o.Source, o.TileSize, o.Overlap, o.Format, p)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDeepZoomPath(t *testing.T) {
+	identifier, tile, err := parseDeepZoomPath("photos/painting.jpg.dzi")
+	if err != nil || identifier != "photos/painting.jpg" || tile != nil {
+		t.Errorf("Invalid descriptor path: %s %v %v", identifier, tile, err)
+	}
+
+	identifier, tile, err = parseDeepZoomPath("photos/painting.jpg_files/12/3_4.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DeepZoomTile{Level: 12, Column: 3, Row: 4, Type: "jpeg"}
+	if identifier != "photos/painting.jpg" || *tile != expected {
+		t.Errorf("Invalid tile path: %s %+v", identifier, *tile)
+	}
+
+	for _, p := range []string{".dzi", "_files/1/0_0.jpeg", "foo_files/1/0_0", "foo_files/1/0.jpeg", "foo_files/a/0_0.jpeg", "foo_files/1/0_0.bmp", "foo_files/1/-1_0.png", "foo.jpg"} {
+		if _, _, err := parseDeepZoomPath(p); err == nil {
+			t.Errorf("Expected error for path: %s", p)
+		}
+	}
+}
+
+func TestDeepZoomTileRegion(t *testing.T) {
+	o := DeepZoomOptions{TileSize: 254, Overlap: 1, Format: "jpeg"}
+
+	if level := deepZoomMaxLevel(1000, 600); level != 10 {
+		t.Errorf("Invalid max level: %d", level)
+	}
+
+	cases := []struct {
+		tile     DeepZoomTile
+		expected IIIFImageRequest
+	}{
+		{
+			DeepZoomTile{Level: 10, Column: 0, Row: 0, Type: "jpeg"},
+			IIIFImageRequest{AreaWidth: 255, AreaHeight: 255, Width: 255, Height: 255, Quality: "default", Type: "jpeg"},
+		},
+		{
+			DeepZoomTile{Level: 10, Column: 3, Row: 2, Type: "png"},
+			IIIFImageRequest{Left: 761, Top: 507, AreaWidth: 239, AreaHeight: 93, Width: 239, Height: 93, Quality: "default", Type: "png"},
+		},
+		{
+			DeepZoomTile{Level: 9, Column: 1, Row: 0, Type: "jpeg"},
+			IIIFImageRequest{Left: 506, AreaWidth: 494, AreaHeight: 510, Width: 247, Height: 255, Quality: "default", Type: "jpeg"},
+		},
+		{
+			DeepZoomTile{Level: 0, Type: "jpeg"},
+			IIIFImageRequest{FullRegion: true, AreaWidth: 1000, AreaHeight: 600, Width: 1, Height: 1, Quality: "default", Type: "jpeg"},
+		},
+	}
+
+	for _, tc := range cases {
+		req, err := deepZoomTileRegion(o, 1000, 600, tc.tile)
+		if err != nil {
+			t.Errorf("Cannot compute region of %+v: %s", tc.tile, err)
+			continue
+		}
+		if req != tc.expected {
+			t.Errorf("Invalid region of %+v: %+v", tc.tile, req)
+		}
+	}
+
+	for _, tile := range []DeepZoomTile{{Level: 11}, {Level: 10, Column: 4}, {Level: 1, Row: 1}} {
+		if _, err := deepZoomTileRegion(o, 1000, 600, tile); err == nil {
+			t.Errorf("Expected error for tile: %+v", tile)
+		}
+	}
+}
+
+func TestNewDeepZoomImage(t *testing.T) {
+	body, err := newDeepZoomImage(DeepZoomOptions{TileSize: 254, Overlap: 1, Format: "jpeg"}, 1000, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="jpeg" Overlap="1" TileSize="254"><Size Width="1000" Height="600"></Size></Image>`
+	if !strings.HasSuffix(string(body), expected) {
+		t.Errorf("Invalid descriptor: %s", body)
+	}
+}
+
+func TestDeepZoomOptionsValidate(t *testing.T) {
+	if err := (DeepZoomOptions{Source: "fs", TileSize: 254, Overlap: 1, Format: "jpeg"}).Validate(); err != nil {
+		t.Errorf("Valid options must pass: %s", err)
+	}
+
+	invalid := []DeepZoomOptions{
+		{Source: "gcs", TileSize: 254, Format: "jpeg"},
+		{Source: "fs", TileSize: 0, Format: "jpeg"},
+		{Source: "fs", TileSize: 254, Overlap: 254, Format: "jpeg"},
+		{Source: "fs", TileSize: 254, Format: "gif"},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Expected error for options: %+v", o)
+		}
+	}
+}
+
+func TestDeepZoomControllerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewOriginCache(dir, 1<<20, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := DeepZoomOptions{Source: "fs", TileSize: 254, Overlap: 1, Format: "jpeg", Cache: cache}
+	if err := cache.Store(deepZoomCacheKey(o, "missing.jpg_files/0/0_0.jpeg"), "", []byte("tile"), http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := NewServerMux(ServerOptions{Mount: "testdata", DeepZoom: o})
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dz/missing.jpg_files/0/0_0.jpeg", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "tile" || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Cached tile must be served: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dz/missing.jpg_files/0/0_0.png", nil))
+	if w.Code == http.StatusOK {
+		t.Error("Tile of a missing image must fail")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dz/missing.jpg", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Invalid status: %d", w.Code)
+	}
+}
+
+func TestDeepZoomControllerDisabled(t *testing.T) {
+	o := DeepZoomOptions{TileSize: 254, Overlap: 1, Format: "jpeg"}
+	for _, source := range []string{"", "fs"} {
+		o.Source = source
+		w := httptest.NewRecorder()
+		NewServerMux(ServerOptions{DeepZoom: o}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dz/large.jpg.dzi", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Invalid status with source %q: %d", source, w.Code)
+		}
+	}
+}
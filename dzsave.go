@@ -0,0 +1,201 @@
+package main
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+static int
+imaginary_dzsave(void *buf, size_t len, const char *name, int tile_size, int overlap,
+	VipsForeignDzDepth depth, const char *suffix, VipsForeignDzLayout layout,
+	VipsForeignDzContainer container)
+{
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	int err = vips_dzsave(image, name,
+		"tile_size", tile_size,
+		"overlap", overlap,
+		"depth", depth,
+		"suffix", suffix,
+		"layout", layout,
+		"container", container,
+		NULL);
+
+	g_object_unref(image);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// dzLayouts maps the pyramid layouts to the libvips ones.
+var dzLayouts = map[string]C.VipsForeignDzLayout{
+	"dz":      C.VIPS_FOREIGN_DZ_LAYOUT_DZ,
+	"zoomify": C.VIPS_FOREIGN_DZ_LAYOUT_ZOOMIFY,
+	"google":  C.VIPS_FOREIGN_DZ_LAYOUT_GOOGLE,
+	"iiif":    C.VIPS_FOREIGN_DZ_LAYOUT_IIIF,
+}
+
+// dzDepths maps the pyramid depths to the libvips ones.
+var dzDepths = map[string]C.VipsForeignDzDepth{
+	"onepixel": C.VIPS_FOREIGN_DZ_DEPTH_ONEPIXEL,
+	"onetile":  C.VIPS_FOREIGN_DZ_DEPTH_ONETILE,
+	"one":      C.VIPS_FOREIGN_DZ_DEPTH_ONE,
+}
+
+// dzOutputs maps the outputs to the libvips containers.
+var dzOutputs = map[string]C.VipsForeignDzContainer{
+	"dir": C.VIPS_FOREIGN_DZ_CONTAINER_FS,
+	"zip": C.VIPS_FOREIGN_DZ_CONTAINER_ZIP,
+}
+
+// dzFormats maps the tile formats to the file suffixes.
+var dzFormats = map[string]string{
+	"jpeg": ".jpeg",
+	"png":  ".png",
+	"webp": ".webp",
+}
+
+// DZSaveOptions represents the options of the generated image pyramid.
+// Overlap is a pointer, so an explicit 0 is told apart from a missing value.
+type DZSaveOptions struct {
+	TileSize int    `json:"tileSize"`
+	Overlap  *int   `json:"overlap,omitempty"`
+	Depth    string `json:"depth"`   // onepixel || onetile || one
+	Format   string `json:"format"`  // jpeg || png || webp
+	Quality  int    `json:"quality"` // jpeg and webp quality
+	Layout   string `json:"layout"`  // dz || zoomify || google || iiif
+	Output   string `json:"output"`  // dir || zip
+}
+
+// WithDefaults returns the options with the libvips defaults of the
+// missing fields.
+func (o DZSaveOptions) WithDefaults() DZSaveOptions {
+	if o.Layout == "" {
+		o.Layout = "dz"
+	}
+	if o.TileSize == 0 {
+		o.TileSize = 254
+		if o.Layout != "dz" {
+			o.TileSize = 256
+		}
+	}
+	if o.Overlap == nil {
+		overlap := 0
+		if o.Layout == "dz" {
+			overlap = 1
+		}
+		o.Overlap = &overlap
+	}
+	if o.Depth == "" {
+		o.Depth = "onepixel"
+		if o.Layout == "google" {
+			o.Depth = "onetile"
+		}
+	}
+	if o.Format == "" {
+		o.Format = "jpeg"
+	}
+	if o.Output == "" {
+		o.Output = "dir"
+	}
+	return o
+}
+
+// Validate checks the options, once the defaults are applied.
+func (o DZSaveOptions) Validate() error {
+	switch {
+	case o.TileSize < 1 || o.TileSize > 8192:
+		return NewError(fmt.Sprintf("dzsave: invalid tile size: %d", o.TileSize), BadRequest)
+	case o.overlap() < 0 || o.overlap() > o.TileSize:
+		return NewError(fmt.Sprintf("dzsave: invalid overlap: %d", o.overlap()), BadRequest)
+	case o.Quality < 0 || o.Quality > 100:
+		return NewError(fmt.Sprintf("dzsave: invalid quality: %d", o.Quality), BadRequest)
+	}
+
+	if _, ok := dzLayouts[o.Layout]; !ok {
+		return NewError(fmt.Sprintf("dzsave: unsupported layout: %s", o.Layout), BadRequest)
+	}
+	if _, ok := dzDepths[o.Depth]; !ok {
+		return NewError(fmt.Sprintf("dzsave: unsupported depth: %s", o.Depth), BadRequest)
+	}
+	if _, ok := dzFormats[o.Format]; !ok {
+		return NewError(fmt.Sprintf("dzsave: unsupported format: %s", o.Format), BadRequest)
+	}
+	if _, ok := dzOutputs[o.Output]; !ok {
+		return NewError(fmt.Sprintf("dzsave: unsupported output: %s", o.Output), BadRequest)
+	}
+	return nil
+}
+
+// overlap returns the tile overlap, 0 if undefined.
+func (o DZSaveOptions) overlap() int {
+	if o.Overlap == nil {
+		return 0
+	}
+	return *o.Overlap
+}
+
+// suffix returns the libvips tile suffix, which carries the save options.
+func (o DZSaveOptions) suffix() string {
+	suffix := dzFormats[o.Format]
+	if o.Quality > 0 && o.Format != "png" {
+		suffix += fmt.Sprintf("[Q=%d]", o.Quality)
+	}
+	return suffix
+}
+
+// dzSave generates the image pyramid of an image buffer with libvips. The
+// output is written next to the name path, e.g. name.dzi and name_files for
+// the dz layout or name.zip for the zip output.
+func dzSave(buf []byte, name string, o DZSaveOptions) error {
+	if len(buf) == 0 {
+		return ErrEmptyBody
+	}
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	cSuffix := C.CString(o.suffix())
+	defer C.free(unsafe.Pointer(cSuffix))
+
+	defer C.vips_thread_shutdown()
+
+	if C.imaginary_dzsave(
+		unsafe.Pointer(&buf[0]),
+		C.size_t(len(buf)),
+		cName,
+		C.int(o.TileSize),
+		C.int(o.overlap()),
+		dzDepths[o.Depth],
+		cSuffix,
+		dzLayouts[o.Layout],
+		dzOutputs[o.Output],
+	) != 0 {
+		return vipsError()
+	}
+
+	return nil
+}
+
+// vipsError returns the libvips error buffer, which is then cleared.
+func vipsError() error {
+	message := strings.TrimSpace(C.GoString(C.vips_error_buffer()))
+	C.vips_error_clear()
+
+	if message == "" {
+		message = "libvips internal error"
+	}
+	return errors.New(message)
+}
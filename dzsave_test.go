@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDZSaveOptionsDefaults(t *testing.T) {
+	o := DZSaveOptions{}.WithDefaults()
+	expected := DZSaveOptions{TileSize: 254, Depth: "onepixel", Format: "jpeg", Layout: "dz", Output: "dir"}
+	if o.overlap() != 1 || withoutOverlap(o) != expected {
+		t.Errorf("Invalid defaults: %+v", o)
+	}
+
+	o = DZSaveOptions{Layout: "google", Output: "zip"}.WithDefaults()
+	expected = DZSaveOptions{TileSize: 256, Depth: "onetile", Format: "jpeg", Layout: "google", Output: "zip"}
+	if o.Overlap == nil || o.overlap() != 0 || withoutOverlap(o) != expected {
+		t.Errorf("Invalid google defaults: %+v", o)
+	}
+
+	// An explicit overlap is kept, even 0
+	var explicit DZSaveOptions
+	if err := json.Unmarshal([]byte(`{"overlap": 0}`), &explicit); err != nil {
+		t.Fatal(err)
+	}
+	if o := explicit.WithDefaults(); o.overlap() != 0 {
+		t.Errorf("Invalid explicit overlap: %d", o.overlap())
+	}
+
+	if suffix := (DZSaveOptions{Format: "webp", Quality: 80}).suffix(); suffix != ".webp[Q=80]" {
+		t.Errorf("Invalid suffix: %s", suffix)
+	}
+	if suffix := (DZSaveOptions{Format: "png", Quality: 80}).suffix(); suffix != ".png" {
+		t.Errorf("Invalid suffix: %s", suffix)
+	}
+}
+
+func withoutOverlap(o DZSaveOptions) DZSaveOptions {
+	o.Overlap = nil
+	return o
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestDZSaveOptionsValidate(t *testing.T) {
+	invalid := []DZSaveOptions{
+		{TileSize: -1},
+		{Overlap: intPtr(300)},
+		{Quality: 101},
+		{Layout: "deepzoom"},
+		{Depth: "two"},
+		{Format: "gif"},
+		{Output: "tar"},
+	}
+
+	for _, o := range invalid {
+		if err := o.WithDefaults().Validate(); err == nil {
+			t.Errorf("Expected error for options: %+v", o)
+		}
+	}
+}
+
+func TestDZSaveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = dzSave([]byte("not an image"), filepath.Join(dir, "image"), DZSaveOptions{}.WithDefaults())
+	if err == nil || !strings.Contains(err.Error(), "not in a known format") {
+		t.Errorf("Expected libvips error: %v", err)
+	}
+}
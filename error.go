@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -20,22 +21,34 @@ const (
 	NotImplemented
 	Forbidden
 	NotAcceptable
+	EntityTooLarge
 )
 
 var (
-	ErrNotFound             = NewError("not found", NotFound)
-	ErrInvalidAPIKey        = NewError("invalid or missing API key", Unauthorized)
-	ErrMethodNotAllowed     = NewError("method not allowed", NotAllowed)
-	ErrUnsupportedMedia     = NewError("unsupported media type", Unsupported)
-	ErrOutputFormat         = NewError("unsupported output image format", BadRequest)
-	ErrEmptyBody            = NewError("empty image", BadRequest)
-	ErrMissingParamFile     = NewError("missing required param: file", BadRequest)
-	ErrInvalidFilePath      = NewError("invalid file path", BadRequest)
-	ErrInvalidImageURL      = NewError("invalid image URL", BadRequest)
-	ErrMissingImageSource   = NewError("cannot process the image due to missing or invalid params", BadRequest)
-	ErrNotImplemented       = NewError("not implemented endpoint", NotImplemented)
-	ErrInvalidURLSignature  = NewError("invalid URL signature", BadRequest)
-	ErrURLSignatureMismatch = NewError("URL signature mismatch", Forbidden)
+	ErrNotFound              = NewError("not found", NotFound)
+	ErrInvalidAPIKey         = NewError("invalid or missing API key", Unauthorized)
+	ErrMethodNotAllowed      = NewError("method not allowed", NotAllowed)
+	ErrUnsupportedMedia      = NewError("unsupported media type", Unsupported)
+	ErrOutputFormat          = NewError("unsupported output image format", BadRequest)
+	ErrEmptyBody             = NewError("empty image", BadRequest)
+	ErrMissingParamFile      = NewError("missing required param: file", BadRequest)
+	ErrInvalidFilePath       = NewError("invalid file path", BadRequest)
+	ErrInvalidImageURL       = NewError("invalid image URL", BadRequest)
+	ErrMissingImageSource    = NewError("cannot process the image due to missing or invalid params", BadRequest)
+	ErrNotImplemented        = NewError("not implemented endpoint", NotImplemented)
+	ErrInvalidURLSignature   = NewError("invalid URL signature", BadRequest)
+	ErrURLSignatureMismatch  = NewError("URL signature mismatch", Forbidden)
+	ErrImageTooLarge         = NewError("image exceeds the maximum allowed size", EntityTooLarge)
+	ErrOutboundAddressDenied = NewError("outbound address is not allowed", Forbidden)
+	ErrInvalidOutputPath     = NewError("invalid output file path", BadRequest)
+	ErrInvalidOutputURL      = NewError("invalid output URL", BadRequest)
+	ErrInvalidOutputKey      = NewError("invalid output key", BadRequest)
+	ErrOutputMountDisabled   = NewError("output mount directory is not configured", Forbidden)
+	ErrURLSinkDisabled       = NewError("output URL uploads are disabled", Forbidden)
+	ErrURLSourceDisabled     = NewError("remote URL sources are disabled", Forbidden)
+	ErrMountDisabled         = NewError("mount directory is not configured", Forbidden)
+	ErrSignedRequestBody     = NewError("JSON requests cannot be used with URL signatures", Forbidden)
+	ErrOutputsNotSupported   = NewError("the outputs param is only supported by pipelines", BadRequest)
 )
 
 type Error struct {
@@ -63,6 +76,7 @@ func (e Error) HTTPCode() int {
 		NotImplemented: http.StatusNotImplemented,
 		Forbidden:      http.StatusForbidden,
 		NotAcceptable:  http.StatusNotAcceptable,
+		EntityTooLarge: http.StatusRequestEntityTooLarge,
 	}
 
 	if v, ok := codes[e.Code]; ok {
@@ -77,6 +91,16 @@ func NewError(err string, code uint8) Error {
 	return Error{err, code}
 }
 
+// ToError converts err into an Error with the same message. If err wraps an
+// Error its code is kept, otherwise the given code is used.
+func ToError(err error, code uint8) Error {
+	var e Error
+	if errors.As(err, &e) {
+		code = e.Code
+	}
+	return NewError(err.Error(), code)
+}
+
 func sendErrorResponse(w http.ResponseWriter, httpStatusCode int, imaginaryErrorCode uint8, err error) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(httpStatusCode)
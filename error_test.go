@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestError(t *testing.T) {
 	err := NewError("oops!\n\n", 1)
@@ -22,3 +25,21 @@ func TestError(t *testing.T) {
 		t.Fatalf("Invalid JSON output: %s", json)
 	}
 }
+
+func TestToError(t *testing.T) {
+	err := ToError(fmt.Errorf("download failed: %w", ErrImageTooLarge), BadRequest)
+	if err.Code != EntityTooLarge {
+		t.Fatalf("Invalid error code: %d", err.Code)
+	}
+	if err.HTTPCode() != 413 {
+		t.Fatalf("Invalid HTTP error status: %d", err.HTTPCode())
+	}
+	if err.Error() != "download failed: image exceeds the maximum allowed size" {
+		t.Fatalf("Invalid error message: %s", err)
+	}
+
+	err = ToError(fmt.Errorf("oops"), InternalError)
+	if err.Code != InternalError {
+		t.Fatalf("Invalid error code: %d", err.Code)
+	}
+}
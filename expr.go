@@ -0,0 +1,523 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Pipeline expressions are evaluated against the current image, only
+// reading the variables below. They support numbers, quoted strings, true
+// and false, the + - * / % arithmetic operators, the == != < <= > >=
+// comparisons, the && || ! logical operators, parentheses and the min, max,
+// round, floor and ceil functions. Expressions are parsed and type checked
+// before any image is processed.
+const (
+	maxExprLength = 256
+	maxExprDepth  = 32
+)
+
+type exprKind int
+
+const (
+	exprNumber exprKind = iota
+	exprString
+	exprBool
+)
+
+func (k exprKind) String() string {
+	switch k {
+	case exprNumber:
+		return "number"
+	case exprString:
+		return "string"
+	default:
+		return "bool"
+	}
+}
+
+// exprVariables defines the variables of pipeline expressions.
+var exprVariables = map[string]exprKind{
+	"width":       exprNumber,
+	"height":      exprNumber,
+	"type":        exprString,
+	"alpha":       exprBool,
+	"orientation": exprNumber,
+	"pages":       exprNumber,
+}
+
+// exprFunctions defines the number of arguments of the functions, which
+// take and return numbers.
+var exprFunctions = map[string]int{
+	"min":   2,
+	"max":   2,
+	"round": 1,
+	"floor": 1,
+	"ceil":  1,
+}
+
+// exprEnv holds the values of the variables, where numbers are float64.
+type exprEnv map[string]interface{}
+
+type exprNode interface {
+	kind() exprKind
+	eval(env exprEnv) (interface{}, error)
+}
+
+// compileExpr parses and type checks an expression.
+func compileExpr(src string) (exprNode, error) {
+	if len(src) > maxExprLength {
+		return nil, fmt.Errorf("invalid expression: longer than %d characters", maxExprLength)
+	}
+
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %s", src, err)
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %s", src, err)
+	}
+	return node, nil
+}
+
+// parseExprParam returns the expression of a param value of the form
+// "${expression}".
+func parseExprParam(value interface{}) (string, bool) {
+	s, ok := value.(string)
+	if !ok || !strings.HasPrefix(s, "${") || !strings.HasSuffix(s, "}") {
+		return "", false
+	}
+	return s[2 : len(s)-1], true
+}
+
+type exprTokenType int
+
+const (
+	tokenNumber exprTokenType = iota
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type exprToken struct {
+	typ  exprTokenType
+	text string
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokenNumber, src[i:j]})
+			i = j
+		case c == '\'' || c == '"':
+			j := strings.IndexByte(src[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, exprToken{tokenString, src[i+1 : i+1+j]})
+			i += j + 2
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokenIdent, src[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "!", "(", ")", ","} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, exprToken{tokenOperator, op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	depth  int
+}
+
+// accept consumes the next token if it is one of the operators.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].typ != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return fmt.Errorf("expected %q", op)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExprDepth {
+		return nil, fmt.Errorf("nested deeper than %d levels", maxExprDepth)
+	}
+
+	x, err := p.parseAnd()
+	for err == nil {
+		if _, ok := p.accept("||"); !ok {
+			break
+		}
+		var y exprNode
+		if y, err = p.parseAnd(); err == nil {
+			x, err = newExprBinary("||", x, y)
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	x, err := p.parseComparison()
+	for err == nil {
+		if _, ok := p.accept("&&"); !ok {
+			break
+		}
+		var y exprNode
+		if y, err = p.parseComparison(); err == nil {
+			x, err = newExprBinary("&&", x, y)
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	x, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return x, nil
+	}
+	y, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return newExprBinary(op, x, y)
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	x, err := p.parseMultiplicative()
+	for err == nil {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			break
+		}
+		var y exprNode
+		if y, err = p.parseMultiplicative(); err == nil {
+			x, err = newExprBinary(op, x, y)
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+	x, err := p.parseUnary()
+	for err == nil {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			break
+		}
+		var y exprNode
+		if y, err = p.parseUnary(); err == nil {
+			x, err = newExprBinary(op, x, y)
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	op, ok := p.accept("-", "!")
+	if !ok {
+		return p.parsePrimary()
+	}
+
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExprDepth {
+		return nil, fmt.Errorf("nested deeper than %d levels", maxExprDepth)
+	}
+
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if op == "-" && x.kind() != exprNumber || op == "!" && x.kind() != exprBool {
+		return nil, fmt.Errorf("invalid operand of %s: %s", op, x.kind())
+	}
+	return &exprUnary{op: op, x: x}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if _, ok := p.accept("("); ok {
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.typ {
+	case tokenNumber:
+		n, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token.text)
+		}
+		return &exprLiteral{value: n, k: exprNumber}, nil
+	case tokenString:
+		return &exprLiteral{value: token.text, k: exprString}, nil
+	case tokenIdent:
+		if token.text == "true" || token.text == "false" {
+			return &exprLiteral{value: token.text == "true", k: exprBool}, nil
+		}
+		if k, ok := exprVariables[token.text]; ok {
+			return &exprVariable{name: token.text, k: k}, nil
+		}
+		if _, ok := exprFunctions[token.text]; ok {
+			return p.parseCall(token.text)
+		}
+		return nil, fmt.Errorf("unknown variable %q", token.text)
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	call := &exprCall{name: name}
+	for len(call.args) < exprFunctions[name] {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if arg.kind() != exprNumber {
+			return nil, fmt.Errorf("invalid argument of %s: %s", name, arg.kind())
+		}
+		call.args = append(call.args, arg)
+	}
+	return call, p.expect(")")
+}
+
+type exprLiteral struct {
+	value interface{}
+	k     exprKind
+}
+
+func (e *exprLiteral) kind() exprKind { return e.k }
+
+func (e *exprLiteral) eval(env exprEnv) (interface{}, error) {
+	return e.value, nil
+}
+
+type exprVariable struct {
+	name string
+	k    exprKind
+}
+
+func (e *exprVariable) kind() exprKind { return e.k }
+
+func (e *exprVariable) eval(env exprEnv) (interface{}, error) {
+	v, ok := env[e.name]
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %q", e.name)
+	}
+	return v, nil
+}
+
+type exprUnary struct {
+	op string
+	x  exprNode
+}
+
+func (e *exprUnary) kind() exprKind { return e.x.kind() }
+
+func (e *exprUnary) eval(env exprEnv) (interface{}, error) {
+	x, err := e.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "-" {
+		return -x.(float64), nil
+	}
+	return !x.(bool), nil
+}
+
+type exprBinary struct {
+	op   string
+	x, y exprNode
+	k    exprKind
+}
+
+// newExprBinary type checks the operands of a binary operator.
+func newExprBinary(op string, x, y exprNode) (exprNode, error) {
+	e := &exprBinary{op: op, x: x, y: y, k: exprBool}
+
+	var valid bool
+	switch op {
+	case "+", "-", "*", "/", "%":
+		valid = x.kind() == exprNumber && y.kind() == exprNumber
+		e.k = exprNumber
+	case "<", "<=", ">", ">=":
+		valid = x.kind() == exprNumber && y.kind() == exprNumber
+	case "==", "!=":
+		valid = x.kind() == y.kind()
+	case "&&", "||":
+		valid = x.kind() == exprBool && y.kind() == exprBool
+	}
+
+	if !valid {
+		return nil, fmt.Errorf("invalid operands of %s: %s and %s", op, x.kind(), y.kind())
+	}
+	return e, nil
+}
+
+func (e *exprBinary) kind() exprKind { return e.k }
+
+func (e *exprBinary) eval(env exprEnv) (interface{}, error) {
+	x, err := e.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logical operators short-circuit
+	switch e.op {
+	case "&&":
+		if !x.(bool) {
+			return false, nil
+		}
+		return e.y.eval(env)
+	case "||":
+		if x.(bool) {
+			return true, nil
+		}
+		return e.y.eval(env)
+	}
+
+	y, err := e.y.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return x == y, nil
+	case "!=":
+		return x != y, nil
+	}
+
+	a, b := x.(float64), y.(float64)
+	switch e.op {
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "/", "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+	}
+
+	var n float64
+	switch e.op {
+	case "+":
+		n = a + b
+	case "-":
+		n = a - b
+	case "*":
+		n = a * b
+	case "/":
+		n = a / b
+	case "%":
+		n = math.Mod(a, b)
+	}
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		return nil, fmt.Errorf("number out of range")
+	}
+	return n, nil
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+func (e *exprCall) kind() exprKind { return exprNumber }
+
+func (e *exprCall) eval(env exprEnv) (interface{}, error) {
+	args := make([]float64, len(e.args))
+	for i, arg := range e.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v.(float64)
+	}
+
+	switch e.name {
+	case "min":
+		return math.Min(args[0], args[1]), nil
+	case "max":
+		return math.Max(args[0], args[1]), nil
+	case "round":
+		return math.Round(args[0]), nil
+	case "floor":
+		return math.Floor(args[0]), nil
+	default:
+		return math.Ceil(args[0]), nil
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileExpr(t *testing.T) {
+	env := exprEnv{
+		"width":       2400.0,
+		"height":      1200.0,
+		"type":        "png",
+		"alpha":       true,
+		"orientation": 6.0,
+		"pages":       1.0,
+	}
+
+	cases := []struct {
+		src      string
+		expected interface{}
+	}{
+		{"width", 2400.0},
+		{"width / 2", 1200.0},
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"-width + 100", -2300.0},
+		{"width % 7", 6.0},
+		{"min(width, 2000)", 2000.0},
+		{"max(width / 3, 1000)", 1000.0},
+		{"round(height / 7)", 171.0},
+		{"floor(1.9) + ceil(0.1)", 2.0},
+		{"width > 2000", true},
+		{"width > 2000 && height > 2000", false},
+		{"width > 2000 || height > 2000", true},
+		{"type == 'png' && alpha", true},
+		{`type != "jpeg"`, true},
+		{"!alpha", false},
+		{"orientation >= 5 && pages == 1", true},
+		{"true", true},
+	}
+
+	for _, c := range cases {
+		node, err := compileExpr(c.src)
+		if err != nil {
+			t.Errorf("Cannot compile %q: %s", c.src, err)
+			continue
+		}
+		if v, err := node.eval(env); err != nil || v != c.expected {
+			t.Errorf("Invalid value of %q: %v %v", c.src, v, err)
+		}
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	invalid := []string{
+		"",
+		"width +",
+		"(width",
+		"width)",
+		"foo > 1",
+		"os.Exit(1)",
+		"width > 'a'",
+		"type + 1",
+		"alpha && 1",
+		"!width",
+		"-type",
+		"min(width)",
+		"max(type, 1)",
+		"1 < 2 < 3",
+		"width == 'jpeg'",
+		"'unterminated",
+		"width # 2",
+		"1..2",
+		strings.Repeat("(", 40) + "1" + strings.Repeat(")", 40),
+		strings.Repeat("1+", 200) + "1",
+	}
+
+	for _, src := range invalid {
+		if _, err := compileExpr(src); err == nil {
+			t.Errorf("Expected error for %q", src)
+		}
+	}
+
+	node, err := compileExpr("width / (height - 1200)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.eval(exprEnv{"width": 100.0, "height": 1200.0}); err == nil {
+		t.Error("Expected division by zero error")
+	}
+}
+
+func TestPipelineOperationEvaluate(t *testing.T) {
+	operations, err := parseJSONOperations(`[
+		{"operation": "resize", "if": "width > 2000", "params": {"width": "${width / 2}", "type": "webp"}},
+		{"operation": "convert", "if": "alpha", "params": {"type": "png"}}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := exprEnv{"width": 2400.0, "height": 1200.0, "type": "jpeg", "alpha": false, "orientation": 0.0, "pages": 1.0}
+	if apply, err := operations[0].evaluate(env); err != nil || !apply {
+		t.Fatalf("Operation must apply: %v", err)
+	}
+	if o := operations[0].ImageOptions; o.Width != 1200 || o.Type != "webp" {
+		t.Errorf("Invalid options: %+v", o)
+	}
+	if apply, err := operations[1].evaluate(env); err != nil || apply {
+		t.Errorf("Operation must not apply: %v", err)
+	}
+
+	invalid := []string{
+		`[{"operation": "resize", "if": "width", "params": {}}]`,
+		`[{"operation": "resize", "if": "size > 1", "params": {}}]`,
+		`[{"operation": "resize", "params": {"width": "${width *}"}}]`,
+		`[{"operation": "resize", "params": {"width": "${type}"}}]`,
+		`[{"operation": "resize", "params": {"type": "${width*2}"}}]`,
+		`[{"operation": "resize", "params": {"flip": "${width}"}}]`,
+		`[{"operation": "resize", "params": {"size": "${width}"}}]`,
+	}
+	for _, data := range invalid {
+		if _, err := parseJSONOperations(data); err == nil {
+			t.Errorf("Expected error for operations: %s", data)
+		}
+	}
+}
@@ -21,13 +21,19 @@ type HealthStats struct {
 	HeapAllocated        float64 `json:"heapInUse"`
 	ObjectsInUse         uint64  `json:"objectsInUse"`
 	OSMemoryObtained     float64 `json:"OSMemoryObtained"`
+	AzureCredentialError string  `json:"azureCredentialError,omitempty"`
+}
+
+// Healthy reports whether every configured storage credential is usable.
+func (h *HealthStats) Healthy() bool {
+	return h.AzureCredentialError == ""
 }
 
 func GetHealthStats() *HealthStats {
 	mem := &runtime.MemStats{}
 	runtime.ReadMemStats(mem)
 
-	return &HealthStats{
+	stats := &HealthStats{
 		Uptime:               GetUptime(),
 		AllocatedMemory:      toMegaBytes(mem.Alloc),
 		TotalAllocatedMemory: toMegaBytes(mem.TotalAlloc),
@@ -39,6 +45,12 @@ func GetHealthStats() *HealthStats {
 		ObjectsInUse:         mem.Mallocs - mem.Frees,
 		OSMemoryObtained:     toMegaBytes(mem.Sys),
 	}
+
+	if err := AzureCredentialError(); err != nil {
+		stats.AzureCredentialError = err.Error()
+	}
+
+	return stats
 }
 
 func GetUptime() int64 {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// parseIdentifierSource parses the source of the routes which address images
+// by identifier, such as IIIF: fs, http, s3:{bucket}, azure:{container} or
+// storage:{profile}.
+func parseIdentifierSource(value string) (url.Values, error) {
+	name, container := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		name, container = value[:i], value[i+1:]
+	}
+
+	query := url.Values{}
+	switch ImageSourceType(name) {
+	case ImageSourceTypeFileSystem, ImageSourceTypeHTTP:
+		if container != "" {
+			return nil, fmt.Errorf("identifier source: source %s does not take a container", name)
+		}
+	case ImageSourceTypeS3:
+		query.Set("bucket", container)
+	case ImageSourceTypeAzure:
+		query.Set("azureContainer", container)
+	case ImageSourceTypeStorage:
+		query.Set("storage", container)
+	default:
+		return nil, fmt.Errorf("identifier source: unsupported source: %s", value)
+	}
+
+	if name != string(ImageSourceTypeFileSystem) && name != string(ImageSourceTypeHTTP) && container == "" {
+		return nil, fmt.Errorf("identifier source: source %s requires a container", name)
+	}
+
+	query.Set(SourceQueryKey, name)
+	return query, nil
+}
+
+// checkIdentifierSource checks the source of identifiers can be used with
+// the server options: reading files requires a mount directory, and remote
+// URLs require -enable-url-source.
+func checkIdentifierSource(value string, o ServerOptions) error {
+	query, err := parseIdentifierSource(value)
+	if err != nil {
+		return err
+	}
+
+	switch ImageSourceType(query.Get(SourceQueryKey)) {
+	case ImageSourceTypeFileSystem:
+		if o.Mount == "" {
+			return fmt.Errorf("identifier source: source fs requires -mount")
+		}
+	case ImageSourceTypeHTTP:
+		if !o.EnableURLSource {
+			return fmt.Errorf("identifier source: source http requires -enable-url-source")
+		}
+	}
+	return nil
+}
+
+// identifierQuery returns the query params reading the image of an
+// identifier from the given source.
+func identifierQuery(source, identifier string) (url.Values, error) {
+	query, err := parseIdentifierSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ImageSourceType(query.Get(SourceQueryKey)) {
+	case ImageSourceTypeFileSystem:
+		query.Set("file", identifier)
+	case ImageSourceTypeHTTP:
+		query.Set(URLQueryKey, identifier)
+	case ImageSourceTypeS3:
+		query.Set("s3key", identifier)
+	case ImageSourceTypeAzure:
+		query.Set("azureBlobKey", identifier)
+	case ImageSourceTypeStorage:
+		query.Set("storageKey", identifier)
+	}
+
+	return query, nil
+}
+
+// readIdentifierImage reads the image of an identifier through the image
+// sources.
+func readIdentifierImage(r *http.Request, source, identifier string) ([]byte, error) {
+	query, err := identifierQuery(source, identifier)
+	if err != nil {
+		return nil, NewError(err.Error(), NotImplemented)
+	}
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.URL.RawQuery = query.Encode()
+
+	imageSource, err := MatchSource(req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := imageSource.GetImage(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, ErrEmptyBody
+	}
+	return buf, nil
+}
+
+// orientedImageSize returns the size of the image once rotated according to
+// its EXIF orientation, as operations do.
+func orientedImageSize(buf []byte) (int, int, error) {
+	meta, err := bimg.Metadata(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if meta.Orientation > 4 {
+		return meta.Size.Height, meta.Size.Width, nil
+	}
+	return meta.Size.Width, meta.Size.Height, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIdentifierQuery(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"fs", "file=a%2Fb.jpg&source=fs"},
+		{"http", "source=http&url=a%2Fb.jpg"},
+		{"s3:images", "bucket=images&s3key=a%2Fb.jpg&source=s3"},
+		{"azure:assets", "azureBlobKey=a%2Fb.jpg&azureContainer=assets&source=azure"},
+		{"storage:media", "source=storage&storage=media&storageKey=a%2Fb.jpg"},
+	}
+
+	for _, tc := range cases {
+		query, err := identifierQuery(tc.source, "a/b.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query.Encode() != tc.expected {
+			t.Errorf("Invalid query for %s: %s", tc.source, query.Encode())
+		}
+	}
+
+	for _, source := range []string{"", "payload", "s3", "fs:foo", "gcs:images"} {
+		if _, err := parseIdentifierSource(source); err == nil {
+			t.Errorf("Expected error for source: %s", source)
+		}
+	}
+}
+
+func TestCheckIdentifierSource(t *testing.T) {
+	if err := checkIdentifierSource("fs", ServerOptions{Mount: "testdata"}); err != nil {
+		t.Error(err)
+	}
+	if err := checkIdentifierSource("storage:media", ServerOptions{}); err != nil {
+		t.Error(err)
+	}
+	if err := checkIdentifierSource("fs", ServerOptions{}); err == nil {
+		t.Error("Expected error for fs source without mount directory")
+	}
+	if err := checkIdentifierSource("http", ServerOptions{}); err == nil {
+		t.Error("Expected error for http source without -enable-url-source")
+	}
+}
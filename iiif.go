@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+const (
+	// IIIFPrefix is the route of the IIIF Image API 3.0 endpoint.
+	IIIFPrefix   = "/iiif"
+	iiifContext  = "http://iiif.io/api/image/3/context.json"
+	iiifProtocol = "http://iiif.io/api/image"
+	iiifTileSize = 512
+)
+
+// iiifFormats maps the IIIF output formats to the image types.
+var iiifFormats = map[string]string{
+	"jpg":  "jpeg",
+	"png":  "png",
+	"webp": "webp",
+	"gif":  "gif",
+	"tif":  "tiff",
+}
+
+// IIIFInfo represents the info.json document of an image.
+type IIIFInfo struct {
+	Context        string     `json:"@context"`
+	ID             string     `json:"id"`
+	Type           string     `json:"type"`
+	Protocol       string     `json:"protocol"`
+	Profile        string     `json:"profile"`
+	Width          int        `json:"width"`
+	Height         int        `json:"height"`
+	MaxWidth       int        `json:"maxWidth,omitempty"`
+	MaxHeight      int        `json:"maxHeight,omitempty"`
+	Tiles          []IIIFTile `json:"tiles"`
+	ExtraFormats   []string   `json:"extraFormats"`
+	ExtraQualities []string   `json:"extraQualities"`
+	ExtraFeatures  []string   `json:"extraFeatures"`
+}
+
+// IIIFTile describes the tiles which viewers should request.
+type IIIFTile struct {
+	Width        int   `json:"width"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+// IIIFImageRequest represents the parsed parameters of an image request.
+type IIIFImageRequest struct {
+	FullRegion                       bool
+	Left, Top, AreaWidth, AreaHeight int
+	Width, Height                    int
+	Mirror                           bool
+	Rotate                           int
+	Quality                          string
+	Type                             string
+}
+
+// iiifController serves the IIIF Image API:
+//
+//	/iiif/{identifier}/info.json
+//	/iiif/{identifier}/{region}/{size}/{rotation}/{quality}.{format}
+func iiifController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	prefix := join(o, IIIFPrefix)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			ErrorReply(r, w, ErrMethodNotAllowed, o)
+			return
+		}
+
+		segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), prefix+"/"), "/")
+		identifier, err := url.PathUnescape(segments[0])
+		if err != nil || identifier == "" {
+			ErrorReply(r, w, ErrNotFound, o)
+			return
+		}
+
+		switch {
+		case len(segments) == 1:
+			http.Redirect(w, r, prefix+"/"+segments[0]+"/info.json", http.StatusSeeOther)
+			return
+		case len(segments) == 2 && segments[1] == "info.json":
+		case len(segments) == 5:
+		default:
+			ErrorReply(r, w, ErrNotFound, o)
+			return
+		}
+
+		buf, err := readIdentifierImage(r, o.IIIFSource, identifier)
+		if err != nil {
+			ErrorReply(r, w, ToError(err, BadRequest), o)
+			return
+		}
+
+		width, height, err := orientedImageSize(buf)
+		if err != nil {
+			ErrorReply(r, w, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest), o)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if len(segments) == 2 {
+			info := newIIIFInfo(iiifBaseURL(r, prefix, segments[0]), width, height, o.IIIFMaxSize)
+			body, _ := json.Marshal(info)
+
+			contentType := "application/json"
+			if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+				contentType = fmt.Sprintf("application/ld+json;profile=%q", iiifContext)
+			}
+			w.Header().Set("Content-Type", contentType)
+			_, _ = w.Write(body)
+			return
+		}
+
+		req, err := parseIIIFImageRequest(segments[1:], width, height, o.IIIFMaxSize)
+		if err != nil {
+			ErrorReply(r, w, ToError(err, BadRequest), o)
+			return
+		}
+
+		image, err := req.Process(buf)
+		if err != nil {
+			ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
+			return
+		}
+
+		w.Header().Set("Content-Type", image.Mime)
+		w.Header().Set("Content-Length", strconv.Itoa(len(image.Body)))
+		w.Header().Set("Link", fmt.Sprintf(`<%s>;rel="profile"`, "http://iiif.io/api/image/3/level2.json"))
+		_, _ = w.Write(image.Body)
+	}
+}
+
+func iiifBaseURL(r *http.Request, prefix, identifier string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + prefix + "/" + identifier
+}
+
+func newIIIFInfo(id string, width, height, maxSize int) IIIFInfo {
+	info := IIIFInfo{
+		Context:        iiifContext,
+		ID:             id,
+		Type:           "ImageService3",
+		Protocol:       iiifProtocol,
+		Profile:        "level2",
+		Width:          width,
+		Height:         height,
+		ExtraFormats:   []string{"webp", "gif", "tif"},
+		ExtraQualities: []string{"color", "gray"},
+		ExtraFeatures:  []string{"mirroring", "regionSquare", "sizeUpscaling"},
+	}
+
+	if maxSize > 0 {
+		info.MaxWidth, info.MaxHeight = maxSize, maxSize
+	}
+
+	size := width
+	if height > size {
+		size = height
+	}
+
+	// Scale factors go down to a single tile covering the whole image
+	tile := IIIFTile{Width: iiifTileSize, ScaleFactors: []int{1}}
+	for factor := 1; (size+factor-1)/factor > iiifTileSize; {
+		factor *= 2
+		tile.ScaleFactors = append(tile.ScaleFactors, factor)
+	}
+	info.Tiles = []IIIFTile{tile}
+
+	return info
+}
+
+// parseIIIFImageRequest parses the region, size, rotation and quality.format
+// segments of an image request, for an image of the given size.
+func parseIIIFImageRequest(segments []string, width, height, maxSize int) (IIIFImageRequest, error) {
+	var req IIIFImageRequest
+	var err error
+
+	if req.Left, req.Top, req.AreaWidth, req.AreaHeight, err = parseIIIFRegion(segments[0], width, height); err != nil {
+		return req, err
+	}
+	req.FullRegion = req.AreaWidth == width && req.AreaHeight == height
+	if req.Width, req.Height, err = parseIIIFSize(segments[1], req.AreaWidth, req.AreaHeight, maxSize); err != nil {
+		return req, err
+	}
+
+	rotation := segments[2]
+	if strings.HasPrefix(rotation, "!") {
+		req.Mirror = true
+		rotation = rotation[1:]
+	}
+	if req.Rotate, err = strconv.Atoi(rotation); err != nil || req.Rotate%90 != 0 || req.Rotate < 0 || req.Rotate >= 360 {
+		return req, NewError(fmt.Sprintf("iiif: unsupported rotation: %s", segments[2]), BadRequest)
+	}
+
+	i := strings.LastIndex(segments[3], ".")
+	if i < 0 {
+		return req, NewError(fmt.Sprintf("iiif: missing format: %s", segments[3]), BadRequest)
+	}
+
+	req.Quality = segments[3][:i]
+	if req.Quality != "default" && req.Quality != "color" && req.Quality != "gray" {
+		return req, NewError(fmt.Sprintf("iiif: unsupported quality: %s", req.Quality), BadRequest)
+	}
+
+	var ok bool
+	if req.Type, ok = iiifFormats[segments[3][i+1:]]; !ok {
+		return req, NewError(fmt.Sprintf("iiif: unsupported format: %s", segments[3][i+1:]), BadRequest)
+	}
+
+	return req, nil
+}
+
+func parseIIIFRegion(region string, width, height int) (left, top, areaWidth, areaHeight int, err error) {
+	switch {
+	case region == "full":
+		return 0, 0, width, height, nil
+	case region == "square":
+		side := width
+		if height < side {
+			side = height
+		}
+		return (width - side) / 2, (height - side) / 2, side, side, nil
+	}
+
+	invalid := NewError(fmt.Sprintf("iiif: invalid region: %s", region), BadRequest)
+
+	var values []float64
+	if strings.HasPrefix(region, "pct:") {
+		if values, err = parseIIIFNumbers(strings.TrimPrefix(region, "pct:"), 4); err != nil {
+			return 0, 0, 0, 0, invalid
+		}
+		values[0] = values[0] * float64(width) / 100
+		values[1] = values[1] * float64(height) / 100
+		values[2] = values[2] * float64(width) / 100
+		values[3] = values[3] * float64(height) / 100
+	} else if values, err = parseIIIFNumbers(region, 4); err != nil {
+		return 0, 0, 0, 0, invalid
+	}
+
+	left, top = int(math.Round(values[0])), int(math.Round(values[1]))
+	areaWidth, areaHeight = int(math.Round(values[2])), int(math.Round(values[3]))
+	if areaWidth <= 0 || areaHeight <= 0 || left >= width || top >= height {
+		return 0, 0, 0, 0, invalid
+	}
+
+	// Regions extending beyond the image are cropped at its edges
+	if left+areaWidth > width {
+		areaWidth = width - left
+	}
+	if top+areaHeight > height {
+		areaHeight = height - top
+	}
+
+	return left, top, areaWidth, areaHeight, nil
+}
+
+func parseIIIFSize(size string, regionWidth, regionHeight, maxSize int) (width, height int, err error) {
+	invalid := NewError(fmt.Sprintf("iiif: invalid size: %s", size), BadRequest)
+
+	upscale := strings.HasPrefix(size, "^")
+	s := strings.TrimPrefix(size, "^")
+
+	switch {
+	case s == "max":
+		width, height = regionWidth, regionHeight
+		if maxSize > 0 && (upscale || width > maxSize || height > maxSize) {
+			width, height = calculateDestinationFitDimension(regionWidth, regionHeight, maxSize, maxSize)
+		}
+		if !upscale && (width > regionWidth || height > regionHeight) {
+			width, height = regionWidth, regionHeight
+		}
+		return width, height, nil
+
+	case strings.HasPrefix(s, "pct:"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(s, "pct:"), 1)
+		if err != nil {
+			return 0, 0, invalid
+		}
+		width = int(math.Round(float64(regionWidth) * values[0] / 100))
+		height = int(math.Round(float64(regionHeight) * values[0] / 100))
+
+	case strings.HasPrefix(s, "!"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(s, "!"), 2)
+		if err != nil {
+			return 0, 0, invalid
+		}
+		width, height = calculateDestinationFitDimension(regionWidth, regionHeight, int(values[0]), int(values[1]))
+		// Without ^ the best fit is never larger than the region itself
+		if !upscale && (width > regionWidth || height > regionHeight) {
+			width, height = regionWidth, regionHeight
+		}
+
+	default:
+		parts := strings.Split(s, ",")
+		if len(parts) != 2 || (parts[0] == "" && parts[1] == "") {
+			return 0, 0, invalid
+		}
+		if parts[0] != "" {
+			if width, err = strconv.Atoi(parts[0]); err != nil {
+				return 0, 0, invalid
+			}
+		}
+		if parts[1] != "" {
+			if height, err = strconv.Atoi(parts[1]); err != nil {
+				return 0, 0, invalid
+			}
+		}
+		if parts[0] == "" {
+			width = int(math.Round(float64(height) * float64(regionWidth) / float64(regionHeight)))
+		}
+		if parts[1] == "" {
+			height = int(math.Round(float64(width) * float64(regionHeight) / float64(regionWidth)))
+		}
+	}
+
+	if width <= 0 || height <= 0 {
+		return 0, 0, invalid
+	}
+	if !upscale && (width > regionWidth || height > regionHeight) {
+		return 0, 0, NewError(fmt.Sprintf("iiif: size %s exceeds the region without ^", size), BadRequest)
+	}
+	if maxSize > 0 && (width > maxSize || height > maxSize) {
+		return 0, 0, NewError(fmt.Sprintf("iiif: size %s exceeds the maximum size", size), BadRequest)
+	}
+
+	return width, height, nil
+}
+
+// parseIIIFNumbers parses count comma separated non negative numbers.
+func parseIIIFNumbers(value string, count int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != count {
+		return nil, ErrUnsupportedValue
+	}
+
+	values := make([]float64, count)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, ErrUnsupportedValue
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// Process runs the request with the Extract, Resize, Flop, Rotate and
+// Convert operations, skipping the ones which are not needed.
+func (req IIIFImageRequest) Process(buf []byte) (Image, error) {
+	type step struct {
+		operation Operation
+		options   ImageOptions
+	}
+
+	var steps []step
+	if !req.FullRegion {
+		steps = append(steps, step{Extract, ImageOptions{Left: req.Left, Top: req.Top, AreaWidth: req.AreaWidth, AreaHeight: req.AreaHeight}})
+	}
+	if req.Width != req.AreaWidth || req.Height != req.AreaHeight {
+		steps = append(steps, step{Resize, ImageOptions{Width: req.Width, Height: req.Height, Force: true}})
+	}
+	if req.Mirror {
+		steps = append(steps, step{Flop, ImageOptions{}})
+	}
+	if req.Rotate != 0 {
+		steps = append(steps, step{Rotate, ImageOptions{Rotate: req.Rotate}})
+	}
+
+	options := ImageOptions{Type: req.Type}
+	if req.Quality == "gray" {
+		options.Colorspace = bimg.InterpretationBW
+	}
+	steps = append(steps, step{Convert, options})
+
+	image := Image{Body: buf}
+	for _, s := range steps {
+		s.options.Type = req.Type
+		out, err := s.operation(image.Body, s.options)
+		if err != nil {
+			return Image{}, err
+		}
+		image = out
+	}
+
+	return image, nil
+}
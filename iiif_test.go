@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseIIIFImageRequest(t *testing.T) {
+	cases := []struct {
+		path     []string
+		expected IIIFImageRequest
+	}{
+		{
+			[]string{"full", "max", "0", "default.jpg"},
+			IIIFImageRequest{FullRegion: true, AreaWidth: 1000, AreaHeight: 800, Width: 1000, Height: 800, Quality: "default", Type: "jpeg"},
+		},
+		{
+			[]string{"square", "200,", "!90", "gray.png"},
+			IIIFImageRequest{Left: 100, AreaWidth: 800, AreaHeight: 800, Width: 200, Height: 200, Mirror: true, Rotate: 90, Quality: "gray", Type: "png"},
+		},
+		{
+			[]string{"900,700,500,500", ",50", "0", "color.webp"},
+			IIIFImageRequest{Left: 900, Top: 700, AreaWidth: 100, AreaHeight: 100, Width: 50, Height: 50, Quality: "color", Type: "webp"},
+		},
+		{
+			[]string{"pct:50,50,50,50", "pct:50", "180", "default.tif"},
+			IIIFImageRequest{Left: 500, Top: 400, AreaWidth: 500, AreaHeight: 400, Width: 250, Height: 200, Rotate: 180, Quality: "default", Type: "tiff"},
+		},
+		{
+			[]string{"full", "!500,500", "0", "default.jpg"},
+			IIIFImageRequest{FullRegion: true, AreaWidth: 1000, AreaHeight: 800, Width: 500, Height: 400, Quality: "default", Type: "jpeg"},
+		},
+		{
+			[]string{"0,0,500,400", "!1000,1000", "0", "default.jpg"},
+			IIIFImageRequest{AreaWidth: 500, AreaHeight: 400, Width: 500, Height: 400, Quality: "default", Type: "jpeg"},
+		},
+		{
+			[]string{"0,0,500,400", "^!1000,1000", "0", "default.jpg"},
+			IIIFImageRequest{AreaWidth: 500, AreaHeight: 400, Width: 1000, Height: 800, Quality: "default", Type: "jpeg"},
+		},
+		{
+			[]string{"0,0,100,100", "^200,300", "0", "default.jpg"},
+			IIIFImageRequest{AreaWidth: 100, AreaHeight: 100, Width: 200, Height: 300, Quality: "default", Type: "jpeg"},
+		},
+		{
+			[]string{"full", "^max", "0", "default.jpg"},
+			IIIFImageRequest{FullRegion: true, AreaWidth: 1000, AreaHeight: 800, Width: 2000, Height: 1600, Quality: "default", Type: "jpeg"},
+		},
+	}
+
+	for _, tc := range cases {
+		req, err := parseIIIFImageRequest(tc.path, 1000, 800, 2000)
+		if err != nil {
+			t.Errorf("Cannot parse %v: %s", tc.path, err)
+			continue
+		}
+		if req != tc.expected {
+			t.Errorf("Invalid request for %v: %+v", tc.path, req)
+		}
+	}
+}
+
+func TestParseIIIFImageRequestInvalid(t *testing.T) {
+	paths := [][]string{
+		{"1000,0,10,10", "max", "0", "default.jpg"},
+		{"0,0,0,10", "max", "0", "default.jpg"},
+		{"0,0,10", "max", "0", "default.jpg"},
+		{"full", "2000,", "0", "default.jpg"},
+		{"full", "pct:150", "0", "default.jpg"},
+		{"full", "^3000,", "0", "default.jpg"},
+		{"full", ",", "0", "default.jpg"},
+		{"full", "max", "45", "default.jpg"},
+		{"full", "max", "0", "bitonal.jpg"},
+		{"full", "max", "0", "default.bmp"},
+		{"full", "max", "0", "default"},
+	}
+
+	for _, p := range paths {
+		if _, err := parseIIIFImageRequest(p, 1000, 800, 2000); err == nil {
+			t.Errorf("Expected error for %v", p)
+		}
+	}
+}
+
+func TestNewIIIFInfo(t *testing.T) {
+	info := newIIIFInfo("http://foo/iiif/bar.jpg", 3000, 1000, 0)
+	expected := []int{1, 2, 4, 8}
+	if len(info.Tiles) != 1 || len(info.Tiles[0].ScaleFactors) != len(expected) {
+		t.Fatalf("Invalid tiles: %+v", info.Tiles)
+	}
+	for i, factor := range expected {
+		if info.Tiles[0].ScaleFactors[i] != factor {
+			t.Errorf("Invalid scale factors: %v", info.Tiles[0].ScaleFactors)
+		}
+	}
+	if info.MaxWidth != 0 || info.Profile != "level2" {
+		t.Errorf("Invalid info: %+v", info)
+	}
+}
+
+func TestIIIFController(t *testing.T) {
+	mux := NewServerMux(ServerOptions{Mount: "testdata", IIIFSource: "fs"})
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/iiif/large.jpg", nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/iiif/large.jpg/info.json" {
+		t.Errorf("Invalid redirect: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/iiif/large.jpg/full/max", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Invalid status: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/iiif/large.jpg/info.json", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Invalid status: %d", w.Code)
+	}
+}
+
+func TestIIIFControllerDisabled(t *testing.T) {
+	for _, o := range []ServerOptions{{Mount: "testdata"}, {IIIFSource: "fs"}} {
+		w := httptest.NewRecorder()
+		NewServerMux(o).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/iiif/large.jpg/info.json", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Invalid status with source %q: %d", o.IIIFSource, w.Code)
+		}
+	}
+}
@@ -7,45 +7,68 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
-	"net/http"
+	"reflect"
 
 	"gopkg.in/h2non/bimg.v1"
 )
 
 // OperationsMap defines the allowed image transformation operations listed by name.
 // Used for pipeline image processing.
-var OperationsMap = map[string]Operation{
-	"crop":           Crop,
-	"resize":         Resize,
-	"enlarge":        Enlarge,
-	"extract":        Extract,
-	"rotate":         Rotate,
-	"flip":           Flip,
-	"flop":           Flop,
-	"thumbnail":      Thumbnail,
-	"zoom":           Zoom,
-	"convert":        Convert,
-	"watermark":      Watermark,
-	"watermarkImage": WatermarkImage,
-	"blur":           GaussianBlur,
-	"smartcrop":      SmartCrop,
-	"fit":            Fit,
-}
-
-// Image stores an image binary buffer and its MIME type
+var OperationsMap = map[string]Transformation{
+	"crop":           cropOptions,
+	"resize":         resizeOptions,
+	"enlarge":        enlargeOptions,
+	"extract":        extractOptions,
+	"rotate":         rotateOptions,
+	"flip":           flipOptions,
+	"flop":           flopOptions,
+	"thumbnail":      thumbnailOptions,
+	"zoom":           zoomOptions,
+	"convert":        convertOptions,
+	"watermark":      watermarkOptions,
+	"watermarkImage": watermarkImageOptions,
+	"blur":           gaussianBlurOptions,
+	"smartcrop":      smartCropOptions,
+	"fit":            fitOptions,
+}
+
+// Image stores an image binary buffer and its MIME type. A pipeline with
+// several outputs returns them in Outputs, identified by their Name.
 type Image struct {
-	Body []byte
-	Mime string
+	Body    []byte
+	Mime    string
+	Name    string
+	Outputs []Image
 }
 
 // Operation implements an image transformation runnable interface
 type Operation func([]byte, ImageOptions) (Image, error)
 
+// isPipeline reports whether the operation is Pipeline, the only one
+// producing the outputs of the outputs param.
+func isPipeline(operation Operation) bool {
+	return reflect.ValueOf(operation).Pointer() == reflect.ValueOf(Pipeline).Pointer()
+}
+
 // Run performs the image transformation
 func (o Operation) Run(buf []byte, opts ImageOptions) (Image, error) {
 	return o(buf, opts)
 }
 
+// Transformation builds the processing options of an operation. The
+// metadata of the transformed image is only read when needed.
+type Transformation func(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error)
+
+// processOperation processes an image buffer with the options of an
+// operation.
+func processOperation(buf []byte, o ImageOptions, transformation Transformation) (Image, error) {
+	opts, err := transformation(func() (bimg.ImageMetadata, error) { return bimg.Metadata(buf) }, o)
+	if err != nil {
+		return Image{}, err
+	}
+	return Process(buf, opts)
+}
+
 // ImageInfo represents an image details and additional metadata
 type ImageInfo struct {
 	Width       int    `json:"width"`
@@ -86,8 +109,12 @@ func Info(buf []byte, o ImageOptions) (Image, error) {
 }
 
 func Resize(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, resizeOptions)
+}
+
+func resizeOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Width == 0 && o.Height == 0 {
-		return Image{}, NewError("Missing required param: height or width", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: height or width", BadRequest)
 	}
 
 	opts := BimgOptions(o)
@@ -97,26 +124,30 @@ func Resize(buf []byte, o ImageOptions) (Image, error) {
 		opts.Crop = !o.NoCrop
 	}
 
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func Fit(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, fitOptions)
+}
+
+func fitOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Width == 0 || o.Height == 0 {
-		return Image{}, NewError("Missing required params: height, width", BadRequest)
+		return bimg.Options{}, NewError("Missing required params: height, width", BadRequest)
 	}
 
-	metadata, err := bimg.Metadata(buf)
+	meta, err := metadata()
 	if err != nil {
-		return Image{}, err
+		return bimg.Options{}, err
 	}
 
-	dims := metadata.Size
+	dims := meta.Size
 
 	if dims.Width == 0 || dims.Height == 0 {
-		return Image{}, NewError("Width or height of requested image is zero", NotAcceptable)
+		return bimg.Options{}, NewError("Width or height of requested image is zero", NotAcceptable)
 	}
 
-	// metadata.Orientation
+	// meta.Orientation
 	// 0: no EXIF orientation
 	// 1: CW 0
 	// 2: CW 0, flip horizontal
@@ -129,7 +160,7 @@ func Fit(buf []byte, o ImageOptions) (Image, error) {
 
 	var originHeight, originWidth int
 	var fitHeight, fitWidth *int
-	if o.NoRotation || (metadata.Orientation <= 4) {
+	if o.NoRotation || (meta.Orientation <= 4) {
 		originHeight = dims.Height
 		originWidth = dims.Width
 		fitHeight = &o.Height
@@ -147,7 +178,7 @@ func Fit(buf []byte, o ImageOptions) (Image, error) {
 	opts := BimgOptions(o)
 	opts.Embed = true
 
-	return Process(buf, opts)
+	return opts, nil
 }
 
 // calculateDestinationFitDimension calculates the fit area based on the image and desired fit dimensions
@@ -164,8 +195,12 @@ func calculateDestinationFitDimension(imageWidth, imageHeight, fitWidth, fitHeig
 }
 
 func Enlarge(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, enlargeOptions)
+}
+
+func enlargeOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Width == 0 || o.Height == 0 {
-		return Image{}, NewError("Missing required params: height, width", BadRequest)
+		return bimg.Options{}, NewError("Missing required params: height, width", BadRequest)
 	}
 
 	opts := BimgOptions(o)
@@ -174,12 +209,16 @@ func Enlarge(buf []byte, o ImageOptions) (Image, error) {
 	// Since both width & height is required, we allow cropping by default.
 	opts.Crop = !o.NoCrop
 
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func Extract(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, extractOptions)
+}
+
+func extractOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.AreaWidth == 0 || o.AreaHeight == 0 {
-		return Image{}, NewError("Missing required params: areawidth or areaheight", BadRequest)
+		return bimg.Options{}, NewError("Missing required params: areawidth or areaheight", BadRequest)
 	}
 
 	opts := BimgOptions(o)
@@ -188,69 +227,96 @@ func Extract(buf []byte, o ImageOptions) (Image, error) {
 	opts.AreaWidth = o.AreaWidth
 	opts.AreaHeight = o.AreaHeight
 
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func Crop(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, cropOptions)
+}
+
+func cropOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Width == 0 && o.Height == 0 {
-		return Image{}, NewError("Missing required param: height or width", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: height or width", BadRequest)
 	}
 
 	opts := BimgOptions(o)
 	opts.Crop = true
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func SmartCrop(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, smartCropOptions)
+}
+
+func smartCropOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Width == 0 && o.Height == 0 {
-		return Image{}, NewError("Missing required param: height or width", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: height or width", BadRequest)
 	}
 
 	opts := BimgOptions(o)
 	opts.Crop = true
 	opts.Gravity = bimg.GravitySmart
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func Rotate(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, rotateOptions)
+}
+
+func rotateOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Rotate == 0 {
-		return Image{}, NewError("Missing required param: rotate", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: rotate", BadRequest)
 	}
 
-	opts := BimgOptions(o)
-	return Process(buf, opts)
+	return BimgOptions(o), nil
 }
 
 func Flip(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, flipOptions)
+}
+
+func flipOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	opts := BimgOptions(o)
 	opts.Flip = true
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func Flop(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, flopOptions)
+}
+
+func flopOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	opts := BimgOptions(o)
 	opts.Flop = true
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func Thumbnail(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, thumbnailOptions)
+}
+
+func thumbnailOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Width == 0 && o.Height == 0 {
-		return Image{}, NewError("Missing required params: width or height", BadRequest)
+		return bimg.Options{}, NewError("Missing required params: width or height", BadRequest)
 	}
 
-	return Process(buf, BimgOptions(o))
+	return BimgOptions(o), nil
 }
 
 func Zoom(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, zoomOptions)
+}
+
+func zoomOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Factor == 0 {
-		return Image{}, NewError("Missing required param: factor", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: factor", BadRequest)
 	}
 
 	opts := BimgOptions(o)
 
 	if o.Top > 0 || o.Left > 0 {
 		if o.AreaWidth == 0 && o.AreaHeight == 0 {
-			return Image{}, NewError("Missing required params: areawidth, areaheight", BadRequest)
+			return bimg.Options{}, NewError("Missing required params: areawidth, areaheight", BadRequest)
 		}
 
 		opts.Top = o.Top
@@ -264,24 +330,31 @@ func Zoom(buf []byte, o ImageOptions) (Image, error) {
 	}
 
 	opts.Zoom = o.Factor
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func Convert(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, convertOptions)
+}
+
+func convertOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Type == "" {
-		return Image{}, NewError("Missing required param: type", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: type", BadRequest)
 	}
 	if ImageType(o.Type) == bimg.UNKNOWN {
-		return Image{}, NewError("Invalid image type: "+o.Type, BadRequest)
+		return bimg.Options{}, NewError("Invalid image type: "+o.Type, BadRequest)
 	}
-	opts := BimgOptions(o)
 
-	return Process(buf, opts)
+	return BimgOptions(o), nil
 }
 
 func Watermark(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, watermarkOptions)
+}
+
+func watermarkOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Text == "" {
-		return Image{}, NewError("Missing required param: text", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: text", BadRequest)
 	}
 
 	opts := BimgOptions(o)
@@ -297,7 +370,7 @@ func Watermark(buf []byte, o ImageOptions) (Image, error) {
 		opts.Watermark.Background = bimg.Color{R: o.Color[0], G: o.Color[1], B: o.Color[2]}
 	}
 
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func WatermarkImageSVG(buf []byte, o ImageOptions) (Image, error) {
@@ -311,12 +384,19 @@ func WatermarkImageSVG(buf []byte, o ImageOptions) (Image, error) {
 }
 
 func WatermarkImage(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, watermarkImageOptions)
+}
+
+func watermarkImageOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Image == "" {
-		return Image{}, NewError("Missing required param: image", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: image", BadRequest)
+	}
+	response, err := outboundClient.Get(o.Image)
+	if errors.Is(err, ErrOutboundAddressDenied) {
+		return bimg.Options{}, ErrOutboundAddressDenied
 	}
-	response, err := http.Get(o.Image)
 	if err != nil {
-		return Image{}, NewError(fmt.Sprintf("Unable to retrieve watermark image. %s", o.Image), BadRequest)
+		return bimg.Options{}, NewError(fmt.Sprintf("Unable to retrieve watermark image. %s", o.Image), BadRequest)
 	}
 	defer func() {
 		_ = response.Body.Close()
@@ -332,7 +412,7 @@ func WatermarkImage(buf []byte, o ImageOptions) (Image, error) {
 			errMessage = fmt.Sprintf("%s. %s", errMessage, err.Error())
 		}
 
-		return Image{}, NewError(errMessage, BadRequest)
+		return bimg.Options{}, NewError(errMessage, BadRequest)
 	}
 
 	opts := BimgOptions(o)
@@ -341,77 +421,167 @@ func WatermarkImage(buf []byte, o ImageOptions) (Image, error) {
 	opts.WatermarkImage.Buf = imageBuf
 	opts.WatermarkImage.Opacity = o.Opacity
 
-	return Process(buf, opts)
+	return opts, nil
 }
 
 func GaussianBlur(buf []byte, o ImageOptions) (Image, error) {
+	return processOperation(buf, o, gaussianBlurOptions)
+}
+
+func gaussianBlurOptions(metadata func() (bimg.ImageMetadata, error), o ImageOptions) (bimg.Options, error) {
 	if o.Sigma == 0 && o.MinAmpl == 0 {
-		return Image{}, NewError("Missing required param: sigma or minampl", BadRequest)
+		return bimg.Options{}, NewError("Missing required param: sigma or minampl", BadRequest)
 	}
-	opts := BimgOptions(o)
-	return Process(buf, opts)
+	return BimgOptions(o), nil
 }
 
-func Pipeline(buf []byte, o ImageOptions) (Image, error) {
-	if len(o.Operations) == 0 {
+func Pipeline(buf []byte, o ImageOptions) (out Image, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r)
+			out = Image{}
+		}
+	}()
+
+	if len(o.Operations) == 0 && len(o.Outputs) == 0 {
 		return Image{}, NewError("Missing or invalid pipeline operations JSON", BadRequest)
 	}
-	if len(o.Operations) > 10 {
-		return Image{}, NewError("Maximum allowed pipeline operations exceeded", BadRequest)
+	if len(o.Outputs) > 10 {
+		return Image{}, NewError("Maximum allowed pipeline outputs exceeded", BadRequest)
+	}
+
+	if err := buildPipelineOperations(o.Operations); err != nil {
+		return Image{}, err
+	}
+	for _, output := range o.Outputs {
+		if err := buildPipelineOperations(output.Operations); err != nil {
+			return Image{}, err
+		}
+	}
+
+	// The image is decoded once and the operations are chained in memory,
+	// so it is only encoded with the output options of the last operation
+	image, err := newVipsImage(buf)
+	if err != nil {
+		return Image{}, err
+	}
+	defer image.close()
+
+	transformed, err := runPipeline(image, o.Operations)
+	if err != nil {
+		return Image{}, err
+	}
+	if len(o.Outputs) == 0 {
+		return savePipelineImage(image, buf, transformed)
+	}
+
+	// Each output branches from the result of the shared operations
+	result := Image{Outputs: make([]Image, 0, len(o.Outputs))}
+	for _, output := range o.Outputs {
+		branch := image.branch()
+		applied, err := runPipeline(branch, output.Operations)
+		var out Image
+		if err == nil {
+			out, err = savePipelineImage(branch, buf, transformed || applied)
+		}
+		branch.close()
+		if err != nil {
+			return Image{}, fmt.Errorf("output %s: %w", output.Name, err)
+		}
+
+		out.Name = output.Name
+		result.Outputs = append(result.Outputs, out)
+	}
+	return result, nil
+}
+
+// buildPipelineOperations validates the operations and builds their options,
+// unless they depend on the image they are applied to.
+func buildPipelineOperations(operations PipelineOperations) error {
+	if len(operations) > 10 {
+		return NewError("Maximum allowed pipeline operations exceeded", BadRequest)
 	}
 
-	// Validate and built operations
-	for i, operation := range o.Operations {
+	for i, operation := range operations {
 		// Validate supported operation name
 		var exists bool
-		if operation.Operation, exists = OperationsMap[operation.Name]; !exists {
-			return Image{}, NewError(fmt.Sprintf("Unsupported operation name: %s", operation.Name), BadRequest)
+		if operation.Transformation, exists = OperationsMap[operation.Name]; !exists {
+			return NewError(fmt.Sprintf("Unsupported operation name: %s", operation.Name), BadRequest)
+		}
+
+		if err := operation.compile(); err != nil {
+			return NewError(err.Error(), BadRequest)
 		}
 
 		// Parse and construct operation options
-		var err error
-		operation.ImageOptions, err = buildParamsFromOperation(operation)
-		if err != nil {
-			return Image{}, err
+		if len(operation.expressions) == 0 {
+			var err error
+			operation.ImageOptions, err = buildParamsFromOperation(operation)
+			if err != nil {
+				return err
+			}
 		}
 
 		// Mutate list by value
-		o.Operations[i] = operation
+		operations[i] = operation
 	}
+	return nil
+}
 
-	var image Image
-	var err error
-
-	// Reduce image by running multiple operations
-	image = Image{Body: buf}
-	for _, operation := range o.Operations {
-		var curImage Image
-		curImage, err = operation.Operation(image.Body, operation.ImageOptions)
-		if err != nil && !operation.IgnoreFailure {
-			return Image{}, err
-		}
-		if operation.IgnoreFailure {
-			err = nil
+// runPipeline applies the operations to the image and reports whether any of
+// them was applied.
+func runPipeline(image *vipsImage, operations PipelineOperations) (bool, error) {
+	var transformed bool
+	for _, operation := range operations {
+		applied, err := runPipelineOperation(image, operation)
+		if err != nil {
+			if operation.IgnoreFailure {
+				continue
+			}
+			return false, err
 		}
-		if err == nil {
-			image = curImage
+		transformed = transformed || applied
+	}
+	return transformed, nil
+}
+
+// savePipelineImage encodes the image, or returns the source buffer if all
+// the operations failed, were ignored or skipped.
+func savePipelineImage(image *vipsImage, buf []byte, transformed bool) (Image, error) {
+	if !transformed {
+		return Image{Body: buf, Mime: GetImageMimeType(bimg.DetermineImageType(buf))}, nil
+	}
+
+	body, err := image.save()
+	if err != nil {
+		return Image{}, err
+	}
+
+	mime := GetImageMimeType(bimg.DetermineImageType(body))
+	return Image{Body: body, Mime: mime}, nil
+}
+
+// runPipelineOperation applies an operation to the image, unless its
+// condition is false, and reports whether it was applied.
+func runPipelineOperation(image *vipsImage, operation PipelineOperation) (bool, error) {
+	if operation.dynamic() {
+		apply, err := operation.evaluate(image.variables())
+		if err != nil || !apply {
+			return false, err
 		}
 	}
 
-	return image, err
+	opts, err := operation.Transformation(image.metadata, operation.ImageOptions)
+	if err != nil {
+		return false, err
+	}
+	return true, image.transform(opts)
 }
 
 func Process(buf []byte, opts bimg.Options) (out Image, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			switch value := r.(type) {
-			case error:
-				err = value
-			case string:
-				err = errors.New(value)
-			default:
-				err = errors.New("libvips internal error")
-			}
+			err = recoveredError(r)
 			out = Image{}
 		}
 	}()
@@ -424,3 +594,15 @@ func Process(buf []byte, opts bimg.Options) (out Image, err error) {
 	mime := GetImageMimeType(bimg.DetermineImageType(buf))
 	return Image{Body: buf, Mime: mime}, nil
 }
+
+// recoveredError converts the value of a recovered libvips panic to an error.
+func recoveredError(r interface{}) error {
+	switch value := r.(type) {
+	case error:
+		return value
+	case string:
+		return errors.New(value)
+	default:
+		return errors.New("libvips internal error")
+	}
+}
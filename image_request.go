@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ImageRequestSpecField is the form field holding the JSON document of a
+// multipart image request, next to the image in the "file" field.
+const ImageRequestSpecField = "spec"
+
+// maxImageRequestSpecSize is the size allowed for the JSON document on top
+// of the Base64 encoded image data.
+const maxImageRequestSpecSize = 1024 * 1024
+
+// ImageRequest is the JSON document of an image request, which defines with
+// typed fields what the query params define otherwise:
+//
+//	{"source": {"url": "https://example.com/image.jpg"}, "params": {"width": 300, "type": "webp"}}
+type ImageRequest struct {
+	Source     ImageRequestSource     `json:"source"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Operations PipelineOperations     `json:"operations,omitempty"`
+	Outputs    PipelineOutputs        `json:"outputs,omitempty"`
+	Output     ImageRequestOutput     `json:"output"`
+}
+
+// ImageRequestSource defines the image to process: a remote URL, a file of
+// the mount directory, an object of a storage profile or the Base64 encoded
+// image data.
+type ImageRequestSource struct {
+	URL       string `json:"url,omitempty"`
+	File      string `json:"file,omitempty"`
+	Storage   string `json:"storage,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Container string `json:"container,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+}
+
+// ImageRequestOutput defines where the processed image is uploaded, or how
+// the outputs of a pipeline are bundled in the response.
+type ImageRequestOutput struct {
+	Storage            string `json:"storage,omitempty"`
+	Key                string `json:"key,omitempty"`
+	Container          string `json:"container,omitempty"`
+	File               string `json:"file,omitempty"`
+	URL                string `json:"url,omitempty"`
+	ContentType        string `json:"contentType,omitempty"`
+	CacheControl       string `json:"cacheControl,omitempty"`
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+	Bundle             string `json:"bundle,omitempty"`
+}
+
+// readImageRequest reads the JSON document of a request with an
+// application/json body, or with a multipart body holding the spec field.
+// It returns the equivalent request with query params, and the image data
+// when sent with the document. It reports false for any other request.
+func readImageRequest(r *http.Request, o ServerOptions) (*http.Request, []byte, bool, error) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		return nil, nil, false, nil
+	}
+
+	var data, buf []byte
+	var err error
+
+	switch {
+	case isJSONBody(r):
+		limit := 0
+		if o.MaxAllowedSize > 0 {
+			limit = base64.StdEncoding.EncodedLen(o.MaxAllowedSize) + maxImageRequestSpecSize
+		}
+		if data, err = readAllLimited(r.Body, limit); err != nil {
+			return nil, nil, true, err
+		}
+	case isFormBody(r):
+		if err := parseFormBody(r, o.MaxAllowedSize, maxImageRequestSpecSize+maxFormOverhead); err != nil {
+			return nil, nil, true, err
+		}
+		spec, ok := r.MultipartForm.Value[ImageRequestSpecField]
+		if !ok || len(spec) == 0 {
+			return nil, nil, false, nil
+		}
+		data = []byte(spec[0])
+		if _, ok := r.MultipartForm.File[formFieldName]; ok {
+			if buf, err = readFormBody(r, o.MaxAllowedSize); err != nil {
+				return nil, nil, true, err
+			}
+		}
+	default:
+		return nil, nil, false, nil
+	}
+
+	if o.EnableURLSignature {
+		return nil, nil, true, ErrSignedRequestBody
+	}
+	for key := range r.URL.Query() {
+		if key != "key" {
+			return nil, nil, true, NewError(fmt.Sprintf("query params cannot be combined with a JSON request: %s", key), BadRequest)
+		}
+	}
+
+	spec, err := decodeImageRequest(data)
+	if err != nil {
+		return nil, nil, true, err
+	}
+
+	if buf != nil {
+		if spec.Source.defined() {
+			return nil, nil, true, NewError("the image source cannot be combined with the file field", BadRequest)
+		}
+	} else if len(spec.Source.Data) > 0 {
+		if exceedsMaxAllowedSize(int64(len(spec.Source.Data)), o.MaxAllowedSize) {
+			return nil, nil, true, ErrImageTooLarge
+		}
+		buf = spec.Source.Data
+	}
+
+	query, err := spec.query(o, buf != nil)
+	if err != nil {
+		return nil, nil, true, err
+	}
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req.Header.Del("Content-Type")
+	req.URL.RawQuery = query.Encode()
+	req.RequestURI = req.URL.RequestURI()
+
+	return req, buf, true, nil
+}
+
+func isJSONBody(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+func decodeImageRequest(data []byte) (*ImageRequest, error) {
+	var spec ImageRequest
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&spec); err != nil {
+		return nil, NewError("invalid JSON request: "+err.Error(), BadRequest)
+	}
+	return &spec, nil
+}
+
+// query translates the document into the query params of the request. The
+// params are validated like query params, so a JSON request is processed
+// exactly as the equivalent query string. The image source is pinned, as
+// the image data may come with the document instead.
+func (ir *ImageRequest) query(o ServerOptions, inline bool) (url.Values, error) {
+	query := url.Values{}
+
+	if err := ir.Source.query(query, o, inline); err != nil {
+		return nil, err
+	}
+	if err := ir.Output.query(query); err != nil {
+		return nil, err
+	}
+
+	for param, value := range ir.Params {
+		if _, exists := paramTypeCoercions[param]; !exists || param == "operations" || param == "outputs" {
+			return nil, NewError(fmt.Sprintf("unsupported param: %s", param), BadRequest)
+		}
+		s, ok := formatParamValue(value)
+		if !ok {
+			return nil, NewError(fmt.Sprintf("invalid value of param %s: %v", param, value), BadRequest)
+		}
+		query.Set(param, s)
+	}
+
+	if len(ir.Operations) > 0 {
+		buf, err := json.Marshal(ir.Operations)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("operations", string(buf))
+	}
+	if len(ir.Outputs) > 0 {
+		buf, err := json.Marshal(ir.Outputs)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("outputs", string(buf))
+	}
+
+	if _, err := buildParamsFromQuery(query); err != nil {
+		return nil, NewError("Error while processing parameters, "+err.Error(), BadRequest)
+	}
+
+	return query, nil
+}
+
+func (s ImageRequestSource) defined() bool {
+	return s.URL != "" || s.File != "" || s.Storage != "" || s.Key != "" || s.Container != "" || len(s.Data) > 0
+}
+
+func (s ImageRequestSource) query(query url.Values, o ServerOptions, inline bool) error {
+	sources := 0
+	for _, defined := range []bool{s.URL != "", s.File != "", s.Storage != "", inline} {
+		if defined {
+			sources++
+		}
+	}
+	if sources == 0 {
+		return ErrMissingImageSource
+	}
+	if sources > 1 {
+		return NewError("only one image source can be defined", BadRequest)
+	}
+	if s.Storage == "" && (s.Key != "" || s.Container != "") {
+		return NewError("the source key and container require a storage", BadRequest)
+	}
+
+	switch {
+	case s.URL != "":
+		if !o.EnableURLSource {
+			return ErrURLSourceDisabled
+		}
+		query.Set(SourceQueryKey, string(ImageSourceTypeHTTP))
+		query.Set(URLQueryKey, s.URL)
+	case s.File != "":
+		if o.Mount == "" {
+			return ErrMountDisabled
+		}
+		query.Set(SourceQueryKey, string(ImageSourceTypeFileSystem))
+		query.Set("file", s.File)
+	case s.Storage != "":
+		if s.Key == "" {
+			return NewError("missing source key of storage: "+s.Storage, BadRequest)
+		}
+		query.Set(SourceQueryKey, string(ImageSourceTypeStorage))
+		query.Set("storage", s.Storage)
+		query.Set("storageKey", s.Key)
+		if s.Container != "" {
+			query.Set("storageContainer", s.Container)
+		}
+	}
+
+	return nil
+}
+
+func (out ImageRequestOutput) query(query url.Values) error {
+	sinks := 0
+	for _, defined := range []bool{out.URL != "", out.File != "", out.Storage != ""} {
+		if defined {
+			sinks++
+		}
+	}
+	if sinks > 1 {
+		return NewError("only one output destination can be defined", BadRequest)
+	}
+	if out.Storage == "" && (out.Key != "" || out.Container != "") {
+		return NewError("the output key and container require a storage", BadRequest)
+	}
+
+	switch {
+	case out.URL != "":
+		query.Set(SinkQueryKey, string(ImageSinkTypeHTTP))
+		query.Set(OutputURLQueryKey, out.URL)
+	case out.File != "":
+		query.Set(SinkQueryKey, string(ImageSinkTypeFileSystem))
+		query.Set("outputFile", out.File)
+	case out.Storage != "":
+		if out.Key == "" {
+			return NewError("missing output key of storage: "+out.Storage, BadRequest)
+		}
+		query.Set(SinkQueryKey, string(ImageSinkTypeStorage))
+		query.Set("outputStorage", out.Storage)
+		query.Set("outputKey", out.Key)
+		if out.Container != "" {
+			query.Set("outputContainer", out.Container)
+		}
+	}
+
+	for param, value := range map[string]string{
+		"contentType":         out.ContentType,
+		"cacheControl":        out.CacheControl,
+		"contentDisposition":  out.ContentDisposition,
+		OutputsBundleQueryKey: out.Bundle,
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+
+	return nil
+}
+
+// formatParamValue formats a JSON value as a query param value.
+func formatParamValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImageRequestQuery(t *testing.T) {
+	spec, err := decodeImageRequest([]byte(`{
+		"source": {"storage": "media", "key": "photos/beach.jpg"},
+		"params": {"width": 300, "quality": 80.5, "stripmeta": true, "type": "webp"},
+		"operations": [{"operation": "resize", "params": {"width": 300}}],
+		"output": {"storage": "media", "key": "thumbs/{name}.{format}", "cacheControl": "max-age=3600"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := spec.query(ServerOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"source":       "storage",
+		"storage":      "media",
+		"storageKey":   "photos/beach.jpg",
+		"sink":         "storage",
+		"outputKey":    "thumbs/{name}.{format}",
+		"cacheControl": "max-age=3600",
+		"width":        "300",
+		"quality":      "80.5",
+		"stripmeta":    "true",
+		"type":         "webp",
+	}
+	for param, value := range expected {
+		if query.Get(param) != value {
+			t.Errorf("Invalid param %s: %q", param, query.Get(param))
+		}
+	}
+	if !strings.Contains(query.Get("operations"), `"operation":"resize"`) {
+		t.Errorf("Invalid operations: %s", query.Get("operations"))
+	}
+
+	invalid := []string{
+		`{"source": {"storage": "media", "key": "a.jpg"}, "format": "webp"}`,
+		`{"source": {"storage": "media", "key": "a.jpg"}, "params": {"size": 300}}`,
+		`{"source": {"storage": "media", "key": "a.jpg"}, "params": {"operations": "[]"}}`,
+		`{"source": {"storage": "media", "key": "a.jpg"}, "params": {"width": "wide"}}`,
+		`{"source": {"storage": "media", "key": "a.jpg"}, "params": {"width": [300]}}`,
+		`{"source": {"storage": "media", "key": "a.jpg"}, "operations": [{"operation": "blur", "if": "width +", "params": {}}]}`,
+		`{"source": {"storage": "media", "key": "a.jpg"}, "output": {"file": "a.jpg", "url": "http://example.com"}}`,
+		`{"source": {"storage": "media", "key": "a.jpg"}, "output": {"key": "a.jpg"}}`,
+		`{"source": {"storage": "media"}}`,
+		`{"source": {"url": "http://example.com/a.jpg", "file": "a.jpg"}}`,
+		`{"source": {"url": "http://example.com/a.jpg"}}`,
+		`{"source": {"file": "a.jpg"}}`,
+		`{"source": {}}`,
+	}
+	for _, data := range invalid {
+		spec, err := decodeImageRequest([]byte(data))
+		if err == nil {
+			_, err = spec.query(ServerOptions{}, false)
+		}
+		if err == nil {
+			t.Errorf("Expected error for request: %s", data)
+		}
+	}
+}
+
+func TestReadImageRequest(t *testing.T) {
+	image := []byte("image data")
+	o := ServerOptions{EnableURLSource: true}
+
+	body := `{"source": {"data": "` + base64.StdEncoding.EncodeToString(image) + `"}, "params": {"width": 300}}`
+	r := httptest.NewRequest(http.MethodPost, "/resize?key=secret", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	req, buf, ok, err := readImageRequest(r, o)
+	if err != nil || !ok {
+		t.Fatalf("Cannot read the request: %v", err)
+	}
+	if string(buf) != string(image) {
+		t.Errorf("Invalid image: %q", buf)
+	}
+	if req.Method != http.MethodGet || req.URL.Path != "/resize" || req.URL.RawQuery != "width=300" {
+		t.Errorf("Invalid request: %s %s", req.Method, req.URL)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	_ = mw.WriteField(ImageRequestSpecField, `{"params": {"width": 300, "type": "png"}}`)
+	part, _ := mw.CreateFormFile(formFieldName, "image.jpg")
+	_, _ = part.Write(image)
+	_ = mw.Close()
+
+	r = httptest.NewRequest(http.MethodPost, "/resize", bytes.NewReader(form.Bytes()))
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	req, buf, ok, err = readImageRequest(r, o)
+	if err != nil || !ok {
+		t.Fatalf("Cannot read the multipart request: %v", err)
+	}
+	if string(buf) != string(image) || req.URL.Query().Get("type") != "png" {
+		t.Errorf("Invalid multipart request: %q %s", buf, req.URL)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/resize?width=300", bytes.NewReader(image))
+	r.Header.Set("Content-Type", "image/jpeg")
+	if _, _, ok, err := readImageRequest(r, o); ok || err != nil {
+		t.Errorf("Unexpected JSON request: %v", err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/resize?width=200", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if _, _, _, err := readImageRequest(r, o); err == nil {
+		t.Error("Expected error for query params combined with a JSON request")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/resize", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if _, _, _, err := readImageRequest(r, ServerOptions{EnableURLSignature: true}); err != ErrSignedRequestBody {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestReadImageRequestExceedsMaximumAllowedSize(t *testing.T) {
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	_ = mw.WriteField(ImageRequestSpecField, `{"params": {"width": 300}}`)
+	part, _ := mw.CreateFormFile(formFieldName, "image.jpg")
+	_, _ = part.Write(bytes.Repeat([]byte("x"), 2*(maxImageRequestSpecSize+maxFormOverhead)))
+	_ = mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/resize", bytes.NewReader(form.Bytes()))
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if _, _, _, err := readImageRequest(r, ServerOptions{MaxAllowedSize: 1024}); err != ErrImageTooLarge {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
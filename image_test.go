@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -127,6 +135,161 @@ func TestImagePipelineOperations(t *testing.T) {
 	}
 }
 
+func TestImagePipelineTransformations(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	rotated := withExifOrientation(buf, 6)
+
+	cases := []struct {
+		name          string
+		buf           []byte
+		operation     string
+		params        map[string]interface{}
+		width, height int
+	}{
+		{"crop", buf, "crop", map[string]interface{}{"width": 300, "height": 260}, 300, 260},
+		{"resize", buf, "resize", map[string]interface{}{"width": 300}, 300, 404},
+		{"fit", buf, "fit", map[string]interface{}{"width": 300, "height": 300}, 223, 300},
+		// The image is rotated to 740x550 by its EXIF orientation
+		{"crop rotated", rotated, "crop", map[string]interface{}{"width": 300, "height": 260}, 300, 260},
+		{"resize rotated", rotated, "resize", map[string]interface{}{"width": 300}, 300, 223},
+		{"fit rotated", rotated, "fit", map[string]interface{}{"width": 300, "height": 300}, 300, 223},
+		{"resize not rotated", rotated, "resize", map[string]interface{}{"width": 300, "norotation": true}, 300, 404},
+	}
+
+	for _, c := range cases {
+		operations := PipelineOperations{{Name: c.operation, Params: c.params}}
+		img, err := Pipeline(c.buf, ImageOptions{Operations: operations})
+		if err != nil {
+			t.Errorf("%s: cannot process image: %s", c.name, err)
+			continue
+		}
+		if img.Mime != "image/jpeg" {
+			t.Errorf("%s: invalid image MIME type: %s", c.name, img.Mime)
+		}
+		if err := assertSize(img.Body, c.width, c.height); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+	}
+}
+
+func TestImagePipelineBackground(t *testing.T) {
+	// A fully transparent image is flattened on the background color
+	buf := encodePNG(image.NewNRGBA(image.Rect(0, 0, 100, 100)))
+
+	operations := PipelineOperations{
+		{Name: "resize", Params: map[string]interface{}{"width": 50, "background": "255,0,0"}},
+	}
+	img, err := Pipeline(buf, ImageOptions{Operations: operations})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/png" {
+		t.Errorf("Invalid image MIME type: %s", img.Mime)
+	}
+
+	out, err := png.Decode(bytes.NewReader(img.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Bounds().Dx() != 50 || out.Bounds().Dy() != 50 {
+		t.Errorf("Invalid image size: %s", out.Bounds())
+	}
+	if r, g, b, a := out.At(25, 25).RGBA(); r>>8 != 255 || g>>8 != 0 || b>>8 != 0 || a>>8 != 255 {
+		t.Errorf("Invalid background color: %d,%d,%d,%d", r>>8, g>>8, b>>8, a>>8)
+	}
+}
+
+func TestImagePipelineWatermarkImage(t *testing.T) {
+	watermark := image.NewNRGBA(image.Rect(0, 0, 50, 50))
+	for x := 0; x < 50; x++ {
+		for y := 0; y < 50; y++ {
+			watermark.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(encodePNG(watermark))
+	}))
+	defer ts.Close()
+
+	operations := PipelineOperations{
+		{Name: "resize", Params: map[string]interface{}{"width": 300}},
+		{Name: "watermarkImage", Params: map[string]interface{}{"image": ts.URL, "top": 10, "left": 10, "opacity": 1}},
+	}
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	img, err := Pipeline(buf, ImageOptions{Operations: operations})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if err := assertSize(img.Body, 300, 404); err != nil {
+		t.Error(err)
+	}
+
+	out, err := jpeg.Decode(bytes.NewReader(img.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := out.At(35, 35).RGBA(); r>>8 < 200 || g>>8 > 60 || b>>8 > 60 {
+		t.Errorf("Invalid watermark color: %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestImagePipelineIgnoreFailure(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	failing := PipelineOperation{Name: "watermarkImage", Params: map[string]interface{}{}, IgnoreFailure: true}
+
+	// An ignored failure leaves the image unchanged
+	img, err := Pipeline(buf, ImageOptions{Operations: PipelineOperations{failing}})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if !bytes.Equal(img.Body, buf) || img.Mime != "image/jpeg" {
+		t.Error("Expected the image to be unchanged")
+	}
+
+	operations := PipelineOperations{
+		{Name: "crop", Params: map[string]interface{}{"width": 300, "height": 260}},
+		failing,
+	}
+	img, err = Pipeline(buf, ImageOptions{Operations: operations})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if err := assertSize(img.Body, 300, 260); err != nil {
+		t.Error(err)
+	}
+
+	failing.IgnoreFailure = false
+	if _, err := Pipeline(buf, ImageOptions{Operations: PipelineOperations{failing}}); err == nil {
+		t.Error("Expected error for a failing operation")
+	}
+}
+
+// withExifOrientation inserts an EXIF segment with the orientation tag
+// after the start of a JPEG image.
+func withExifOrientation(buf []byte, orientation uint16) []byte {
+	var exif bytes.Buffer
+	exif.WriteString("Exif\x00\x00MM\x00\x2a")
+	_ = binary.Write(&exif, binary.BigEndian, uint32(8))                 // IFD offset
+	_ = binary.Write(&exif, binary.BigEndian, uint16(1))                 // IFD entries
+	_ = binary.Write(&exif, binary.BigEndian, []uint16{0x0112, 3, 0, 1}) // orientation tag, short type, count
+	_ = binary.Write(&exif, binary.BigEndian, []uint16{orientation, 0})  // value
+	_ = binary.Write(&exif, binary.BigEndian, uint32(0))                 // next IFD
+
+	out := append([]byte{}, buf[:2]...)
+	out = append(out, 0xff, 0xe1)
+	out = append(out, byte((exif.Len()+2)>>8), byte(exif.Len()+2))
+	out = append(out, exif.Bytes()...)
+	return append(out, buf[2:]...)
+}
+
+func encodePNG(img image.Image) []byte {
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
 func TestCalculateDestinationFitDimension(t *testing.T) {
 	cases := []struct {
 		// Image
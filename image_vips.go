@@ -0,0 +1,989 @@
+package main
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+#define IMAGINARY_EXIF_ORIENTATION "exif-ifd0-Orientation"
+
+static void
+imaginary_image_ref(VipsImage *image)
+{
+	g_object_ref(image);
+}
+
+static void
+imaginary_image_unref(VipsImage *image)
+{
+	g_object_unref(image);
+}
+
+static void
+imaginary_free(void *buf)
+{
+	g_free(buf);
+}
+
+// imaginary_replace replaces the image with the output of an operation,
+// which holds its own reference to the input.
+static int
+imaginary_replace(VipsImage **image, VipsImage *out)
+{
+	g_object_unref(*image);
+	*image = out;
+	return 0;
+}
+
+static VipsImage *
+imaginary_image_load(const void *buf, size_t len, int shrink)
+{
+	if (shrink > 1) {
+		return vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_RANDOM, "shrink", shrink, NULL);
+	}
+	return vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_RANDOM, NULL);
+}
+
+static int
+imaginary_has_alpha(VipsImage *image)
+{
+	int bands = vips_image_get_bands(image);
+	VipsInterpretation type = vips_image_get_interpretation(image);
+
+	return (bands == 2 && type == VIPS_INTERPRETATION_B_W) ||
+		(bands == 4 && type != VIPS_INTERPRETATION_CMYK) ||
+		(bands == 5 && type == VIPS_INTERPRETATION_CMYK);
+}
+
+static int
+imaginary_is_16bit(VipsImage *image)
+{
+	VipsInterpretation type = vips_image_get_interpretation(image);
+	return type == VIPS_INTERPRETATION_RGB16 || type == VIPS_INTERPRETATION_GREY16;
+}
+
+static int
+imaginary_image_pages(VipsImage *image)
+{
+	int pages = 1;
+
+	if (vips_image_get_typeof(image, VIPS_META_N_PAGES) != 0) {
+		vips_image_get_int(image, VIPS_META_N_PAGES, &pages);
+	}
+	return pages;
+}
+
+static int
+imaginary_image_orientation(VipsImage *image)
+{
+	const char *exif;
+
+	if (vips_image_get_typeof(image, IMAGINARY_EXIF_ORIENTATION) != 0 &&
+		!vips_image_get_string(image, IMAGINARY_EXIF_ORIENTATION, &exif)) {
+		return atoi(exif);
+	}
+	return 0;
+}
+
+// imaginary_image_reset_orientation marks an auto rotated image as upright,
+// so it is neither rotated again nor saved with its original orientation.
+static int
+imaginary_image_reset_orientation(VipsImage **image)
+{
+	VipsImage *out;
+
+	if (vips_copy(*image, &out, NULL)) {
+		return -1;
+	}
+	vips_image_remove(out, IMAGINARY_EXIF_ORIENTATION);
+	vips_image_set_int(out, "orientation", 1);
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_remove_profile(VipsImage **image)
+{
+	VipsImage *out;
+
+	if (vips_copy(*image, &out, NULL)) {
+		return -1;
+	}
+	vips_image_remove(out, VIPS_META_ICC_NAME);
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_rotate(VipsImage **image, VipsAngle angle)
+{
+	VipsImage *out;
+
+	if (vips_rot(*image, &out, angle, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_flip(VipsImage **image, VipsDirection direction)
+{
+	VipsImage *out;
+
+	if (vips_flip(*image, &out, direction, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_zoom(VipsImage **image, int factor)
+{
+	VipsImage *out;
+
+	if (vips_zoom(*image, &out, factor, factor, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_shrink(VipsImage **image, double shrink)
+{
+	VipsImage *out;
+
+	if (vips_shrink(*image, &out, shrink, shrink, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_reduce(VipsImage **image, double xshrink, double yshrink)
+{
+	VipsImage *out;
+
+	if (vips_reduce(*image, &out, xshrink, yshrink, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_affine(VipsImage **image, double xscale, double yscale, const char *interpolator)
+{
+	VipsInterpolate *interpolate = vips_interpolate_new(interpolator);
+	VipsImage *out;
+	int err;
+
+	if (interpolate == NULL) {
+		return -1;
+	}
+	err = vips_affine(*image, &out, xscale, 0, 0, yscale, "interpolate", interpolate, NULL);
+	g_object_unref(interpolate);
+	if (err) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_interpolator_window_size(const char *name)
+{
+	VipsInterpolate *interpolate = vips_interpolate_new(name);
+	int size;
+
+	if (interpolate == NULL) {
+		return 0;
+	}
+	size = vips_interpolate_get_window_size(interpolate);
+	g_object_unref(interpolate);
+	return size;
+}
+
+static int
+imaginary_image_extract(VipsImage **image, int left, int top, int width, int height)
+{
+	VipsImage *out;
+
+	if (vips_extract_area(*image, &out, left, top, width, height, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_smartcrop(VipsImage **image, int width, int height)
+{
+	VipsImage *out;
+
+	if (vips_smartcrop(*image, &out, width, height, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_embed(VipsImage **image, int left, int top, int width, int height,
+	VipsExtend extend, double r, double g, double b)
+{
+	double background[3] = {r, g, b};
+	VipsArrayDouble *array;
+	VipsImage *out;
+	int err;
+
+	if (extend != VIPS_EXTEND_BACKGROUND) {
+		err = vips_embed(*image, &out, left, top, width, height, "extend", extend, NULL);
+	} else {
+		array = vips_array_double_new(background, 3);
+		err = vips_embed(*image, &out, left, top, width, height, "extend", extend, "background", array, NULL);
+		vips_area_unref(VIPS_AREA(array));
+	}
+	if (err) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_gaussblur(VipsImage **image, double sigma, double min_ampl)
+{
+	VipsImage *out;
+
+	if (vips_gaussblur(*image, &out, sigma, "min_ampl", min_ampl, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_flatten(VipsImage **image, double r, double g, double b)
+{
+	double background[3];
+	VipsArrayDouble *array;
+	VipsImage *out;
+	double max_alpha = 255.0;
+	int err;
+
+	if (!imaginary_has_alpha(*image)) {
+		return 0;
+	}
+	if (imaginary_is_16bit(*image)) {
+		r = 65535 * r / 255;
+		g = 65535 * g / 255;
+		b = 65535 * b / 255;
+		max_alpha = 65535.0;
+	}
+
+	background[0] = r;
+	background[1] = g;
+	background[2] = b;
+	array = vips_array_double_new(background, 3);
+	err = vips_flatten(*image, &out, "background", array, "max_alpha", max_alpha, NULL);
+	vips_area_unref(VIPS_AREA(array));
+	if (err) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_colourspace(VipsImage **image, VipsInterpretation space)
+{
+	VipsImage *out;
+
+	if (!vips_colourspace_issupported(*image)) {
+		return 0;
+	}
+	if (vips_colourspace(*image, &out, space, NULL)) {
+		return -1;
+	}
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_watermark_text(VipsImage **image, const char *text, const char *font,
+	int width, int dpi, int margin, int no_replicate, double opacity, double r, double g, double b)
+{
+	VipsImage *in = *image;
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 11);
+	VipsImage *mask;
+	VipsImage *out;
+	double ones[3] = {1, 1, 1};
+	double background[3] = {r, g, b};
+	int w = vips_image_get_width(in);
+	int h = vips_image_get_height(in);
+
+	// Make the text mask
+	if (vips_text(&t[0], text, "width", width, "dpi", dpi, "font", font, NULL) ||
+		vips_linear1(t[0], &t[1], opacity, 0.0, NULL) ||
+		vips_cast(t[1], &t[2], VIPS_FORMAT_UCHAR, NULL) ||
+		vips_embed(t[2], &t[3], 100, 100,
+			vips_image_get_width(t[2]) + margin, vips_image_get_height(t[2]) + margin, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	mask = t[3];
+
+	// Replicate it over the whole image
+	if (!no_replicate) {
+		if (vips_replicate(mask, &t[4], 1 + w / vips_image_get_width(mask), 1 + h / vips_image_get_height(mask), NULL) ||
+			vips_crop(t[4], &t[5], 0, 0, w, h, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		mask = t[5];
+	}
+
+	// Paint the text with a constant image
+	if (vips_black(&t[6], 1, 1, NULL) ||
+		vips_linear(t[6], &t[7], ones, background, 3, NULL) ||
+		vips_cast(t[7], &t[8], VIPS_FORMAT_UCHAR, NULL) ||
+		vips_copy(t[8], &t[9], "interpretation", vips_image_get_interpretation(in), NULL) ||
+		vips_embed(t[9], &t[10], 0, 0, w, h, "extend", VIPS_EXTEND_COPY, NULL) ||
+		vips_ifthenelse(mask, t[10], in, &out, "blend", TRUE, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	g_object_unref(base);
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_image_watermark_image(VipsImage **image, VipsImage *sub, int left, int top, double opacity)
+{
+	VipsImage *in = *image;
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 8);
+	VipsImage *out;
+
+	if (!imaginary_has_alpha(in)) {
+		if (vips_bandjoin_const1(in, &t[0], 255.0, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		in = t[0];
+	}
+	if (!imaginary_has_alpha(sub)) {
+		if (vips_bandjoin_const1(sub, &t[1], 255.0, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		sub = t[1];
+	}
+
+	// Blend the watermark at its position, masked by its alpha band
+	if (vips_embed(sub, &t[2], left, top, vips_image_get_width(in), vips_image_get_height(in), NULL) ||
+		vips_extract_band(sub, &t[3], vips_image_get_bands(sub) - 1, "n", 1, NULL) ||
+		vips_linear1(t[3], &t[4], opacity, 0.0, NULL) ||
+		vips_cast(t[4], &t[5], VIPS_FORMAT_UCHAR, NULL) ||
+		vips_copy(t[5], &t[6], "interpretation", vips_image_get_interpretation(in), NULL) ||
+		vips_embed(t[6], &t[7], left, top, vips_image_get_width(in), vips_image_get_height(in), NULL) ||
+		vips_ifthenelse(t[7], t[2], in, &out, "blend", TRUE, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	g_object_unref(base);
+	return imaginary_replace(image, out);
+}
+
+static int
+imaginary_jpegsave(VipsImage *image, void **buf, size_t *len, int strip, int quality, int interlace)
+{
+	return vips_jpegsave_buffer(image, buf, len,
+		"strip", strip,
+		"Q", quality,
+		"optimize_coding", TRUE,
+		"interlace", interlace,
+		NULL);
+}
+
+static int
+imaginary_pngsave(VipsImage *image, void **buf, size_t *len, int strip, int compression, int interlace)
+{
+	return vips_pngsave_buffer(image, buf, len,
+		"strip", strip,
+		"compression", compression,
+		"interlace", interlace,
+		"filter", VIPS_FOREIGN_PNG_FILTER_NONE,
+		NULL);
+}
+
+static int
+imaginary_webpsave(VipsImage *image, void **buf, size_t *len, int strip, int quality)
+{
+	return vips_webpsave_buffer(image, buf, len,
+		"strip", strip,
+		"Q", quality,
+		NULL);
+}
+
+static int
+imaginary_tiffsave(VipsImage *image, void **buf, size_t *len)
+{
+	return vips_tiffsave_buffer(image, buf, len, NULL);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"unsafe"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// vipsImage is an image decoded once by libvips and transformed in memory.
+// Its operations are evaluated lazily, when the image is finally saved.
+// It follows the semantics of bimg.Resize for each applied options.
+type vipsImage struct {
+	image   *C.VipsImage
+	typ     bimg.ImageType // type the image would be saved as
+	options bimg.Options   // options of the last transformation
+
+	// source is the C copy of the loaded buffer, which the image reads from
+	source    unsafe.Pointer
+	sourceLen int
+	buffers   []unsafe.Pointer
+	pristine  bool // not transformed yet, so it can be reloaded shrunk
+}
+
+// newVipsImage decodes an image buffer.
+func newVipsImage(buf []byte) (*vipsImage, error) {
+	if len(buf) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+
+	typ := bimg.DetermineImageType(buf)
+	if typ == bimg.UNKNOWN {
+		return nil, errors.New("Unsupported image format")
+	}
+
+	img := &vipsImage{typ: typ, sourceLen: len(buf), pristine: true}
+	img.source = img.copyBuffer(buf)
+
+	img.image = C.imaginary_image_load(img.source, C.size_t(img.sourceLen), 1)
+	if img.image == nil {
+		img.close()
+		return nil, vipsError()
+	}
+	return img, nil
+}
+
+// branch returns a copy of the image which can be transformed
+// independently. It reads the source of the image, so it must be closed
+// before the image.
+func (img *vipsImage) branch() *vipsImage {
+	C.imaginary_image_ref(img.image)
+	return &vipsImage{
+		image:     img.image,
+		typ:       img.typ,
+		options:   img.options,
+		source:    img.source,
+		sourceLen: img.sourceLen,
+		pristine:  img.pristine,
+	}
+}
+
+// copyBuffer copies a buffer to C memory, which libvips may read until the
+// image is closed.
+func (img *vipsImage) copyBuffer(buf []byte) unsafe.Pointer {
+	ptr := C.CBytes(buf)
+	img.buffers = append(img.buffers, ptr)
+	return ptr
+}
+
+// close releases the image and its buffers.
+func (img *vipsImage) close() {
+	if img.image != nil {
+		C.imaginary_image_unref(img.image)
+		img.image = nil
+	}
+	for _, ptr := range img.buffers {
+		C.free(ptr)
+	}
+	img.buffers = nil
+	C.vips_thread_shutdown()
+}
+
+// metadata returns the size and the EXIF orientation of the image.
+func (img *vipsImage) metadata() (bimg.ImageMetadata, error) {
+	return bimg.ImageMetadata{
+		Size:        bimg.ImageSize{Width: vipsImageWidth(img.image), Height: vipsImageHeight(img.image)},
+		Type:        bimg.ImageTypeName(img.typ),
+		Orientation: int(C.imaginary_image_orientation(img.image)),
+	}, nil
+}
+
+// variables returns the values of the pipeline expression variables.
+func (img *vipsImage) variables() exprEnv {
+	return exprEnv{
+		"width":       float64(vipsImageWidth(img.image)),
+		"height":      float64(vipsImageHeight(img.image)),
+		"type":        bimg.ImageTypeName(img.typ),
+		"alpha":       C.imaginary_has_alpha(img.image) != 0,
+		"orientation": float64(C.imaginary_image_orientation(img.image)),
+		"pages":       float64(C.imaginary_image_pages(img.image)),
+	}
+}
+
+// transform applies the options to the image. The image is unchanged if
+// an error is returned.
+func (img *vipsImage) transform(o bimg.Options) error {
+	if o.Quality == 0 {
+		o.Quality = bimg.Quality
+	}
+	if o.Compression == 0 {
+		o.Compression = 6
+	}
+	if o.Type == 0 {
+		o.Type = img.typ
+	}
+	if o.Interpretation == 0 {
+		o.Interpretation = bimg.InterpretationSRGB
+	}
+	if !bimg.IsTypeSupported(o.Type) {
+		return errors.New("Unsupported image output type")
+	}
+
+	image := img.image
+	C.imaginary_image_ref(image)
+	if err := img.apply(&image, o); err != nil {
+		C.imaginary_image_unref(image)
+		return err
+	}
+
+	C.imaginary_image_unref(img.image)
+	img.image = image
+	img.typ = o.Type
+	img.options = o
+	img.pristine = false
+	return nil
+}
+
+// apply transforms the image like bimg.Resize, up to its encoding.
+func (img *vipsImage) apply(image **C.VipsImage, o bimg.Options) error {
+	rotated, err := vipsRotateAndFlip(image, o)
+	if err != nil {
+		return err
+	}
+
+	inWidth, inHeight := vipsImageWidth(*image), vipsImageHeight(*image)
+
+	// Infer the required operation based on the in/out image sizes
+	if !o.Force && !o.Crop && !o.Embed && !o.Enlarge && o.Rotate == 0 && (o.Width > 0 || o.Height > 0) {
+		o.Force = true
+	}
+
+	factor := vipsImageCalculations(&o, inWidth, inHeight)
+	shrink := vipsCalculateShrink(factor, o.Interpolator)
+	residual := float64(shrink) / factor
+
+	// Do not enlarge the output if the input is already smaller
+	if !o.Enlarge && !o.Force && inWidth < o.Width && inHeight < o.Height {
+		shrink = 1
+		residual = 0
+		o.Width = inWidth
+		o.Height = inHeight
+	}
+
+	// Reload an untouched JPEG image with libjpeg shrink-on-load
+	if img.pristine && !rotated && img.typ == bimg.JPEG && shrink >= 2 {
+		load := 2
+		switch {
+		case shrink >= 8:
+			load = 8
+		case shrink >= 4:
+			load = 4
+		}
+
+		shrunk := C.imaginary_image_load(img.source, C.size_t(img.sourceLen), C.int(load))
+		if shrunk == nil {
+			return vipsError()
+		}
+		C.imaginary_replace(image, shrunk)
+
+		factor = math.Max(factor/float64(load), 1.0)
+		shrink = int(math.Floor(factor))
+		residual = float64(shrink) / factor
+	}
+
+	if o.Zoom > 0 {
+		if C.imaginary_image_zoom(image, C.int(o.Zoom+1)) != 0 {
+			return vipsError()
+		}
+	}
+
+	if o.Force || (o.Width > 0 && o.Width != inWidth) || (o.Height > 0 && o.Height != inHeight) ||
+		o.AreaWidth > 0 || o.AreaHeight > 0 {
+		if err := vipsTransformImage(image, o, shrink, residual); err != nil {
+			return err
+		}
+	}
+
+	if o.GaussianBlur.Sigma > 0 || o.GaussianBlur.MinAmpl > 0 {
+		if C.imaginary_image_gaussblur(image, C.double(o.GaussianBlur.Sigma), C.double(o.GaussianBlur.MinAmpl)) != 0 {
+			return vipsError()
+		}
+	}
+
+	if err := vipsWatermarkText(image, o.Watermark); err != nil {
+		return err
+	}
+	if err := img.watermarkImage(image, o.WatermarkImage); err != nil {
+		return err
+	}
+
+	// Flatten PNG images on the background
+	if img.typ == bimg.PNG && o.Background != bimg.ColorBlack {
+		if C.imaginary_image_flatten(image, C.double(o.Background.R), C.double(o.Background.G), C.double(o.Background.B)) != 0 {
+			return vipsError()
+		}
+	}
+
+	if o.NoProfile {
+		if C.imaginary_image_remove_profile(image) != 0 {
+			return vipsError()
+		}
+	}
+	if C.imaginary_image_colourspace(image, C.VipsInterpretation(o.Interpretation)) != 0 {
+		return vipsError()
+	}
+
+	return nil
+}
+
+// save encodes the image with the output options of the last transformation.
+func (img *vipsImage) save() ([]byte, error) {
+	o := img.options
+	if o.Type != 0 && !bimg.IsTypeSupportedSave(o.Type) {
+		return nil, fmt.Errorf("VIPS cannot save to %#v", bimg.ImageTypes[o.Type])
+	}
+
+	var ptr unsafe.Pointer
+	var length C.size_t
+	var err C.int
+
+	strip := C.int(boolToInt(o.StripMetadata))
+	interlace := C.int(boolToInt(o.Interlace))
+
+	switch o.Type {
+	case bimg.WEBP:
+		err = C.imaginary_webpsave(img.image, &ptr, &length, strip, C.int(o.Quality))
+	case bimg.PNG:
+		err = C.imaginary_pngsave(img.image, &ptr, &length, strip, C.int(o.Compression), interlace)
+	case bimg.TIFF:
+		err = C.imaginary_tiffsave(img.image, &ptr, &length)
+	default:
+		err = C.imaginary_jpegsave(img.image, &ptr, &length, strip, C.int(o.Quality), interlace)
+	}
+	if err != 0 {
+		return nil, vipsError()
+	}
+	defer C.imaginary_free(ptr)
+
+	return C.GoBytes(ptr, C.int(length)), nil
+}
+
+func (img *vipsImage) watermarkImage(image **C.VipsImage, w bimg.WatermarkImage) error {
+	if len(w.Buf) == 0 {
+		return nil
+	}
+	if w.Opacity == 0 {
+		w.Opacity = 1
+	}
+	if bimg.DetermineImageType(w.Buf) == bimg.UNKNOWN {
+		return errors.New("Unsupported image format")
+	}
+
+	sub := C.imaginary_image_load(img.copyBuffer(w.Buf), C.size_t(len(w.Buf)), 1)
+	if sub == nil {
+		return vipsError()
+	}
+	defer C.imaginary_image_unref(sub)
+
+	if C.imaginary_image_watermark_image(image, sub, C.int(w.Left), C.int(w.Top), C.double(w.Opacity)) != 0 {
+		return vipsError()
+	}
+	return nil
+}
+
+func vipsWatermarkText(image **C.VipsImage, w bimg.Watermark) error {
+	if w.Text == "" {
+		return nil
+	}
+
+	if w.Font == "" {
+		w.Font = bimg.WatermarkFont
+	}
+	if w.Width == 0 {
+		w.Width = vipsImageWidth(*image) / 6
+	}
+	if w.DPI == 0 {
+		w.DPI = 150
+	}
+	if w.Margin == 0 {
+		w.Margin = w.Width
+	}
+	if w.Opacity == 0 {
+		w.Opacity = 0.25
+	} else if w.Opacity > 1 {
+		w.Opacity = 1
+	}
+
+	text := C.CString(w.Text)
+	defer C.free(unsafe.Pointer(text))
+	font := C.CString(w.Font)
+	defer C.free(unsafe.Pointer(font))
+
+	if C.imaginary_image_watermark_text(image, text, font,
+		C.int(w.Width), C.int(w.DPI), C.int(w.Margin), C.int(boolToInt(w.NoReplicate)), C.double(w.Opacity),
+		C.double(w.Background.R), C.double(w.Background.G), C.double(w.Background.B),
+	) != 0 {
+		return vipsError()
+	}
+	return nil
+}
+
+// vipsRotateAndFlip applies the explicit rotation and flips, or the EXIF
+// orientation of the image unless auto rotation is disabled.
+func vipsRotateAndFlip(image **C.VipsImage, o bimg.Options) (bool, error) {
+	var autoRotated bool
+	if !o.NoAutoRotate && o.Rotate == 0 {
+		switch C.imaginary_image_orientation(*image) {
+		case 2:
+			o.Flip = true
+		case 3:
+			o.Rotate = bimg.D180
+		case 4:
+			o.Flip, o.Rotate = true, bimg.D180
+		case 5:
+			o.Flip, o.Rotate = true, bimg.D90
+		case 6:
+			o.Rotate = bimg.D90
+		case 7:
+			o.Flip, o.Rotate = true, bimg.D270
+		case 8:
+			o.Rotate = bimg.D270
+		}
+		autoRotated = o.Flip || o.Rotate > 0
+	}
+
+	if angle := vipsAngle(o.Rotate); angle > 0 {
+		angles := map[bimg.Angle]C.VipsAngle{bimg.D90: C.VIPS_ANGLE_D90, bimg.D180: C.VIPS_ANGLE_D180, bimg.D270: C.VIPS_ANGLE_D270}
+		if C.imaginary_image_rotate(image, angles[angle]) != 0 {
+			return false, vipsError()
+		}
+	}
+	if o.Flip {
+		if C.imaginary_image_flip(image, C.VIPS_DIRECTION_VERTICAL) != 0 {
+			return false, vipsError()
+		}
+	}
+	if o.Flop {
+		if C.imaginary_image_flip(image, C.VIPS_DIRECTION_HORIZONTAL) != 0 {
+			return false, vipsError()
+		}
+	}
+	if autoRotated {
+		if C.imaginary_image_reset_orientation(image) != 0 {
+			return false, vipsError()
+		}
+	}
+
+	return o.Rotate > 0 || o.Flip || o.Flop, nil
+}
+
+func vipsTransformImage(image **C.VipsImage, o bimg.Options, shrink int, residual float64) error {
+	// Integral box shrink, followed by the residual resize
+	if shrink > 1 {
+		if C.imaginary_image_shrink(image, C.double(shrink)) != 0 {
+			return vipsError()
+		}
+
+		residualx := float64(o.Width) / float64(vipsImageWidth(*image))
+		residualy := float64(o.Height) / float64(vipsImageHeight(*image))
+		if o.Crop {
+			residual = math.Max(residualx, residualy)
+		} else {
+			residual = math.Min(residualx, residualy)
+		}
+	}
+
+	residualx, residualy := residual, residual
+	if o.Force {
+		residualx = float64(o.Width) / float64(vipsImageWidth(*image))
+		residualy = float64(o.Height) / float64(vipsImageHeight(*image))
+	}
+
+	if o.Force || residual != 0 {
+		if residualx < 1 && residualy < 1 {
+			if C.imaginary_image_reduce(image, C.double(1/residualx), C.double(1/residualy)) != 0 {
+				return vipsError()
+			}
+		} else {
+			interpolator := C.CString(o.Interpolator.String())
+			defer C.free(unsafe.Pointer(interpolator))
+			if C.imaginary_image_affine(image, C.double(residualx), C.double(residualy), interpolator) != 0 {
+				return vipsError()
+			}
+		}
+	}
+
+	if o.Force {
+		o.Crop = false
+		o.Embed = false
+	}
+
+	return vipsExtractOrEmbed(image, o)
+}
+
+func vipsExtractOrEmbed(image **C.VipsImage, o bimg.Options) error {
+	inWidth, inHeight := vipsImageWidth(*image), vipsImageHeight(*image)
+
+	var err C.int
+	switch {
+	case o.Gravity == bimg.GravitySmart, o.SmartCrop:
+		if o.Width > bimg.MaxSize || o.Height > bimg.MaxSize {
+			return errors.New("Maximum image size exceeded")
+		}
+		err = C.imaginary_image_smartcrop(image, C.int(o.Width), C.int(o.Height))
+	case o.Crop:
+		width, height := minInt(inWidth, o.Width), minInt(inHeight, o.Height)
+		left, top := vipsCalculateCrop(inWidth, inHeight, o.Width, o.Height, o.Gravity)
+		return vipsExtract(image, left, top, width, height)
+	case o.Embed:
+		extend := o.Extend
+		if extend > 5 {
+			extend = bimg.ExtendBackground
+		}
+		left, top := (o.Width-inWidth)/2, (o.Height-inHeight)/2
+		err = C.imaginary_image_embed(image, C.int(left), C.int(top), C.int(o.Width), C.int(o.Height),
+			C.VipsExtend(extend), C.double(o.Background.R), C.double(o.Background.G), C.double(o.Background.B))
+	case o.Top != 0 || o.Left != 0 || o.AreaWidth != 0 || o.AreaHeight != 0:
+		if o.AreaWidth == 0 {
+			o.AreaWidth = o.Width
+		}
+		if o.AreaHeight == 0 {
+			o.AreaHeight = o.Height
+		}
+		if o.AreaWidth == 0 || o.AreaHeight == 0 {
+			return errors.New("Extract area width/height params are required")
+		}
+		return vipsExtract(image, o.Left, o.Top, o.AreaWidth, o.AreaHeight)
+	}
+
+	if err != 0 {
+		return vipsError()
+	}
+	return nil
+}
+
+func vipsExtract(image **C.VipsImage, left, top, width, height int) error {
+	if width > bimg.MaxSize || height > bimg.MaxSize {
+		return errors.New("Maximum image size exceeded")
+	}
+	left, top = int(math.Max(float64(left), 0)), int(math.Max(float64(top), 0))
+	if C.imaginary_image_extract(image, C.int(left), C.int(top), C.int(width), C.int(height)) != 0 {
+		return vipsError()
+	}
+	return nil
+}
+
+// vipsImageCalculations returns the shrink factor of the image, completing
+// the missing output dimension.
+func vipsImageCalculations(o *bimg.Options, inWidth, inHeight int) float64 {
+	factor := 1.0
+	xfactor := float64(inWidth) / float64(o.Width)
+	yfactor := float64(inHeight) / float64(o.Height)
+
+	switch {
+	case o.Width > 0 && o.Height > 0:
+		if o.Crop {
+			factor = math.Min(xfactor, yfactor)
+		} else {
+			factor = math.Max(xfactor, yfactor)
+		}
+	case o.Width > 0:
+		if o.Crop {
+			o.Height = inHeight
+		} else {
+			factor = xfactor
+			o.Height = int(math.Round(float64(inHeight) / factor))
+		}
+	case o.Height > 0:
+		if o.Crop {
+			o.Width = inWidth
+		} else {
+			factor = yfactor
+			o.Width = int(math.Round(float64(inWidth) / factor))
+		}
+	default:
+		o.Width = inWidth
+		o.Height = inHeight
+	}
+
+	return factor
+}
+
+func vipsCalculateShrink(factor float64, interpolator bimg.Interpolator) int {
+	name := C.CString(interpolator.String())
+	defer C.free(unsafe.Pointer(name))
+	windowSize := float64(C.imaginary_interpolator_window_size(name))
+
+	// Shrink less and resize more with interpolators of at least 4x4 pixels
+	shrink := math.Floor(factor)
+	if factor >= 2 && windowSize > 3 {
+		shrink = math.Floor(factor * 3.0 / windowSize)
+	}
+	return int(math.Max(shrink, 1))
+}
+
+func vipsCalculateCrop(inWidth, inHeight, outWidth, outHeight int, gravity bimg.Gravity) (int, int) {
+	left, top := 0, 0
+
+	switch gravity {
+	case bimg.GravityNorth:
+		left = (inWidth - outWidth + 1) / 2
+	case bimg.GravityEast:
+		left = inWidth - outWidth
+		top = (inHeight - outHeight + 1) / 2
+	case bimg.GravitySouth:
+		left = (inWidth - outWidth + 1) / 2
+		top = inHeight - outHeight
+	case bimg.GravityWest:
+		top = (inHeight - outHeight + 1) / 2
+	default:
+		left = (inWidth - outWidth + 1) / 2
+		top = (inHeight - outHeight + 1) / 2
+	}
+
+	return left, top
+}
+
+// vipsAngle rounds down the angle to a multiple of 90 degrees.
+func vipsAngle(angle bimg.Angle) bimg.Angle {
+	angle -= angle % 90
+	if angle > bimg.D270 {
+		return bimg.D270
+	}
+	return angle
+}
+
+func vipsImageWidth(image *C.VipsImage) int {
+	return int(C.vips_image_get_width(image))
+}
+
+func vipsImageHeight(image *C.VipsImage) int {
+	return int(C.vips_image_get_height(image))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
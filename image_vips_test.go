@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestVipsImageCalculations(t *testing.T) {
+	cases := []struct {
+		options bimg.Options
+		factor  float64
+		width   int
+		height  int
+	}{
+		{bimg.Options{Width: 500, Height: 500}, 4, 500, 500},
+		{bimg.Options{Width: 500, Height: 500, Crop: true}, 2, 500, 500},
+		{bimg.Options{Width: 500}, 4, 500, 250},
+		{bimg.Options{Height: 250}, 4, 500, 250},
+		{bimg.Options{Width: 500, Crop: true}, 1, 500, 1000},
+		{bimg.Options{}, 1, 2000, 1000},
+	}
+
+	for _, c := range cases {
+		o := c.options
+		factor := vipsImageCalculations(&o, 2000, 1000)
+		if factor != c.factor || o.Width != c.width || o.Height != c.height {
+			t.Errorf("Invalid calculations for %+v: %v %dx%d", c.options, factor, o.Width, o.Height)
+		}
+	}
+}
+
+func TestVipsCalculateCrop(t *testing.T) {
+	cases := []struct {
+		gravity   bimg.Gravity
+		left, top int
+	}{
+		{bimg.GravityCentre, 50, 25},
+		{bimg.GravityNorth, 50, 0},
+		{bimg.GravityEast, 100, 25},
+		{bimg.GravitySouth, 50, 50},
+		{bimg.GravityWest, 0, 25},
+	}
+
+	for _, c := range cases {
+		if left, top := vipsCalculateCrop(200, 100, 100, 50, c.gravity); left != c.left || top != c.top {
+			t.Errorf("Invalid crop for gravity %d: %d,%d", c.gravity, left, top)
+		}
+	}
+}
+
+func TestVipsAngle(t *testing.T) {
+	cases := map[bimg.Angle]bimg.Angle{0: bimg.D0, 45: bimg.D0, 90: bimg.D90, 200: bimg.D180, 359: bimg.D270}
+	for angle, expected := range cases {
+		if a := vipsAngle(angle); a != expected {
+			t.Errorf("Invalid angle for %d: %d", angle, a)
+		}
+	}
+}
@@ -17,38 +17,81 @@ import (
 )
 
 var (
-	aAddr               = flag.String("a", "", "Bind address")
-	aPort               = flag.Int("p", 8088, "Port to listen")
-	aVers               = flag.Bool("v", false, "Show version")
-	aVersl              = flag.Bool("version", false, "Show version")
-	aHelp               = flag.Bool("h", false, "Show help")
-	aHelpl              = flag.Bool("help", false, "Show help")
-	aPathPrefix         = flag.String("path-prefix", "/", "Url path prefix to listen to")
-	aCors               = flag.Bool("cors", false, "Enable CORS support")
-	aCorsURLs           = flag.String("cors-urls", "", "Cors URL-s separated by comma")
-	aGzip               = flag.Bool("gzip", false, "Enable gzip compression (deprecated)")
-	aAuthForwarding     = flag.Bool("enable-auth-forwarding", false, "Forwards X-Forward-Authorization or Authorization header to the image source server. -enable-url-source flag must be defined. Tip: secure your server from public access to prevent attack vectors")
-	aEnableURLSource    = flag.Bool("enable-url-source", false, "Enable remote HTTP URL image source processing")
-	aEnablePlaceholder  = flag.Bool("enable-placeholder", false, "Enable image response placeholder to be used in case of error")
-	aEnableURLSignature = flag.Bool("enable-url-signature", false, "Enable URL signature (URL-safe Base64-encoded HMAC digest)")
-	aURLSignatureKey    = flag.String("url-signature-key", "", "The URL signature key (32 characters minimum)")
-	aAllowedOrigins     = flag.String("allowed-origins", "", "Restrict remote image source processing to certain origins (separated by commas). Note: Origins are validated against host *AND* path.")
-	aMaxAllowedSize     = flag.Int("max-allowed-size", 0, "Restrict maximum size of http image source (in bytes)")
-	aKey                = flag.String("key", "", "Define API key for authorization")
-	aMount              = flag.String("mount", "", "Mount server local directory")
-	aCertFile           = flag.String("certfile", "", "TLS certificate file path")
-	aKeyFile            = flag.String("keyfile", "", "TLS private key file path")
-	aAuthorization      = flag.String("authorization", "", "Defines a constant Authorization header value passed to all the image source servers. -enable-url-source flag must be defined. This overwrites authorization headers forwarding behavior via X-Forward-Authorization")
-	aForwardHeaders     = flag.String("forward-headers", "", "Forwards custom headers to the image source server. -enable-url-source flag must be defined.")
-	aPlaceholder        = flag.String("placeholder", "", "Image path to image custom placeholder to be used in case of error. Recommended minimum image size is: 1200x1200")
-	aDisableEndpoints   = flag.String("disable-endpoints", "", "Comma separated endpoints to disable. E.g: form,crop,rotate,health")
-	aHTTPCacheTTL       = flag.Int("http-cache-ttl", -1, "The TTL in seconds")
-	aReadTimeout        = flag.Int("http-read-timeout", 60, "HTTP read timeout in seconds")
-	aWriteTimeout       = flag.Int("http-write-timeout", 60, "HTTP write timeout in seconds")
-	aConcurrency        = flag.Int("concurrency", 0, "Throttle concurrency limit per second")
-	aBurst              = flag.Int("burst", 100, "Throttle burst max cache size")
-	aMRelease           = flag.Int("mrelease", 30, "OS memory release interval in seconds")
-	aCpus               = flag.Int("cpus", runtime.GOMAXPROCS(-1), "Number of cpu cores to use")
+	aAddr                   = flag.String("a", "", "Bind address")
+	aPort                   = flag.Int("p", 8088, "Port to listen")
+	aVers                   = flag.Bool("v", false, "Show version")
+	aVersl                  = flag.Bool("version", false, "Show version")
+	aHelp                   = flag.Bool("h", false, "Show help")
+	aHelpl                  = flag.Bool("help", false, "Show help")
+	aPathPrefix             = flag.String("path-prefix", "/", "Url path prefix to listen to")
+	aCors                   = flag.Bool("cors", false, "Enable CORS support")
+	aCorsURLs               = flag.String("cors-urls", "", "Cors URL-s separated by comma")
+	aGzip                   = flag.Bool("gzip", false, "Enable gzip compression (deprecated)")
+	aAuthForwarding         = flag.Bool("enable-auth-forwarding", false, "Forwards X-Forward-Authorization or Authorization header to the image source server. -enable-url-source flag must be defined. Tip: secure your server from public access to prevent attack vectors")
+	aEnableURLSource        = flag.Bool("enable-url-source", false, "Enable remote HTTP URL image source processing")
+	aEnableURLSink          = flag.Bool("enable-url-sink", false, "Enable uploading processed images to a remote HTTP URL with PUT (?outputUrl=http://..)")
+	aEnablePlaceholder      = flag.Bool("enable-placeholder", false, "Enable image response placeholder to be used in case of error")
+	aEnableURLSignature     = flag.Bool("enable-url-signature", false, "Enable URL signature (URL-safe Base64-encoded HMAC digest)")
+	aURLSignatureKey        = flag.String("url-signature-key", "", "The URL signature key (32 characters minimum)")
+	aAllowedOrigins         = flag.String("allowed-origins", "", "Restrict remote image source processing to certain origins (separated by commas). Note: Origins are validated against host *AND* path.")
+	aMaxAllowedSize         = flag.Int("max-allowed-size", 0, "Restrict maximum size of the image read from any source (in bytes)")
+	aOutboundConnectTimeout = flag.Int("outbound-connect-timeout", 10, "Connect timeout in seconds for outbound HTTP requests")
+	aOutboundReadTimeout    = flag.Int("outbound-read-timeout", 60, "Read timeout in seconds for outbound HTTP requests")
+	aOutboundMaxRedirects   = flag.Int("outbound-max-redirects", 10, "Maximum number of redirects followed by outbound HTTP requests")
+	aOutboundCABundle       = flag.String("outbound-ca-bundle", "", "PEM encoded CA bundle trusted by outbound HTTP requests, in addition to the system roots")
+	aOutboundDenyRanges     = flag.String("outbound-deny-ranges", DefaultDenyRanges, "Comma separated IP ranges outbound HTTP requests are not allowed to connect to. Use an empty value to allow all")
+	aOriginCacheDir         = flag.String("origin-cache-dir", "", "Directory used to cache images fetched from remote HTTP origins. Empty disables the cache")
+	aOriginCacheCapacity    = flag.Int64("origin-cache-capacity", 1<<30, "Maximum size of the origin cache (in bytes)")
+	aOriginCacheMaxAge      = flag.Int("origin-cache-max-age", 3600, "Time in seconds cached origin images are served before being revalidated")
+	aS3Endpoint             = flag.String("s3-endpoint", "", "Custom S3 endpoint URL, e.g. for MinIO or Ceph")
+	aS3ForcePathStyle       = flag.Bool("s3-force-path-style", false, "Use S3 path-style addressing instead of virtual hosted buckets")
+	aAzureEndpoint          = flag.String("azure-endpoint", "", "Custom Azure blob service endpoint URL, e.g. for Azurite")
+	aAzureEnvironment       = flag.String("azure-environment", "AZUREPUBLICCLOUD", "Azure cloud name, e.g. AZUREUSGOVERNMENTCLOUD or AZURECHINACLOUD")
+	aUploadCacheControl     = flag.String("upload-cache-control", "", "Cache-Control header of uploaded images")
+	aUploadMetadata         = flag.String("upload-metadata", "", "Comma separated key:value metadata of uploaded images")
+	aUploadACL              = flag.String("upload-acl", "", "S3 canned ACL of uploaded images, e.g. public-read")
+	aUploadStorageClass     = flag.String("upload-storage-class", "", "S3 storage class of uploaded images, e.g. STANDARD_IA")
+	aUploadTags             = flag.String("upload-tags", "", "Comma separated key:value S3 tags of uploaded images")
+	aUploadSSE              = flag.String("upload-sse", "", "S3 server-side encryption of uploaded images: AES256 or aws:kms")
+	aUploadSSEKMSKeyID      = flag.String("upload-sse-kms-key-id", "", "AWS KMS key ID used to encrypt uploaded images")
+	aUploadAccessTier       = flag.String("upload-access-tier", "", "Azure access tier of uploaded images: Hot, Cool or Archive")
+	aStorageReadAllowlist   = flag.String("storage-read-allowlist", "", "Comma separated [provider:]bucket[/prefix] rules of the S3 and Azure objects which can be read")
+	aStorageWriteAllowlist  = flag.String("storage-write-allowlist", "", "Comma separated [provider:]bucket[/prefix] rules of the S3 and Azure objects which can be written")
+	aStorageProfiles        = flag.String("storage-profiles", "", "JSON file with the named storage profiles which can be referenced by requests")
+	aPresets                = flag.String("presets", "", "JSON file with the named presets which can be referenced by requests. Reloaded on SIGHUP")
+	aIIIFSource             = flag.String("iiif-source", "", "Image source resolving IIIF identifiers, which enables the /iiif route: fs, http, s3:{bucket}, azure:{container} or storage:{profile}")
+	aIIIFMaxSize            = flag.Int("iiif-max-size", 10000, "Maximum width and height of IIIF images in pixels, 0 for no limit")
+	aDZSource               = flag.String("dz-source", "", "Image source resolving Deep Zoom images, which enables the /dz route: fs, http, s3:{bucket}, azure:{container} or storage:{profile}")
+	aDZTileSize             = flag.Int("dz-tile-size", 254, "Size of Deep Zoom tiles in pixels")
+	aDZOverlap              = flag.Int("dz-overlap", 1, "Overlap of Deep Zoom tiles in pixels")
+	aDZFormat               = flag.String("dz-format", "jpeg", "Format of Deep Zoom tiles: jpeg, png or webp")
+	aDZCacheDir             = flag.String("dz-cache-dir", "", "Directory used to cache Deep Zoom tiles. Empty disables the cache")
+	aDZCacheCapacity        = flag.Int64("dz-cache-capacity", 1<<30, "Maximum size of the Deep Zoom tile cache (in bytes)")
+	aDZCacheMaxAge          = flag.Int("dz-cache-max-age", 86400, "Time in seconds cached Deep Zoom tiles are served")
+	aDZUploadWorkers        = flag.Int("dz-upload-workers", 16, "Number of concurrent uploads of the files generated by /dzsave")
+	aDZUploadAttempts       = flag.Int("dz-upload-attempts", 3, "Maximum number of attempts to upload each file generated by /dzsave")
+	aJobsDir                = flag.String("jobs-dir", "", "Directory where asynchronous jobs are persisted. Empty keeps them in memory only, so they are lost on restart")
+	aJobsWorkers            = flag.Int("jobs-workers", 2, "Number of asynchronous jobs run concurrently")
+	aJobsMaxAttempts        = flag.Int("jobs-max-attempts", 3, "Maximum number of attempts of a failing asynchronous job")
+	aJobsRetryBackoff       = flag.Int("jobs-retry-backoff", 10, "Delay in seconds before the first retry of a failed job, doubled at each retry")
+	aJobsRetention          = flag.Int("jobs-retention", 604800, "Time in seconds finished jobs are kept, 0 to keep them until deleted")
+	aJobsCallbackAttempts   = flag.Int("jobs-callback-attempts", 5, "Maximum number of attempts to notify the callback URL of a finished job")
+	aKey                    = flag.String("key", "", "Define API key for authorization")
+	aMount                  = flag.String("mount", "", "Mount server local directory")
+	aOutputMount            = flag.String("output-mount", "", "Mount server local directory where processed images can be stored")
+	aCertFile               = flag.String("certfile", "", "TLS certificate file path")
+	aKeyFile                = flag.String("keyfile", "", "TLS private key file path")
+	aAuthorization          = flag.String("authorization", "", "Defines a constant Authorization header value passed to all the image source servers. -enable-url-source flag must be defined. This overwrites authorization headers forwarding behavior via X-Forward-Authorization")
+	aForwardHeaders         = flag.String("forward-headers", "", "Forwards custom headers to the image source server. -enable-url-source flag must be defined.")
+	aPlaceholder            = flag.String("placeholder", "", "Image path to image custom placeholder to be used in case of error. Recommended minimum image size is: 1200x1200")
+	aDisableEndpoints       = flag.String("disable-endpoints", "", "Comma separated endpoints to disable. E.g: form,crop,rotate,health")
+	aHTTPCacheTTL           = flag.Int("http-cache-ttl", -1, "The TTL in seconds")
+	aReadTimeout            = flag.Int("http-read-timeout", 60, "HTTP read timeout in seconds")
+	aWriteTimeout           = flag.Int("http-write-timeout", 60, "HTTP write timeout in seconds")
+	aConcurrency            = flag.Int("concurrency", 0, "Throttle concurrency limit per second")
+	aBurst                  = flag.Int("burst", 100, "Throttle burst max cache size")
+	aMRelease               = flag.Int("mrelease", 30, "OS memory release interval in seconds")
+	aCpus                   = flag.Int("cpus", runtime.GOMAXPROCS(-1), "Number of cpu cores to use")
 )
 
 const usage = `imaginary %s
@@ -67,6 +110,18 @@ Usage:
   imaginary -enable-url-source -placeholder ./placeholder.jpg
   imaginary -enable-url-signature -url-signature-key 4f46feebafc4b5e988f131c4ff8b5997
   imaginary -enable-url-source -forward-headers X-Custom,X-Token
+  imaginary -enable-url-source -outbound-deny-ranges 10.0.0.0/8,127.0.0.0/8
+  imaginary -enable-url-source -origin-cache-dir /var/cache/imaginary
+  imaginary -output-mount /data/output
+  imaginary -enable-url-sink -allowed-origins https://my-bucket.s3.amazonaws.com
+  imaginary -s3-endpoint http://localhost:9000 -s3-force-path-style
+  imaginary -storage-read-allowlist s3:images -storage-write-allowlist s3:images/thumbs/
+  imaginary -azure-endpoint http://127.0.0.1:10000/devstoreaccount1
+  imaginary -storage-profiles /etc/imaginary/storage.json
+  imaginary -enable-url-source -presets /etc/imaginary/presets.json
+  imaginary -mount /data/images -iiif-source fs
+  imaginary -mount /data/images -dz-source fs -dz-tile-size 510 -dz-cache-dir /var/cache/imaginary-dz
+  imaginary -jobs-dir /var/lib/imaginary/jobs -jobs-workers 4
   imaginary -h | -help
   imaginary -v | -version
 
@@ -81,17 +136,66 @@ Options:
   -disable-endpoints        Comma separated endpoints to disable. E.g: form,crop,rotate,health [default: ""]
   -key <key>                Define API key for authorization
   -mount <path>             Mount server local directory
+  -output-mount <path>      Mount server local directory where processed images can be stored (?outputFile=..)
   -http-cache-ttl <num>     The TTL in seconds. Adds caching headers to locally served files.
   -http-read-timeout <num>  HTTP read timeout in seconds [default: 30]
   -http-write-timeout <num> HTTP write timeout in seconds [default: 30]
   -enable-url-source        Enable remote HTTP URL image source processing
+  -enable-url-sink          Enable uploading processed images to a remote HTTP URL with PUT (?outputUrl=http://..)
   -enable-placeholder       Enable image response placeholder to be used in case of error [default: false]
   -enable-auth-forwarding   Forwards X-Forward-Authorization or Authorization header to the image source server. -enable-url-source flag must be defined. Tip: secure your server from public access to prevent attack vectors
   -forward-headers          Forwards custom headers to the image source server. -enable-url-source flag must be defined.
   -enable-url-signature     Enable URL signature (URL-safe Base64-encoded HMAC digest) [default: false]
   -url-signature-key        The URL signature key (32 characters minimum)
   -allowed-origins <urls>   Restrict remote image source processing to certain origins (separated by commas)
-  -max-allowed-size <bytes> Restrict maximum size of http image source (in bytes)
+  -max-allowed-size <bytes> Restrict maximum size of the image read from any source (in bytes)
+  -outbound-connect-timeout <num> Connect timeout in seconds for outbound HTTP requests [default: 10]
+  -outbound-read-timeout <num>    Read timeout in seconds for outbound HTTP requests [default: 60]
+  -outbound-max-redirects <num>   Maximum number of redirects followed by outbound HTTP requests [default: 10]
+  -outbound-ca-bundle <path>      PEM encoded CA bundle trusted by outbound HTTP requests, in addition to the system roots
+  -outbound-deny-ranges <ranges>  Comma separated IP ranges outbound HTTP requests are not allowed to connect to.
+                                  Checked after DNS resolution and on every redirect. Use an empty value to allow all
+                                  [default: loopback, private, link-local and unspecified ranges]
+  -origin-cache-dir <path>        Directory used to cache images fetched from remote HTTP origins [default: disabled]
+  -origin-cache-capacity <bytes>  Maximum size of the origin cache (in bytes) [default: 1073741824]
+  -origin-cache-max-age <num>     Time in seconds cached origin images are served before being revalidated [default: 3600]
+  -s3-endpoint <url>              Custom S3 endpoint URL, e.g. for MinIO or Ceph [default: AWS endpoints]
+  -s3-force-path-style            Use S3 path-style addressing instead of virtual hosted buckets [default: false]
+  -azure-endpoint <url>           Custom Azure blob service endpoint URL, e.g. for Azurite [default: account endpoint]
+  -azure-environment <name>       Azure cloud name, e.g. AZUREUSGOVERNMENTCLOUD or AZURECHINACLOUD [default: AZUREPUBLICCLOUD]
+  -upload-cache-control <value>   Cache-Control header of uploaded images
+  -upload-metadata <pairs>        Comma separated key:value metadata of uploaded images
+  -upload-acl <acl>               S3 canned ACL of uploaded images, e.g. public-read
+  -upload-storage-class <class>   S3 storage class of uploaded images, e.g. STANDARD_IA
+  -upload-tags <pairs>            Comma separated key:value S3 tags of uploaded images
+  -upload-sse <value>             S3 server-side encryption of uploaded images: AES256 or aws:kms
+  -upload-sse-kms-key-id <id>     AWS KMS key ID used to encrypt uploaded images
+  -upload-access-tier <tier>      Azure access tier of uploaded images: Hot, Cool or Archive
+  -storage-read-allowlist <rules>  Comma separated [provider:]bucket[/prefix] rules of the S3 and Azure
+                                  objects which can be read, e.g. s3:images/public/,azure:assets [default: all]
+  -storage-write-allowlist <rules> Comma separated [provider:]bucket[/prefix] rules of the S3 and Azure
+                                  objects which can be written, e.g. s3:images/thumbs/ [default: all]
+  -storage-profiles <path>  JSON file with the named storage profiles which can be referenced by requests
+  -presets <path>           JSON file with the named presets which can be referenced by requests. Reloaded on SIGHUP
+  -iiif-source <source>     Image source resolving IIIF identifiers, which enables the /iiif route: fs, http,
+                            s3:{bucket}, azure:{container} or storage:{profile} [default: disabled]
+  -iiif-max-size <px>       Maximum width and height of IIIF images in pixels, 0 for no limit [default: 10000]
+  -dz-source <source>       Image source resolving Deep Zoom images, which enables the /dz route: fs, http,
+                            s3:{bucket}, azure:{container} or storage:{profile} [default: disabled]
+  -dz-tile-size <px>        Size of Deep Zoom tiles in pixels [default: 254]
+  -dz-overlap <px>          Overlap of Deep Zoom tiles in pixels [default: 1]
+  -dz-format <format>       Format of Deep Zoom tiles: jpeg, png or webp [default: jpeg]
+  -dz-cache-dir <path>      Directory used to cache Deep Zoom tiles [default: disabled]
+  -dz-cache-capacity <bytes> Maximum size of the Deep Zoom tile cache (in bytes) [default: 1073741824]
+  -dz-cache-max-age <num>   Time in seconds cached Deep Zoom tiles are served [default: 86400]
+  -dz-upload-workers <num>  Number of concurrent uploads of the files generated by /dzsave [default: 16]
+  -dz-upload-attempts <num> Maximum number of attempts to upload each file generated by /dzsave [default: 3]
+  -jobs-dir <path>          Directory where asynchronous jobs are persisted. Without it, jobs are lost on restart [default: memory only]
+  -jobs-workers <num>       Number of asynchronous jobs run concurrently [default: 2]
+  -jobs-max-attempts <num>  Maximum number of attempts of a failing asynchronous job [default: 3]
+  -jobs-retry-backoff <num> Delay in seconds before the first retry of a failed job, doubled at each retry [default: 10]
+  -jobs-retention <num>     Time in seconds finished jobs are kept, 0 to keep them until deleted [default: 604800]
+  -jobs-callback-attempts <num> Maximum number of attempts to notify the callback URL of a finished job [default: 5]
   -certfile <path>          TLS certificate file path
   -keyfile <path>           TLS private key file path
   -authorization <value>    Defines a constant Authorization header value passed to all the image source servers. -enable-url-source flag must be defined. This overwrites authorization headers forwarding behavior via X-Forward-Authorization
@@ -127,30 +231,38 @@ func main() {
 	urlSignature := getURLSignature(*aURLSignatureKey)
 
 	opts := ServerOptions{
-		Port:               port,
-		Address:            *aAddr,
-		CORS:               *aCors,
-		CORSURLs:           strings.Split(*aCorsURLs, ","),
-		AuthForwarding:     *aAuthForwarding,
-		EnableURLSource:    *aEnableURLSource,
-		EnablePlaceholder:  *aEnablePlaceholder,
-		EnableURLSignature: *aEnableURLSignature,
-		URLSignatureKey:    urlSignature.Key,
-		PathPrefix:         *aPathPrefix,
-		APIKey:             *aKey,
-		Concurrency:        *aConcurrency,
-		Burst:              *aBurst,
-		Mount:              *aMount,
-		CertFile:           *aCertFile,
-		KeyFile:            *aKeyFile,
-		Placeholder:        *aPlaceholder,
-		HTTPCacheTTL:       *aHTTPCacheTTL,
-		HTTPReadTimeout:    *aReadTimeout,
-		HTTPWriteTimeout:   *aWriteTimeout,
-		Authorization:      *aAuthorization,
-		ForwardHeaders:     parseForwardHeaders(*aForwardHeaders),
-		AllowedOrigins:     parseOrigins(*aAllowedOrigins),
-		MaxAllowedSize:     *aMaxAllowedSize,
+		Port:                   port,
+		Address:                *aAddr,
+		CORS:                   *aCors,
+		CORSURLs:               strings.Split(*aCorsURLs, ","),
+		AuthForwarding:         *aAuthForwarding,
+		EnableURLSource:        *aEnableURLSource,
+		EnableURLSink:          *aEnableURLSink,
+		EnablePlaceholder:      *aEnablePlaceholder,
+		EnableURLSignature:     *aEnableURLSignature,
+		URLSignatureKey:        urlSignature.Key,
+		PathPrefix:             *aPathPrefix,
+		APIKey:                 *aKey,
+		Concurrency:            *aConcurrency,
+		Burst:                  *aBurst,
+		Mount:                  *aMount,
+		OutputMount:            *aOutputMount,
+		IIIFSource:             *aIIIFSource,
+		IIIFMaxSize:            *aIIIFMaxSize,
+		CertFile:               *aCertFile,
+		KeyFile:                *aKeyFile,
+		Placeholder:            *aPlaceholder,
+		HTTPCacheTTL:           *aHTTPCacheTTL,
+		HTTPReadTimeout:        *aReadTimeout,
+		HTTPWriteTimeout:       *aWriteTimeout,
+		Authorization:          *aAuthorization,
+		ForwardHeaders:         parseForwardHeaders(*aForwardHeaders),
+		AllowedOrigins:         parseOrigins(*aAllowedOrigins),
+		MaxAllowedSize:         *aMaxAllowedSize,
+		OutboundConnectTimeout: *aOutboundConnectTimeout,
+		OutboundReadTimeout:    *aOutboundReadTimeout,
+		OutboundMaxRedirects:   *aOutboundMaxRedirects,
+		OutboundCABundle:       *aOutboundCABundle,
 	}
 
 	// Show warning if gzip flag is passed
@@ -168,11 +280,57 @@ func main() {
 		checkMountDirectory(*aMount)
 	}
 
+	// Check if the output mount directory exists, if present
+	if *aOutputMount != "" {
+		checkMountDirectory(*aOutputMount)
+	}
+
 	// Validate HTTP cache param, if present
 	if *aHTTPCacheTTL != -1 {
 		checkHTTPCacheTTL(*aHTTPCacheTTL)
 	}
 
+	// Parse outbound deny IP ranges, if present
+	if *aOutboundDenyRanges != "" {
+		ranges, err := parseIPRanges(*aOutboundDenyRanges)
+		if err != nil {
+			exitWithError("invalid -outbound-deny-ranges value: %s", err)
+		}
+		opts.OutboundDenyRanges = ranges
+	}
+
+	// Open the origin cache, if required
+	if *aOriginCacheDir != "" {
+		cache, err := NewOriginCache(*aOriginCacheDir, *aOriginCacheCapacity, time.Duration(*aOriginCacheMaxAge)*time.Second)
+		if err != nil {
+			exitWithError("cannot open the origin cache: %s", err)
+		}
+		opts.OriginCache = cache
+	}
+
+	// Check the Deep Zoom options and open the tile cache, if required
+	opts.DeepZoom = DeepZoomOptions{
+		Source:   *aDZSource,
+		TileSize: *aDZTileSize,
+		Overlap:  *aDZOverlap,
+		Format:   *aDZFormat,
+	}
+	if err := opts.DeepZoom.Validate(); err != nil {
+		exitWithError("invalid Deep Zoom options: %s", err)
+	}
+	if opts.DeepZoom.Source != "" {
+		if err := checkIdentifierSource(opts.DeepZoom.Source, opts); err != nil {
+			exitWithError("invalid Deep Zoom source: %s", err)
+		}
+	}
+	if *aDZCacheDir != "" {
+		cache, err := NewOriginCache(*aDZCacheDir, *aDZCacheCapacity, time.Duration(*aDZCacheMaxAge)*time.Second)
+		if err != nil {
+			exitWithError("cannot open the Deep Zoom tile cache: %s", err)
+		}
+		opts.DeepZoom.Cache = cache
+	}
+
 	// Parse endpoint names to disabled, if present
 	if *aDisableEndpoints != "" {
 		opts.Endpoints = parseEndpoints(*aDisableEndpoints)
@@ -209,9 +367,85 @@ func main() {
 
 	debug("imaginary server listening on port :%d/%s", opts.Port, strings.TrimPrefix(opts.PathPrefix, "/"))
 
+	// Configure the S3 client shared by sources and uploads
+	ConfigureS3(S3Options{
+		Endpoint:       *aS3Endpoint,
+		ForcePathStyle: *aS3ForcePathStyle,
+	})
+
+	// Configure the Azure Blob Storage client
+	ConfigureAzure(AzureOptions{
+		Endpoint:    *aAzureEndpoint,
+		Environment: *aAzureEnvironment,
+	})
+
+	// Load the named storage profiles
+	if *aStorageProfiles != "" {
+		if err := LoadStorageProfiles(*aStorageProfiles); err != nil {
+			exitWithError("cannot load storage profiles: %s", err)
+		}
+	}
+
+	// Load the named presets, reloading them on SIGHUP
+	if *aPresets != "" {
+		if err := LoadPresets(*aPresets); err != nil {
+			exitWithError("cannot load presets: %s", err)
+		}
+		ReloadPresetsOnSignal(*aPresets)
+	}
+
+	// Check the source of IIIF identifiers, if enabled
+	if *aIIIFSource != "" {
+		if err := checkIdentifierSource(*aIIIFSource, opts); err != nil {
+			exitWithError("invalid IIIF source: %s", err)
+		}
+	}
+
+	// Configure the storage allowlists
+	if err := configureStorageAccess(); err != nil {
+		exitWithError("invalid storage allowlist: %s", err)
+	}
+
+	// Configure the default options of storage uploads
+	if err := configureUploads(); err != nil {
+		exitWithError("invalid upload options: %s", err)
+	}
+
+	// Configure the client used for outbound HTTP requests
+	if err := LoadOutboundClient(opts); err != nil {
+		exitWithError("cannot configure outbound HTTP client: %s", err)
+	}
+
 	// Load image source providers
 	LoadSources(opts)
 
+	// Load image sink providers
+	LoadSinks(opts)
+
+	// Configure the uploads of the files generated by /dzsave
+	if err := ConfigureDZUploads(DZUploadOptions{
+		Workers:  *aDZUploadWorkers,
+		Attempts: *aDZUploadAttempts,
+		Backoff:  time.Second,
+	}); err != nil {
+		exitWithError("invalid dzsave upload options: %s", err)
+	}
+
+	// Start the asynchronous job workers, resuming the stored jobs once
+	// the storage is configured
+	if err := StartJobs(JobsOptions{
+		Dir:          *aJobsDir,
+		Workers:      *aJobsWorkers,
+		MaxAttempts:  *aJobsMaxAttempts,
+		RetryBackoff: time.Duration(*aJobsRetryBackoff) * time.Second,
+		Retention:    time.Duration(*aJobsRetention) * time.Second,
+
+		CallbackAttempts: *aJobsCallbackAttempts,
+		CallbackOrigins:  opts.AllowedOrigins,
+	}); err != nil {
+		exitWithError("cannot start the job queue: %s", err)
+	}
+
 	// Start the server
 	err := Server(opts)
 	if err != nil {
@@ -247,6 +481,44 @@ func showVersion() {
 	os.Exit(1)
 }
 
+func configureStorageAccess() error {
+	read, err := parseStorageRules(*aStorageReadAllowlist)
+	if err != nil {
+		return err
+	}
+
+	write, err := parseStorageRules(*aStorageWriteAllowlist)
+	if err != nil {
+		return err
+	}
+
+	ConfigureStorageAccess(StorageAccess{Read: read, Write: write})
+	return nil
+}
+
+func configureUploads() error {
+	metadata, err := parseKeyValuePairs(*aUploadMetadata)
+	if err != nil {
+		return err
+	}
+
+	tags, err := parseKeyValuePairs(*aUploadTags)
+	if err != nil {
+		return err
+	}
+
+	return ConfigureUploads(UploadOptions{
+		CacheControl: *aUploadCacheControl,
+		Metadata:     metadata,
+		ACL:          *aUploadACL,
+		StorageClass: *aUploadStorageClass,
+		Tags:         tags,
+		SSE:          *aUploadSSE,
+		SSEKMSKeyID:  *aUploadSSEKMSKeyID,
+		AccessTier:   *aUploadAccessTier,
+	})
+}
+
 func checkMountDirectory(path string) {
 	src, err := os.Stat(path)
 	if err != nil {
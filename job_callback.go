@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// JobCallbackSignatureHeader carries the hex encoded HMAC-SHA256 digest
+	// of the callback body, when the job has a callback secret.
+	JobCallbackSignatureHeader = "X-Imaginary-Signature"
+	// JobCallbackIDHeader carries the ID of the finished job.
+	JobCallbackIDHeader = "X-Imaginary-Job"
+)
+
+// JobCallback states.
+const (
+	JobCallbackPending   = "pending"
+	JobCallbackDelivered = "delivered"
+	JobCallbackFailed    = "failed"
+)
+
+// JobCallback represents the URL notified once a job is finished. A callback
+// is never modified once shared, it is replaced by an updated copy.
+type JobCallback struct {
+	URL         string     `json:"url"`
+	Secret      string     `json:"-"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// JobCallbackPayload represents the JSON body posted to the callback URL.
+type JobCallbackPayload struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Status     JobState        `json:"status"`
+	Attempts   int             `json:"attempts"`
+	Duration   float64         `json:"duration"` // seconds since the job was queued
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	FinishedAt time.Time       `json:"finishedAt"`
+}
+
+// NewJobCallback checks the callback URL, which follows the same origin
+// restrictions as URL image sources.
+func NewJobCallback(rawURL, secret string, origins []*url.URL) (*JobCallback, error) {
+	if rawURL == "" {
+		if secret != "" {
+			return nil, NewError("jobs: callback secret without callback URL", BadRequest)
+		}
+		return nil, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, NewError("jobs: invalid callback URL", BadRequest)
+	}
+	if shouldRestrictOrigin(u, origins) {
+		return nil, NewError(fmt.Sprintf("jobs: not allowed callback URL origin: %s%s", u.Host, u.Path), Forbidden)
+	}
+
+	return &JobCallback{URL: u.String(), Secret: secret, State: JobCallbackPending}, nil
+}
+
+func newJobCallbackPayload(job Job) JobCallbackPayload {
+	payload := JobCallbackPayload{
+		ID:       job.ID,
+		Type:     job.Type,
+		Status:   job.State,
+		Attempts: job.Attempts,
+		Result:   job.Result,
+		Error:    job.Error,
+	}
+	if job.FinishedAt != nil {
+		payload.FinishedAt = *job.FinishedAt
+		payload.Duration = job.FinishedAt.Sub(job.CreatedAt).Seconds()
+	}
+	return payload
+}
+
+// deliverJobCallback posts the outcome of a finished job to its callback.
+func deliverJobCallback(ctx context.Context, job Job, origins []*url.URL) error {
+	callback := job.Callback
+
+	u, err := url.Parse(callback.URL)
+	if err != nil {
+		return fmt.Errorf("jobs: invalid callback URL: %w", err)
+	}
+	if shouldRestrictOrigin(u, origins) {
+		return fmt.Errorf("jobs: not allowed callback URL origin: %s%s", u.Host, u.Path)
+	}
+
+	body, err := json.Marshal(newJobCallbackPayload(job))
+	if err != nil {
+		return fmt.Errorf("jobs: error encoding callback: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("jobs: invalid callback URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+	req.Header.Set(JobCallbackIDHeader, job.ID)
+	if callback.Secret != "" {
+		req.Header.Set(JobCallbackSignatureHeader, "sha256="+jobCallbackSignature(callback.Secret, body))
+	}
+
+	res, err := outboundClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("jobs: error calling callback: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("jobs: error calling callback: (status=%d) (url=%s)", res.StatusCode, u.Host+u.Path)
+	}
+	return nil
+}
+
+func jobCallbackSignature(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// notify delivers the callback of a finished job, retrying with the job
+// backoff until the callback attempts are exhausted. It stops once the job
+// is deleted or the queue is closed.
+func (q *JobQueue) notify(id string) {
+	q.mu.Lock()
+	ctx, cancel := context.WithCancel(q.ctx)
+	q.notifying[id] = cancel
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		delete(q.notifying, id)
+		q.mu.Unlock()
+		cancel()
+	}()
+
+	for ctx.Err() == nil {
+		q.mu.Lock()
+		job, ok := q.jobs[id]
+		if !ok || job.Callback == nil || job.Callback.State != JobCallbackPending {
+			q.mu.Unlock()
+			return
+		}
+		snapshot := *job
+		q.mu.Unlock()
+
+		err := deliverJobCallback(ctx, snapshot, q.opts.CallbackOrigins)
+
+		q.mu.Lock()
+		job, ok = q.jobs[id]
+		if !ok || job.Callback == nil || ctx.Err() != nil {
+			q.mu.Unlock()
+			return
+		}
+		callback := *job.Callback
+		callback.Attempts++
+		callback.Error = ""
+		switch {
+		case err == nil:
+			now := time.Now().UTC()
+			callback.State = JobCallbackDelivered
+			callback.DeliveredAt = &now
+		case callback.Attempts >= q.opts.CallbackAttempts:
+			callback.State = JobCallbackFailed
+			callback.Error = err.Error()
+		default:
+			callback.Error = err.Error()
+		}
+		job.Callback = &callback
+		job.UpdatedAt = time.Now().UTC()
+		snapshot = *job
+		q.mu.Unlock()
+
+		q.save(snapshot)
+
+		if callback.State != JobCallbackPending {
+			if err != nil {
+				log.Printf("jobs: error notifying job %s: %s", id, err)
+			}
+			return
+		}
+
+		timer := time.NewTimer(q.opts.RetryBackoff << uint(callback.Attempts-1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
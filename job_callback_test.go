@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewJobCallback(t *testing.T) {
+	origins := []*url.URL{{Host: "hooks.example.org", Path: "/imaginary"}}
+
+	callback, err := NewJobCallback("https://hooks.example.org/imaginary/done", "secret", origins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.State != JobCallbackPending || callback.Secret != "secret" {
+		t.Errorf("Invalid callback: %+v", callback)
+	}
+
+	if callback, err := NewJobCallback("", "", origins); callback != nil || err != nil {
+		t.Errorf("Expected no callback: %+v %v", callback, err)
+	}
+
+	invalid := []struct{ url, secret string }{
+		{"", "secret"},
+		{"ftp://hooks.example.org/imaginary", ""},
+		{"https://evil.example.org/imaginary", ""},
+		{"https://hooks.example.org/other", ""},
+	}
+	for _, test := range invalid {
+		if _, err := NewJobCallback(test.url, test.secret, origins); err == nil {
+			t.Errorf("Expected error for callback: %s", test.url)
+		}
+	}
+}
+
+func TestJobCallbackDelivery(t *testing.T) {
+	var calls int32
+	payloads := make(chan JobCallbackPayload, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(JobCallbackSignatureHeader) != "sha256="+jobCallbackSignature("secret", body) {
+			t.Errorf("Invalid callback signature: %s", r.Header.Get(JobCallbackSignatureHeader))
+		}
+
+		var payload JobCallbackPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get(JobCallbackIDHeader) != payload.ID {
+			t.Errorf("Invalid job header: %s", r.Header.Get(JobCallbackIDHeader))
+		}
+		payloads <- payload
+	}))
+	defer ts.Close()
+
+	RegisterJobHandler("test-callback", func(ctx context.Context, params json.RawMessage, progress func(done, total int)) (interface{}, error) {
+		return DZFilesResult{Container: "tiles", Keys: []string{"image.dzi", "image_files/"}, Files: 3, Tiles: 2}, nil
+	})
+
+	q := newTestJobQueue(t, "")
+	callback, err := NewJobCallback(ts.URL+"/done", "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Submit("test-callback", nil, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := <-payloads
+	if payload.ID != job.ID || payload.Status != JobSucceeded || payload.Attempts != 1 || payload.Duration <= 0 {
+		t.Errorf("Invalid payload: %+v", payload)
+	}
+	var result DZFilesResult
+	if err := json.Unmarshal(payload.Result, &result); err != nil || result.Tiles != 2 || len(result.Keys) != 2 {
+		t.Errorf("Invalid payload result: %s", payload.Result)
+	}
+
+	for {
+		job, _ = q.Get(job.ID)
+		if job.Callback.State != JobCallbackPending {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if job.Callback.State != JobCallbackDelivered || job.Callback.Attempts != 2 || job.Callback.DeliveredAt == nil {
+		t.Errorf("Invalid callback state: %+v", job.Callback)
+	}
+}
+
+func TestJobCallbackCanceled(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	RegisterJobHandler("test-callback-canceled", func(ctx context.Context, params json.RawMessage, progress func(done, total int)) (interface{}, error) {
+		return nil, nil
+	})
+
+	// The next delivery attempt is not due before the end of the test
+	q, err := NewJobQueue(JobsOptions{Workers: 1, MaxAttempts: 1, RetryBackoff: time.Hour, CallbackAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifying := func() int {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.notifying)
+	}
+	waitNotifying := func() {
+		for i := 0; notifying() != 0; i++ {
+			if i == 100 {
+				t.Fatal("The callback delivery must stop")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	submit := func() Job {
+		callback, err := NewJobCallback(ts.URL, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job, err := q.Submit("test-callback-canceled", nil, callback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-calls
+		return job
+	}
+
+	// Deleting the job stops the delivery of its callback
+	job := submit()
+	if err := q.Delete(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitNotifying()
+
+	// Closing the queue stops the delivery of the pending callbacks
+	job = submit()
+	q.Close()
+	waitNotifying()
+	if job, _ := q.Get(job.ID); job.Callback.State != JobCallbackPending {
+		t.Errorf("The callback must stay pending: %+v", job.Callback)
+	}
+}
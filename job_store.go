@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const jobStoreExt = ".json"
+
+// jobRecord is the persisted form of a job, which also holds its params and
+// its callback secret.
+type jobRecord struct {
+	Job
+	Params         json.RawMessage `json:"params"`
+	CallbackSecret string          `json:"callbackSecret,omitempty"`
+}
+
+// JobStore persists jobs as JSON files of a local directory, so queued and
+// interrupted jobs survive a restart. A store without directory keeps the
+// jobs in memory only.
+type JobStore struct {
+	dir string
+}
+
+// NewJobStore creates a job store persisted in the given directory.
+func NewJobStore(dir string) (*JobStore, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("job store: error creating directory: %w", err)
+		}
+	}
+	return &JobStore{dir: dir}, nil
+}
+
+// Save writes the job. The file is replaced atomically, so a crash never
+// leaves a partial record behind. Params may carry credentials, so the
+// records are only readable by the server user.
+func (s *JobStore) Save(job Job) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	record := jobRecord{Job: job, Params: job.Params}
+	if job.Callback != nil {
+		record.CallbackSecret = job.Callback.Secret
+	}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("job store: error encoding job: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, ".job-")
+	if err != nil {
+		return fmt.Errorf("job store: error creating file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("job store: error writing job: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("job store: error writing job: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path(job.ID)); err != nil {
+		return fmt.Errorf("job store: error writing job: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the job record.
+func (s *JobStore) Delete(id string) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("job store: error removing job: %w", err)
+	}
+	return nil
+}
+
+// Load reads all the stored jobs. Unreadable records are skipped.
+func (s *JobStore) Load() ([]Job, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("job store: error reading directory: %w", err)
+	}
+
+	var jobs []Job
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, jobStoreExt) {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			continue
+		}
+
+		var record jobRecord
+		if err := json.Unmarshal(buf, &record); err != nil || record.ID == "" {
+			continue
+		}
+
+		job := record.Job
+		job.Params = record.Params
+		if job.Callback != nil {
+			job.Callback.Secret = record.CallbackSecret
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (s *JobStore) path(id string) string {
+	return filepath.Join(s.dir, id+jobStoreExt)
+}
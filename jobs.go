@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobsPrefix is the route exposing the asynchronous jobs.
+const JobsPrefix = "/jobs"
+
+// jobProgressInterval limits how often the progress of a job is persisted.
+const jobProgressInterval = time.Second
+
+// JobState represents the state of a job.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobRetrying  JobState = "retrying"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// JobProgress represents the units of work done by a job.
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Job represents an asynchronous task. Its params are never exposed, since
+// they may carry credentials.
+type Job struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	State         JobState        `json:"state"`
+	Progress      JobProgress     `json:"progress"`
+	Attempts      int             `json:"attempts"`
+	MaxAttempts   int             `json:"maxAttempts"`
+	Error         string          `json:"error,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
+	StartedAt     *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time      `json:"finishedAt,omitempty"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt,omitempty"`
+	Result        json.RawMessage `json:"result,omitempty"`
+	Callback      *JobCallback    `json:"callback,omitempty"`
+
+	Params json.RawMessage `json:"-"`
+}
+
+// Finished reports whether the job reached a final state.
+func (j Job) Finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed
+}
+
+// JobHandler runs a job with its params and returns its result. It reports
+// the units of work done with progress and should stop when the context is
+// canceled.
+type JobHandler func(ctx context.Context, params json.RawMessage, progress func(done, total int)) (interface{}, error)
+
+var jobHandlers = map[string]JobHandler{}
+
+// RegisterJobHandler registers the handler of a job type.
+func RegisterJobHandler(jobType string, handler JobHandler) {
+	jobHandlers[jobType] = handler
+}
+
+// JobsOptions represents the configuration of the job queue.
+type JobsOptions struct {
+	Dir          string
+	Workers      int
+	MaxAttempts  int
+	RetryBackoff time.Duration
+	Retention    time.Duration
+
+	CallbackAttempts int
+	CallbackOrigins  []*url.URL
+}
+
+// Validate checks the job options given by the command-line flags.
+func (o JobsOptions) Validate() error {
+	switch {
+	case o.Workers < 1:
+		return fmt.Errorf("jobs: invalid number of workers: %d", o.Workers)
+	case o.MaxAttempts < 1:
+		return fmt.Errorf("jobs: invalid number of attempts: %d", o.MaxAttempts)
+	case o.RetryBackoff < 0:
+		return fmt.Errorf("jobs: invalid retry backoff: %s", o.RetryBackoff)
+	case o.Retention < 0:
+		return fmt.Errorf("jobs: invalid retention: %s", o.Retention)
+	case o.CallbackAttempts < 1:
+		return fmt.Errorf("jobs: invalid number of callback attempts: %d", o.CallbackAttempts)
+	}
+	return nil
+}
+
+// JobQueue runs the jobs with a bounded pool of workers. A failed job is
+// retried with an exponential backoff, unless its error is caused by the
+// request.
+type JobQueue struct {
+	opts    JobsOptions
+	store   *JobStore
+	workDir string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    map[string]*Job
+	pending []string
+	cancels map[string]context.CancelFunc
+	saved   map[string]time.Time
+
+	// ctx is canceled once the queue is closed, stopping the callback
+	// deliveries, which are canceled by job in notifying
+	ctx       context.Context
+	stop      context.CancelFunc
+	notifying map[string]context.CancelFunc
+}
+
+// jobQueue is the queue shared by the controllers.
+var jobQueue *JobQueue
+
+// StartJobs starts the shared job queue.
+func StartJobs(o JobsOptions) error {
+	q, err := NewJobQueue(o)
+	if err != nil {
+		return err
+	}
+	jobQueue = q
+	return nil
+}
+
+// NewJobQueue creates a job queue and starts its workers. The unfinished
+// jobs of a previous process are resumed.
+func NewJobQueue(o JobsOptions) (*JobQueue, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	store, err := NewJobStore(o.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &JobQueue{
+		opts:    o,
+		store:   store,
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]context.CancelFunc),
+		saved:   make(map[string]time.Time),
+
+		notifying: make(map[string]context.CancelFunc),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.ctx, q.stop = context.WithCancel(context.Background())
+
+	// Work directories are kept along with the jobs, so they survive a
+	// restart when the jobs are persisted
+	if o.Dir != "" {
+		q.workDir = filepath.Join(o.Dir, "work")
+		err = os.MkdirAll(q.workDir, 0700)
+	} else {
+		q.workDir, err = ioutil.TempDir("", "imaginary-jobs-")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jobs: error creating work directory: %w", err)
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < o.Workers; i++ {
+		go q.work()
+	}
+	if o.Retention > 0 {
+		go q.purge()
+	}
+
+	return q, nil
+}
+
+// load restores the stored jobs. Jobs interrupted while running are queued
+// again and their attempt is counted, unless it was their last one.
+func (q *JobQueue) load() error {
+	jobs, err := q.store.Load()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	now := time.Now()
+	for i := range jobs {
+		job := &jobs[i]
+		q.jobs[job.ID] = job
+
+		switch {
+		case job.State == JobRunning && job.Attempts >= job.MaxAttempts:
+			// The job may have caused the interruption, so it is not retried
+			// indefinitely
+			finished := now.UTC()
+			job.State = JobFailed
+			job.Error = fmt.Sprintf("jobs: interrupted after %d attempts", job.Attempts)
+			job.UpdatedAt = finished
+			job.FinishedAt = &finished
+			q.save(*job)
+			if job.Callback != nil {
+				go q.notify(job.ID)
+			}
+		case job.State == JobRunning, job.State == JobQueued:
+			job.State = JobQueued
+			q.pending = append(q.pending, job.ID)
+		case job.State == JobRetrying:
+			delay := time.Duration(0)
+			if job.NextAttemptAt != nil && job.NextAttemptAt.After(now) {
+				delay = job.NextAttemptAt.Sub(now)
+			}
+			q.schedule(job.ID, delay)
+		case job.Finished():
+			if job.Callback != nil && job.Callback.State == JobCallbackPending {
+				go q.notify(job.ID)
+			}
+		}
+	}
+
+	// Remove the work directories left by finished or deleted jobs
+	dirs, err := ioutil.ReadDir(q.workDir)
+	if err != nil {
+		return fmt.Errorf("jobs: error reading work directory: %w", err)
+	}
+	for _, dir := range dirs {
+		if job, ok := q.jobs[dir.Name()]; !ok || job.Finished() {
+			_ = os.RemoveAll(filepath.Join(q.workDir, dir.Name()))
+		}
+	}
+
+	return nil
+}
+
+// Submit queues a job of the given type with its params. The optional
+// callback is notified once the job is finished.
+func (q *JobQueue) Submit(jobType string, params interface{}, callback *JobCallback) (Job, error) {
+	if _, ok := jobHandlers[jobType]; !ok {
+		return Job{}, fmt.Errorf("jobs: unknown job type: %s", jobType)
+	}
+
+	buf, err := json.Marshal(params)
+	if err != nil {
+		return Job{}, fmt.Errorf("jobs: error encoding params: %w", err)
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now().UTC()
+	job := &Job{
+		ID:          id,
+		Type:        jobType,
+		State:       JobQueued,
+		MaxAttempts: q.opts.MaxAttempts,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Callback:    callback,
+		Params:      buf,
+	}
+	if err := q.store.Save(*job); err != nil {
+		return Job{}, err
+	}
+
+	snapshot := *job
+
+	q.mu.Lock()
+	q.jobs[id] = job
+	q.pending = append(q.pending, id)
+	q.cond.Signal()
+	q.mu.Unlock()
+
+	return snapshot, nil
+}
+
+// Get returns the job with the given ID.
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List returns the jobs, the most recent first. An empty state matches all
+// the jobs.
+func (q *JobQueue) List(state JobState) []Job {
+	q.mu.Lock()
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		if state == "" || job.State == state {
+			jobs = append(jobs, *job)
+		}
+	}
+	q.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// Delete cancels the job, if not finished, and removes it.
+func (q *JobQueue) Delete(id string) error {
+	q.mu.Lock()
+	if _, ok := q.jobs[id]; !ok {
+		q.mu.Unlock()
+		return ErrNotFound
+	}
+	if cancel, ok := q.cancels[id]; ok {
+		// The work directory is removed once the handler returns
+		cancel()
+	} else {
+		_ = os.RemoveAll(q.jobWorkDir(id))
+	}
+	if cancel, ok := q.notifying[id]; ok {
+		cancel()
+	}
+	delete(q.jobs, id)
+	delete(q.saved, id)
+	defer q.mu.Unlock()
+
+	return q.store.Delete(id)
+}
+
+// Close stops the callback deliveries. The pending callbacks are delivered
+// by the next process when the jobs are persisted.
+func (q *JobQueue) Close() {
+	q.stop()
+}
+
+func (q *JobQueue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		id := q.pending[0]
+		q.pending = q.pending[1:]
+
+		job, ok := q.jobs[id]
+		if !ok || job.State != JobQueued {
+			q.mu.Unlock()
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = context.WithValue(ctx, jobWorkDirKey{}, q.jobWorkDir(id))
+		q.cancels[id] = cancel
+
+		now := time.Now().UTC()
+		job.State = JobRunning
+		job.Attempts++
+		job.StartedAt = &now
+		job.NextAttemptAt = nil
+		job.UpdatedAt = now
+		snapshot := *job
+		q.mu.Unlock()
+
+		q.save(snapshot)
+		result, err := q.run(ctx, snapshot)
+		cancel()
+		q.finish(id, result, err)
+	}
+}
+
+// run calls the job handler, turning a panic into a job failure.
+func (q *JobQueue) run(ctx context.Context, job Job) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewError(fmt.Sprintf("jobs: handler panic: %v", r), InternalError)
+		}
+	}()
+
+	handler, ok := jobHandlers[job.Type]
+	if !ok {
+		return nil, NewError(fmt.Sprintf("jobs: unknown job type: %s", job.Type), BadRequest)
+	}
+
+	return handler(ctx, job.Params, func(done, total int) {
+		q.progress(job.ID, done, total)
+	})
+}
+
+func (q *JobQueue) progress(id string, done, total int) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	if total == job.Progress.Total && done < job.Progress.Done {
+		// Reported out of order by concurrent units of work
+		q.mu.Unlock()
+		return
+	}
+	job.Progress = JobProgress{Done: done, Total: total}
+	job.UpdatedAt = time.Now().UTC()
+
+	if time.Since(q.saved[id]) < jobProgressInterval {
+		q.mu.Unlock()
+		return
+	}
+	snapshot := *job
+	q.mu.Unlock()
+
+	q.save(snapshot)
+}
+
+// finish records the result of an attempt and schedules the next one.
+func (q *JobQueue) finish(id string, result interface{}, err error) {
+	var buf json.RawMessage
+	if err == nil && result != nil {
+		if buf, err = json.Marshal(result); err != nil {
+			err = fmt.Errorf("jobs: error encoding result: %w", err)
+		}
+	}
+
+	q.mu.Lock()
+	delete(q.cancels, id)
+
+	job, ok := q.jobs[id]
+	if !ok {
+		// The job was deleted while running
+		q.mu.Unlock()
+		_ = os.RemoveAll(q.jobWorkDir(id))
+		return
+	}
+
+	now := time.Now().UTC()
+	job.UpdatedAt = now
+
+	var delay time.Duration
+	switch {
+	case err == nil:
+		job.State = JobSucceeded
+		job.Error = ""
+		job.Result = buf
+		job.FinishedAt = &now
+	case job.Attempts < job.MaxAttempts && retryableJobError(err):
+		delay = q.opts.RetryBackoff << uint(job.Attempts-1)
+		next := now.Add(delay)
+		job.State = JobRetrying
+		job.Error = err.Error()
+		job.NextAttemptAt = &next
+	default:
+		job.State = JobFailed
+		job.Error = err.Error()
+		job.FinishedAt = &now
+	}
+	snapshot := *job
+	q.mu.Unlock()
+
+	q.save(snapshot)
+
+	if snapshot.State == JobRetrying {
+		q.schedule(id, delay)
+		return
+	}
+	if err := os.RemoveAll(q.jobWorkDir(id)); err != nil {
+		debug("jobs: error removing work directory of job %s: %s", id, err)
+	}
+	if err != nil {
+		debug("jobs: %s job %s failed: %s", snapshot.Type, id, err)
+	}
+	if snapshot.Callback != nil {
+		go q.notify(id)
+	}
+}
+
+func (q *JobQueue) jobWorkDir(id string) string {
+	return filepath.Join(q.workDir, id)
+}
+
+type jobWorkDirKey struct{}
+
+// JobWorkDir returns the work directory of the job run with the context. It
+// is kept across the attempts of the job, so a handler can resume the work
+// of a failed attempt, and removed once the job is finished.
+func JobWorkDir(ctx context.Context) (string, error) {
+	dir, ok := ctx.Value(jobWorkDirKey{}).(string)
+	if !ok {
+		return "", errors.New("jobs: no work directory outside of a job")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("jobs: error creating work directory: %w", err)
+	}
+	return dir, nil
+}
+
+// schedule queues a retrying job again once the delay is elapsed.
+func (q *JobQueue) schedule(id string, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		job, ok := q.jobs[id]
+		if !ok || job.State != JobRetrying {
+			return
+		}
+		job.State = JobQueued
+		q.pending = append(q.pending, id)
+		q.cond.Signal()
+	})
+}
+
+// save persists the job, unless it was deleted meanwhile. The lock is held
+// while writing, so a deleted job is never written back.
+func (q *JobQueue) save(job Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.jobs[job.ID]; !ok {
+		return
+	}
+	q.saved[job.ID] = time.Now()
+
+	if err := q.store.Save(job); err != nil {
+		log.Printf("jobs: error saving job %s: %s", job.ID, err)
+	}
+}
+
+// purge periodically removes the jobs finished for longer than the
+// retention period.
+func (q *JobQueue) purge() {
+	interval := q.opts.Retention / 10
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+
+	for {
+		for _, job := range q.List("") {
+			if job.Finished() && job.FinishedAt != nil && time.Since(*job.FinishedAt) > q.opts.Retention {
+				_ = q.Delete(job.ID)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// retryableJobError reports whether a failed attempt may succeed later.
+// Errors caused by the request, such as invalid params or a denied access,
+// are final.
+func retryableJobError(err error) bool {
+	var e Error
+	if errors.As(err, &e) {
+		return e.Code == InternalError
+	}
+	return true
+}
+
+func newJobID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("jobs: error generating ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// jobsController exposes the jobs:
+//
+//	GET    /jobs[?state={state}]
+//	GET    /jobs/{id}
+//	DELETE /jobs/{id}
+func jobsController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	prefix := join(o, JobsPrefix)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if jobQueue == nil {
+			ErrorReply(r, w, ErrNotImplemented, o)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			jobs := jobQueue.List(JobState(r.URL.Query().Get("state")))
+			writeJobsResponse(w, http.StatusOK, map[string]interface{}{"jobs": jobs})
+		case id != "" && r.Method == http.MethodGet:
+			job, ok := jobQueue.Get(id)
+			if !ok {
+				ErrorReply(r, w, ErrNotFound, o)
+				return
+			}
+			writeJobsResponse(w, http.StatusOK, job)
+		case id != "" && r.Method == http.MethodDelete:
+			if err := jobQueue.Delete(id); err != nil {
+				ErrorReply(r, w, ToError(err, InternalError), o)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			ErrorReply(r, w, ErrMethodNotAllowed, o)
+		}
+	}
+}
+
+func writeJobsResponse(w http.ResponseWriter, status int, v interface{}) {
+	body, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestJobQueue(t *testing.T, dir string) *JobQueue {
+	q, err := NewJobQueue(JobsOptions{Dir: dir, Workers: 2, MaxAttempts: 3, RetryBackoff: time.Millisecond, CallbackAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func waitJob(t *testing.T, q *JobQueue, id string, state JobState) Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := q.Get(id); ok && job.State == state {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, _ := q.Get(id)
+	t.Fatalf("Job %s did not reach state %s: %+v", id, state, job)
+	return job
+}
+
+func TestJobQueueRetries(t *testing.T) {
+	var calls int32
+	RegisterJobHandler("test-retry", func(ctx context.Context, params json.RawMessage, progress func(done, total int)) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return nil, errors.New("temporary failure")
+		}
+		progress(2, 2)
+		return map[string]int{"files": 2}, nil
+	})
+	RegisterJobHandler("test-invalid", func(ctx context.Context, params json.RawMessage, progress func(done, total int)) (interface{}, error) {
+		return nil, NewError("invalid params", BadRequest)
+	})
+
+	q := newTestJobQueue(t, "")
+
+	job, err := q.Submit("test-retry", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitJob(t, q, job.ID, JobSucceeded)
+	if job.Attempts != 3 || job.Error != "" || job.FinishedAt == nil {
+		t.Errorf("Invalid succeeded job: %+v", job)
+	}
+	if job.Progress != (JobProgress{Done: 2, Total: 2}) {
+		t.Errorf("Invalid progress: %+v", job.Progress)
+	}
+	if string(job.Result) != `{"files":2}` {
+		t.Errorf("Invalid result: %s", job.Result)
+	}
+
+	job, err = q.Submit("test-invalid", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitJob(t, q, job.ID, JobFailed)
+	if job.Attempts != 1 || job.Error != "invalid params" {
+		t.Errorf("Request errors must not be retried: %+v", job)
+	}
+
+	if _, err := q.Submit("test-unknown", nil, nil); err == nil {
+		t.Error("Expected error for an unknown job type")
+	}
+}
+
+func TestJobQueueResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := make(chan string, 1)
+	RegisterJobHandler("test-resume", func(ctx context.Context, raw json.RawMessage, progress func(done, total int)) (interface{}, error) {
+		// The work of the interrupted attempt is kept
+		workDir, err := JobWorkDir(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(workDir, "partial")); err != nil {
+			return nil, NewError("missing work file", BadRequest)
+		}
+
+		var p string
+		_ = json.Unmarshal(raw, &p)
+		params <- p
+		return nil, nil
+	})
+
+	// A job interrupted while running by a previous process
+	store, err := NewJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted := Job{ID: "abc", Type: "test-resume", State: JobRunning, Attempts: 1, MaxAttempts: 3, Params: json.RawMessage(`"foo"`)}
+	if err := store.Save(interrupted); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "work", "abc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "work", "abc", "partial"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A work directory left by a deleted job
+	if err := os.MkdirAll(filepath.Join(dir, "work", "def"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	q := newTestJobQueue(t, dir)
+	job := waitJob(t, q, "abc", JobSucceeded)
+	if job.Attempts != 2 {
+		t.Errorf("Invalid attempts: %d", job.Attempts)
+	}
+	if p := <-params; p != "foo" {
+		t.Errorf("Invalid params: %s", p)
+	}
+	for i := 0; ; i++ {
+		dirs, _ := ioutil.ReadDir(filepath.Join(dir, "work"))
+		if len(dirs) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Work directories should be removed: %d", len(dirs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	jobs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].State != JobSucceeded {
+		t.Errorf("Invalid stored jobs: %+v", jobs)
+	}
+
+	if err := q.Delete("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, _ := store.Load(); len(jobs) != 0 {
+		t.Errorf("Deleted job is still stored: %+v", jobs)
+	}
+}
+
+func TestJobQueueResumeLastAttempt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	RegisterJobHandler("test-poison", func(ctx context.Context, raw json.RawMessage, progress func(done, total int)) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+
+	// A job interrupted while running its last attempt is not resumed
+	store, err := NewJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted := Job{ID: "abc", Type: "test-poison", State: JobRunning, Attempts: 3, MaxAttempts: 3}
+	if err := store.Save(interrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	q := newTestJobQueue(t, dir)
+	job := waitJob(t, q, "abc", JobFailed)
+	if job.Attempts != 3 || job.Error == "" || job.FinishedAt == nil {
+		t.Errorf("Invalid failed job: %+v", job)
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("The job must not be run again")
+	}
+
+	jobs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].State != JobFailed {
+		t.Errorf("Invalid stored jobs: %+v", jobs)
+	}
+}
+
+func TestJobsController(t *testing.T) {
+	started := make(chan struct{})
+	RegisterJobHandler("test-cancel", func(ctx context.Context, params json.RawMessage, progress func(done, total int)) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	jobQueue = newTestJobQueue(t, "")
+	defer func() { jobQueue = nil }()
+
+	job, err := jobQueue.Submit("test-cancel", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ts := httptest.NewServer(NewServerMux(ServerOptions{PathPrefix: "/"}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/jobs/" + job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Job
+	_ = json.NewDecoder(res.Body).Decode(&got)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || got.ID != job.ID || got.State != JobRunning {
+		t.Errorf("Invalid job response: %d %+v", res.StatusCode, got)
+	}
+
+	res, err = http.Get(ts.URL + "/jobs?state=running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct{ Jobs []Job }
+	_ = json.NewDecoder(res.Body).Decode(&list)
+	res.Body.Close()
+	if len(list.Jobs) != 1 || list.Jobs[0].ID != job.ID {
+		t.Errorf("Invalid job list: %+v", list)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/jobs/"+job.ID, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("Invalid delete status: %d", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL + "/jobs/" + job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Deleted job should not be found: %d", res.StatusCode)
+	}
+}
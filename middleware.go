@@ -51,14 +51,20 @@ func Middleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) ht
 
 func ImageMiddleware(o ServerOptions) func(Operation) http.Handler {
 	return func(fn Operation) http.Handler {
-		handler := validateImage(Middleware(imageController(o, fn), o), o)
+		return imageRouteMiddleware(imageController(o, fn), o)
+	}
+}
 
-		if o.EnableURLSignature {
-			return validateURLSignature(handler, o)
-		}
+// imageRouteMiddleware applies the checks of the image endpoints, including
+// the URL signature, to a route reading the image by itself.
+func imageRouteMiddleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) http.Handler {
+	handler := validateImage(Middleware(fn, o), o)
 
-		return handler
+	if o.EnableURLSignature {
+		return validateURLSignature(handler, o)
 	}
+
+	return handler
 }
 
 func filterEndpoint(next http.Handler, o ServerOptions) http.Handler {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -49,6 +50,7 @@ type ImageOptions struct {
 	Gravity       bimg.Gravity
 	Colorspace    bimg.Interpretation
 	Operations    PipelineOperations
+	Outputs       PipelineOutputs
 }
 
 // IsDefinedField holds boolean ImageOptions fields. If true it means the field was specified in the request. This
@@ -66,18 +68,110 @@ type IsDefinedField struct {
 	Interlace     bool
 }
 
-// PipelineOperation represents the structure for an operation field.
+// PipelineOperation represents the structure for an operation field. The
+// operation only applies if its Condition expression is true, and params
+// may be "${expression}" values, both evaluated against the current image.
 type PipelineOperation struct {
-	Name          string                 `json:"operation"`
-	IgnoreFailure bool                   `json:"ignore_failure"`
-	Params        map[string]interface{} `json:"params"`
-	ImageOptions  ImageOptions           `json:"-"`
-	Operation     Operation              `json:"-"`
+	Name           string                 `json:"operation"`
+	Condition      string                 `json:"if,omitempty"`
+	IgnoreFailure  bool                   `json:"ignore_failure"`
+	Params         map[string]interface{} `json:"params"`
+	ImageOptions   ImageOptions           `json:"-"`
+	Transformation Transformation         `json:"-"`
+
+	condition   exprNode
+	expressions map[string]exprNode
 }
 
 // PipelineOperations defines the expected interface for a list of operations.
 type PipelineOperations []PipelineOperation
 
+// PipelineOutput represents a named variant of a pipeline, produced by its
+// own operations applied after the shared ones. Key replaces the output key
+// of the request when the variant is uploaded, or URL the output URL of the
+// HTTP sink.
+type PipelineOutput struct {
+	Name       string             `json:"name"`
+	Key        string             `json:"key,omitempty"`
+	URL        string             `json:"url,omitempty"`
+	Operations PipelineOperations `json:"operations"`
+}
+
+// PipelineOutputs defines the expected interface for a list of outputs.
+type PipelineOutputs []PipelineOutput
+
+// compile parses the condition and the param expressions of the operation.
+func (op *PipelineOperation) compile() error {
+	op.condition = nil
+	if op.Condition != "" {
+		condition, err := compileExpr(op.Condition)
+		if err != nil {
+			return err
+		}
+		if condition.kind() != exprBool {
+			return fmt.Errorf("invalid expression %q: %s condition", op.Condition, condition.kind())
+		}
+		op.condition = condition
+	}
+
+	op.expressions = nil
+	for key, value := range op.Params {
+		src, ok := parseExprParam(value)
+		if !ok {
+			continue
+		}
+		kind, ok := paramExprKinds[key]
+		if !ok {
+			return fmt.Errorf(`error while processing parameter "%s": expressions are not supported`, key)
+		}
+		expression, err := compileExpr(src)
+		if err != nil {
+			return fmt.Errorf(`error while processing parameter "%s": %s`, key, err)
+		}
+		if expression.kind() != kind {
+			return fmt.Errorf(`error while processing parameter "%s": invalid expression %q: %s value, expected %s`, key, src, expression.kind(), kind)
+		}
+		if op.expressions == nil {
+			op.expressions = make(map[string]exprNode)
+		}
+		op.expressions[key] = expression
+	}
+	return nil
+}
+
+// dynamic reports whether the operation depends on the current image.
+func (op *PipelineOperation) dynamic() bool {
+	return op.condition != nil || len(op.expressions) > 0
+}
+
+// evaluate evaluates the condition and the param expressions of the
+// operation, building its options. It reports whether the operation applies.
+func (op *PipelineOperation) evaluate(env exprEnv) (bool, error) {
+	if op.condition != nil {
+		apply, err := op.condition.eval(env)
+		if err != nil || !apply.(bool) {
+			return false, err
+		}
+	}
+
+	evaluated := *op
+	evaluated.Params = make(map[string]interface{}, len(op.Params))
+	for key, value := range op.Params {
+		if expression, ok := op.expressions[key]; ok {
+			v, err := expression.eval(env)
+			if err != nil {
+				return false, fmt.Errorf(`error while processing parameter "%s": %s`, key, err)
+			}
+			value = v
+		}
+		evaluated.Params[key] = value
+	}
+
+	var err error
+	op.ImageOptions, err = buildParamsFromOperation(evaluated)
+	return err == nil, err
+}
+
 func transformByAspectRatio(params map[string]interface{}) (width, height int) {
 	width, _ = coerceTypeInt(params["width"])
 	height, _ = coerceTypeInt(params["height"])
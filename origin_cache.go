@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	originCacheDataExt = ".data"
+	originCacheMetaExt = ".json"
+)
+
+// OriginCacheEntry represents the metadata stored along with a cached origin image.
+type OriginCacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Size         int64     `json:"size"`
+	StoredAt     time.Time `json:"storedAt"`
+
+	key        string
+	accessedAt time.Time
+}
+
+// Fresh reports whether the entry can be served without revalidation.
+func (e OriginCacheEntry) Fresh(maxAge time.Duration) bool {
+	return time.Since(e.StoredAt) < maxAge
+}
+
+// Revalidable reports whether the entry exposes any validator which allows a
+// conditional request to the origin.
+func (e OriginCacheEntry) Revalidable() bool {
+	return e.ETag != "" || e.LastModified != ""
+}
+
+// OriginCache is an on-disk, size bounded cache for images downloaded from
+// remote HTTP origins. The least recently used entries are evicted first.
+type OriginCache struct {
+	dir      string
+	capacity int64
+	maxAge   time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*OriginCacheEntry
+}
+
+// NewOriginCache creates an origin cache persisted in the given directory.
+// Entries written by a previous process are loaded back into the index.
+func NewOriginCache(dir string, capacity int64, maxAge time.Duration) (*OriginCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("origin cache: error creating directory: %w", err)
+	}
+
+	c := &OriginCache{
+		dir:      dir,
+		capacity: capacity,
+		maxAge:   maxAge,
+		entries:  make(map[string]*OriginCacheEntry),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// MaxAge returns the period of time entries are served without revalidation.
+func (c *OriginCache) MaxAge() time.Duration {
+	return c.maxAge
+}
+
+// Lookup returns the metadata of the cached entry for the given key.
+func (c *OriginCache) Lookup(key string) (OriginCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return OriginCacheEntry{}, false
+	}
+	return *entry, true
+}
+
+// Read returns the cached image for the given key.
+func (c *OriginCache) Read(key string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(c.path(key, originCacheDataExt))
+	if err != nil {
+		c.Remove(key)
+		return nil, fmt.Errorf("origin cache: error reading entry: %w", err)
+	}
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		entry.accessedAt = time.Now()
+	}
+	c.mu.Unlock()
+
+	return buf, nil
+}
+
+// Store saves the image and the validators of the origin response headers.
+func (c *OriginCache) Store(key, url string, buf []byte, header http.Header) error {
+	if int64(len(buf)) > c.capacity {
+		return nil
+	}
+
+	entry := &OriginCacheEntry{
+		URL:          url,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Size:         int64(len(buf)),
+		StoredAt:     time.Now().UTC(),
+		key:          key,
+		accessedAt:   time.Now(),
+	}
+
+	if err := writeFileAtomic(c.path(key, originCacheDataExt), buf); err != nil {
+		return fmt.Errorf("origin cache: error writing entry: %w", err)
+	}
+	if err := c.writeMeta(entry); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if prev, ok := c.entries[key]; ok {
+		c.size -= prev.Size
+	}
+	c.entries[key] = entry
+	c.size += entry.Size
+	c.evict()
+
+	return nil
+}
+
+// Refresh marks the entry as fresh again after the origin answered a
+// conditional request with 304 Not Modified.
+func (c *OriginCache) Refresh(key string, header http.Header) error {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+
+	entry.StoredAt = time.Now().UTC()
+	if etag := header.Get("ETag"); etag != "" {
+		entry.ETag = etag
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		entry.LastModified = lastModified
+	}
+	updated := *entry
+	c.mu.Unlock()
+
+	return c.writeMeta(&updated)
+}
+
+// Remove deletes the entry for the given key.
+func (c *OriginCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+func (c *OriginCache) remove(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.Size
+		delete(c.entries, key)
+	}
+	_ = os.Remove(c.path(key, originCacheDataExt))
+	_ = os.Remove(c.path(key, originCacheMetaExt))
+}
+
+// evict removes the least recently used entries until the cache fits in its
+// capacity. The lock must be held by the caller.
+func (c *OriginCache) evict() {
+	if c.size <= c.capacity {
+		return
+	}
+
+	entries := make([]*OriginCacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].accessedAt.Before(entries[j].accessedAt)
+	})
+
+	for _, entry := range entries {
+		if c.size <= c.capacity {
+			return
+		}
+		c.remove(entry.key)
+	}
+}
+
+func (c *OriginCache) load() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("origin cache: error reading directory: %w", err)
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".tmp-") {
+			_ = os.Remove(filepath.Join(c.dir, name))
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(name, originCacheMetaExt) {
+			continue
+		}
+
+		key := strings.TrimSuffix(name, originCacheMetaExt)
+		data, err := ioutil.ReadFile(c.path(key, originCacheMetaExt))
+		if err != nil {
+			continue
+		}
+
+		entry := &OriginCacheEntry{}
+		info, statErr := os.Stat(c.path(key, originCacheDataExt))
+		if err := json.Unmarshal(data, entry); err != nil || statErr != nil || info.Size() != entry.Size {
+			// Discard partially written or corrupted entries
+			c.remove(key)
+			continue
+		}
+
+		entry.key = key
+		entry.accessedAt = entry.StoredAt
+		c.entries[key] = entry
+		c.size += entry.Size
+	}
+
+	return nil
+}
+
+func (c *OriginCache) writeMeta(entry *OriginCacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("origin cache: error encoding entry: %w", err)
+	}
+	if err := writeFileAtomic(c.path(entry.key, originCacheMetaExt), data); err != nil {
+		return fmt.Errorf("origin cache: error writing entry: %w", err)
+	}
+	return nil
+}
+
+func (c *OriginCache) path(key, ext string) string {
+	return filepath.Join(c.dir, key+ext)
+}
+
+// originCacheKey builds the cache key of an outbound request. Authorization
+// and forwarded headers are part of the key, so responses are never shared
+// between different credentials.
+func originCacheKey(req *http.Request, forwardHeaders []string) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(req.URL.String()))
+	_, _ = h.Write([]byte("\nAuthorization: " + req.Header.Get("Authorization")))
+
+	headers := append([]string(nil), forwardHeaders...)
+	sort.Strings(headers)
+	for _, header := range headers {
+		_, _ = h.Write([]byte("\n" + header + ": " + req.Header.Get(header)))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeFileAtomic writes data in a temporary file which is then renamed, so
+// readers never observe partially written files.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
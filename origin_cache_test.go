@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestOriginCache(t *testing.T, capacity int64, maxAge time.Duration) (*OriginCache, func()) {
+	dir, err := ioutil.TempDir("", "imaginary-origin-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewOriginCache(dir, capacity, maxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cache, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestOriginCacheStoreAndReload(t *testing.T) {
+	cache, cleanup := newTestOriginCache(t, 1024, time.Hour)
+	defer cleanup()
+
+	header := http.Header{}
+	header.Set("ETag", `"abc"`)
+	header.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+
+	if err := cache.Store("foo", "http://bar/image.jpg", []byte("image"), header); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new cache instance must load the entries persisted on disk
+	reloaded, err := NewOriginCache(cache.dir, 1024, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, ok := reloaded.Lookup("foo")
+	if !ok {
+		t.Fatal("Cached entry must be loaded from disk")
+	}
+	if entry.ETag != `"abc"` || entry.LastModified != "Wed, 21 Oct 2015 07:28:00 GMT" || entry.Size != 5 {
+		t.Fatalf("Invalid cached entry: %#v", entry)
+	}
+	if !entry.Fresh(time.Hour) || entry.Fresh(0) {
+		t.Fatal("Invalid entry freshness")
+	}
+
+	buf, err := reloaded.Read("foo")
+	if err != nil || string(buf) != "image" {
+		t.Fatalf("Invalid cached data: %s (%v)", buf, err)
+	}
+}
+
+func TestOriginCacheEviction(t *testing.T) {
+	cache, cleanup := newTestOriginCache(t, 10, time.Hour)
+	defer cleanup()
+
+	_ = cache.Store("a", "http://bar/a", []byte("aaaa"), http.Header{})
+	time.Sleep(time.Millisecond)
+	_ = cache.Store("b", "http://bar/b", []byte("bbbb"), http.Header{})
+	time.Sleep(time.Millisecond)
+
+	// Reading "a" makes "b" the least recently used entry
+	if _, err := cache.Read("a"); err != nil {
+		t.Fatal(err)
+	}
+	_ = cache.Store("c", "http://bar/c", []byte("cccc"), http.Header{})
+
+	if _, ok := cache.Lookup("b"); ok {
+		t.Error("Least recently used entry must be evicted")
+	}
+	if _, ok := cache.Lookup("a"); !ok {
+		t.Error("Recently used entry must be kept")
+	}
+	if cache.size != 8 {
+		t.Errorf("Invalid cache size: %d", cache.size)
+	}
+
+	// Entries above the capacity are never stored
+	_ = cache.Store("d", "http://bar/d", []byte("ddddddddddd"), http.Header{})
+	if _, ok := cache.Lookup("d"); ok {
+		t.Error("Entry larger than capacity must not be stored")
+	}
+}
+
+func TestOriginCacheKey(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://bar/image.jpg", nil)
+	key := originCacheKey(req, nil)
+
+	req.Header.Set("Authorization", "Bearer foo")
+	if originCacheKey(req, nil) == key {
+		t.Error("Authorization must be part of the key")
+	}
+
+	key = originCacheKey(req, []string{"X-Token"})
+	req.Header.Set("X-Token", "bar")
+	if originCacheKey(req, []string{"X-Token"}) == key {
+		t.Error("Forwarded headers must be part of the key")
+	}
+}
+
+func TestHttpImageSourceOriginCache(t *testing.T) {
+	var requests, revalidations int
+	buf, _ := ioutil.ReadFile(fixtureImage)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(buf)
+	}))
+	defer ts.Close()
+
+	cache, cleanup := newTestOriginCache(t, 1<<30, time.Hour)
+	defer cleanup()
+
+	source := NewHTTPImageSource(&SourceConfig{OriginCache: cache})
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+
+	for i := 0; i < 3; i++ {
+		body, err := source.GetImage(r)
+		if err != nil {
+			t.Fatalf("Error while reading the body: %s", err)
+		}
+		if len(body) != len(buf) {
+			t.Fatal("Invalid response body")
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("Fresh cached image must not be requested again: %d requests", requests)
+	}
+
+	// Stale entries are revalidated with the origin
+	cache.maxAge = 0
+	body, err := source.GetImage(r)
+	if err != nil {
+		t.Fatalf("Error while reading the body: %s", err)
+	}
+	if len(body) != len(buf) {
+		t.Fatal("Invalid response body")
+	}
+	if requests != 2 || revalidations != 1 {
+		t.Fatalf("Stale image must be revalidated: %d requests, %d revalidations", requests, revalidations)
+	}
+}
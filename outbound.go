@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultDenyRanges lists the IP ranges which remote image sources cannot
+// resolve to by default: loopback, private, shared, link-local and
+// unspecified addresses.
+const DefaultDenyRanges = "0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,172.16.0.0/12,192.168.0.0/16,::/128,::1/128,fc00::/7,fe80::/10"
+
+// outboundClient is the HTTP client shared by every outbound request, such as
+// URL image sources or remote watermark images.
+var outboundClient = http.DefaultClient
+
+// OutboundOptions represents the settings of the outbound HTTP client.
+type OutboundOptions struct {
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	MaxRedirects   int
+	CABundle       string
+	DenyRanges     []*net.IPNet
+	// Proxy returns the proxy of a request, by default the one defined by
+	// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+// LoadOutboundClient configures the shared outbound HTTP client.
+func LoadOutboundClient(o ServerOptions) error {
+	client, err := NewOutboundClient(OutboundOptions{
+		ConnectTimeout: time.Duration(o.OutboundConnectTimeout) * time.Second,
+		ReadTimeout:    time.Duration(o.OutboundReadTimeout) * time.Second,
+		MaxRedirects:   o.OutboundMaxRedirects,
+		CABundle:       o.OutboundCABundle,
+		DenyRanges:     o.OutboundDenyRanges,
+	})
+	if err != nil {
+		return err
+	}
+
+	outboundClient = client
+	return nil
+}
+
+// NewOutboundClient creates an HTTP client which applies the given timeouts and
+// redirect limit, and refuses to connect to any address within the deny ranges.
+// Addresses are checked once resolved, for the first request and every redirect.
+// Through a proxy, the target host is resolved and checked before proxying,
+// while the proxy itself, configured by the operator, may be at any address.
+// This check is only best effort: the proxy resolves the host again, so a DNS
+// rebinding between both resolutions gets past it.
+func NewOutboundClient(o OutboundOptions) (*http.Client, error) {
+	tlsConfig, err := newOutboundTLSConfig(o.CABundle)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   o.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   denyAddressControl(o.DenyRanges),
+	}
+	proxyDialer := &net.Dialer{
+		Timeout:   o.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	proxy := o.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
+	// The addresses of the proxies used so far, dialed without the deny check
+	var proxies sync.Map
+	proxyTarget := denyProxyTarget(proxy, o.DenyRanges)
+
+	transport := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			u, err := proxyTarget(req)
+			if err == nil && u != nil {
+				proxies.Store(proxyAddress(u), true)
+			}
+			return u, err
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if _, ok := proxies.Load(address); ok {
+				return proxyDialer.DialContext(ctx, network, address)
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   o.ConnectTimeout,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   o.ReadTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > o.MaxRedirects {
+				return fmt.Errorf("outbound: stopped after %d redirects", o.MaxRedirects)
+			}
+			return nil
+		},
+	}, nil
+}
+
+func newOutboundTLSConfig(caBundle string) (*tls.Config, error) {
+	if caBundle == "" {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("outbound: error reading CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("outbound: no certificates found in CA bundle: %s", caBundle)
+	}
+
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// proxyAddress returns the address the transport dials to reach a proxy,
+// with the default port of its scheme.
+func proxyAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// denyAddressControl returns a dialer control function which runs right before
+// connecting, once the host name has been resolved to an IP address.
+func denyAddressControl(ranges []*net.IPNet) func(network, address string, c syscall.RawConn) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("outbound: invalid address: %s", address)
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return fmt.Errorf("outbound: invalid address: %s", address)
+		}
+
+		if isDeniedIP(ip, ranges) {
+			return fmt.Errorf("%w: %s", ErrOutboundAddressDenied, ip)
+		}
+
+		return nil
+	}
+}
+
+// denyProxyTarget wraps the proxy function of the transport. The dialer only
+// sees the address of the proxy, so the target host of a proxied request is
+// resolved and checked against the deny ranges beforehand.
+func denyProxyTarget(proxy func(*http.Request) (*url.URL, error), ranges []*net.IPNet) func(*http.Request) (*url.URL, error) {
+	if len(ranges) == 0 {
+		return proxy
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err != nil || u == nil {
+			return u, err
+		}
+
+		if err := checkHostAddresses(req.Context(), req.URL.Hostname(), ranges); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+}
+
+// checkHostAddresses resolves the host and fails if any of its addresses is
+// within the deny ranges.
+func checkHostAddresses(ctx context.Context, host string, ranges []*net.IPNet) error {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("outbound: cannot resolve host %s: %w", host, err)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if isDeniedIP(ip, ranges) {
+			return fmt.Errorf("%w: %s", ErrOutboundAddressDenied, ip)
+		}
+	}
+	return nil
+}
+
+func isDeniedIP(ip net.IP, ranges []*net.IPNet) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPRanges parses a comma separated list of CIDR ranges or single IPs.
+func parseIPRanges(input string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, value := range strings.Split(input, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", value)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range: %s", value)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
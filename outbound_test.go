@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseIPRanges(t *testing.T) {
+	ranges, err := parseIPRanges(" 10.0.0.0/8, 127.0.0.1,::1 ,fc00::/7,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"10.0.0.0/8", "127.0.0.1/32", "::1/128", "fc00::/7"}
+	if len(ranges) != len(expected) {
+		t.Fatalf("Invalid number of ranges: %d", len(ranges))
+	}
+	for i, r := range ranges {
+		if r.String() != expected[i] {
+			t.Errorf("Invalid range: %s != %s", r, expected[i])
+		}
+	}
+
+	for _, value := range []string{"10.0.0.0/33", "localhost", "300.0.0.1"} {
+		if _, err := parseIPRanges(value); err == nil {
+			t.Errorf("Expected error for value: %s", value)
+		}
+	}
+}
+
+func TestIsDeniedIP(t *testing.T) {
+	ranges, _ := parseIPRanges(DefaultDenyRanges)
+
+	cases := []struct {
+		ip     string
+		denied bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+
+	for _, tc := range cases {
+		if denied := isDeniedIP(net.ParseIP(tc.ip), ranges); denied != tc.denied {
+			t.Errorf("Invalid result for %s: %t", tc.ip, denied)
+		}
+	}
+}
+
+func TestOutboundClientDeniedAddress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	ranges, _ := parseIPRanges(DefaultDenyRanges)
+	client, err := NewOutboundClient(OutboundOptions{DenyRanges: ranges})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get(ts.URL)
+	if !errors.Is(err, ErrOutboundAddressDenied) {
+		t.Fatalf("Request to a denied address must fail: %v", err)
+	}
+
+	client, _ = NewOutboundClient(OutboundOptions{})
+	res, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Request without deny ranges must succeed: %s", err)
+	}
+	_ = res.Body.Close()
+}
+
+func TestOutboundClientDeniedRedirect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Cannot listen on a second loopback address: %s", err)
+	}
+
+	internal := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secret"))
+	}))
+	internal.Listener = listener
+	internal.Start()
+	defer internal.Close()
+
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL, http.StatusFound)
+	}))
+	defer public.Close()
+
+	ranges, _ := parseIPRanges("127.0.0.2")
+	client, _ := NewOutboundClient(OutboundOptions{DenyRanges: ranges, MaxRedirects: 10})
+	if _, err := client.Get(public.URL); !errors.Is(err, ErrOutboundAddressDenied) {
+		t.Fatalf("Redirect to a denied address must fail: %v", err)
+	}
+}
+
+func TestOutboundClientMaxRedirects(t *testing.T) {
+	var hops int
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops++
+		http.Redirect(w, r, ts.URL, http.StatusFound)
+	}))
+	defer ts.Close()
+
+	client, _ := NewOutboundClient(OutboundOptions{MaxRedirects: 2})
+	if _, err := client.Get(ts.URL); err == nil {
+		t.Fatal("Redirect loop must fail")
+	}
+	if hops != 3 {
+		t.Fatalf("Invalid number of requests: %d", hops)
+	}
+}
+
+func TestOutboundClientInvalidCABundle(t *testing.T) {
+	if _, err := NewOutboundClient(OutboundOptions{CABundle: "testdata/missing.pem"}); err == nil {
+		t.Fatal("Missing CA bundle must fail")
+	}
+	if _, err := NewOutboundClient(OutboundOptions{CABundle: "testdata/1024bytes"}); err == nil {
+		t.Fatal("CA bundle without certificates must fail")
+	}
+	if _, err := NewOutboundClient(OutboundOptions{CABundle: "testdata/server.crt"}); err != nil {
+		t.Fatalf("Valid CA bundle must be loaded: %s", err)
+	}
+}
+
+func TestOutboundClientDeniedProxyTarget(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("proxied " + r.URL.Host))
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	ranges, _ := parseIPRanges("10.0.0.0/8")
+	client, _ := NewOutboundClient(OutboundOptions{DenyRanges: ranges, Proxy: http.ProxyURL(proxyURL)})
+
+	if _, err := client.Get("http://10.1.2.3/image.jpg"); !errors.Is(err, ErrOutboundAddressDenied) {
+		t.Fatalf("Proxied request to a denied address must fail: %v", err)
+	}
+
+	res, err := client.Get("http://192.0.2.1/image.jpg")
+	if err != nil {
+		t.Fatalf("Proxied request to an allowed address must succeed: %s", err)
+	}
+	_ = res.Body.Close()
+}
+
+func TestOutboundClientLoopbackProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("proxied " + r.URL.Host))
+	}))
+	defer proxy.Close()
+
+	// The proxy is reachable within the default deny ranges, not the targets
+	proxyURL, _ := url.Parse(proxy.URL)
+	ranges, _ := parseIPRanges(DefaultDenyRanges)
+	client, _ := NewOutboundClient(OutboundOptions{DenyRanges: ranges, Proxy: http.ProxyURL(proxyURL)})
+
+	res, err := client.Get("http://192.0.2.1/image.jpg")
+	if err != nil {
+		t.Fatalf("Request through a loopback proxy must succeed: %s", err)
+	}
+	_ = res.Body.Close()
+
+	if _, err := client.Get("http://127.0.0.1/image.jpg"); !errors.Is(err, ErrOutboundAddressDenied) {
+		t.Fatalf("Proxied request to a denied address must fail: %v", err)
+	}
+
+	// Without proxy, the same address is denied
+	direct, _ := NewOutboundClient(OutboundOptions{DenyRanges: ranges, Proxy: func(*http.Request) (*url.URL, error) { return nil, nil }})
+	if _, err := direct.Get(proxy.URL); !errors.Is(err, ErrOutboundAddressDenied) {
+		t.Fatalf("Request to a denied address must fail: %v", err)
+	}
+}
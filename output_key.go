@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+var outputKeyPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// renderOutputKey fills the placeholders of an output key template, such as
+// "{dir}/{name}_{width}x{height}.{format}", and validates the resulting key.
+// Empty path segments are removed, so "{dir}/{name}" works for top-level keys.
+func renderOutputKey(template string, vars map[string]string) (string, error) {
+	var unknown string
+	key := outputKeyPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value, ok := vars[strings.Trim(placeholder, "{}")]
+		if !ok && unknown == "" {
+			unknown = placeholder
+		}
+		return value
+	})
+
+	if unknown != "" {
+		return "", NewError(fmt.Sprintf("invalid output key, unknown placeholder: %s", unknown), BadRequest)
+	}
+
+	return cleanOutputKey(key)
+}
+
+// cleanOutputKey rejects keys which could escape the destination directory
+// or container once used as a file path.
+func cleanOutputKey(key string) (string, error) {
+	if strings.ContainsAny(key, "\\\x00") {
+		return "", ErrInvalidOutputKey
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(key, "/") {
+		switch segment {
+		case "":
+			continue
+		case ".", "..":
+			return "", ErrInvalidOutputKey
+		}
+		segments = append(segments, segment)
+	}
+
+	if len(segments) == 0 {
+		return "", ErrInvalidOutputKey
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// outputKeyVars returns the values of the output key placeholders. Source
+// placeholders are taken from the key, file or URL path of the input image,
+// the other ones from the processed image. The image size is only read when
+// withSize is set.
+func outputKeyVars(r *http.Request, image Image, withSize bool) (map[string]string, error) {
+	source := sourceKey(r)
+	dir, file := path.Split(source)
+	ext := path.Ext(file)
+
+	vars := map[string]string{
+		"dir":    strings.Trim(dir, "/"),
+		"name":   strings.TrimSuffix(file, ext),
+		"ext":    strings.TrimPrefix(ext, "."),
+		"format": ExtractImageTypeFromMime(image.Mime),
+		"output": image.Name,
+	}
+
+	sum := sha256.Sum256(image.Body)
+	vars["hash"] = hex.EncodeToString(sum[:])[:16]
+
+	if !withSize {
+		return vars, nil
+	}
+
+	size, err := bimg.Size(image.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read output image size: %w", err)
+	}
+	vars["width"] = strconv.Itoa(size.Width)
+	vars["height"] = strconv.Itoa(size.Height)
+
+	return vars, nil
+}
+
+// buildOutputKey renders the given output key template for the request.
+// Literal keys without placeholders are only validated.
+func buildOutputKey(template string, r *http.Request, image Image) (string, error) {
+	if !outputKeyPlaceholder.MatchString(template) {
+		return cleanOutputKey(template)
+	}
+
+	withSize := strings.Contains(template, "{width}") || strings.Contains(template, "{height}")
+	vars, err := outputKeyVars(r, image, withSize)
+	if err != nil {
+		return "", err
+	}
+
+	return renderOutputKey(template, vars)
+}
+
+func sourceKey(r *http.Request) string {
+	query := r.URL.Query()
+	for _, param := range []string{"s3key", "azureBlobKey", "storageKey", "file"} {
+		if value := query.Get(param); value != "" {
+			return value
+		}
+	}
+
+	if u, err := url.Parse(query.Get(URLQueryKey)); err == nil {
+		return u.Path
+	}
+	return ""
+}
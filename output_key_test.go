@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRenderOutputKey(t *testing.T) {
+	vars := map[string]string{
+		"dir":    "photos/2020",
+		"name":   "beach",
+		"ext":    "jpg",
+		"width":  "300",
+		"height": "200",
+		"format": "webp",
+		"hash":   "0123456789abcdef",
+	}
+
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{"{dir}/{name}_{width}x{height}.{format}", "photos/2020/beach_300x200.webp"},
+		{"variants/{hash}.{format}", "variants/0123456789abcdef.webp"},
+		{"{name}.{ext}", "beach.jpg"},
+		{"/static//{name}.{format}", "static/beach.webp"},
+	}
+
+	for _, tc := range cases {
+		key, err := renderOutputKey(tc.template, vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != tc.expected {
+			t.Errorf("Invalid output key: %s != %s", key, tc.expected)
+		}
+	}
+
+	vars["dir"] = ""
+	if key, _ := renderOutputKey("{dir}/{name}.{format}", vars); key != "beach.webp" {
+		t.Errorf("Invalid top-level output key: %s", key)
+	}
+
+	if _, err := renderOutputKey("{name}_{size}", vars); err == nil {
+		t.Error("Unknown placeholders must fail")
+	}
+}
+
+func TestRenderOutputKeyTraversal(t *testing.T) {
+	vars := map[string]string{"dir": "../../etc", "name": "..", "ext": ""}
+
+	for _, template := range []string{"{dir}/passwd", "{name}/foo", "foo/../bar", "./foo", "foo\\..\\bar", "{ext}", "/"} {
+		if _, err := renderOutputKey(template, vars); err != ErrInvalidOutputKey {
+			t.Errorf("Output key must be rejected: %s (%v)", template, err)
+		}
+	}
+}
+
+func TestBuildOutputKey(t *testing.T) {
+	u, _ := url.Parse("http://foo?s3key=photos/beach.jpg&outputKey=foo")
+	r := &http.Request{Method: http.MethodGet, URL: u}
+	image := Image{Body: []byte("image"), Mime: "image/webp"}
+
+	key, err := buildOutputKey("thumbs/{dir}/{name}.{format}", r, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "thumbs/photos/beach.webp" {
+		t.Errorf("Invalid output key: %s", key)
+	}
+
+	u, _ = url.Parse("http://foo?url=" + url.QueryEscape("http://bar/images/logo.png?v=1"))
+	key, _ = buildOutputKey("{dir}/{name}-{hash}.{ext}", &http.Request{URL: u}, image)
+	if key != "images/logo-6105d6cc76af4003.png" {
+		t.Errorf("Invalid output key: %s", key)
+	}
+
+	if key, _ := buildOutputKey("literal/key.jpg", r, image); key != "literal/key.jpg" {
+		t.Errorf("Literal keys must be kept: %s", key)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -53,10 +54,52 @@ var paramTypeCoercions = map[string]Coercion{
 	"sigma":       coerceSigma,
 	"minampl":     coerceMinAmpl,
 	"operations":  coerceOperations,
+	"outputs":     coerceOutputs,
 	"interlace":   coerceInterlace,
 	"aspectratio": coerceAspectRatio,
 }
 
+// paramExprKinds defines the kind of the expressions a param accepts. The
+// params which are not listed do not accept expressions.
+var paramExprKinds = map[string]exprKind{
+	"width":       exprNumber,
+	"height":      exprNumber,
+	"quality":     exprNumber,
+	"top":         exprNumber,
+	"left":        exprNumber,
+	"areawidth":   exprNumber,
+	"areaheight":  exprNumber,
+	"compression": exprNumber,
+	"rotate":      exprNumber,
+	"margin":      exprNumber,
+	"factor":      exprNumber,
+	"dpi":         exprNumber,
+	"textwidth":   exprNumber,
+	"opacity":     exprNumber,
+	"sigma":       exprNumber,
+	"minampl":     exprNumber,
+	"flip":        exprBool,
+	"flop":        exprBool,
+	"nocrop":      exprBool,
+	"noprofile":   exprBool,
+	"norotation":  exprBool,
+	"noreplicate": exprBool,
+	"force":       exprBool,
+	"embed":       exprBool,
+	"stripmeta":   exprBool,
+	"interlace":   exprBool,
+	"text":        exprString,
+	"image":       exprString,
+	"font":        exprString,
+	"type":        exprString,
+	"color":       exprString,
+	"colorspace":  exprString,
+	"gravity":     exprString,
+	"background":  exprString,
+	"extend":      exprString,
+	"aspectratio": exprString,
+}
+
 func coerceTypeInt(param interface{}) (int, error) {
 	if v, ok := param.(int); ok {
 		return v, nil
@@ -337,6 +380,19 @@ func coerceOperations(io *ImageOptions, param interface{}) (err error) {
 	return ErrUnsupportedValue
 }
 
+func coerceOutputs(io *ImageOptions, param interface{}) (err error) {
+	if v, ok := param.(string); ok {
+		outputs, err := parseJSONOutputs(v)
+		if err == nil {
+			io.Outputs = outputs
+		}
+
+		return err
+	}
+
+	return ErrUnsupportedValue
+}
+
 func coerceInterlace(io *ImageOptions, param interface{}) (err error) {
 	io.Interlace, err = coerceTypeBool(param)
 	io.IsDefinedField.Interlace = true
@@ -439,8 +495,56 @@ func parseJSONOperations(data string) (PipelineOperations, error) {
 	d := json.NewDecoder(strings.NewReader(data))
 	d.DisallowUnknownFields()
 
-	err := d.Decode(&operations)
-	return operations, err
+	if err := d.Decode(&operations); err != nil {
+		return operations, err
+	}
+
+	// Expressions are validated before the image is processed
+	for i := range operations {
+		if err := operations[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return operations, nil
+}
+
+var outputNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func parseJSONOutputs(data string) (PipelineOutputs, error) {
+	var outputs PipelineOutputs
+
+	// Fewer than 2 characters cannot be valid JSON. We assume no outputs.
+	if len(data) < 2 {
+		return outputs, nil
+	}
+
+	d := json.NewDecoder(strings.NewReader(data))
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(&outputs); err != nil {
+		return outputs, err
+	}
+
+	names := make(map[string]bool, len(outputs))
+	for _, output := range outputs {
+		if !outputNamePattern.MatchString(output.Name) {
+			return nil, fmt.Errorf("invalid output name: %q", output.Name)
+		}
+		if names[output.Name] {
+			return nil, fmt.Errorf("duplicated output name: %s", output.Name)
+		}
+		names[output.Name] = true
+		if output.Key != "" && output.URL != "" {
+			return nil, fmt.Errorf("output %s: key and url cannot be combined", output.Name)
+		}
+
+		for i := range output.Operations {
+			if err := output.Operations[i].compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return outputs, nil
 }
 
 func parseExtendMode(val string) bimg.Extend {
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PathAPIPrefix is the route of the path based API, where the processing
+// options and the image source are encoded in the URL path:
+//
+//	/p/{signature}/resize:w=300,h=200/format:webp/{source}
+const PathAPIPrefix = "/p"
+
+// pathParamAliases defines the short names accepted in path options.
+var pathParamAliases = map[string]string{
+	"w":      "width",
+	"h":      "height",
+	"q":      "quality",
+	"g":      "gravity",
+	"bg":     "background",
+	"f":      "type",
+	"format": "type",
+}
+
+// pathAPIController serves the path based API by translating the path into
+// a pipeline request, which is then processed like any other image request.
+func pathAPIController(o ServerOptions) http.Handler {
+	handler := validateImage(Middleware(imageController(o, Pipeline), o), o)
+	prefix := join(o, PathAPIPrefix)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			ErrorReply(r, w, ErrMethodNotAllowed, o)
+			return
+		}
+
+		signature, p := splitPathSignature(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+		if o.EnableURLSignature {
+			if err := checkPathSignature(o.URLSignatureKey, signature, p); err != nil {
+				ErrorReply(r, w, ToError(err, BadRequest), o)
+				return
+			}
+		}
+
+		query, negotiated, err := parsePathAPI(p, r.Header.Get("Accept"))
+		if err != nil {
+			ErrorReply(r, w, ToError(err, BadRequest), o)
+			return
+		}
+		if negotiated {
+			w.Header().Set("Vary", "Accept")
+		}
+
+		// The signature only covers the path, so no other query param than
+		// the API key is honored.
+		if key := r.URL.Query().Get("key"); key != "" {
+			query.Set("key", key)
+		}
+
+		req := r.Clone(r.Context())
+		req.URL.Path = join(o, "/pipeline")
+		req.URL.RawPath = ""
+		req.URL.RawQuery = query.Encode()
+		req.RequestURI = req.URL.RequestURI()
+		req.Method = http.MethodGet
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// splitPathSignature splits "/{signature}/{options}/{source}" into the
+// signature and the signed path, which keeps its leading slash.
+func splitPathSignature(p string) (string, string) {
+	p = strings.TrimPrefix(p, "/")
+	i := strings.Index(p, "/")
+	if i < 0 {
+		return p, ""
+	}
+	return p[:i], p[i:]
+}
+
+// checkPathSignature checks the URL-safe Base64-encoded HMAC-SHA256 digest
+// of the escaped path following the signature.
+func checkPathSignature(key, signature, p string) error {
+	sign, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidURLSignature
+	}
+
+	if !hmac.Equal(sign, pathSignature(key, p)) {
+		return ErrURLSignatureMismatch
+	}
+	return nil
+}
+
+func pathSignature(key, p string) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	_, _ = h.Write([]byte(p))
+	return h.Sum(nil)
+}
+
+// parsePathAPI translates the escaped path following the signature into the
+// query params of a pipeline request. Option segments have the form
+// "name:args": operations take comma separated key=value params, any other
+// known param takes a single value and applies to all the operations. It
+// reports whether the output format was negotiated with the Accept header.
+func parsePathAPI(p, accept string) (url.Values, bool, error) {
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, segment := range segments {
+		s, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, false, NewError(fmt.Sprintf("invalid path segment: %s", segment), BadRequest)
+		}
+		segments[i] = s
+	}
+
+	var operations PipelineOperations
+	options := map[string]interface{}{}
+
+	i := 0
+	for ; i < len(segments); i++ {
+		name, args, ok := splitPathOption(segments[i])
+		if !ok {
+			break
+		}
+
+		if _, exists := OperationsMap[name]; exists {
+			params, err := parsePathParams(args)
+			if err != nil {
+				return nil, false, err
+			}
+			operations = append(operations, PipelineOperation{Name: name, Params: params})
+			continue
+		}
+
+		param := resolvePathParam(name)
+		if _, exists := paramTypeCoercions[param]; !exists || param == "operations" || param == "outputs" {
+			return nil, false, NewError(fmt.Sprintf("unsupported path option: %s", name), BadRequest)
+		}
+		options[param] = args
+	}
+
+	query, err := parsePathSource(segments[i:])
+	if err != nil {
+		return nil, false, err
+	}
+
+	negotiated := options["type"] == "auto"
+	if negotiated {
+		options["type"] = determineAcceptMimeType(accept)
+	}
+
+	if len(operations) == 0 {
+		operations = append(operations, PipelineOperation{Name: "convert", Params: map[string]interface{}{}})
+	}
+	for _, operation := range operations {
+		for param, value := range options {
+			if _, exists := operation.Params[param]; !exists {
+				operation.Params[param] = value
+			}
+		}
+	}
+
+	buf, err := json.Marshal(operations)
+	if err != nil {
+		return nil, false, err
+	}
+	query.Set("operations", string(buf))
+
+	return query, negotiated, nil
+}
+
+// splitPathOption splits an option segment into its name and arguments.
+func splitPathOption(segment string) (string, string, bool) {
+	i := strings.Index(segment, ":")
+	if i <= 0 {
+		return "", "", false
+	}
+	return segment[:i], segment[i+1:], true
+}
+
+// parsePathParams parses comma separated key=value params. A value may
+// contain commas, such as a color: "bg=255,255,255".
+func parsePathParams(args string) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+	if args == "" {
+		return params, nil
+	}
+
+	last := ""
+	for _, pair := range strings.Split(args, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			if last == "" {
+				return nil, NewError(fmt.Sprintf("invalid path option param: %s", pair), BadRequest)
+			}
+			params[last] = params[last].(string) + "," + pair
+			continue
+		}
+
+		last = resolvePathParam(pair[:i])
+		if _, exists := paramTypeCoercions[last]; !exists {
+			return nil, NewError(fmt.Sprintf("unsupported path option param: %s", pair[:i]), BadRequest)
+		}
+		params[last] = pair[i+1:]
+	}
+
+	return params, nil
+}
+
+func resolvePathParam(name string) string {
+	if param, ok := pathParamAliases[name]; ok {
+		return param
+	}
+	return name
+}
+
+// parsePathSource translates the trailing path segments into the query params
+// of an image source:
+//
+//	{base64url encoded URL}   image URL, requires -enable-url-source
+//	file/{path}               file under the -mount directory
+//	storage/{profile}/{key}   object of a storage profile
+func parsePathSource(segments []string) (url.Values, error) {
+	query := url.Values{}
+
+	switch {
+	case len(segments) == 0 || segments[0] == "":
+		return nil, ErrMissingImageSource
+	case segments[0] == "file" && len(segments) > 1:
+		query.Set("file", strings.Join(segments[1:], "/"))
+	case segments[0] == "storage" && len(segments) > 2:
+		query.Set("storage", segments[1])
+		query.Set("storageKey", strings.Join(segments[2:], "/"))
+	case len(segments) == 1:
+		buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[0], "="))
+		if err != nil {
+			return nil, ErrInvalidImageURL
+		}
+		u, err := url.Parse(string(buf))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, ErrInvalidImageURL
+		}
+		query.Set(URLQueryKey, u.String())
+	default:
+		return nil, ErrMissingImageSource
+	}
+
+	return query, nil
+}
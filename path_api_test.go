@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePathAPI(t *testing.T) {
+	source := base64.RawURLEncoding.EncodeToString([]byte("http://foo/bar.jpg"))
+
+	query, negotiated, err := parsePathAPI("/resize:w=300,h=200/extend:bg=255,200,150/format:webp/q:80/"+source, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if negotiated {
+		t.Error("Format must not be negotiated")
+	}
+	if query.Get("url") != "http://foo/bar.jpg" {
+		t.Errorf("Invalid source URL: %s", query.Get("url"))
+	}
+
+	var operations PipelineOperations
+	if err := json.Unmarshal([]byte(query.Get("operations")), &operations); err != nil {
+		t.Fatal(err)
+	}
+	if len(operations) != 1 || operations[0].Name != "resize" {
+		t.Fatalf("Invalid operations: %s", query.Get("operations"))
+	}
+
+	expected := map[string]interface{}{
+		"width":      "300",
+		"height":     "200",
+		"type":       "webp",
+		"quality":    "80",
+		"extend":     nil,
+		"background": nil,
+	}
+	for param, value := range expected {
+		if value != nil && operations[0].Params[param] != value {
+			t.Errorf("Invalid param %s: %v", param, operations[0].Params[param])
+		}
+	}
+}
+
+func TestParsePathAPIOptions(t *testing.T) {
+	query, negotiated, err := parsePathAPI("/crop:w=100,bg=255,255,255/rotate:rotate=90,type=png/format:auto/storage/media/a/b.jpg", "image/webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !negotiated {
+		t.Error("Format must be negotiated")
+	}
+	if query.Get("storage") != "media" || query.Get("storageKey") != "a/b.jpg" {
+		t.Errorf("Invalid storage source: %v", query)
+	}
+
+	var operations PipelineOperations
+	_ = json.Unmarshal([]byte(query.Get("operations")), &operations)
+	if len(operations) != 2 {
+		t.Fatalf("Invalid operations: %s", query.Get("operations"))
+	}
+	if operations[0].Params["background"] != "255,255,255" || operations[0].Params["type"] != "webp" {
+		t.Errorf("Invalid crop params: %v", operations[0].Params)
+	}
+	if operations[1].Params["type"] != "png" {
+		t.Errorf("Operation params must take precedence: %v", operations[1].Params)
+	}
+
+	query, _, err = parsePathAPI("/format:png/file/foo/bar%2Fbaz.jpg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("file") != "foo/bar/baz.jpg" {
+		t.Errorf("Invalid file source: %s", query.Get("file"))
+	}
+	_ = json.Unmarshal([]byte(query.Get("operations")), &operations)
+	if len(operations) != 1 || operations[0].Name != "convert" {
+		t.Errorf("Options without operations must convert: %s", query.Get("operations"))
+	}
+}
+
+func TestParsePathAPIInvalid(t *testing.T) {
+	paths := []string{
+		"/resize:w=300",
+		"/resize:w=300/unknown:1/file/foo.jpg",
+		"/resize:foo=1/file/foo.jpg",
+		"/resize:300/file/foo.jpg",
+		"/operations:[]/file/foo.jpg",
+		"/resize:w=300/" + base64.RawURLEncoding.EncodeToString([]byte("file:///etc/passwd")),
+		"/resize:w=300/not%20base64",
+	}
+
+	for _, p := range paths {
+		if _, _, err := parsePathAPI(p, ""); err == nil {
+			t.Errorf("Expected error for path: %s", p)
+		}
+	}
+}
+
+func TestPathAPISignature(t *testing.T) {
+	key := "4f46feebafc4b5e988f131c4ff8b5997"
+	p := "/resize:w=300/file/foo.jpg"
+	signature := base64.RawURLEncoding.EncodeToString(pathSignature(key, p))
+
+	if err := checkPathSignature(key, signature, p); err != nil {
+		t.Errorf("Valid signature must pass: %s", err)
+	}
+	if err := checkPathSignature(key, signature, "/resize:w=3000/file/foo.jpg"); err != ErrURLSignatureMismatch {
+		t.Errorf("Signature of another path must not match: %v", err)
+	}
+	if err := checkPathSignature(key, "!", p); err != ErrInvalidURLSignature {
+		t.Errorf("Invalid signature must fail: %v", err)
+	}
+
+	mux := NewServerMux(ServerOptions{EnableURLSignature: true, URLSignatureKey: key, Mount: "testdata"})
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/p/" + signature + "/resize:w=3000/file/foo.jpg", http.StatusForbidden},
+		{"/p/" + signature + "/resize:w=300/unknown:1/file/foo.jpg", http.StatusForbidden},
+		{"/p/_/resize:w=300/file/foo.jpg", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.code {
+			t.Errorf("Invalid status for %s: %d", tc.path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// OutputsBundleQueryKey is the param choosing how the outputs of a pipeline
+// are returned in the response: "multipart" (default) or "zip".
+const OutputsBundleQueryKey = "bundle"
+
+// outputKeyParams are the params holding the destination of an upload,
+// which an output key replaces. The output URL of the HTTP sink is replaced
+// by the output url instead.
+var outputKeyParams = []string{"outputKey", "azureOutputBlobKey", "outputFile"}
+
+// OutputResult describes an uploaded output of a pipeline.
+type OutputResult struct {
+	Name string `json:"name"`
+	UploadResult
+}
+
+// checkPipelineOutputs checks the outputs can be returned or uploaded
+// before the image is processed.
+func checkPipelineOutputs(r *http.Request, outputs PipelineOutputs, sink ImageSink) error {
+	if sink == nil {
+		switch r.URL.Query().Get(OutputsBundleQueryKey) {
+		case "", "multipart", "zip":
+			return nil
+		}
+		return NewError(fmt.Sprintf("unsupported outputs bundle: %s", r.URL.Query().Get(OutputsBundleQueryKey)), BadRequest)
+	}
+
+	for _, output := range outputs {
+		if _, err := outputRequest(r, output, len(outputs) > 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputRequest returns the request uploading an output, where its key
+// replaces the output key of the request, or its url the output URL. Without
+// them, uploading several outputs requires the {output} placeholder in the
+// key, so they are not overwritten.
+func outputRequest(r *http.Request, output PipelineOutput, multiple bool) (*http.Request, error) {
+	query := r.URL.Query()
+
+	if query.Get(OutputURLQueryKey) != "" {
+		switch {
+		case output.Key != "":
+			return nil, NewError(fmt.Sprintf("output %s: the output URL is replaced by url, not key", output.Name), BadRequest)
+		case output.URL != "":
+			query.Set(OutputURLQueryKey, output.URL)
+		case multiple:
+			return nil, NewError(fmt.Sprintf("output %s: missing url", output.Name), BadRequest)
+		}
+	} else if output.URL != "" {
+		return nil, NewError(fmt.Sprintf("output %s: url requires an output URL", output.Name), BadRequest)
+	}
+
+	for _, param := range outputKeyParams {
+		value := query.Get(param)
+		switch {
+		case value == "":
+			continue
+		case output.Key != "":
+			query.Set(param, output.Key)
+		case multiple && !strings.Contains(value, "{output}"):
+			return nil, NewError(fmt.Sprintf("output %s: missing key or {output} placeholder in %s", output.Name, param), BadRequest)
+		}
+	}
+
+	req := r.Clone(r.Context())
+	req.URL.RawQuery = query.Encode()
+	return req, nil
+}
+
+// replyWithOutputs uploads the outputs of a pipeline, replying with the
+// JSON manifest of the uploaded objects, or writes them in the response.
+func replyWithOutputs(w http.ResponseWriter, r *http.Request, image Image, outputs PipelineOutputs, sink ImageSink, o ServerOptions) {
+	if sink == nil {
+		replyWithOutputsBundle(w, r, image.Outputs, o)
+		return
+	}
+
+	results := make([]OutputResult, 0, len(outputs))
+	for i, output := range outputs {
+		req, err := outputRequest(r, output, len(outputs) > 1)
+		if err != nil {
+			ErrorReply(r, w, ToError(err, BadRequest), o)
+			return
+		}
+
+		out := image.Outputs[i]
+		result, err := sink.Upload(req, out)
+		if err != nil {
+			e := ToError(err, InternalError)
+			ErrorReply(r, w, NewError(fmt.Sprintf("Error while uploading the image output %s: %s", output.Name, e.Message), e.Code), o)
+			return
+		}
+
+		result.Size = len(out.Body)
+		result.Mime = out.Mime
+		if size, err := bimg.Size(out.Body); err == nil {
+			result.Width, result.Height = size.Width, size.Height
+		}
+		results = append(results, OutputResult{Name: output.Name, UploadResult: result})
+	}
+
+	body, _ := json.Marshal(struct {
+		Outputs []OutputResult `json:"outputs"`
+	}{results})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func replyWithOutputsBundle(w http.ResponseWriter, r *http.Request, outputs []Image, o ServerOptions) {
+	var buf bytes.Buffer
+	var contentType string
+	var err error
+
+	if r.URL.Query().Get(OutputsBundleQueryKey) == "zip" {
+		contentType = "application/zip"
+		err = writeOutputsZip(&buf, outputs)
+	} else {
+		contentType, err = writeOutputsMultipart(&buf, outputs)
+	}
+	if err != nil {
+		ErrorReply(r, w, NewError("Error while writing the image outputs: "+err.Error(), InternalError), o)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// outputFileName returns the name of an output with the extension of its
+// format.
+func outputFileName(output Image) string {
+	if ext := ExtractImageTypeFromMime(output.Mime); ext != "" {
+		return output.Name + "." + ext
+	}
+	return output.Name
+}
+
+// writeOutputsMultipart writes the outputs as a multipart/mixed body and
+// returns its content type.
+func writeOutputsMultipart(buf *bytes.Buffer, outputs []Image) (string, error) {
+	mw := multipart.NewWriter(buf)
+	for _, output := range outputs {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", output.Mime)
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; name=%q; filename=%q", output.Name, outputFileName(output)))
+		header.Set("Content-Length", strconv.Itoa(len(output.Body)))
+
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := part.Write(output.Body); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return "multipart/mixed; boundary=" + mw.Boundary(), nil
+}
+
+// writeOutputsZip writes the outputs as a zip archive. Images are already
+// compressed, so they are stored as is.
+func writeOutputsZip(buf *bytes.Buffer, outputs []Image) error {
+	zw := zip.NewWriter(buf)
+	for _, output := range outputs {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: outputFileName(output), Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(output.Body); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var testOutputs = []Image{
+	{Name: "small", Mime: "image/webp", Body: []byte("small image")},
+	{Name: "large", Mime: "image/jpeg", Body: []byte("large image")},
+}
+
+func TestParseJSONOutputs(t *testing.T) {
+	outputs, err := parseJSONOutputs(`[
+		{"name": "small", "key": "thumbs/small.webp", "operations": [{"operation": "resize", "params": {"width": 320}}]},
+		{"name": "large", "operations": []}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || outputs[0].Key != "thumbs/small.webp" || outputs[0].Operations[0].Name != "resize" {
+		t.Errorf("Invalid outputs: %+v", outputs)
+	}
+
+	invalid := []string{
+		`[{"name": "", "operations": []}]`,
+		`[{"name": "a/b", "operations": []}]`,
+		`[{"name": "a", "operations": []}, {"name": "a", "operations": []}]`,
+		`[{"name": "a", "operations": [{"operation": "resize", "if": "width +", "params": {}}]}]`,
+		`[{"name": "a", "format": "webp"}]`,
+		`[{"name": "a", "key": "a.jpg", "url": "http://example.com/a.jpg"}]`,
+	}
+	for _, data := range invalid {
+		if _, err := parseJSONOutputs(data); err == nil {
+			t.Errorf("Expected error for outputs: %s", data)
+		}
+	}
+}
+
+func TestOutputRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/pipeline?outputStorage=media&outputKey=thumbs/{name}_{output}.{format}", nil)
+
+	req, err := outputRequest(r, PipelineOutput{Name: "small"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := req.URL.Query().Get("outputKey"); key != "thumbs/{name}_{output}.{format}" {
+		t.Errorf("Invalid output key: %s", key)
+	}
+
+	req, err = outputRequest(r, PipelineOutput{Name: "small", Key: "small.webp"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := req.URL.Query().Get("outputKey"); key != "small.webp" {
+		t.Errorf("Invalid output key: %s", key)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/pipeline?outputStorage=media&outputKey=thumbs/image.webp", nil)
+	if _, err := outputRequest(r, PipelineOutput{Name: "small"}, true); err == nil {
+		t.Error("Expected error for outputs overwriting each other")
+	}
+	if _, err := outputRequest(r, PipelineOutput{Name: "small"}, false); err != nil {
+		t.Errorf("A single output can use the request key: %s", err)
+	}
+	if _, err := outputRequest(r, PipelineOutput{Name: "small", URL: "http://example.com/small.webp"}, false); err == nil {
+		t.Error("Expected error for an output url without output URL")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/pipeline?outputUrl=http://example.com/image.webp", nil)
+	req, err = outputRequest(r, PipelineOutput{Name: "small", URL: "http://example.com/small.webp"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := req.URL.Query().Get(OutputURLQueryKey); u != "http://example.com/small.webp" {
+		t.Errorf("Invalid output URL: %s", u)
+	}
+	if _, err := outputRequest(r, PipelineOutput{Name: "small", Key: "small.webp"}, true); err == nil {
+		t.Error("Expected error for an output key replacing the output URL")
+	}
+	if _, err := outputRequest(r, PipelineOutput{Name: "small"}, true); err == nil {
+		t.Error("Expected error for outputs overwriting each other")
+	}
+}
+
+func TestImageHandlerOutputsNotSupported(t *testing.T) {
+	if !isPipeline(Pipeline) || isPipeline(Resize) {
+		t.Fatal("Invalid pipeline operation")
+	}
+
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	outputs := url.QueryEscape(`[{"name": "small", "operations": []}]`)
+	res, err := http.Post(ts.URL+"?width=300&outputs="+outputs, "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), ErrOutputsNotSupported.Message) {
+		t.Errorf("Invalid response: %d %s", res.StatusCode, body)
+	}
+}
+
+func TestReplyWithOutputsStorage(t *testing.T) {
+	defer func(p map[string]*StorageProfile) { storageProfiles = p }(storageProfiles)
+	profile := &StorageProfile{Provider: StorageProviderMemory, Container: "images"}
+	if err := profile.init("memory"); err != nil {
+		t.Fatal(err)
+	}
+	storageProfiles = map[string]*StorageProfile{"memory": profile}
+
+	r := httptest.NewRequest(http.MethodGet, "/pipeline?storageKey=photos/beach.jpg&outputStorage=memory&outputKey={dir}/{name}_{output}.{format}", nil)
+	outputs := PipelineOutputs{{Name: "small"}, {Name: "large", Key: "large.jpg"}}
+	sink := NewStorageImageSink(&SinkConfig{Type: ImageSinkTypeStorage})
+
+	w := httptest.NewRecorder()
+	replyWithOutputs(w, r, Image{Outputs: testOutputs}, outputs, sink, ServerOptions{})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid response: %d %s", w.Code, w.Body.String())
+	}
+
+	var manifest struct {
+		Outputs []OutputResult `json:"outputs"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Outputs) != 2 || manifest.Outputs[0].Name != "small" || manifest.Outputs[0].Key != "photos/beach_small.webp" ||
+		manifest.Outputs[1].Key != "large.jpg" || manifest.Outputs[1].Mime != "image/jpeg" {
+		t.Errorf("Invalid manifest: %s", w.Body.String())
+	}
+
+	if data, err := profile.DownloadImage("images", "photos/beach_small.webp"); err != nil || string(data) != "small image" {
+		t.Errorf("Invalid uploaded output: %q %v", data, err)
+	}
+}
+
+func TestReplyWithOutputsBundle(t *testing.T) {
+	outputs := PipelineOutputs{{Name: "small"}, {Name: "large"}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/pipeline", nil)
+	replyWithOutputs(w, r, Image{Outputs: testOutputs}, outputs, nil, ServerOptions{})
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Invalid content type: %s", w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, output := range testOutputs {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if part.FileName() != outputFileName(output) || part.Header.Get("Content-Type") != output.Mime || string(body) != string(output.Body) {
+			t.Errorf("Invalid part: %v %q", part.Header, body)
+		}
+	}
+	if part, err := mr.NextPart(); err == nil {
+		t.Errorf("Unexpected part: %v", part.Header)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/pipeline?bundle=zip", nil)
+	replyWithOutputs(w, r, Image{Outputs: testOutputs}, outputs, nil, ServerOptions{})
+	if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Fatalf("Invalid content type: %s", ct)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "small.webp" || zr.File[1].Name != "large.jpeg" {
+		t.Errorf("Invalid zip entries: %+v", zr.File)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/pipeline?bundle=tar", nil)
+	if err := checkPipelineOutputs(r, outputs, nil); err == nil {
+		t.Error("Expected error for an unsupported bundle")
+	}
+}
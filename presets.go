@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// PresetPrefix is the route processing an image with a named preset:
+//
+//	/preset/{name}?url=https://example.com/image.jpg
+const PresetPrefix = "/preset"
+
+// PresetsPath is the route listing the loaded presets.
+const PresetsPath = "/presets"
+
+// presets holds the presets loaded from the configuration file, which may
+// be reloaded while requests are served.
+var (
+	presetsMu sync.RWMutex
+	presets   = make(map[string]*Preset)
+)
+
+// Preset represents a named pipeline and its output options, so clients can
+// refer to it instead of sending the operations. Requests can only override
+// the params listed in Allow.
+type Preset struct {
+	Description string             `json:"description,omitempty"`
+	Operations  PipelineOperations `json:"operations"`
+	Type        string             `json:"type,omitempty"`
+	Quality     int                `json:"quality,omitempty"`
+	Compression int                `json:"compression,omitempty"`
+	Allow       []string           `json:"allow,omitempty"`
+}
+
+// LoadPresets reads the presets from a JSON file such as:
+//
+//	{"presets": {"thumbnail": {"operations": [{"operation": "fit", "params": {"width": 200, "height": 200}}], "type": "webp", "allow": ["width"]}}}
+//
+// The presets are only replaced if all of them are valid.
+func LoadPresets(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("presets: error reading file: %w", err)
+	}
+
+	config := struct {
+		Presets map[string]*Preset `json:"presets"`
+	}{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		return fmt.Errorf("presets: error decoding file: %w", err)
+	}
+
+	for name, preset := range config.Presets {
+		if err := preset.validate(name); err != nil {
+			return err
+		}
+	}
+	if config.Presets == nil {
+		config.Presets = make(map[string]*Preset)
+	}
+
+	presetsMu.Lock()
+	presets = config.Presets
+	presetsMu.Unlock()
+	return nil
+}
+
+// ReloadPresetsOnSignal reloads the presets file when the process receives
+// SIGHUP. The current presets are kept if the file is invalid, and the
+// outcome is logged either way, as the reload is requested by the operator.
+func ReloadPresetsOnSignal(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if err := LoadPresets(path); err != nil {
+				log.Printf("cannot reload presets: %s", err)
+				continue
+			}
+			log.Printf("presets reloaded from %s", path)
+		}
+	}()
+}
+
+// GetPreset returns the preset with the given name.
+func GetPreset(name string) (*Preset, error) {
+	presetsMu.RLock()
+	defer presetsMu.RUnlock()
+
+	preset, ok := presets[name]
+	if !ok {
+		return nil, NewError(fmt.Sprintf("unknown preset: %s", name), NotFound)
+	}
+	return preset, nil
+}
+
+func (p *Preset) validate(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("presets: invalid preset name: %q", name)
+	}
+	if len(p.Operations) == 0 {
+		return fmt.Errorf("presets: %s: missing operations", name)
+	}
+	if len(p.Operations) > 10 {
+		return fmt.Errorf("presets: %s: maximum allowed pipeline operations exceeded", name)
+	}
+
+	for _, operation := range p.Operations {
+		if _, exists := OperationsMap[operation.Name]; !exists {
+			return fmt.Errorf("presets: %s: unsupported operation name: %s", name, operation.Name)
+		}
+		for param := range operation.Params {
+			if _, exists := paramTypeCoercions[param]; !exists || param == "operations" || param == "outputs" {
+				return fmt.Errorf("presets: %s: unsupported param: %s", name, param)
+			}
+		}
+		if err := operation.compile(); err != nil {
+			return fmt.Errorf("presets: %s: %s", name, err)
+		}
+		if len(operation.expressions) > 0 {
+			continue
+		}
+		if _, err := buildParamsFromOperation(operation); err != nil {
+			return fmt.Errorf("presets: %s: %s", name, err)
+		}
+	}
+
+	if p.Type != "" && p.Type != "auto" && ImageType(p.Type) == 0 {
+		return fmt.Errorf("presets: %s: unsupported output type: %s", name, p.Type)
+	}
+	if p.Quality < 0 || p.Quality > 100 {
+		return fmt.Errorf("presets: %s: invalid quality: %d", name, p.Quality)
+	}
+	if p.Compression < 0 || p.Compression > 9 {
+		return fmt.Errorf("presets: %s: invalid compression: %d", name, p.Compression)
+	}
+
+	for _, param := range p.Allow {
+		if _, exists := paramTypeCoercions[param]; !exists || param == "operations" || param == "outputs" {
+			return fmt.Errorf("presets: %s: unsupported allowed param: %s", name, param)
+		}
+	}
+	return nil
+}
+
+func (p *Preset) allows(param string) bool {
+	for _, allowed := range p.Allow {
+		if allowed == param {
+			return true
+		}
+	}
+	return false
+}
+
+// pipeline returns a copy of the preset operations with the output options
+// and the overrides applied. An override replaces the param in the
+// operations defining it, or is added to all of them if none does.
+func (p *Preset) pipeline(overrides map[string]interface{}) PipelineOperations {
+	operations := make(PipelineOperations, len(p.Operations))
+	for i, operation := range p.Operations {
+		params := make(map[string]interface{}, len(operation.Params))
+		for param, value := range operation.Params {
+			params[param] = value
+		}
+		operations[i] = PipelineOperation{
+			Name:          operation.Name,
+			Condition:     operation.Condition,
+			IgnoreFailure: operation.IgnoreFailure,
+			Params:        params,
+		}
+	}
+
+	output := map[string]interface{}{}
+	if p.Type != "" {
+		output["type"] = p.Type
+	}
+	if p.Quality != 0 {
+		output["quality"] = p.Quality
+	}
+	if p.Compression != 0 {
+		output["compression"] = p.Compression
+	}
+	for param, value := range overrides {
+		output[param] = value
+	}
+
+	for param, value := range output {
+		_, override := overrides[param]
+		defined := p.defines(param)
+		for _, operation := range operations {
+			_, exists := operation.Params[param]
+			if (override && (exists || !defined)) || (!override && !exists) {
+				operation.Params[param] = value
+			}
+		}
+	}
+
+	return operations
+}
+
+// defines reports whether any operation of the preset defines the param.
+func (p *Preset) defines(param string) bool {
+	for _, operation := range p.Operations {
+		if _, exists := operation.Params[param]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPreset translates the query params of a request using a preset into
+// the ones of a pipeline request. Processing params are rejected unless the
+// preset allows them, while the others, such as the image source, are kept.
+// It reports whether the output format was negotiated with the Accept header.
+func applyPreset(name string, query url.Values, accept string) (url.Values, bool, error) {
+	preset, err := GetPreset(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	params := url.Values{}
+	overrides := map[string]interface{}{}
+	for key, values := range query {
+		if key == "preset" {
+			continue
+		}
+		if _, exists := paramTypeCoercions[key]; !exists {
+			params[key] = values
+			continue
+		}
+		if !preset.allows(key) {
+			return nil, false, NewError(fmt.Sprintf("param not allowed by preset %s: %s", name, key), BadRequest)
+		}
+		overrides[key] = query.Get(key)
+	}
+
+	operations := preset.pipeline(overrides)
+
+	var negotiated bool
+	for _, operation := range operations {
+		if operation.Params["type"] == "auto" {
+			operation.Params["type"] = determineAcceptMimeType(accept)
+			negotiated = true
+		}
+	}
+
+	buf, err := json.Marshal(operations)
+	if err != nil {
+		return nil, false, err
+	}
+	params.Set("operations", string(buf))
+
+	return params, negotiated, nil
+}
+
+// presetController serves /preset/{name}, processing the image like a
+// pipeline request with the preset param.
+func presetController(o ServerOptions) http.Handler {
+	handler := validateImage(Middleware(imageController(o, Pipeline), o), o)
+	prefix := join(o, PresetPrefix) + "/"
+
+	next := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		if _, err := GetPreset(name); err != nil {
+			ErrorReply(r, w, ToError(err, NotFound), o)
+			return
+		}
+
+		query := r.URL.Query()
+		query.Set("preset", name)
+
+		req := r.Clone(r.Context())
+		req.URL.Path = join(o, "/pipeline")
+		req.URL.RawPath = ""
+		req.URL.RawQuery = query.Encode()
+		req.RequestURI = req.URL.RequestURI()
+
+		handler.ServeHTTP(w, req)
+	}))
+
+	if o.EnableURLSignature {
+		return validateURLSignature(next, o)
+	}
+	return next
+}
+
+// presetsController lists the loaded presets.
+func presetsController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		ErrorReply(r, w, ErrMethodNotAllowed, ServerOptions{})
+		return
+	}
+
+	presetsMu.RLock()
+	body, _ := json.Marshal(struct {
+		Presets map[string]*Preset `json:"presets"`
+	}{presets})
+	presetsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
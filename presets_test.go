@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPresets = `{"presets": {
+	"thumbnail": {
+		"operations": [
+			{"operation": "fit", "params": {"width": 200, "height": 200}},
+			{"operation": "blur", "params": {"sigma": 0.5}}
+		],
+		"type": "webp",
+		"quality": 80,
+		"allow": ["width", "type"]
+	},
+	"negotiated": {
+		"operations": [{"operation": "convert", "params": {}}],
+		"type": "auto"
+	}
+}}`
+
+func loadTestPresets(t *testing.T, config string) error {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "presets.json")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadPresets(path)
+}
+
+func TestLoadPresets(t *testing.T) {
+	defer func() { presets = make(map[string]*Preset) }()
+
+	if err := loadTestPresets(t, testPresets); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetPreset("thumbnail"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetPreset("missing"); err == nil {
+		t.Error("Expected error for an unknown preset")
+	}
+
+	invalid := []string{
+		`{"presets": {"empty": {"operations": []}}}`,
+		`{"presets": {"op": {"operations": [{"operation": "foo", "params": {}}]}}}`,
+		`{"presets": {"param": {"operations": [{"operation": "resize", "params": {"foo": 1}}]}}}`,
+		`{"presets": {"value": {"operations": [{"operation": "resize", "params": {"width": "foo"}}]}}}`,
+		`{"presets": {"type": {"operations": [{"operation": "convert", "params": {}}], "type": "bmp"}}}`,
+		`{"presets": {"quality": {"operations": [{"operation": "convert", "params": {}}], "quality": 101}}}`,
+		`{"presets": {"allow": {"operations": [{"operation": "convert", "params": {}}], "allow": ["operations"]}}}`,
+		`{"presets": {"field": {"operations": [{"operation": "convert", "params": {}}], "formats": "webp"}}}`,
+	}
+	for _, config := range invalid {
+		if err := loadTestPresets(t, config); err == nil {
+			t.Errorf("Expected error for presets: %s", config)
+		}
+	}
+
+	// Invalid files keep the current presets
+	if _, err := GetPreset("thumbnail"); err != nil {
+		t.Errorf("Presets must be kept: %s", err)
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+	defer func() { presets = make(map[string]*Preset) }()
+	if err := loadTestPresets(t, testPresets); err != nil {
+		t.Fatal(err)
+	}
+
+	query := url.Values{"preset": {"thumbnail"}, "url": {"http://example.com/image.jpg"}, "width": {"100"}}
+	params, negotiated, err := applyPreset("thumbnail", query, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if negotiated || params.Get("url") != "http://example.com/image.jpg" || params.Get("width") != "" || params.Get("preset") != "" {
+		t.Errorf("Invalid params: %v", params)
+	}
+
+	var operations PipelineOperations
+	if err := json.Unmarshal([]byte(params.Get("operations")), &operations); err != nil {
+		t.Fatal(err)
+	}
+	if len(operations) != 2 {
+		t.Fatalf("Invalid operations: %+v", operations)
+	}
+	// The override only replaces the param of the operations defining it
+	if operations[0].Params["width"] != "100" || operations[1].Params["width"] != nil {
+		t.Errorf("Invalid override: %+v", operations)
+	}
+	for _, operation := range operations {
+		if operation.Params["type"] != "webp" || operation.Params["quality"] != float64(80) {
+			t.Errorf("Invalid output options: %+v", operation.Params)
+		}
+	}
+
+	// The preset itself is not modified
+	if preset, _ := GetPreset("thumbnail"); preset.Operations[0].Params["width"] != float64(200) {
+		t.Errorf("Preset was modified: %+v", preset.Operations[0].Params)
+	}
+
+	if _, _, err := applyPreset("thumbnail", url.Values{"height": {"100"}}, ""); err == nil {
+		t.Error("Expected error for a param not allowed by the preset")
+	}
+	if _, _, err := applyPreset("missing", url.Values{}, ""); err == nil {
+		t.Error("Expected error for an unknown preset")
+	}
+
+	params, negotiated, err = applyPreset("negotiated", url.Values{}, "image/webp,*/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !negotiated || params.Get("operations") != `[{"operation":"convert","ignore_failure":false,"params":{"type":"webp"}}]` {
+		t.Errorf("Invalid negotiated operations: %s", params.Get("operations"))
+	}
+}
+
+func TestPresetsController(t *testing.T) {
+	defer func() { presets = make(map[string]*Preset) }()
+	if err := loadTestPresets(t, testPresets); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(NewServerMux(ServerOptions{PathPrefix: "/"}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/presets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Presets map[string]Preset `json:"presets"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || len(body.Presets) != 2 || body.Presets["thumbnail"].Type != "webp" {
+		t.Errorf("Invalid presets: %s %+v", res.Status, body)
+	}
+
+	res, err = http.Get(ts.URL + "/preset/missing?url=http://example.com/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Invalid status for an unknown preset: %s", res.Status)
+	}
+}
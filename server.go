@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -11,33 +12,44 @@ import (
 )
 
 type ServerOptions struct {
-	Port               int
-	Burst              int
-	Concurrency        int
-	HTTPCacheTTL       int
-	HTTPReadTimeout    int
-	HTTPWriteTimeout   int
-	MaxAllowedSize     int
-	CORS               bool
-	CORSURLs           []string
-	Gzip               bool // deprecated
-	AuthForwarding     bool
-	EnableURLSource    bool
-	EnablePlaceholder  bool
-	EnableURLSignature bool
-	URLSignatureKey    string
-	Address            string
-	PathPrefix         string
-	APIKey             string
-	Mount              string
-	CertFile           string
-	KeyFile            string
-	Authorization      string
-	Placeholder        string
-	ForwardHeaders     []string
-	PlaceholderImage   []byte
-	Endpoints          Endpoints
-	AllowedOrigins     []*url.URL
+	Port                   int
+	Burst                  int
+	Concurrency            int
+	HTTPCacheTTL           int
+	HTTPReadTimeout        int
+	HTTPWriteTimeout       int
+	MaxAllowedSize         int
+	OutboundConnectTimeout int
+	OutboundReadTimeout    int
+	OutboundMaxRedirects   int
+	CORS                   bool
+	CORSURLs               []string
+	Gzip                   bool // deprecated
+	AuthForwarding         bool
+	EnableURLSource        bool
+	EnableURLSink          bool
+	EnablePlaceholder      bool
+	EnableURLSignature     bool
+	URLSignatureKey        string
+	Address                string
+	PathPrefix             string
+	APIKey                 string
+	Mount                  string
+	OutputMount            string
+	IIIFSource             string
+	IIIFMaxSize            int
+	DeepZoom               DeepZoomOptions
+	CertFile               string
+	KeyFile                string
+	Authorization          string
+	Placeholder            string
+	ForwardHeaders         []string
+	PlaceholderImage       []byte
+	Endpoints              Endpoints
+	AllowedOrigins         []*url.URL
+	OutboundCABundle       string
+	OutboundDenyRanges     []*net.IPNet
+	OriginCache            *OriginCache
 }
 
 // Endpoints represents a list of endpoint names to disable.
@@ -89,6 +101,8 @@ func NewServerMux(o ServerOptions) http.Handler {
 	mux.Handle(join(o, "/form"), Middleware(formController, o))
 	mux.Handle(join(o, "/health"), Middleware(healthController, o))
 	mux.Handle(join(o, "/dzsave"), Middleware(DZSave, o))
+	mux.Handle(join(o, JobsPrefix), Middleware(jobsController(o), o))
+	mux.Handle(join(o, JobsPrefix)+"/", Middleware(jobsController(o), o))
 
 	image := ImageMiddleware(o)
 	mux.Handle(join(o, "/resize"), image(Resize))
@@ -109,6 +123,15 @@ func NewServerMux(o ServerOptions) http.Handler {
 	mux.Handle(join(o, "/info"), image(Info))
 	mux.Handle(join(o, "/blur"), image(GaussianBlur))
 	mux.Handle(join(o, "/pipeline"), image(Pipeline))
+	mux.Handle(join(o, PathAPIPrefix)+"/", pathAPIController(o))
+	mux.Handle(join(o, PresetPrefix)+"/", presetController(o))
+	mux.Handle(join(o, PresetsPath), Middleware(presetsController, o))
+	if o.IIIFSource != "" && checkIdentifierSource(o.IIIFSource, o) == nil {
+		mux.Handle(join(o, IIIFPrefix)+"/", imageRouteMiddleware(iiifController(o), o))
+	}
+	if o.DeepZoom.Source != "" && checkIdentifierSource(o.DeepZoom.Source, o) == nil {
+		mux.Handle(join(o, DeepZoomPrefix)+"/", imageRouteMiddleware(deepZoomController(o), o))
+	}
 
 	return mux
 }
@@ -430,3 +430,23 @@ func assertSize(buf []byte, width, height int) error {
 	}
 	return nil
 }
+
+func TestWatermarkImageSVGStorageMaxAllowedSize(t *testing.T) {
+	defer func(p map[string]*StorageProfile) { storageProfiles = p }(storageProfiles)
+	profile := &StorageProfile{Provider: StorageProviderMemory, Container: "images"}
+	if err := profile.init("memory"); err != nil {
+		t.Fatal(err)
+	}
+	storageProfiles = map[string]*StorageProfile{"memory": profile}
+	if err := profile.UploadImage(bytes.Repeat([]byte("<svg/>"), 100), "logo.svg", "images"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	r := httptest.NewRequest(http.MethodPost, "/watermarkimagesvg?storage=memory&image=logo.svg", nil)
+	w := httptest.NewRecorder()
+	imageHandler(w, r, buf, WatermarkImageSVG, ServerOptions{MaxAllowedSize: 64})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Invalid response: %d %s", w.Code, w.Body.String())
+	}
+}
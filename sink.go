@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const SinkQueryKey = "sink"
+
+type ImageSinkType string
+type ImageSinkFactoryFunction func(*SinkConfig) ImageSink
+
+type SinkConfig struct {
+	Type           ImageSinkType
+	OutputMount    string
+	EnableURLSink  bool
+	AllowedOrigins []*url.URL
+}
+
+var imageSinkMap = make(map[ImageSinkType]ImageSink)
+var imageSinkFactoryMap = make(map[ImageSinkType]ImageSinkFactoryFunction)
+var imageSinkPriorityMap = make(map[ImageSinkType]int)
+
+// imageSinkOrder holds the loaded sink types sorted by ascending priority.
+var imageSinkOrder []ImageSinkType
+
+// ImageSink stores the processed image instead of writing it in the response.
+type ImageSink interface {
+	Matches(*http.Request) bool
+	Upload(*http.Request, Image) (UploadResult, error)
+}
+
+// UploadResult describes the object written by an image sink. It is sent as
+// JSON response body once the upload succeeds.
+type UploadResult struct {
+	Provider  ImageSinkType `json:"provider"`
+	Profile   string        `json:"profile,omitempty"`
+	Container string        `json:"container,omitempty"`
+	Key       string        `json:"key"`
+	Size      int           `json:"size"`
+	Mime      string        `json:"mime"`
+	Width     int           `json:"width,omitempty"`
+	Height    int           `json:"height,omitempty"`
+	ETag      string        `json:"etag,omitempty"`
+	VersionID string        `json:"versionId,omitempty"`
+}
+
+// RegisterSink registers an image sink factory. Sinks are matched in
+// ascending priority order, so lower values are evaluated first.
+func RegisterSink(sinkType ImageSinkType, priority int, factory ImageSinkFactoryFunction) {
+	imageSinkFactoryMap[sinkType] = factory
+	imageSinkPriorityMap[sinkType] = priority
+}
+
+func LoadSinks(o ServerOptions) {
+	for name, factory := range imageSinkFactoryMap {
+		imageSinkMap[name] = factory(&SinkConfig{
+			Type:           name,
+			OutputMount:    o.OutputMount,
+			EnableURLSink:  o.EnableURLSink,
+			AllowedOrigins: o.AllowedOrigins,
+		})
+	}
+
+	imageSinkOrder = sortSinkTypes(imageSinkMap)
+}
+
+func sortSinkTypes(sinks map[ImageSinkType]ImageSink) []ImageSinkType {
+	types := make([]ImageSinkType, 0, len(sinks))
+	for name := range sinks {
+		types = append(types, name)
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		pi, pj := imageSinkPriorityMap[types[i]], imageSinkPriorityMap[types[j]]
+		if pi != pj {
+			return pi < pj
+		}
+		return types[i] < types[j]
+	})
+
+	return types
+}
+
+// MatchSink returns the image sink which should store the result of the given
+// request, or nil if the image must be written in the response. The sink can
+// be pinned with the "sink" query param, otherwise the request must match at
+// most one of the loaded sinks.
+func MatchSink(req *http.Request) (ImageSink, error) {
+	if name := req.URL.Query().Get(SinkQueryKey); name != "" {
+		return matchPinnedSink(req, ImageSinkType(name))
+	}
+
+	var matches []ImageSinkType
+	for _, name := range imageSinkOrder {
+		if imageSinkMap[name].Matches(req) {
+			matches = append(matches, name)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return imageSinkMap[matches[0]], nil
+	}
+
+	names := make([]string, len(matches))
+	for i, name := range matches {
+		names[i] = string(name)
+	}
+
+	return nil, NewError(
+		fmt.Sprintf("ambiguous image sink, request matches: %s. Use the sink param to choose one", strings.Join(names, ", ")),
+		BadRequest,
+	)
+}
+
+func matchPinnedSink(req *http.Request, name ImageSinkType) (ImageSink, error) {
+	sink, ok := imageSinkMap[name]
+	if !ok {
+		return nil, NewError(fmt.Sprintf("unknown image sink: %s", name), BadRequest)
+	}
+	if !sink.Matches(req) {
+		return nil, NewError(fmt.Sprintf("missing or invalid params for image sink: %s", name), BadRequest)
+	}
+
+	return sink, nil
+}
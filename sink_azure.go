@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const ImageSinkTypeAzure ImageSinkType = "azure"
+
+type AzureImageSink struct {
+	Config *SinkConfig
+}
+
+func NewAzureImageSink(config *SinkConfig) ImageSink {
+	return &AzureImageSink{Config: config}
+}
+
+func (s *AzureImageSink) Matches(r *http.Request) bool {
+	return parseAzureSASToken(r) == "" && parseAzureBlobOutputKey(r) != ""
+}
+
+func (s *AzureImageSink) Upload(r *http.Request, image Image) (UploadResult, error) {
+	result := UploadResult{
+		Provider:  ImageSinkTypeAzure,
+		Container: parseAzureContainer(r),
+	}
+
+	key, err := buildOutputKey(parseAzureBlobOutputKey(r), r, image)
+	if err != nil {
+		return result, err
+	}
+	result.Key = key
+
+	if err := CheckStorageWrite(string(ImageSinkTypeAzure), result.Container, result.Key); err != nil {
+		return result, err
+	}
+
+	opts, err := newUploadOptions(r, image)
+	if err != nil {
+		return result, err
+	}
+
+	session, err := newAzureSession(result.Container)
+	if err != nil {
+		return result, fmt.Errorf("azure: error getting azure session: %w", err)
+	}
+
+	res, err := uploadAzureBlob(r.Context(), session.NewBlockBlobURL(result.Key), image.Body, opts)
+	if err != nil {
+		return result, fmt.Errorf("azure: uploading image failed: %w", err)
+	}
+
+	result.ETag = string(res.ETag())
+
+	return result, nil
+}
+
+func init() {
+	RegisterSink(ImageSinkTypeAzure, 60, NewAzureImageSink)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const ImageSinkTypeAzureSAS ImageSinkType = "azure_sas"
+
+type AzureSASImageSink struct {
+	Config *SinkConfig
+}
+
+func NewAzureSASImageSink(config *SinkConfig) ImageSink {
+	return &AzureSASImageSink{Config: config}
+}
+
+func (s *AzureSASImageSink) Matches(r *http.Request) bool {
+	return parseAzureSASToken(r) != "" && parseAzureBlobOutputKey(r) != ""
+}
+
+func (s *AzureSASImageSink) Upload(r *http.Request, image Image) (UploadResult, error) {
+	result := UploadResult{
+		Provider:  ImageSinkTypeAzureSAS,
+		Container: parseAzureContainer(r),
+	}
+
+	key, err := buildOutputKey(parseAzureBlobOutputKey(r), r, image)
+	if err != nil {
+		return result, err
+	}
+	result.Key = key
+
+	opts, err := newUploadOptions(r, image)
+	if err != nil {
+		return result, err
+	}
+
+	u, err := assebleBlobURL(
+		parseAzureSASToken(r),
+		os.Getenv("AZURE_ACCOUNT_NAME"),
+		result.Container,
+		result.Key,
+	)
+	if err != nil {
+		return result, fmt.Errorf("azure_sas: error assembling url path: %w", err)
+	}
+
+	blobURL := azblob.NewBlobURL(
+		*u,
+		azblob.NewPipeline(
+			azblob.NewAnonymousCredential(),
+			azblob.PipelineOptions{},
+		),
+	).ToBlockBlobURL()
+
+	res, err := uploadAzureBlob(r.Context(), blobURL, image.Body, opts)
+	if err != nil {
+		return result, fmt.Errorf("azure_sas: uploading image failed: %w", err)
+	}
+
+	result.ETag = string(res.ETag())
+
+	return result, nil
+}
+
+func init() {
+	RegisterSink(ImageSinkTypeAzureSAS, 50, NewAzureSASImageSink)
+}
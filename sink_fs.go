@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ImageSinkTypeFileSystem ImageSinkType = "fs"
+
+type FileSystemImageSink struct {
+	Config *SinkConfig
+}
+
+func NewFileSystemImageSink(config *SinkConfig) ImageSink {
+	return &FileSystemImageSink{config}
+}
+
+func (s *FileSystemImageSink) Matches(r *http.Request) bool {
+	return s.getOutputFileParam(r) != ""
+}
+
+func (s *FileSystemImageSink) Upload(r *http.Request, image Image) (UploadResult, error) {
+	result := UploadResult{Provider: ImageSinkTypeFileSystem}
+	if s.Config.OutputMount == "" {
+		return result, ErrOutputMountDisabled
+	}
+
+	key, err := buildOutputKey(s.getOutputFileParam(r), r, image)
+	if err != nil {
+		return result, err
+	}
+
+	file, err := s.buildPath(key)
+	if err != nil {
+		return result, err
+	}
+	result.Key, _ = filepath.Rel(filepath.Clean(s.Config.OutputMount), file)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return result, err
+	}
+
+	return result, writeFileAtomic(file, image.Body)
+}
+
+// buildPath resolves the output file within the output mount directory.
+func (s *FileSystemImageSink) buildPath(file string) (string, error) {
+	root := filepath.Clean(s.Config.OutputMount)
+	file = filepath.Join(root, file)
+	if file == root || !strings.HasPrefix(file, root+string(filepath.Separator)) {
+		return "", ErrInvalidOutputPath
+	}
+	return file, nil
+}
+
+func (s *FileSystemImageSink) getOutputFileParam(r *http.Request) string {
+	return r.URL.Query().Get("outputFile")
+}
+
+func init() {
+	RegisterSink(ImageSinkTypeFileSystem, 20, NewFileSystemImageSink)
+}
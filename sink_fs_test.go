@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSystemImageSinkUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := NewFileSystemImageSink(&SinkConfig{OutputMount: dir})
+	u, _ := url.Parse("http://foo?outputFile=thumbs/image.jpg")
+	r := &http.Request{Method: http.MethodGet, URL: u}
+
+	result, err := sink.Upload(r, Image{Body: []byte("image"), Mime: "image/jpeg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Provider != ImageSinkTypeFileSystem || result.Key != filepath.Join("thumbs", "image.jpg") {
+		t.Errorf("Invalid upload result: %#v", result)
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "thumbs", "image.jpg"))
+	if err != nil || string(buf) != "image" {
+		t.Fatalf("Invalid stored image: %s (%v)", buf, err)
+	}
+}
+
+func TestFileSystemImageSinkPath(t *testing.T) {
+	sink := &FileSystemImageSink{&SinkConfig{OutputMount: "/data/output"}}
+
+	for _, file := range []string{"../etc/passwd", "../output-other/image.jpg", "/", ""} {
+		if _, err := sink.buildPath(file); err != ErrInvalidOutputPath {
+			t.Errorf("Path must be rejected: %s", file)
+		}
+	}
+
+	file, err := sink.buildPath("/foo/../bar/image.jpg")
+	if err != nil || file != "/data/output/bar/image.jpg" {
+		t.Errorf("Invalid path: %s (%v)", file, err)
+	}
+
+	sink = &FileSystemImageSink{&SinkConfig{}}
+	u, _ := url.Parse("http://foo?outputFile=image.jpg")
+	if _, err := sink.Upload(&http.Request{URL: u}, Image{}); err != ErrOutputMountDisabled {
+		t.Errorf("Upload without output mount must fail: %v", err)
+	}
+}
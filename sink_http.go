@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const ImageSinkTypeHTTP ImageSinkType = "http"
+const OutputURLQueryKey = "outputUrl"
+
+// HTTPImageSink uploads the image with a PUT request, e.g. to a presigned URL.
+type HTTPImageSink struct {
+	Config *SinkConfig
+}
+
+func NewHTTPImageSink(config *SinkConfig) ImageSink {
+	return &HTTPImageSink{config}
+}
+
+func (s *HTTPImageSink) Matches(r *http.Request) bool {
+	return r.URL.Query().Get(OutputURLQueryKey) != ""
+}
+
+func (s *HTTPImageSink) Upload(r *http.Request, image Image) (UploadResult, error) {
+	result := UploadResult{Provider: ImageSinkTypeHTTP}
+	if !s.Config.EnableURLSink {
+		return result, ErrURLSinkDisabled
+	}
+
+	u, err := url.Parse(r.URL.Query().Get(OutputURLQueryKey))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return result, ErrInvalidOutputURL
+	}
+	if shouldRestrictOrigin(u, s.Config.AllowedOrigins) {
+		return result, NewError(fmt.Sprintf("not allowed output URL origin: %s%s", u.Host, u.Path), Forbidden)
+	}
+	result.Container, result.Key = u.Host, u.Path
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, u.String(), bytes.NewReader(image.Body))
+	if err != nil {
+		return result, ErrInvalidOutputURL
+	}
+	req.Header.Set("Content-Type", image.Mime)
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := outboundClient.Do(req)
+	if err != nil {
+		return result, fmt.Errorf("error uploading image: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return result, fmt.Errorf("error uploading image: (status=%d) (url=%s)", res.StatusCode, u.Host+u.Path)
+	}
+
+	result.ETag = res.Header.Get("ETag")
+	result.VersionID = res.Header.Get("X-Amz-Version-Id")
+
+	return result, nil
+}
+
+func init() {
+	RegisterSink(ImageSinkTypeHTTP, 30, NewHTTPImageSink)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHTTPImageSinkUpload(t *testing.T) {
+	var body []byte
+	var contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("Invalid method: %s", r.Method)
+		}
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("X-Amz-Version-Id", "v1")
+	}))
+	defer ts.Close()
+
+	sink := NewHTTPImageSink(&SinkConfig{EnableURLSink: true})
+	u, _ := url.Parse("http://foo?outputUrl=" + url.QueryEscape(ts.URL+"/image.webp?X-Amz-Signature=foo"))
+	r, _ := http.NewRequest(http.MethodGet, u.String(), nil)
+
+	result, err := sink.Upload(r, Image{Body: []byte("image"), Mime: "image/webp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "image" || contentType != "image/webp" {
+		t.Fatalf("Invalid upload: %s (%s)", body, contentType)
+	}
+	if result.Key != "/image.webp" || result.ETag != `"abc"` || result.VersionID != "v1" {
+		t.Errorf("Invalid upload result: %#v", result)
+	}
+}
+
+func TestHTTPImageSinkErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo?outputUrl="+url.QueryEscape(ts.URL), nil)
+	image := Image{Body: []byte("image"), Mime: "image/jpeg"}
+
+	if _, err := NewHTTPImageSink(&SinkConfig{}).Upload(r, image); err != ErrURLSinkDisabled {
+		t.Errorf("Disabled sink must fail: %v", err)
+	}
+	if _, err := NewHTTPImageSink(&SinkConfig{EnableURLSink: true}).Upload(r, image); err == nil {
+		t.Error("Rejected upload must fail")
+	}
+
+	origins := parseOrigins("http://bar")
+	if _, err := NewHTTPImageSink(&SinkConfig{EnableURLSink: true, AllowedOrigins: origins}).Upload(r, image); err == nil {
+		t.Error("Upload to a not allowed origin must fail")
+	}
+
+	r, _ = http.NewRequest(http.MethodGet, "http://foo?outputUrl=file:///etc/passwd", nil)
+	if _, err := NewHTTPImageSink(&SinkConfig{EnableURLSink: true}).Upload(r, image); err != ErrInvalidOutputURL {
+		t.Errorf("Invalid URL must fail: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const ImageSinkTypeS3 ImageSinkType = "s3"
+
+type S3ImageSink struct {
+	Config *SinkConfig
+}
+
+func NewS3ImageSink(config *SinkConfig) ImageSink {
+	return &S3ImageSink{Config: config}
+}
+
+func (s *S3ImageSink) Matches(r *http.Request) bool {
+	return parseOutputStorageProfile(r) == "" && parseS3OutputKey(r) != "" && parseS3Bucket(r) != ""
+}
+
+func (s *S3ImageSink) Upload(r *http.Request, image Image) (UploadResult, error) {
+	result := UploadResult{
+		Provider:  ImageSinkTypeS3,
+		Container: parseS3Bucket(r),
+	}
+
+	key, err := buildOutputKey(parseS3OutputKey(r), r, image)
+	if err != nil {
+		return result, err
+	}
+	result.Key = key
+
+	if err := CheckStorageWrite(string(ImageSinkTypeS3), result.Container, result.Key); err != nil {
+		return result, err
+	}
+
+	opts, err := newUploadOptions(r, image)
+	if err != nil {
+		return result, err
+	}
+
+	sess, err := newS3Session(parseS3Region(r))
+	if err != nil {
+		return result, fmt.Errorf("failed to create s3 session: %w", err)
+	}
+
+	input := newS3PutObjectInput(result.Container, result.Key, image.Body, opts)
+	out, err := s3.New(sess).PutObjectWithContext(r.Context(), input)
+	if err != nil {
+		return result, fmt.Errorf("failed to upload file, %w", err)
+	}
+
+	result.ETag = aws.StringValue(out.ETag)
+	result.VersionID = aws.StringValue(out.VersionId)
+
+	return result, nil
+}
+
+func init() {
+	RegisterSink(ImageSinkTypeS3, 40, NewS3ImageSink)
+}
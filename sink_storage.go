@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+)
+
+const ImageSinkTypeStorage ImageSinkType = "storage"
+
+type StorageImageSink struct {
+	Config *SinkConfig
+}
+
+func NewStorageImageSink(config *SinkConfig) ImageSink {
+	return &StorageImageSink{Config: config}
+}
+
+func (s *StorageImageSink) Matches(r *http.Request) bool {
+	return parseOutputStorageProfile(r) != "" && parseS3OutputKey(r) != ""
+}
+
+func (s *StorageImageSink) Upload(r *http.Request, image Image) (UploadResult, error) {
+	profile, err := GetStorageProfile(parseOutputStorageProfile(r))
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	key, err := buildOutputKey(parseS3OutputKey(r), r, image)
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	opts, err := newUploadOptions(r, image)
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	return profile.Upload(r.Context(), parseOutputStorageContainer(r), key, image.Body, opts)
+}
+
+func parseOutputStorageProfile(request *http.Request) string {
+	return request.URL.Query().Get("outputStorage")
+}
+
+func parseOutputStorageContainer(request *http.Request) string {
+	return request.URL.Query().Get("outputContainer")
+}
+
+func init() {
+	RegisterSink(ImageSinkTypeStorage, 70, NewStorageImageSink)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMatchSink(t *testing.T) {
+	LoadSinks(ServerOptions{})
+
+	cases := []struct {
+		query string
+		sink  string
+	}{
+		{"outputKey=foo.jpg&bucket=bar", "*main.S3ImageSink"},
+		{"azureOutputBlobKey=foo.jpg&azureContainer=bar", "*main.AzureImageSink"},
+		{"azureOutputBlobKey=foo.jpg&azureSASBlobURL=sig", "*main.AzureSASImageSink"},
+		{"outputFile=foo.jpg", "*main.FileSystemImageSink"},
+		{"outputUrl=http://bar/foo.jpg", "*main.HTTPImageSink"},
+		{"outputFile=foo.jpg&outputUrl=http://bar/foo.jpg&sink=http", "*main.HTTPImageSink"},
+		{"outputKey=foo.jpg&bucket=bar&outputStorage=media", "*main.StorageImageSink"},
+	}
+
+	for _, tc := range cases {
+		u, _ := url.Parse("http://foo?" + tc.query)
+		sink, err := MatchSink(&http.Request{Method: http.MethodGet, URL: u})
+		if err != nil {
+			t.Fatalf("Cannot match image sink: %s", err)
+		}
+		if name := fmt.Sprintf("%T", sink); name != tc.sink {
+			t.Errorf("Invalid image sink for %s: %s", tc.query, name)
+		}
+	}
+}
+
+func TestMatchSinkNone(t *testing.T) {
+	LoadSinks(ServerOptions{})
+
+	u, _ := url.Parse("http://foo?s3key=foo.jpg&bucket=bar")
+	sink, err := MatchSink(&http.Request{Method: http.MethodGet, URL: u})
+	if err != nil || sink != nil {
+		t.Fatalf("Request without output params must not match: %v", err)
+	}
+}
+
+func TestMatchSinkAmbiguous(t *testing.T) {
+	LoadSinks(ServerOptions{})
+
+	u, _ := url.Parse("http://foo?outputFile=foo.jpg&outputUrl=http://bar/foo.jpg")
+	if _, err := MatchSink(&http.Request{Method: http.MethodGet, URL: u}); err == nil {
+		t.Fatal("Request matching several sinks must fail")
+	}
+
+	u, _ = url.Parse("http://foo?outputFile=foo.jpg&sink=s3")
+	if _, err := MatchSink(&http.Request{Method: http.MethodGet, URL: u}); err == nil {
+		t.Fatal("Pinned sink without params must fail")
+	}
+}
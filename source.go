@@ -1,10 +1,17 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 )
 
+const SourceQueryKey = "source"
+
 type ImageSourceType string
 type ImageSourceFactoryFunction func(*SourceConfig) ImageSource
 
@@ -16,18 +23,26 @@ type SourceConfig struct {
 	ForwardHeaders []string
 	AllowedOrigins []*url.URL
 	MaxAllowedSize int
+	OriginCache    *OriginCache
 }
 
 var imageSourceMap = make(map[ImageSourceType]ImageSource)
 var imageSourceFactoryMap = make(map[ImageSourceType]ImageSourceFactoryFunction)
+var imageSourcePriorityMap = make(map[ImageSourceType]int)
+
+// imageSourceOrder holds the loaded source types sorted by ascending priority.
+var imageSourceOrder []ImageSourceType
 
 type ImageSource interface {
 	Matches(*http.Request) bool
 	GetImage(*http.Request) ([]byte, error)
 }
 
-func RegisterSource(sourceType ImageSourceType, factory ImageSourceFactoryFunction) {
+// RegisterSource registers an image source factory. Sources are matched in
+// ascending priority order, so lower values are evaluated first.
+func RegisterSource(sourceType ImageSourceType, priority int, factory ImageSourceFactoryFunction) {
 	imageSourceFactoryMap[sourceType] = factory
+	imageSourcePriorityMap[sourceType] = priority
 }
 
 func LoadSources(o ServerOptions) {
@@ -40,15 +55,96 @@ func LoadSources(o ServerOptions) {
 			AllowedOrigins: o.AllowedOrigins,
 			MaxAllowedSize: o.MaxAllowedSize,
 			ForwardHeaders: o.ForwardHeaders,
+			OriginCache:    o.OriginCache,
 		})
 	}
+
+	imageSourceOrder = sortSourceTypes(imageSourceMap)
+}
+
+func sortSourceTypes(sources map[ImageSourceType]ImageSource) []ImageSourceType {
+	types := make([]ImageSourceType, 0, len(sources))
+	for name := range sources {
+		types = append(types, name)
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		pi, pj := imageSourcePriorityMap[types[i]], imageSourcePriorityMap[types[j]]
+		if pi != pj {
+			return pi < pj
+		}
+		return types[i] < types[j]
+	})
+
+	return types
 }
 
-func MatchSource(req *http.Request) ImageSource {
-	for _, source := range imageSourceMap {
-		if source.Matches(req) {
-			return source
+// MatchSource returns the image source which should serve the given request.
+// The source can be pinned with the "source" query param, otherwise the request
+// must match exactly one of the loaded sources.
+func MatchSource(req *http.Request) (ImageSource, error) {
+	if name := req.URL.Query().Get(SourceQueryKey); name != "" {
+		return matchPinnedSource(req, ImageSourceType(name))
+	}
+
+	var matches []ImageSourceType
+	for _, name := range imageSourceOrder {
+		if imageSourceMap[name].Matches(req) {
+			matches = append(matches, name)
 		}
 	}
-	return nil
+
+	switch len(matches) {
+	case 0:
+		return nil, ErrMissingImageSource
+	case 1:
+		return imageSourceMap[matches[0]], nil
+	}
+
+	names := make([]string, len(matches))
+	for i, name := range matches {
+		names[i] = string(name)
+	}
+
+	return nil, NewError(
+		fmt.Sprintf("ambiguous image source, request matches: %s. Use the source param to choose one", strings.Join(names, ", ")),
+		BadRequest,
+	)
+}
+
+func matchPinnedSource(req *http.Request, name ImageSourceType) (ImageSource, error) {
+	source, ok := imageSourceMap[name]
+	if !ok {
+		return nil, NewError(fmt.Sprintf("unknown image source: %s", name), BadRequest)
+	}
+
+	if !source.Matches(req) {
+		return nil, NewError(fmt.Sprintf("missing or invalid params for image source: %s", name), BadRequest)
+	}
+
+	return source, nil
+}
+
+// readAllLimited reads r until EOF. If limit is positive, reading is aborted
+// with ErrImageTooLarge as soon as more than limit bytes have been read.
+func readAllLimited(r io.Reader, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > limit {
+		return nil, ErrImageTooLarge
+	}
+
+	return buf, nil
+}
+
+// exceedsMaxAllowedSize reports whether a known content length is above the
+// configured limit, which allows to fail before reading any data.
+func exceedsMaxAllowedSize(length int64, limit int) bool {
+	return limit > 0 && length > int64(limit)
 }
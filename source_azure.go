@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,34 +20,156 @@ import (
 
 const ImageSourceTypeAzure ImageSourceType = "azure"
 
+// azureDevelopmentConnectionString holds the well-known credentials of the
+// local storage emulator (Azurite), used with UseDevelopmentStorage=true.
+const azureDevelopmentConnectionString = "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;" +
+	"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;" +
+	"BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1"
+
+// azureTokenRetryInterval is the delay before retrying a failed token refresh.
+const azureTokenRetryInterval = 30 * time.Second
+
+// AzureOptions represents the settings of the Azure Blob Storage client.
+type AzureOptions struct {
+	// Endpoint overrides the blob service URL, e.g. for Azurite.
+	Endpoint string
+	// Environment is the name of the Azure cloud, e.g. AZUREUSGOVERNMENTCLOUD.
+	Environment string
+}
+
+// AzureCredentials represents the authentication settings of a storage
+// account: a connection string, a shared key or a service principal.
+type AzureCredentials struct {
+	AccountName      string
+	AccountKey       string
+	ConnectionString string
+	TenantID         string
+	ClientID         string
+	ClientSecret     string
+}
+
+// azureAccount represents the storage account resolved from the credentials.
+type azureAccount struct {
+	Name     string
+	Key      string
+	Endpoint *url.URL
+}
+
 var (
-	credential *azblob.TokenCredential
+	azureMu            sync.Mutex
+	defaultAzureClient = newAzureClient(AzureOptions{}, azureCredentialsFromEnv)
 )
 
 func init() {
-	RegisterSource(ImageSourceTypeAzure, NewAzureImageSource)
+	RegisterSource(ImageSourceTypeAzure, 60, NewAzureImageSource)
+}
+
+// ConfigureAzure sets the options of the Azure client. Credentials are
+// resolved again on the next request.
+func ConfigureAzure(o AzureOptions) {
+	azureMu.Lock()
+	defer azureMu.Unlock()
+	defaultAzureClient = newAzureClient(o, azureCredentialsFromEnv)
+}
+
+func currentAzureClient() *azureClient {
+	azureMu.Lock()
+	defer azureMu.Unlock()
+	return defaultAzureClient
 }
 
 func newAzureSession(container string) (*azblob.ContainerURL, error) {
-	if credential == nil {
-		if err := initAzure(); err != nil {
+	return currentAzureClient().session(container)
+}
+
+// AzureCredentialError returns the last failure refreshing an Azure token,
+// if any. It is reported by the health endpoint.
+func AzureCredentialError() error {
+	if err := currentAzureClient().lastError(); err != nil {
+		return err
+	}
+	return storageProfilesCredentialError()
+}
+
+// azureCredentialsFromEnv reads the credentials of the default client.
+func azureCredentialsFromEnv() AzureCredentials {
+	return AzureCredentials{
+		AccountName:      os.Getenv("AZURE_ACCOUNT_NAME"),
+		AccountKey:       os.Getenv("AZURE_ACCOUNT_KEY"),
+		ConnectionString: os.Getenv("AZURE_STORAGE_CONNECTION_STRING"),
+		TenantID:         os.Getenv("AZURE_TENANT_ID"),
+		ClientID:         os.Getenv("AZURE_CLIENT_ID"),
+		ClientSecret:     os.Getenv("AZURE_CLIENT_SECRET"),
+	}
+}
+
+// azureClient resolves the credential of a storage account on first use and
+// keeps it for the next sessions.
+type azureClient struct {
+	options     AzureOptions
+	credentials func() AzureCredentials
+
+	mu         sync.Mutex
+	credential azblob.Credential
+	endpoint   *url.URL
+	refresher  *azureTokenRefresher
+
+	// The failure of the first token refresh, retried once the retry
+	// interval is elapsed
+	initErr      error
+	initFailedAt time.Time
+}
+
+func newAzureClient(o AzureOptions, credentials func() AzureCredentials) *azureClient {
+	return &azureClient{options: o, credentials: credentials}
+}
+
+func (c *azureClient) session(container string) (*azblob.ContainerURL, error) {
+	c.mu.Lock()
+	if c.credential == nil {
+		if c.initErr != nil && time.Since(c.initFailedAt) < azureTokenRetryInterval {
+			err := c.initErr
+			c.mu.Unlock()
+			return nil, err
+		}
+		if err := c.init(); err != nil {
+			c.mu.Unlock()
 			return nil, err
 		}
 	}
+	credential, endpoint, refresher := c.credential, *c.endpoint, c.refresher
+	c.mu.Unlock()
 
-	accountName := os.Getenv("AZURE_ACCOUNT_NAME")
+	if refresher != nil {
+		if err := refresher.Err(); err != nil {
+			return nil, err
+		}
+	}
 
-	p := azblob.NewPipeline(*credential, azblob.PipelineOptions{
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{
 		Retry: azblob.RetryOptions{
 			TryTimeout: 1 * time.Hour,
 		},
 	})
-	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
-	containerURL := azblob.NewServiceURL(*u, p).NewContainerURL(container)
+	containerURL := azblob.NewServiceURL(endpoint, p).NewContainerURL(container)
 
 	return &containerURL, nil
 }
 
+func (c *azureClient) lastError() error {
+	c.mu.Lock()
+	refresher, initErr := c.refresher, c.initErr
+	c.mu.Unlock()
+
+	if initErr != nil {
+		return initErr
+	}
+	if refresher == nil {
+		return nil
+	}
+	return refresher.LastError()
+}
+
 type AzureImageSource struct {
 	Config *SourceConfig
 }
@@ -59,27 +184,43 @@ func (s *AzureImageSource) Matches(r *http.Request) bool {
 
 func (s *AzureImageSource) GetImage(r *http.Request) ([]byte, error) {
 	key, container := parseAzureBlobKey(r), parseAzureContainer(r)
+	if err := CheckStorageRead(string(ImageSourceTypeAzure), container, key); err != nil {
+		return nil, err
+	}
 
 	session, err := newAzureSession(container)
 	if err != nil {
 		return nil, fmt.Errorf("azure: error getting azure session: %w", err)
 	}
 
-	dlResp, err := session.NewBlobURL(key).
-		Download(r.Context(), 0, 0, azblob.BlobAccessConditions{}, false)
+	data, err := downloadAzureBlob(r.Context(), session.NewBlobURL(key), s.Config.MaxAllowedSize)
 	if err != nil {
-		return nil, fmt.Errorf("azure: error downloading blob: %w", err)
+		return nil, fmt.Errorf("azure: %w", err)
+	}
+
+	return data, nil
+}
+
+// downloadAzureBlob reads a blob, aborting if it exceeds limit bytes.
+func downloadAzureBlob(ctx context.Context, blobURL azblob.BlobURL, limit int) ([]byte, error) {
+	dlResp, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading blob: %w", err)
+	}
+
+	if exceedsMaxAllowedSize(dlResp.ContentLength(), limit) {
+		return nil, fmt.Errorf("error downloading blob: %w", ErrImageTooLarge)
 	}
 
-	data := &bytes.Buffer{}
 	bodyData := dlResp.Body(azblob.RetryReaderOptions{})
 	defer bodyData.Close()
 
-	if _, err := data.ReadFrom(bodyData); err != nil {
-		return nil, fmt.Errorf("azure: error reading data: %w", err)
+	data, err := readAllLimited(bodyData, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error reading data: %w", err)
 	}
 
-	return data.Bytes(), nil
+	return data, nil
 }
 
 func (s *AzureImageSource) DownloadImage(container, key string) ([]byte, error) {
@@ -111,40 +252,34 @@ func (s *AzureImageSource) UploadImage(data []byte, fileKey, container string) e
 		return fmt.Errorf("azure: error getting azure session: %w", err)
 	}
 
-	if _, err := session.
-		NewBlockBlobURL(fileKey).
-		Upload(
-			context.Background(),
-			bytes.NewReader(data),
-			azblob.BlobHTTPHeaders{},
-			azblob.Metadata{},
-			azblob.BlobAccessConditions{},
-		); err != nil {
+	if _, err := uploadAzureBlob(
+		context.Background(),
+		session.NewBlockBlobURL(fileKey),
+		data,
+		newFileUploadOptions(data, fileKey),
+	); err != nil {
 		return fmt.Errorf("azure: uploading image failed: %w", err)
 	}
 
 	return nil
 }
 
-func uploadBufferToAzure(data []byte, outputBlobKey, container string) error {
-	session, err := newAzureSession(container)
+// uploadAzureBlob uploads data with the given content headers, metadata and
+// access tier.
+func uploadAzureBlob(ctx context.Context, blobURL azblob.BlockBlobURL, data []byte, o UploadOptions) (*azblob.BlockBlobUploadResponse, error) {
+	headers, metadata := o.azureHeaders()
+	res, err := blobURL.Upload(ctx, bytes.NewReader(data), headers, metadata, azblob.BlobAccessConditions{})
 	if err != nil {
-		return fmt.Errorf("azure: error getting azure session: %w", err)
+		return nil, err
 	}
 
-	if _, err := session.
-		NewBlockBlobURL(outputBlobKey).
-		Upload(
-			context.Background(),
-			bytes.NewReader(data),
-			azblob.BlobHTTPHeaders{},
-			azblob.Metadata{},
-			azblob.BlobAccessConditions{},
-		); err != nil {
-		return fmt.Errorf("azure: uploading image failed: %w", err)
+	if o.AccessTier != "" {
+		if _, err := blobURL.SetTier(ctx, azblob.AccessTierType(o.AccessTier), azblob.LeaseAccessConditions{}); err != nil {
+			return nil, fmt.Errorf("error setting access tier: %w", err)
+		}
 	}
 
-	return nil
+	return res, nil
 }
 
 func parseAzureBlobKey(request *http.Request) string {
@@ -159,14 +294,32 @@ func parseAzureContainer(request *http.Request) string {
 	return request.URL.Query().Get("azureContainer")
 }
 
-func initAzure() error {
-	azureEnv, err := azure.EnvironmentFromName("AZUREPUBLICCLOUD")
+// init resolves the storage account and its credential. A connection string
+// or an account key enables shared key authentication, otherwise a service
+// principal is used. The lock must be held by the caller.
+func (c *azureClient) init() error {
+	azureEnv, err := azure.EnvironmentFromName(azureEnvironmentName(c.options))
 	if err != nil {
 		return fmt.Errorf("azure/init: error getting environment from name: %s", err)
 	}
 
-	azureTenantID := os.Getenv("AZURE_TENANT_ID")
-	azureOAuthConfig, err := adal.NewOAuthConfig(azureEnv.ActiveDirectoryEndpoint, azureTenantID)
+	credentials := c.credentials()
+	account, err := loadAzureAccount(c.options, azureEnv, credentials)
+	if err != nil {
+		return err
+	}
+
+	if account.Key != "" {
+		credential, err := azblob.NewSharedKeyCredential(account.Name, account.Key)
+		if err != nil {
+			return fmt.Errorf("azure/init: invalid account key: %w", err)
+		}
+
+		c.credential, c.endpoint, c.refresher = credential, account.Endpoint, nil
+		return nil
+	}
+
+	azureOAuthConfig, err := adal.NewOAuthConfig(azureEnv.ActiveDirectoryEndpoint, credentials.TenantID)
 	if err != nil {
 		return fmt.Errorf("azure/init: error in new oauth config: %s", err)
 	}
@@ -175,46 +328,343 @@ func initAzure() error {
 		return fmt.Errorf("azure/init: error configuring oauth for tenant")
 	}
 
-	azureClientID := os.Getenv("AZURE_CLIENT_ID")
-	azureClientSecret := os.Getenv("AZURE_CLIENT_SECRET")
-
 	spt, err := adal.NewServicePrincipalToken(
 		*azureOAuthConfig,
-		azureClientID,
-		azureClientSecret,
+		credentials.ClientID,
+		credentials.ClientSecret,
 		azureEnv.ResourceIdentifiers.Storage,
 	)
 	if err != nil {
 		return fmt.Errorf("azure: error getting service principal auth: %w", err)
 	}
 
-	tokenRefresher := func(spt *adal.ServicePrincipalToken) func(credential azblob.TokenCredential) time.Duration {
-		lock := sync.Mutex{}
-		return func(credential azblob.TokenCredential) time.Duration {
-			// This is possible data race for token refresh so we lock it down.
-			lock.Lock()
-			defer lock.Unlock()
+	refresher := &azureTokenRefresher{token: spt}
+	credential := azblob.NewTokenCredential("", refresher.Refresh)
 
-			if err := spt.Refresh(); err != nil {
-				panic(fmt.Errorf("azure: error refreshing token: %s", err))
-			}
+	// The first refresh runs synchronously, a failure leaves the credential
+	// unset so a later request tries again. The failure is recorded to be
+	// reported by the health endpoint until then.
+	if err := refresher.LastError(); err != nil {
+		c.initErr, c.initFailedAt = err, time.Now()
+		return err
+	}
+
+	c.credential, c.endpoint, c.refresher = credential, account.Endpoint, refresher
+	c.initErr = nil
+	return nil
+}
+
+// azureTokenRefresher refreshes the OAuth token of a service principal.
+// Failures are recorded instead of stopping the process: requests fail only
+// once the current token has expired, and the refresh is retried later.
+type azureTokenRefresher struct {
+	token interface {
+		Refresh() error
+		Token() adal.Token
+	}
+
+	mu        sync.Mutex
+	err       error
+	expiresOn time.Time
+}
 
-			token := spt.Token()
-			credential.SetToken(token.AccessToken)
+// Refresh implements azblob.TokenRefresher.
+func (t *azureTokenRefresher) Refresh(credential azblob.TokenCredential) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-			expiresIn, err := token.ExpiresIn.Int64()
-			if err != nil {
-				panic(err)
+	if err := t.token.Refresh(); err != nil {
+		t.err = fmt.Errorf("azure: error refreshing token: %w", err)
+		debug("%s", t.err)
+
+		if t.expiresOn.IsZero() {
+			// Without any valid token the credential is discarded, stop refreshing
+			return 0
+		}
+		return azureTokenRetryInterval
+	}
+
+	token := t.token.Token()
+	credential.SetToken(token.AccessToken)
+	t.err = nil
+	t.expiresOn = token.Expires()
+
+	// We refresh the token 2 minutes before it expires.
+	if d := time.Until(t.expiresOn) - 2*time.Minute; d > azureTokenRetryInterval {
+		return d
+	}
+	return azureTokenRetryInterval
+}
+
+// LastError returns the error of the last refresh, if it failed.
+func (t *azureTokenRefresher) LastError() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Err returns the refresh error once the current token has expired.
+func (t *azureTokenRefresher) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err != nil && time.Now().After(t.expiresOn) {
+		return t.err
+	}
+	return nil
+}
+
+func azureEnvironmentName(o AzureOptions) string {
+	if o.Environment != "" {
+		return o.Environment
+	}
+	return "AZUREPUBLICCLOUD"
+}
+
+// loadAzureAccount resolves the storage account name, key and blob endpoint.
+// The endpoint option takes precedence over the connection string, which
+// takes precedence over the endpoint of the Azure environment.
+func loadAzureAccount(o AzureOptions, env azure.Environment, credentials AzureCredentials) (azureAccount, error) {
+	account := azureAccount{
+		Name: credentials.AccountName,
+		Key:  credentials.AccountKey,
+	}
+
+	endpoint := ""
+	if credentials.ConnectionString != "" {
+		values, err := parseAzureConnectionString(credentials.ConnectionString)
+		if err != nil {
+			return account, err
+		}
+
+		account.Name, account.Key = values["AccountName"], values["AccountKey"]
+		endpoint = values["BlobEndpoint"]
+		if endpoint == "" && account.Name != "" {
+			protocol, suffix := values["DefaultEndpointsProtocol"], values["EndpointSuffix"]
+			if protocol == "" {
+				protocol = "https"
+			}
+			if suffix == "" {
+				suffix = env.StorageEndpointSuffix
 			}
+			endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, account.Name, suffix)
+		}
+	}
 
-			// We reduce the given time by 2 minutes so instead that token is active 10min we
-			// refresh it after 8.
-			return time.Duration(expiresIn-2*60) * time.Second
+	if o.Endpoint != "" {
+		endpoint = o.Endpoint
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.%s", account.Name, env.StorageEndpointSuffix)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return account, fmt.Errorf("azure/init: invalid blob endpoint: %s", endpoint)
+	}
+	account.Endpoint = u
+
+	return account, nil
+}
+
+// parseAzureConnectionString parses a storage account connection string, such
+// as "AccountName=foo;AccountKey=bar;BlobEndpoint=http://127.0.0.1:10000/foo".
+func parseAzureConnectionString(input string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(input, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("azure/init: invalid connection string")
+		}
+		values[parts[0]] = parts[1]
+	}
+
+	if strings.EqualFold(values["UseDevelopmentStorage"], "true") {
+		return parseAzureConnectionString(azureDevelopmentConnectionString)
+	}
+
+	return values, nil
+}
+
+// azureBlobServiceURL returns the blob service endpoint of the given account,
+// used by SAS authenticated requests which do not need any credential.
+func azureBlobServiceURL(accountName string) (*url.URL, error) {
+	return azureAccountServiceURL(currentAzureClient().options, azureCredentialsFromEnv(), accountName)
+}
+
+// azureAccountServiceURL returns the blob service endpoint of the given
+// account. The configured endpoint is used if it belongs to that account.
+func azureAccountServiceURL(o AzureOptions, credentials AzureCredentials, accountName string) (*url.URL, error) {
+	env, err := azure.EnvironmentFromName(azureEnvironmentName(o))
+	if err != nil {
+		return nil, fmt.Errorf("azure: error getting environment from name: %s", err)
+	}
+
+	account, err := loadAzureAccount(o, env, credentials)
+	if err != nil {
+		return nil, err
+	}
+	if o.Endpoint != "" || account.Name == accountName {
+		return account.Endpoint, nil
+	}
+
+	return url.Parse(fmt.Sprintf("https://%s.blob.%s", accountName, env.StorageEndpointSuffix))
+}
+
+func (s *AzureImageSource) Stat(container, key string) (ObjectInfo, error) {
+	session, err := newAzureSession(container)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("azure: error getting azure session: %w", err)
+	}
+
+	info, err := statAzureBlob(context.Background(), session.NewBlobURL(key), key)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("azure: %w", err)
+	}
+	return info, nil
+}
+
+func (s *AzureImageSource) List(container, prefix string) ([]ObjectInfo, error) {
+	session, err := newAzureSession(container)
+	if err != nil {
+		return nil, fmt.Errorf("azure: error getting azure session: %w", err)
+	}
+
+	objects, err := listAzureBlobs(context.Background(), *session, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("azure: %w", err)
+	}
+	return objects, nil
+}
+
+func (s *AzureImageSource) Delete(container, key string) error {
+	session, err := newAzureSession(container)
+	if err != nil {
+		return fmt.Errorf("azure: error getting azure session: %w", err)
+	}
+
+	if err := deleteAzureBlob(context.Background(), session.NewBlobURL(key)); err != nil {
+		return fmt.Errorf("azure: %w", err)
+	}
+	return nil
+}
+
+func (s *AzureImageSource) Reader(container, key string) (io.ReadCloser, error) {
+	session, err := newAzureSession(container)
+	if err != nil {
+		return nil, fmt.Errorf("azure: error getting azure session: %w", err)
+	}
+
+	reader, err := readAzureBlob(context.Background(), session.NewBlobURL(key))
+	if err != nil {
+		return nil, fmt.Errorf("azure: %w", err)
+	}
+	return reader, nil
+}
+
+func (s *AzureImageSource) Writer(container, key string) (ObjectWriter, error) {
+	session, err := newAzureSession(container)
+	if err != nil {
+		return nil, fmt.Errorf("azure: error getting azure session: %w", err)
+	}
+	return writeAzureBlob(context.Background(), session.NewBlockBlobURL(key), newFileUploadOptions(nil, key)), nil
+}
+
+// statAzureBlob returns the metadata of a blob.
+func statAzureBlob(ctx context.Context, blobURL azblob.BlobURL, key string) (ObjectInfo, error) {
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("error getting blob properties: %w", azureNotFoundError(err))
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         props.ContentLength(),
+		ETag:         string(props.ETag()),
+		ContentType:  props.ContentType(),
+		LastModified: props.LastModified(),
+	}, nil
+}
+
+// listAzureBlobs returns all the blobs whose name starts with the prefix.
+func listAzureBlobs(ctx context.Context, containerURL azblob.ContainerURL, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		res, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return nil, fmt.Errorf("error listing blobs: %w", err)
 		}
-	}(spt)
 
-	c := azblob.NewTokenCredential("", tokenRefresher)
-	credential = &c
+		for _, blob := range res.Segment.BlobItems {
+			info := ObjectInfo{
+				Key:          blob.Name,
+				ETag:         string(blob.Properties.Etag),
+				LastModified: blob.Properties.LastModified,
+			}
+			if blob.Properties.ContentLength != nil {
+				info.Size = *blob.Properties.ContentLength
+			}
+			if blob.Properties.ContentType != nil {
+				info.ContentType = *blob.Properties.ContentType
+			}
+			objects = append(objects, info)
+		}
+		marker = res.NextMarker
+	}
+	return objects, nil
+}
 
+func deleteAzureBlob(ctx context.Context, blobURL azblob.BlobURL) error {
+	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	if err != nil && !errors.Is(azureNotFoundError(err), ErrObjectNotFound) {
+		return fmt.Errorf("error deleting blob: %w", err)
+	}
 	return nil
 }
+
+func readAzureBlob(ctx context.Context, blobURL azblob.BlobURL) (io.ReadCloser, error) {
+	dlResp, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading blob: %w", azureNotFoundError(err))
+	}
+	return dlResp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// writeAzureBlob streams an upload, sent in blocks once large enough.
+func writeAzureBlob(ctx context.Context, blobURL azblob.BlockBlobURL, o UploadOptions) ObjectWriter {
+	return newStorageWriter(func(r io.Reader) error {
+		headers, metadata := o.azureHeaders()
+		if _, err := azblob.UploadStreamToBlockBlob(ctx, r, blobURL, azblob.UploadStreamToBlockBlobOptions{
+			BlobHTTPHeaders: headers,
+			Metadata:        metadata,
+		}); err != nil {
+			return fmt.Errorf("uploading blob failed: %w", err)
+		}
+
+		if o.AccessTier != "" {
+			if _, err := blobURL.SetTier(ctx, azblob.AccessTierType(o.AccessTier), azblob.LeaseAccessConditions{}); err != nil {
+				return fmt.Errorf("error setting access tier: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// azureNotFoundError wraps ErrObjectNotFound when the blob does not exist.
+// Responses to HEAD requests have no body, hence no service code.
+func azureNotFoundError(err error) error {
+	var storageErr azblob.StorageError
+	if !errors.As(err, &storageErr) {
+		return err
+	}
+	if storageErr.ServiceCode() == azblob.ServiceCodeBlobNotFound ||
+		(storageErr.Response() != nil && storageErr.Response().StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, err)
+	}
+	return err
+}
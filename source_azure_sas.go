@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
@@ -14,7 +16,7 @@ import (
 const ImageSourceTypeAzureSAS ImageSourceType = "azure_sas"
 
 func init() {
-	RegisterSource(ImageSourceTypeAzureSAS, NewAzureSASImageSource)
+	RegisterSource(ImageSourceTypeAzureSAS, 50, NewAzureSASImageSource)
 }
 
 type AzureSASImageSource struct {
@@ -53,42 +55,12 @@ func (s *AzureSASImageSource) GetImage(r *http.Request) ([]byte, error) {
 		),
 	)
 
-	dlResp, err := blobURL.Download(r.Context(), 0, 0, azblob.BlobAccessConditions{}, false)
+	data, err := downloadAzureBlob(r.Context(), blobURL, s.Config.MaxAllowedSize)
 	if err != nil {
-		return nil, fmt.Errorf("azure_sas: error downloading blob: %w", err)
-	}
-
-	data := &bytes.Buffer{}
-	bodyData := dlResp.Body(azblob.RetryReaderOptions{})
-	defer bodyData.Close()
-
-	if _, err := data.ReadFrom(bodyData); err != nil {
-		return nil, fmt.Errorf("azure_sas: error reading data: %w", err)
+		return nil, fmt.Errorf("azure_sas: %w", err)
 	}
 
-	return data.Bytes(), nil
-}
-
-func uploadBufferToAzureSAS(data []byte, sasURL *url.URL) error {
-	blobURL := azblob.NewBlobURL(
-		*sasURL,
-		azblob.NewPipeline(
-			azblob.NewAnonymousCredential(),
-			azblob.PipelineOptions{},
-		),
-	).ToBlockBlobURL()
-
-	if _, err := blobURL.Upload(
-		context.Background(),
-		bytes.NewReader(data),
-		azblob.BlobHTTPHeaders{},
-		azblob.Metadata{},
-		azblob.BlobAccessConditions{},
-	); err != nil {
-		return fmt.Errorf("azure_sas: uploading image failed: %w", err)
-	}
-
-	return nil
+	return data, nil
 }
 
 func parseAzureSASToken(request *http.Request) string {
@@ -154,12 +126,11 @@ func (a *AzureSASSource) UploadImage(data []byte, fileKey, container string) err
 		),
 	).ToBlockBlobURL()
 
-	if _, err := blobURL.Upload(
+	if _, err := uploadAzureBlob(
 		context.Background(),
-		bytes.NewReader(data),
-		azblob.BlobHTTPHeaders{},
-		azblob.Metadata{},
-		azblob.BlobAccessConditions{},
+		blobURL,
+		data,
+		newFileUploadOptions(data, fileKey),
 	); err != nil {
 		return fmt.Errorf("azure_sas: uploading image failed: %w", err)
 	}
@@ -168,6 +139,85 @@ func (a *AzureSASSource) UploadImage(data []byte, fileKey, container string) err
 }
 
 func assebleBlobURL(sasToken, accountName, container, blobKey string) (*url.URL, error) {
-	return url.ParseRequestURI(fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s?%s",
-		accountName, container, blobKey, sasToken))
+	endpoint, err := azureBlobServiceURL(accountName)
+	if err != nil {
+		return nil, err
+	}
+
+	return url.ParseRequestURI(fmt.Sprintf("%s/%s/%s?%s",
+		strings.TrimSuffix(endpoint.String(), "/"), container, blobKey, sasToken))
+}
+
+func (a *AzureSASSource) Stat(container, key string) (ObjectInfo, error) {
+	containerURL, err := a.containerURL(container)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := statAzureBlob(context.Background(), containerURL.NewBlobURL(key), key)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("azure_sas: %w", err)
+	}
+	return info, nil
+}
+
+func (a *AzureSASSource) List(container, prefix string) ([]ObjectInfo, error) {
+	containerURL, err := a.containerURL(container)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := listAzureBlobs(context.Background(), containerURL, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("azure_sas: %w", err)
+	}
+	return objects, nil
+}
+
+func (a *AzureSASSource) Delete(container, key string) error {
+	containerURL, err := a.containerURL(container)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteAzureBlob(context.Background(), containerURL.NewBlobURL(key)); err != nil {
+		return fmt.Errorf("azure_sas: %w", err)
+	}
+	return nil
+}
+
+func (a *AzureSASSource) Reader(container, key string) (io.ReadCloser, error) {
+	containerURL, err := a.containerURL(container)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := readAzureBlob(context.Background(), containerURL.NewBlobURL(key))
+	if err != nil {
+		return nil, fmt.Errorf("azure_sas: %w", err)
+	}
+	return reader, nil
+}
+
+func (a *AzureSASSource) Writer(container, key string) (ObjectWriter, error) {
+	containerURL, err := a.containerURL(container)
+	if err != nil {
+		return nil, err
+	}
+	return writeAzureBlob(context.Background(), containerURL.NewBlockBlobURL(key), newFileUploadOptions(nil, key)), nil
+}
+
+// containerURL returns the container URL authorized by the SAS token, which
+// must grant the list permission to list blobs.
+func (a *AzureSASSource) containerURL(container string) (azblob.ContainerURL, error) {
+	endpoint, err := azureBlobServiceURL(a.AccountName)
+	if err != nil {
+		return azblob.ContainerURL{}, fmt.Errorf("azure_sas: error assembling url path: %w", err)
+	}
+
+	u := *endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + container
+	u.RawQuery = strings.TrimPrefix(a.SASToken, "?")
+
+	return azblob.NewContainerURL(u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{})), nil
 }
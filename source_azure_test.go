@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+type fakeAzureToken struct {
+	err       error
+	expiresIn time.Duration
+}
+
+func (t *fakeAzureToken) Refresh() error {
+	return t.err
+}
+
+func (t *fakeAzureToken) Token() adal.Token {
+	return adal.Token{
+		AccessToken: "token",
+		ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(t.expiresIn).Unix(), 10)),
+	}
+}
+
+func TestParseAzureConnectionString(t *testing.T) {
+	values, err := parseAzureConnectionString("DefaultEndpointsProtocol=https;AccountName=foo;AccountKey=a2V5==;EndpointSuffix=core.chinacloudapi.cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["AccountName"] != "foo" || values["AccountKey"] != "a2V5==" || values["EndpointSuffix"] != "core.chinacloudapi.cn" {
+		t.Fatalf("Invalid values: %#v", values)
+	}
+
+	values, _ = parseAzureConnectionString("UseDevelopmentStorage=true")
+	if values["AccountName"] != "devstoreaccount1" || values["BlobEndpoint"] != "http://127.0.0.1:10000/devstoreaccount1" {
+		t.Fatalf("Invalid development values: %#v", values)
+	}
+
+	if _, err := parseAzureConnectionString("AccountName"); err == nil {
+		t.Fatal("Invalid connection string must fail")
+	}
+}
+
+func TestLoadAzureAccount(t *testing.T) {
+	defer os.Unsetenv("AZURE_ACCOUNT_NAME")
+	defer os.Unsetenv("AZURE_STORAGE_CONNECTION_STRING")
+
+	os.Setenv("AZURE_ACCOUNT_NAME", "foo")
+	os.Unsetenv("AZURE_STORAGE_CONNECTION_STRING")
+
+	cases := []struct {
+		options     AzureOptions
+		environment azure.Environment
+		connection  string
+		expected    string
+	}{
+		{AzureOptions{}, azure.PublicCloud, "", "https://foo.blob.core.windows.net"},
+		{AzureOptions{}, azure.USGovernmentCloud, "", "https://foo.blob.core.usgovcloudapi.net"},
+		{AzureOptions{Endpoint: "http://azurite:10000/foo"}, azure.PublicCloud, "", "http://azurite:10000/foo"},
+		{AzureOptions{}, azure.PublicCloud, "AccountName=bar;AccountKey=a2V5", "https://bar.blob.core.windows.net"},
+		{AzureOptions{}, azure.PublicCloud, "UseDevelopmentStorage=true", "http://127.0.0.1:10000/devstoreaccount1"},
+	}
+
+	for _, tc := range cases {
+		os.Setenv("AZURE_STORAGE_CONNECTION_STRING", tc.connection)
+		account, err := loadAzureAccount(tc.options, tc.environment, azureCredentialsFromEnv())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Endpoint.String() != tc.expected {
+			t.Errorf("Invalid endpoint: %s != %s", account.Endpoint, tc.expected)
+		}
+	}
+
+	os.Setenv("AZURE_STORAGE_CONNECTION_STRING", "")
+	if _, err := loadAzureAccount(AzureOptions{Endpoint: "azurite"}, azure.PublicCloud, AzureCredentials{}); err == nil {
+		t.Fatal("Invalid endpoint must fail")
+	}
+}
+
+func TestAssembleBlobURL(t *testing.T) {
+	ConfigureAzure(AzureOptions{})
+	u, err := assebleBlobURL("sig=foo", "account", "container", "dir/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "https://account.blob.core.windows.net/container/dir/image.jpg?sig=foo" {
+		t.Errorf("Invalid blob URL: %s", u)
+	}
+
+	ConfigureAzure(AzureOptions{Endpoint: "http://127.0.0.1:10000/account/"})
+	defer ConfigureAzure(AzureOptions{})
+
+	u, _ = assebleBlobURL("sig=foo", "account", "container", "image.jpg")
+	if u.String() != "http://127.0.0.1:10000/account/container/image.jpg?sig=foo" {
+		t.Errorf("Invalid blob URL: %s", u)
+	}
+}
+
+func TestAzureTokenRefresher(t *testing.T) {
+	token := &fakeAzureToken{err: errors.New("unavailable")}
+	refresher := &azureTokenRefresher{token: token}
+	credential := azblob.NewTokenCredential("", nil)
+
+	// Without any valid token the refresher stops and reports the error
+	if d := refresher.Refresh(credential); d != 0 {
+		t.Errorf("Invalid refresh interval: %s", d)
+	}
+	if refresher.Err() == nil || refresher.LastError() == nil {
+		t.Fatal("Initial refresh error must be reported")
+	}
+
+	token.err, token.expiresIn = nil, time.Hour
+	if d := refresher.Refresh(credential); d < 55*time.Minute || d > time.Hour {
+		t.Errorf("Invalid refresh interval: %s", d)
+	}
+	if credential.Token() != "token" || refresher.LastError() != nil {
+		t.Fatal("Token must be set after a successful refresh")
+	}
+
+	// Failures are retried while the current token is still valid
+	token.err = errors.New("unavailable")
+	if d := refresher.Refresh(credential); d != azureTokenRetryInterval {
+		t.Errorf("Invalid retry interval: %s", d)
+	}
+	if refresher.LastError() == nil {
+		t.Fatal("Refresh error must be recorded")
+	}
+	if refresher.Err() != nil {
+		t.Fatal("Requests must not fail while the token is valid")
+	}
+
+	refresher.expiresOn = time.Now().Add(-time.Second)
+	if refresher.Err() == nil {
+		t.Fatal("Requests must fail once the token expired")
+	}
+}
+
+func TestAzureClientInitError(t *testing.T) {
+	var calls int
+	client := newAzureClient(AzureOptions{}, func() AzureCredentials {
+		calls++
+		return AzureCredentials{}
+	})
+
+	// A failed first token refresh is reported and not retried right away
+	initErr := errors.New("azure: error refreshing token: unavailable")
+	client.initErr, client.initFailedAt = initErr, time.Now()
+	if _, err := client.session("images"); err != initErr {
+		t.Errorf("Invalid session error: %v", err)
+	}
+	if calls != 0 {
+		t.Error("The credential must not be initialized before the retry interval")
+	}
+	if err := client.lastError(); err != initErr {
+		t.Errorf("Initial refresh error must be reported: %v", err)
+	}
+
+	client.initFailedAt = time.Now().Add(-azureTokenRetryInterval)
+	_, _ = client.session("images")
+	if calls != 1 {
+		t.Error("The credential must be initialized again after the retry interval")
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"io/ioutil"
+	"io"
 	"net/http"
 	"strings"
 )
@@ -9,6 +9,10 @@ import (
 const formFieldName = "file"
 const maxMemory int64 = 1024 * 1024 * 64
 
+// maxFormOverhead is the size allowed for the multipart encoding and the
+// other fields of a form, on top of the image size limit.
+const maxFormOverhead = 1024 * 1024
+
 const ImageSourceTypeBody ImageSourceType = "payload"
 
 type BodyImageSource struct {
@@ -25,18 +29,20 @@ func (s *BodyImageSource) Matches(r *http.Request) bool {
 
 func (s *BodyImageSource) GetImage(r *http.Request) ([]byte, error) {
 	if isFormBody(r) {
-		return readFormBody(r)
+		return readFormBody(r, s.Config.MaxAllowedSize)
+	}
+	if exceedsMaxAllowedSize(r.ContentLength, s.Config.MaxAllowedSize) {
+		return nil, ErrImageTooLarge
 	}
-	return readRawBody(r)
+	return readRawBody(r, s.Config.MaxAllowedSize)
 }
 
 func isFormBody(r *http.Request) bool {
 	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/")
 }
 
-func readFormBody(r *http.Request) ([]byte, error) {
-	err := r.ParseMultipartForm(maxMemory)
-	if err != nil {
+func readFormBody(r *http.Request, limit int) ([]byte, error) {
+	if err := parseFormBody(r, limit, maxFormOverhead); err != nil {
 		return nil, err
 	}
 
@@ -46,18 +52,63 @@ func readFormBody(r *http.Request) ([]byte, error) {
 	}
 	defer file.Close()
 
-	buf, err := ioutil.ReadAll(file)
-	if len(buf) == 0 {
+	buf, err := readAllLimited(file, limit)
+	if err == nil && len(buf) == 0 {
 		err = ErrEmptyBody
 	}
 
 	return buf, err
 }
 
-func readRawBody(r *http.Request) ([]byte, error) {
-	return ioutil.ReadAll(r.Body)
+// parseFormBody parses a multipart body, which is read entirely before the
+// image can be. If limit is positive, the body is bounded to limit plus the
+// given overhead while it is read.
+func parseFormBody(r *http.Request, limit, overhead int) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+
+	var body *limitedBody
+	if limit > 0 {
+		if exceedsMaxAllowedSize(r.ContentLength, limit+overhead) {
+			return ErrImageTooLarge
+		}
+		body = &limitedBody{ReadCloser: r.Body, limit: int64(limit + overhead)}
+		r.Body = body
+	}
+
+	err := r.ParseMultipartForm(maxMemory)
+	if err != nil && body != nil && body.exceeded() {
+		return ErrImageTooLarge
+	}
+	return err
+}
+
+// limitedBody fails reading a request body once more than limit bytes have
+// been read.
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.exceeded() {
+		return n, ErrImageTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) exceeded() bool {
+	return b.read > b.limit
+}
+
+func readRawBody(r *http.Request, limit int) ([]byte, error) {
+	return readAllLimited(r.Body, limit)
 }
 
 func init() {
-	RegisterSource(ImageSourceTypeBody, NewBodyImageSource)
+	RegisterSource(ImageSourceTypeBody, 10, NewBodyImageSource)
 }
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -49,6 +53,24 @@ func TestBodyImageSource(t *testing.T) {
 	}
 }
 
+func TestBodyImageSourceExceedsMaximumAllowedSize(t *testing.T) {
+	source := NewBodyImageSource(&SourceConfig{MaxAllowedSize: 1023})
+
+	file, _ := os.Open("testdata/1024bytes")
+	defer file.Close()
+
+	r, _ := http.NewRequest(http.MethodPost, "http://foo/bar", file)
+	if _, err := source.GetImage(r); err != ErrImageTooLarge {
+		t.Fatalf("Invalid error: %v", err)
+	}
+
+	buf, _ := ioutil.ReadFile("testdata/1024bytes")
+	r, _ = http.NewRequest(http.MethodPost, "http://foo/bar", bytes.NewReader(buf))
+	if _, err := source.GetImage(r); err != ErrImageTooLarge {
+		t.Fatalf("Invalid error: %v", err)
+	}
+}
+
 func testReadBody(t *testing.T) {
 	var body []byte
 	var err error
@@ -76,3 +98,35 @@ func testReadBody(t *testing.T) {
 		t.Error("Invalid response body")
 	}
 }
+
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestBodyImageSourceFormExceedsMaximumAllowedSize(t *testing.T) {
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	_ = mw.WriteField("padding", strings.Repeat("x", 4*maxFormOverhead))
+	part, _ := mw.CreateFormFile(formFieldName, "image.jpg")
+	_, _ = part.Write([]byte("image"))
+	_ = mw.Close()
+
+	body := &countingReader{r: bytes.NewReader(form.Bytes())}
+	r, _ := http.NewRequest(http.MethodPost, "http://foo/bar", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	source := NewBodyImageSource(&SourceConfig{MaxAllowedSize: 1024})
+	if _, err := source.GetImage(r); err != ErrImageTooLarge {
+		t.Fatalf("Invalid error: %v", err)
+	}
+	if body.read >= form.Len() {
+		t.Errorf("The form must not be read entirely: %d bytes", body.read)
+	}
+}
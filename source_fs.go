@@ -1,8 +1,8 @@
 package main
 
 import (
-	"io/ioutil"
 	"net/http"
+	"os"
 	"path"
 	"strings"
 )
@@ -35,16 +35,36 @@ func (s *FileSystemImageSource) GetImage(r *http.Request) ([]byte, error) {
 	return s.read(file)
 }
 
+// buildPath resolves the file within the mount directory. Without mount
+// directory, no file can be read.
 func (s *FileSystemImageSource) buildPath(file string) (string, error) {
-	file = path.Clean(path.Join(s.Config.MountPath, file))
-	if !strings.HasPrefix(file, s.Config.MountPath) {
+	if s.Config.MountPath == "" {
+		return "", ErrMountDisabled
+	}
+
+	root := path.Clean(s.Config.MountPath)
+	file = path.Join(root, file)
+	if file == root || !strings.HasPrefix(file, strings.TrimSuffix(root, "/")+"/") {
 		return "", ErrInvalidFilePath
 	}
 	return file, nil
 }
 
 func (s *FileSystemImageSource) read(file string) ([]byte, error) {
-	buf, err := ioutil.ReadFile(file)
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, ErrInvalidFilePath
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && exceedsMaxAllowedSize(info.Size(), s.Config.MaxAllowedSize) {
+		return nil, ErrImageTooLarge
+	}
+
+	buf, err := readAllLimited(f, s.Config.MaxAllowedSize)
+	if err == ErrImageTooLarge {
+		return nil, err
+	}
 	if err != nil {
 		return nil, ErrInvalidFilePath
 	}
@@ -56,5 +76,5 @@ func (s *FileSystemImageSource) getFileParam(r *http.Request) string {
 }
 
 func init() {
-	RegisterSource(ImageSourceTypeFileSystem, NewFileSystemImageSource)
+	RegisterSource(ImageSourceTypeFileSystem, 20, NewFileSystemImageSource)
 }
@@ -36,3 +36,35 @@ func TestFileSystemImageSource(t *testing.T) {
 		t.Error("Invalid response body")
 	}
 }
+
+func TestFileSystemImageSourceExceedsMaximumAllowedSize(t *testing.T) {
+	source := NewFileSystemImageSource(&SourceConfig{MountPath: "testdata", MaxAllowedSize: 1023})
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?file=1024bytes", nil)
+	if _, err := source.GetImage(r); err != ErrImageTooLarge {
+		t.Fatalf("Invalid error: %v", err)
+	}
+
+	r, _ = http.NewRequest(http.MethodGet, "http://foo/bar?file=missing.jpg", nil)
+	if _, err := source.GetImage(r); err != ErrInvalidFilePath {
+		t.Fatalf("Invalid error: %v", err)
+	}
+}
+
+func TestFileSystemImageSourceBuildPath(t *testing.T) {
+	source := &FileSystemImageSource{&SourceConfig{MountPath: "/data/images"}}
+	if file, err := source.buildPath("photos/../beach.jpg"); err != nil || file != "/data/images/beach.jpg" {
+		t.Errorf("Invalid path: %s %v", file, err)
+	}
+
+	for _, file := range []string{"", "../images-private/a.jpg", "../../etc/passwd", "/../../etc/passwd"} {
+		if p, err := source.buildPath(file); err == nil {
+			t.Errorf("Expected error for %q: %s", file, p)
+		}
+	}
+
+	source = &FileSystemImageSource{&SourceConfig{}}
+	if _, err := source.buildPath("/etc/passwd"); err != ErrMountDisabled {
+		t.Errorf("Invalid error without mount directory: %v", err)
+	}
+}
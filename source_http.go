@@ -2,10 +2,8 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 )
 
@@ -36,43 +34,97 @@ func (s *HTTPImageSource) GetImage(req *http.Request) ([]byte, error) {
 }
 
 func (s *HTTPImageSource) fetchImage(url *url.URL, ireq *http.Request) ([]byte, error) {
-	// Check remote image size by fetching HTTP Headers
-	if s.Config.MaxAllowedSize > 0 {
-		req := newHTTPRequest(s, ireq, http.MethodHead, url)
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching image http headers: %v", err)
-		}
-		_ = res.Body.Close()
-		if res.StatusCode < 200 && res.StatusCode > 206 {
-			return nil, fmt.Errorf("error fetching image http headers: (status=%d) (url=%s)", res.StatusCode, req.URL.String())
-		}
+	req := newHTTPRequest(s, ireq, http.MethodGet, url)
 
-		contentLength, _ := strconv.Atoi(res.Header.Get("Content-Length"))
-		if contentLength > s.Config.MaxAllowedSize {
-			return nil, fmt.Errorf("Content-Length %d exceeds maximum allowed %d bytes", contentLength, s.Config.MaxAllowedSize)
+	// Serve fresh cached images, or revalidate stale ones with the origin
+	cache := s.Config.OriginCache
+	var key string
+	var cached OriginCacheEntry
+	var isCached bool
+	if cache != nil {
+		key = originCacheKey(req, s.Config.ForwardHeaders)
+		cached, isCached = cache.Lookup(key)
+		if isCached && cached.Fresh(cache.MaxAge()) {
+			if buf, err := s.readCached(key); err == nil {
+				return buf, nil
+			}
+			isCached = false
+		}
+		if isCached && cached.Revalidable() {
+			setConditionalHeaders(req, cached)
 		}
 	}
 
-	// Perform the request using the default client
-	req := newHTTPRequest(s, ireq, http.MethodGet, url)
-	res, err := http.DefaultClient.Do(req)
+	// Perform the request using the shared outbound client
+	res, err := outboundClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error downloading image: %v", err)
+		return nil, fmt.Errorf("error downloading image: %w", err)
 	}
 	defer res.Body.Close()
+
+	if isCached && res.StatusCode == http.StatusNotModified {
+		if buf, err := s.readCached(key); err == nil {
+			if err := cache.Refresh(key, res.Header); err != nil {
+				debug("%s", err)
+			}
+			return buf, nil
+		}
+		// The cached copy is gone, fetch the image again unconditionally
+		return s.fetchImage(url, ireq)
+	}
+
 	if res.StatusCode != 200 {
 		return nil, fmt.Errorf("error downloading image: (status=%d) (url=%s)", res.StatusCode, req.URL.String())
 	}
 
-	// Read the body
-	buf, err := ioutil.ReadAll(res.Body)
+	// Fail early if the origin announces a body above the limit
+	if exceedsMaxAllowedSize(res.ContentLength, s.Config.MaxAllowedSize) {
+		return nil, fmt.Errorf("error downloading image: %w: Content-Length %d exceeds maximum allowed %d bytes (url=%s)",
+			ErrImageTooLarge, res.ContentLength, s.Config.MaxAllowedSize, req.URL.String())
+	}
+
+	// Read the body, enforcing the limit for chunked or misreported responses
+	buf, err := readAllLimited(res.Body, s.Config.MaxAllowedSize)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create image from response body: %s (url=%s)", req.URL.String(), err)
+		return nil, fmt.Errorf("unable to create image from response body: %w (url=%s)", err, req.URL.String())
+	}
+
+	if cache != nil && isCacheableResponse(res) {
+		if err := cache.Store(key, req.URL.String(), buf, res.Header); err != nil {
+			debug("%s", err)
+		}
+	}
+
+	return buf, nil
+}
+
+// readCached reads an image from the origin cache, discarding cached copies
+// which do not fit in the currently configured size limit.
+func (s *HTTPImageSource) readCached(key string) ([]byte, error) {
+	buf, err := s.Config.OriginCache.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	if exceedsMaxAllowedSize(int64(len(buf)), s.Config.MaxAllowedSize) {
+		s.Config.OriginCache.Remove(key)
+		return nil, ErrImageTooLarge
 	}
 	return buf, nil
 }
 
+func setConditionalHeaders(req *http.Request, entry OriginCacheEntry) {
+	if entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+}
+
+func isCacheableResponse(res *http.Response) bool {
+	return !strings.Contains(strings.ToLower(res.Header.Get("Cache-Control")), "no-store")
+}
+
 func (s *HTTPImageSource) setAuthorizationHeader(req *http.Request, ireq *http.Request) {
 	auth := s.Config.Authorization
 	if auth == "" {
@@ -149,5 +201,5 @@ func shouldRestrictOrigin(url *url.URL, origins []*url.URL) bool {
 }
 
 func init() {
-	RegisterSource(ImageSourceTypeHTTP, NewHTTPImageSource)
+	RegisterSource(ImageSourceTypeHTTP, 30, NewHTTPImageSource)
 }
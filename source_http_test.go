@@ -297,6 +297,54 @@ func TestHttpImageSourceExceedsMaximumAllowedLength(t *testing.T) {
 	fakeHandler(w, r)
 }
 
+func TestHttpImageSourceExceedsMaximumAllowedLengthChunked(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixture1024Bytes)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before writing the body forces a chunked response without Content-Length
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(buf)
+	}))
+	defer ts.Close()
+
+	source := NewHTTPImageSource(&SourceConfig{
+		MaxAllowedSize: 1023,
+	})
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+	body, err := source.GetImage(r)
+	if err == nil {
+		t.Fatalf("It should not allow a chunked response exceeding maximum allowed size")
+	}
+	if len(body) != 0 {
+		t.Fatalf("Body must be empty, got %d bytes", len(body))
+	}
+	if code := ToError(err, BadRequest).HTTPCode(); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Invalid error status: %d", code)
+	}
+}
+
+func TestHttpImageSourceMaximumAllowedLength(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixture1024Bytes)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(buf)
+	}))
+	defer ts.Close()
+
+	source := NewHTTPImageSource(&SourceConfig{
+		MaxAllowedSize: 1024,
+	})
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+	body, err := source.GetImage(r)
+	if err != nil {
+		t.Fatalf("Error while reading the body: %s", err)
+	}
+	if len(body) != len(buf) {
+		t.Error("Invalid response body")
+	}
+}
+
 func TestShouldRestrictOrigin(t *testing.T) {
 	plainOrigins := parseOrigins(
 		"https://example.org",
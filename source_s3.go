@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -16,18 +21,80 @@ import (
 const ImageSourceTypeS3 ImageSourceType = "s3"
 
 func init() {
-	RegisterSource(ImageSourceTypeS3, NewS3ImageSource)
+	RegisterSource(ImageSourceTypeS3, 40, NewS3ImageSource)
 }
 
+// S3Options configures the S3 client used by sources, uploads and dz files.
+type S3Options struct {
+	// Endpoint overrides the AWS endpoint, e.g. to use MinIO or Ceph.
+	Endpoint string
+	// ForcePathStyle uses path-style addressing (endpoint/bucket/key)
+	// instead of virtual hosted buckets (bucket.endpoint/key).
+	ForcePathStyle bool
+}
+
+var (
+	s3Options     S3Options
+	s3SessionsMu  sync.Mutex
+	s3SessionsMap = make(map[string]*session.Session)
+)
+
+// ConfigureS3 sets the S3 client options and drops any cached session.
+func ConfigureS3(o S3Options) {
+	s3SessionsMu.Lock()
+	defer s3SessionsMu.Unlock()
+
+	s3Options = o
+	s3SessionsMap = make(map[string]*session.Session)
+}
+
+// newS3Session returns the session for the given region. Sessions are cached,
+// as they are safe for concurrent use and expensive to create.
 func newS3Session(region string) (*session.Session, error) {
-	return session.NewSession(&aws.Config{
-		Region: &region,
-		Credentials: credentials.NewStaticCredentials(
-			os.Getenv("S3_KEY"),
-			os.Getenv("S3_KEY_SECRET"),
-			"",
-		),
+	s3SessionsMu.Lock()
+	defer s3SessionsMu.Unlock()
+
+	if sess, ok := s3SessionsMap[region]; ok {
+		return sess, nil
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *newS3Config(region, s3Options),
+		SharedConfigState: session.SharedConfigEnable,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	s3SessionsMap[region] = sess
+	return sess, nil
+}
+
+// newS3Config builds the AWS config for the given region. Static credentials
+// from S3_KEY and S3_KEY_SECRET take precedence, otherwise the default AWS
+// credential chain is used: environment, shared profiles, web identity (IRSA)
+// and container or instance roles.
+func newS3Config(region string, o S3Options) *aws.Config {
+	config := aws.NewConfig()
+	if region != "" {
+		config.WithRegion(region)
+	}
+	if o.Endpoint != "" {
+		config.WithEndpoint(o.Endpoint)
+	}
+	if o.ForcePathStyle {
+		config.WithS3ForcePathStyle(true)
+	}
+
+	if key := os.Getenv("S3_KEY"); key != "" {
+		config.WithCredentials(credentials.NewStaticCredentials(
+			key,
+			os.Getenv("S3_KEY_SECRET"),
+			os.Getenv("S3_SESSION_TOKEN"),
+		))
+	}
+
+	return config
 }
 
 type S3ImageSource struct {
@@ -44,43 +111,39 @@ func (s *S3ImageSource) Matches(r *http.Request) bool {
 
 func (s *S3ImageSource) GetImage(req *http.Request) ([]byte, error) {
 	key, bucket, region := parseS3Key(req), parseS3Bucket(req), parseS3Region(req)
+	if err := CheckStorageRead(string(ImageSourceTypeS3), bucket, key); err != nil {
+		return nil, err
+	}
 
 	session, err := newS3Session(region)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create s3 session: %w", err)
 	}
 
-	buffer := aws.NewWriteAtBuffer([]byte{})
-	buffer.GrowthCoeff = 1.5
-	if _, err := s3manager.NewDownloader(session).
-		Download(
-			buffer,
-			&s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    &key,
-			}); err != nil {
-		return nil, fmt.Errorf("failed to download file, %w", err)
-	}
-
-	return buffer.Bytes(), nil
+	return getS3Object(req.Context(), session, bucket, key, s.Config.MaxAllowedSize)
 }
 
-func uploadBufferToS3(buffer []byte, outputKey, bucket, region string) error {
-	sess, err := newS3Session(region)
+// getS3Object reads an object, aborting if it exceeds limit bytes.
+func getS3Object(ctx context.Context, sess *session.Session, bucket, key string, limit int) ([]byte, error) {
+	out, err := s3.New(sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create s3 session: %w", err)
+		return nil, fmt.Errorf("failed to download file, %w", err)
 	}
+	defer out.Body.Close()
 
-	if _, err := s3manager.NewUploader(sess).
-		Upload(&s3manager.UploadInput{
-			Bucket: aws.String(bucket),
-			Key:    &outputKey,
-			Body:   bytes.NewReader(buffer),
-		}); err != nil {
-		return fmt.Errorf("failed to upload file, %w", err)
+	if exceedsMaxAllowedSize(aws.Int64Value(out.ContentLength), limit) {
+		return nil, fmt.Errorf("failed to download file, %w", ErrImageTooLarge)
 	}
 
-	return nil
+	buf, err := readAllLimited(out.Body, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file, %w", err)
+	}
+
+	return buf, nil
 }
 
 func parseS3Key(request *http.Request) string {
@@ -130,14 +193,163 @@ func (s *S3Source) UploadImage(data []byte, fileKey, container string) error {
 		return fmt.Errorf("failed to create s3 session: %w", err)
 	}
 
-	if _, err := s3manager.NewUploader(sess).
-		Upload(&s3manager.UploadInput{
-			Bucket: aws.String(container),
-			Key:    &fileKey,
-			Body:   bytes.NewReader(data),
-		}); err != nil {
+	input := newS3PutObjectInput(container, fileKey, data, newFileUploadOptions(data, fileKey))
+	if _, err := s3.New(sess).PutObject(input); err != nil {
 		return fmt.Errorf("failed to upload file, %w", err)
 	}
 
 	return nil
 }
+
+// newS3PutObjectInput builds the request uploading data with the given options.
+func newS3PutObjectInput(bucket, key string, data []byte, o UploadOptions) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}
+	o.applyS3(input)
+	return input
+}
+
+func (s *S3Source) Stat(container, key string) (ObjectInfo, error) {
+	sess, err := newS3Session(s.Zone)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to create s3 session: %w", err)
+	}
+	return statS3Object(context.Background(), sess, container, key)
+}
+
+func (s *S3Source) List(container, prefix string) ([]ObjectInfo, error) {
+	sess, err := newS3Session(s.Zone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 session: %w", err)
+	}
+	return listS3Objects(context.Background(), sess, container, prefix)
+}
+
+func (s *S3Source) Delete(container, key string) error {
+	sess, err := newS3Session(s.Zone)
+	if err != nil {
+		return fmt.Errorf("failed to create s3 session: %w", err)
+	}
+	return deleteS3Object(context.Background(), sess, container, key)
+}
+
+func (s *S3Source) Reader(container, key string) (io.ReadCloser, error) {
+	sess, err := newS3Session(s.Zone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 session: %w", err)
+	}
+	return readS3Object(context.Background(), sess, container, key)
+}
+
+func (s *S3Source) Writer(container, key string) (ObjectWriter, error) {
+	sess, err := newS3Session(s.Zone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 session: %w", err)
+	}
+	return writeS3Object(context.Background(), sess, container, key, newFileUploadOptions(nil, key)), nil
+}
+
+// statS3Object returns the metadata of an object.
+func statS3Object(ctx context.Context, sess *session.Session, bucket, key string) (ObjectInfo, error) {
+	out, err := s3.New(sess).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat file, %w", s3NotFoundError(err))
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(out.ContentLength),
+		ETag:         aws.StringValue(out.ETag),
+		ContentType:  aws.StringValue(out.ContentType),
+		LastModified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+// listS3Objects returns all the objects whose key starts with the prefix.
+func listS3Objects(ctx context.Context, sess *session.Session, bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s3.New(sess).ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				ETag:         aws.StringValue(object.ETag),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files, %w", err)
+	}
+	return objects, nil
+}
+
+func deleteS3Object(ctx context.Context, sess *session.Session, bucket, key string) error {
+	if _, err := s3.New(sess).DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return fmt.Errorf("failed to delete file, %w", err)
+	}
+	return nil
+}
+
+func readS3Object(ctx context.Context, sess *session.Session, bucket, key string) (io.ReadCloser, error) {
+	out, err := s3.New(sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file, %w", s3NotFoundError(err))
+	}
+	return out.Body, nil
+}
+
+// writeS3Object streams an upload, sent in parts once large enough.
+func writeS3Object(ctx context.Context, sess *session.Session, bucket, key string, o UploadOptions) ObjectWriter {
+	return newStorageWriter(func(r io.Reader) error {
+		if _, err := s3manager.NewUploader(sess).UploadWithContext(ctx, newS3UploadInput(bucket, key, r, o)); err != nil {
+			return fmt.Errorf("failed to upload file, %w", err)
+		}
+		return nil
+	})
+}
+
+// newS3UploadInput builds the streamed upload of body with the given options.
+func newS3UploadInput(bucket, key string, body io.Reader, o UploadOptions) *s3manager.UploadInput {
+	put := newS3PutObjectInput(bucket, key, nil, o)
+
+	return &s3manager.UploadInput{
+		Bucket:               put.Bucket,
+		Key:                  put.Key,
+		Body:                 body,
+		ContentType:          put.ContentType,
+		CacheControl:         put.CacheControl,
+		ContentDisposition:   put.ContentDisposition,
+		ACL:                  put.ACL,
+		StorageClass:         put.StorageClass,
+		ServerSideEncryption: put.ServerSideEncryption,
+		SSEKMSKeyId:          put.SSEKMSKeyId,
+		Metadata:             put.Metadata,
+		Tagging:              put.Tagging,
+	}
+}
+
+// s3NotFoundError wraps ErrObjectNotFound when the object does not exist.
+func s3NotFoundError(err error) error {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestNewS3Config(t *testing.T) {
+	config := newS3Config("eu-west-1", S3Options{
+		Endpoint:       "http://localhost:9000",
+		ForcePathStyle: true,
+	})
+
+	if aws.StringValue(config.Region) != "eu-west-1" {
+		t.Errorf("Invalid region: %s", aws.StringValue(config.Region))
+	}
+	if aws.StringValue(config.Endpoint) != "http://localhost:9000" {
+		t.Errorf("Invalid endpoint: %s", aws.StringValue(config.Endpoint))
+	}
+	if !aws.BoolValue(config.S3ForcePathStyle) {
+		t.Error("Path-style addressing must be enabled")
+	}
+
+	config = newS3Config("", S3Options{})
+	if config.Region != nil || config.Endpoint != nil || config.S3ForcePathStyle != nil {
+		t.Error("Empty options must keep the AWS defaults")
+	}
+}
+
+func TestNewS3ConfigCredentials(t *testing.T) {
+	defer os.Unsetenv("S3_KEY")
+	defer os.Unsetenv("S3_KEY_SECRET")
+	defer os.Unsetenv("S3_SESSION_TOKEN")
+
+	os.Unsetenv("S3_KEY")
+	if config := newS3Config("eu-west-1", S3Options{}); config.Credentials != nil {
+		t.Fatal("Default credential chain must be used without S3_KEY")
+	}
+
+	os.Setenv("S3_KEY", "key")
+	os.Setenv("S3_KEY_SECRET", "secret")
+	os.Setenv("S3_SESSION_TOKEN", "token")
+
+	config := newS3Config("eu-west-1", S3Options{})
+	if config.Credentials == nil {
+		t.Fatal("Static credentials must be used with S3_KEY")
+	}
+
+	value, err := config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "key" || value.SecretAccessKey != "secret" || value.SessionToken != "token" {
+		t.Errorf("Invalid credentials: %#v", value)
+	}
+}
+
+func TestNewS3SessionCache(t *testing.T) {
+	ConfigureS3(S3Options{Endpoint: "http://localhost:9000"})
+	defer ConfigureS3(S3Options{})
+
+	first, err := newS3Session("eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := newS3Session("eu-west-1")
+	other, _ := newS3Session("us-east-1")
+
+	if first != second {
+		t.Error("Sessions must be cached per region")
+	}
+	if first == other {
+		t.Error("Sessions must not be shared across regions")
+	}
+	if aws.StringValue(first.Config.Endpoint) != "http://localhost:9000" {
+		t.Errorf("Invalid session endpoint: %s", aws.StringValue(first.Config.Endpoint))
+	}
+}
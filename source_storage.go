@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+)
+
+const ImageSourceTypeStorage ImageSourceType = "storage"
+
+func init() {
+	RegisterSource(ImageSourceTypeStorage, 70, NewStorageImageSource)
+}
+
+type StorageImageSource struct {
+	Config *SourceConfig
+}
+
+func NewStorageImageSource(config *SourceConfig) ImageSource {
+	return &StorageImageSource{Config: config}
+}
+
+func (s *StorageImageSource) Matches(r *http.Request) bool {
+	return r.Method == http.MethodGet && parseStorageProfile(r) != "" && parseStorageKey(r) != ""
+}
+
+func (s *StorageImageSource) GetImage(r *http.Request) ([]byte, error) {
+	profile, err := GetStorageProfile(parseStorageProfile(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return profile.Download(r.Context(), parseStorageContainer(r), parseStorageKey(r), s.Config.MaxAllowedSize)
+}
+
+func parseStorageProfile(request *http.Request) string {
+	return request.URL.Query().Get("storage")
+}
+
+func parseStorageKey(request *http.Request) string {
+	return request.URL.Query().Get("storageKey")
+}
+
+func parseStorageContainer(request *http.Request) string {
+	return request.URL.Query().Get("storageContainer")
+}
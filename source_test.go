@@ -1,17 +1,121 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
 	"testing"
 )
 
 func TestMatchSource(t *testing.T) {
+	LoadSources(ServerOptions{})
+
 	u, _ := url.Parse("http://foo?url=http://bar/image.jpg")
 	req := &http.Request{Method: http.MethodGet, URL: u}
 
-	source := MatchSource(req)
-	if source == nil {
-		t.Error("Cannot match image source")
+	source, err := MatchSource(req)
+	if err != nil {
+		t.Fatalf("Cannot match image source: %s", err)
+	}
+	if _, ok := source.(*HTTPImageSource); !ok {
+		t.Errorf("Invalid image source: %T", source)
+	}
+}
+
+func TestMatchSourceMissing(t *testing.T) {
+	LoadSources(ServerOptions{})
+
+	u, _ := url.Parse("http://foo?width=300")
+	req := &http.Request{Method: http.MethodGet, URL: u}
+
+	source, err := MatchSource(req)
+	if err == nil || source != nil {
+		t.Fatal("Request without source params must not match")
+	}
+	if err != ErrMissingImageSource {
+		t.Errorf("Invalid error: %s", err)
+	}
+}
+
+func TestMatchSourceAmbiguous(t *testing.T) {
+	LoadSources(ServerOptions{})
+
+	u, _ := url.Parse("http://foo?url=http://bar/image.jpg&file=image.jpg")
+	req := &http.Request{Method: http.MethodGet, URL: u}
+
+	for i := 0; i < 10; i++ {
+		source, err := MatchSource(req)
+		if err == nil || source != nil {
+			t.Fatal("Ambiguous request must not match")
+		}
+
+		expected := "ambiguous image source, request matches: fs, http. Use the source param to choose one"
+		if err.Error() != expected {
+			t.Fatalf("Invalid error message: %s", err)
+		}
+		if err.(Error).HTTPCode() != http.StatusBadRequest {
+			t.Fatalf("Invalid error status: %d", err.(Error).HTTPCode())
+		}
+	}
+}
+
+func TestMatchSourcePinned(t *testing.T) {
+	LoadSources(ServerOptions{})
+
+	cases := []struct {
+		query    string
+		expected string
+		valid    bool
+	}{
+		{"url=http://bar/image.jpg&file=image.jpg&source=http", "*main.HTTPImageSource", true},
+		{"url=http://bar/image.jpg&file=image.jpg&source=fs", "*main.FileSystemImageSource", true},
+		{"s3key=image.jpg&azureBlobKey=image.jpg&source=s3", "*main.S3ImageSource", true},
+		{"s3key=image.jpg&azureBlobKey=image.jpg&source=azure", "*main.AzureImageSource", true},
+		{"url=http://bar/image.jpg&source=fs", "", false},
+		{"url=http://bar/image.jpg&source=ftp", "", false},
+	}
+
+	for _, tc := range cases {
+		u, _ := url.Parse("http://foo?" + tc.query)
+		req := &http.Request{Method: http.MethodGet, URL: u}
+
+		source, err := MatchSource(req)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("Expected error for query: %s", tc.query)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Cannot match image source for query %s: %s", tc.query, err)
+			continue
+		}
+		if fmt.Sprintf("%T", source) != tc.expected {
+			t.Errorf("Invalid image source for query %s: %T", tc.query, source)
+		}
+	}
+}
+
+func TestSortSourceTypes(t *testing.T) {
+	LoadSources(ServerOptions{})
+
+	expected := []ImageSourceType{
+		ImageSourceTypeBody,
+		ImageSourceTypeFileSystem,
+		ImageSourceTypeHTTP,
+		ImageSourceTypeS3,
+		ImageSourceTypeAzureSAS,
+		ImageSourceTypeAzure,
+		ImageSourceTypeStorage,
+	}
+
+	if len(imageSourceOrder) != len(expected) {
+		t.Fatalf("Invalid number of sources: %d", len(imageSourceOrder))
+	}
+	for i, name := range expected {
+		if imageSourceOrder[i] != name {
+			t.Errorf("Invalid source at position %d: %s != %s", i, imageSourceOrder[i], name)
+		}
 	}
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Make sure that all implementations implement ImageDownUploader
+var (
+	_ ImageDownUploader = (*AzureSASSource)(nil)
+	_ ImageDownUploader = (*AzureImageSource)(nil)
+	_ ImageDownUploader = (*S3Source)(nil)
+	_ ImageDownUploader = (*StorageProfile)(nil)
+	_ ImageDownUploader = (*FileSystemStorage)(nil)
+	_ ImageDownUploader = (*MemoryStorage)(nil)
+)
+
+// ErrObjectNotFound is returned, possibly wrapped, when a stored object
+// does not exist.
+var ErrObjectNotFound = NewError("object not found", NotFound)
+
+// ImageDownUploader represents an object storage, where objects are
+// identified by a container and a key.
+type ImageDownUploader interface {
+	DownloadImage(container, imageKey string) ([]byte, error)
+	UploadImage(data []byte, fileKey, container string) error
+
+	// Stat returns the metadata of an object, or ErrObjectNotFound.
+	Stat(container, key string) (ObjectInfo, error)
+	// List returns the objects whose key starts with the prefix.
+	List(container, prefix string) ([]ObjectInfo, error)
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(container, key string) error
+	// Reader streams the content of an object.
+	Reader(container, key string) (io.ReadCloser, error)
+	// Writer streams the content of an object, which is stored once the
+	// writer is closed.
+	Writer(container, key string) (ObjectWriter, error)
+}
+
+// ObjectWriter streams the content of an object. The object is stored once
+// the writer is closed, while Abort discards the written content, so an
+// object is never stored truncated after a write error.
+type ObjectWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// ObjectInfo represents the metadata of a stored object.
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	ContentType  string    `json:"contentType,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+var errStorageWriterAborted = errors.New("storage: write aborted")
+
+// storageWriter streams the written data to an upload running in the
+// background. Close waits for the upload to complete.
+type storageWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newStorageWriter(upload func(r io.Reader) error) ObjectWriter {
+	pr, pw := io.Pipe()
+	w := &storageWriter{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		err := upload(pr)
+		// Unblock the writer if the upload stopped reading
+		_ = pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w
+}
+
+func (w *storageWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *storageWriter) Close() error {
+	_ = w.pw.Close()
+	return <-w.done
+}
+
+// Abort fails the upload with a read error, which stops it before the
+// object is committed.
+func (w *storageWriter) Abort() error {
+	_ = w.pw.CloseWithError(errStorageWriterAborted)
+	<-w.done
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// storageAccess holds the configured storage allowlists.
+var storageAccess StorageAccess
+
+// StorageRule allows access to a bucket or container, optionally restricted
+// to a provider and to keys starting with a prefix.
+type StorageRule struct {
+	Provider  string
+	Container string
+	Prefix    string
+}
+
+// StorageAccess represents the buckets and containers which can be read and
+// written with the server credentials. An empty list allows everything.
+type StorageAccess struct {
+	Read  []StorageRule
+	Write []StorageRule
+}
+
+// ConfigureStorageAccess sets the storage allowlists.
+func ConfigureStorageAccess(a StorageAccess) {
+	storageAccess = a
+}
+
+// CheckStorageRead returns an error if the object cannot be read.
+func CheckStorageRead(provider, container, key string) error {
+	return checkStorageRules(storageAccess.Read, "read", provider, container, key)
+}
+
+// CheckStorageWrite returns an error if the object cannot be written.
+func CheckStorageWrite(provider, container, key string) error {
+	return checkStorageRules(storageAccess.Write, "write", provider, container, key)
+}
+
+func checkStorageRules(rules []StorageRule, access, provider, container, key string) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	if !hasDotSegment(key) {
+		for _, rule := range rules {
+			if rule.allows(provider, container, key) {
+				return nil
+			}
+		}
+	}
+
+	return NewError(fmt.Sprintf("storage %s access denied: %s %s/%s", access, provider, container, key), Forbidden)
+}
+
+func (r StorageRule) allows(provider, container, key string) bool {
+	if r.Provider != "" && r.Provider != provider {
+		return false
+	}
+	if r.Container != "*" && r.Container != container {
+		return false
+	}
+	return hasPathPrefix(key, r.Prefix)
+}
+
+// hasPathPrefix reports whether the key is within the prefix, matching whole
+// path segments: "thumbs" matches "thumbs/a.jpg" but not "thumbs-private/a.jpg".
+func hasPathPrefix(key, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// hasDotSegment reports whether the key contains "." or ".." path segments,
+// which some stores could resolve out of the allowed prefix.
+func hasDotSegment(key string) bool {
+	for _, segment := range strings.Split(strings.Replace(key, "\\", "/", -1), "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStorageRules parses a comma separated list of rules with the form
+// [provider:]container[/prefix], such as "s3:images/thumbs/" or "*".
+func parseStorageRules(input string) ([]StorageRule, error) {
+	var rules []StorageRule
+	for _, value := range strings.Split(input, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		rule := StorageRule{}
+		if i := strings.Index(value, ":"); i != -1 {
+			rule.Provider, value = value[:i], value[i+1:]
+			switch rule.Provider {
+			case string(ImageSourceTypeS3), string(ImageSourceTypeAzure), StorageProviderFS, StorageProviderMemory:
+			default:
+				return nil, fmt.Errorf("invalid storage provider: %s", rule.Provider)
+			}
+		}
+
+		parts := strings.SplitN(value, "/", 2)
+		rule.Container = parts[0]
+		if len(parts) == 2 {
+			rule.Prefix = parts[1]
+		}
+		if rule.Container == "" {
+			return nil, fmt.Errorf("invalid storage rule: %s", value)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
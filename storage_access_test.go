@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseStorageRules(t *testing.T) {
+	rules, err := parseStorageRules("s3:images/thumbs/, azure:assets,*,shared/public/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []StorageRule{
+		{Provider: "s3", Container: "images", Prefix: "thumbs/"},
+		{Provider: "azure", Container: "assets"},
+		{Container: "*"},
+		{Container: "shared", Prefix: "public/"},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("Invalid number of rules: %d", len(rules))
+	}
+	for i, rule := range rules {
+		if rule != expected[i] {
+			t.Errorf("Invalid rule: %#v != %#v", rule, expected[i])
+		}
+	}
+
+	for _, value := range []string{"gcs:images", "s3:", "/prefix"} {
+		if _, err := parseStorageRules(value); err == nil {
+			t.Errorf("Expected error for value: %s", value)
+		}
+	}
+}
+
+func TestStorageRulePrefixBoundary(t *testing.T) {
+	for _, value := range []string{"images/thumbs", "images/thumbs/"} {
+		rules, _ := parseStorageRules(value)
+		rule := rules[0]
+
+		for _, key := range []string{"thumbs/photo.jpg", "thumbs/small/photo.jpg"} {
+			if !rule.allows("s3", "images", key) {
+				t.Errorf("Rule %s must allow %s", value, key)
+			}
+		}
+		for _, key := range []string{"thumbsX/photo.jpg", "thumbs-private/photo.jpg", "photo.jpg"} {
+			if rule.allows("s3", "images", key) {
+				t.Errorf("Rule %s must not allow %s", value, key)
+			}
+		}
+	}
+}
+
+func TestCheckStorageAccess(t *testing.T) {
+	read, _ := parseStorageRules("s3:images,azure:assets/public/")
+	write, _ := parseStorageRules("images/thumbs/")
+	ConfigureStorageAccess(StorageAccess{Read: read, Write: write})
+	defer ConfigureStorageAccess(StorageAccess{})
+
+	cases := []struct {
+		check     func(string, string, string) error
+		provider  string
+		container string
+		key       string
+		allowed   bool
+	}{
+		{CheckStorageRead, "s3", "images", "photo.jpg", true},
+		{CheckStorageRead, "azure", "images", "photo.jpg", false},
+		{CheckStorageRead, "s3", "private", "photo.jpg", false},
+		{CheckStorageRead, "azure", "assets", "public/logo.png", true},
+		{CheckStorageRead, "azure", "assets", "private/logo.png", false},
+		{CheckStorageRead, "azure", "assets", "public/../private/logo.png", false},
+		{CheckStorageWrite, "s3", "images", "thumbs/photo.jpg", true},
+		{CheckStorageWrite, "azure", "images", "thumbs/photo.jpg", true},
+		{CheckStorageWrite, "s3", "images", "photo.jpg", false},
+	}
+
+	for _, tc := range cases {
+		err := tc.check(tc.provider, tc.container, tc.key)
+		if (err == nil) != tc.allowed {
+			t.Errorf("Invalid access for %s %s/%s: %v", tc.provider, tc.container, tc.key, err)
+		}
+		if err != nil && ToError(err, InternalError).HTTPCode() != http.StatusForbidden {
+			t.Errorf("Invalid error code: %v", err)
+		}
+	}
+
+	ConfigureStorageAccess(StorageAccess{})
+	if err := CheckStorageWrite("s3", "any", "key"); err != nil {
+		t.Errorf("Empty allowlist must allow everything: %s", err)
+	}
+}
+
+func TestS3ImageSourceStorageAccess(t *testing.T) {
+	read, _ := parseStorageRules("s3:images")
+	ConfigureStorageAccess(StorageAccess{Read: read})
+	defer ConfigureStorageAccess(StorageAccess{})
+
+	u, _ := url.Parse("http://foo?s3key=photo.jpg&bucket=private&region=eu-west-1")
+	source := NewS3ImageSource(&SourceConfig{})
+	if _, err := source.GetImage(&http.Request{Method: http.MethodGet, URL: u}); ToError(err, InternalError).Code != Forbidden {
+		t.Fatalf("Bucket outside of the allowlist must be rejected: %v", err)
+	}
+}
+
+func TestCheckDZFilesAccess(t *testing.T) {
+	write, _ := parseStorageRules("s3:tiles/dz/")
+	ConfigureStorageAccess(StorageAccess{Write: write})
+	defer ConfigureStorageAccess(StorageAccess{})
+
+	conf := DZFilesConfig{Provider: "s3", Container: "images", ImageKey: "photo.tif", TempContainer: "tiles"}
+	if err := checkDZFilesAccess(conf, "photo"); err == nil {
+		t.Error("Prefix outside of the allowlist must be rejected")
+	}
+	if err := checkDZFilesAccess(conf, "dz/photo"); err != nil {
+		t.Errorf("Prefix within the allowlist must be allowed: %s", err)
+	}
+
+	conf.Provider = "azureSAS"
+	if err := checkDZFilesAccess(conf, "photo"); err != nil {
+		t.Errorf("SAS uploads must not be checked: %s", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileSystemStorage stores the objects as files of a local directory, where
+// containers are subdirectories.
+type FileSystemStorage struct {
+	Root string
+}
+
+func (s *FileSystemStorage) DownloadImage(container, imageKey string) ([]byte, error) {
+	file, err := s.path(container, imageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("fs: error reading file: %w", fsNotFoundError(err))
+	}
+	return data, nil
+}
+
+func (s *FileSystemStorage) UploadImage(data []byte, fileKey, container string) error {
+	file, err := s.path(container, fileKey)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("fs: error creating directory: %w", err)
+	}
+	if err := writeFileAtomic(file, data); err != nil {
+		return fmt.Errorf("fs: error writing file: %w", err)
+	}
+	return nil
+}
+
+func (s *FileSystemStorage) Stat(container, key string) (ObjectInfo, error) {
+	file, err := s.path(container, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("fs: error reading file: %w", fsNotFoundError(err))
+	}
+	return newFileObjectInfo(key, info), nil
+}
+
+// List walks the deepest directory holding all the keys with the prefix.
+func (s *FileSystemStorage) List(container, prefix string) ([]ObjectInfo, error) {
+	root, err := s.path(container, "")
+	if err != nil {
+		return nil, err
+	}
+
+	dir := root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		if dir, err = s.path(container, prefix[:i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var objects []ObjectInfo
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		key := filepath.ToSlash(file[len(root)+1:])
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, newFileObjectInfo(key, info))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fs: error listing files: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *FileSystemStorage) Delete(container, key string) error {
+	file, err := s.path(container, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("fs: error removing file: %w", err)
+	}
+	return nil
+}
+
+func (s *FileSystemStorage) Reader(container, key string) (io.ReadCloser, error) {
+	file, err := s.path(container, key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("fs: error reading file: %w", fsNotFoundError(err))
+	}
+	return f, nil
+}
+
+// Writer writes a temporary file, renamed once closed.
+func (s *FileSystemStorage) Writer(container, key string) (ObjectWriter, error) {
+	file, err := s.path(container, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, fmt.Errorf("fs: error creating directory: %w", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("fs: error creating file: %w", err)
+	}
+	return &fileStorageWriter{File: tmp, path: file}, nil
+}
+
+// path resolves the file of an object within the root directory.
+func (s *FileSystemStorage) path(container, key string) (string, error) {
+	root := filepath.Clean(s.Root)
+	if strings.ContainsAny(container, `/\`) || container == ".." || hasDotSegment(key) {
+		return "", ErrInvalidFilePath
+	}
+
+	file := filepath.Join(root, container, filepath.FromSlash(key))
+	if file != root && !strings.HasPrefix(file, root+string(filepath.Separator)) {
+		return "", ErrInvalidFilePath
+	}
+	return file, nil
+}
+
+type fileStorageWriter struct {
+	*os.File
+	path string
+}
+
+func (w *fileStorageWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		_ = os.Remove(w.Name())
+		return fmt.Errorf("fs: error writing file: %w", err)
+	}
+	if err := os.Rename(w.Name(), w.path); err != nil {
+		_ = os.Remove(w.Name())
+		return fmt.Errorf("fs: error writing file: %w", err)
+	}
+	return nil
+}
+
+// Abort removes the temporary file.
+func (w *fileStorageWriter) Abort() error {
+	_ = w.File.Close()
+	if err := os.Remove(w.Name()); err != nil {
+		return fmt.Errorf("fs: error removing file: %w", err)
+	}
+	return nil
+}
+
+func newFileObjectInfo(key string, info os.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		LastModified: info.ModTime().UTC(),
+	}
+}
+
+// fsNotFoundError wraps ErrObjectNotFound when the file does not exist.
+func fsNotFoundError(err error) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage stores the objects in memory. It is meant for tests and
+// local development.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	info ObjectInfo
+	data []byte
+}
+
+// NewMemoryStorage creates an empty in-memory storage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string]memoryObject)}
+}
+
+func (s *MemoryStorage) DownloadImage(container, imageKey string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[memoryObjectID(container, imageKey)]
+	if !ok {
+		return nil, fmt.Errorf("memory: %w: %s/%s", ErrObjectNotFound, container, imageKey)
+	}
+	return append([]byte(nil), object.data...), nil
+}
+
+func (s *MemoryStorage) UploadImage(data []byte, fileKey, container string) error {
+	sum := md5.Sum(data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[memoryObjectID(container, fileKey)] = memoryObject{
+		info: ObjectInfo{
+			Key:          fileKey,
+			Size:         int64(len(data)),
+			ETag:         hex.EncodeToString(sum[:]),
+			ContentType:  newFileUploadOptions(data, fileKey).ContentType,
+			LastModified: time.Now().UTC(),
+		},
+		data: append([]byte(nil), data...),
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Stat(container, key string) (ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[memoryObjectID(container, key)]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("memory: %w: %s/%s", ErrObjectNotFound, container, key)
+	}
+	return object.info, nil
+}
+
+func (s *MemoryStorage) List(container, prefix string) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var objects []ObjectInfo
+	for id, object := range s.objects {
+		if strings.HasPrefix(id, memoryObjectID(container, prefix)) {
+			objects = append(objects, object.info)
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *MemoryStorage) Delete(container, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects, memoryObjectID(container, key))
+	return nil
+}
+
+func (s *MemoryStorage) Reader(container, key string) (io.ReadCloser, error) {
+	data, err := s.DownloadImage(container, key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryStorage) Writer(container, key string) (ObjectWriter, error) {
+	return &memoryStorageWriter{storage: s, container: container, key: key}, nil
+}
+
+type memoryStorageWriter struct {
+	bytes.Buffer
+	storage        *MemoryStorage
+	container, key string
+}
+
+func (w *memoryStorageWriter) Close() error {
+	return w.storage.UploadImage(w.Bytes(), w.key, w.container)
+}
+
+func (w *memoryStorageWriter) Abort() error {
+	w.Reset()
+	return nil
+}
+
+func memoryObjectID(container, key string) string {
+	return container + "\x00" + key
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	StorageProviderS3       = "s3"
+	StorageProviderAzure    = "azure"
+	StorageProviderAzureSAS = "azure_sas"
+	StorageProviderFS       = "fs"
+	StorageProviderMemory   = "memory"
+)
+
+// storageProfiles holds the profiles loaded from the configuration file.
+var storageProfiles = make(map[string]*StorageProfile)
+
+// StorageProfile represents a named storage account, so requests can refer
+// to it without carrying any credential. Keys are relative to KeyPrefix and
+// Container is used when no container is given, while requests can only use
+// another container listed in Containers.
+type StorageProfile struct {
+	Provider   string   `json:"provider"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	Container  string   `json:"container,omitempty"`
+	KeyPrefix  string   `json:"keyPrefix,omitempty"`
+	Containers []string `json:"containers,omitempty"`
+
+	// S3 settings. The default AWS credential chain is used without keys.
+	Region          string `json:"region,omitempty"`
+	ForcePathStyle  bool   `json:"forcePathStyle,omitempty"`
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+
+	// Azure settings.
+	Environment      string `json:"environment,omitempty"`
+	AccountName      string `json:"accountName,omitempty"`
+	AccountKey       string `json:"accountKey,omitempty"`
+	ConnectionString string `json:"connectionString,omitempty"`
+	TenantID         string `json:"tenantId,omitempty"`
+	ClientID         string `json:"clientId,omitempty"`
+	ClientSecret     string `json:"clientSecret,omitempty"`
+	SASToken         string `json:"sasToken,omitempty"`
+
+	// Local filesystem settings, where containers are subdirectories.
+	Root string `json:"root,omitempty"`
+
+	name      string
+	s3Session *session.Session
+	azure     *azureClient
+	sasURL    *url.URL
+	local     ImageDownUploader // fs and memory providers
+}
+
+// LoadStorageProfiles reads the storage profiles from a JSON file such as:
+//
+//	{"profiles": {"media": {"provider": "s3", "region": "eu-west-1", "container": "media"}}}
+func LoadStorageProfiles(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("storage profiles: error reading file: %w", err)
+	}
+
+	config := struct {
+		Profiles map[string]*StorageProfile `json:"profiles"`
+	}{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("storage profiles: error decoding file: %w", err)
+	}
+
+	for name, profile := range config.Profiles {
+		if err := profile.init(name); err != nil {
+			return err
+		}
+	}
+
+	storageProfiles = config.Profiles
+	return nil
+}
+
+// GetStorageProfile returns the storage profile with the given name.
+func GetStorageProfile(name string) (*StorageProfile, error) {
+	profile, ok := storageProfiles[name]
+	if !ok {
+		return nil, NewError(fmt.Sprintf("unknown storage profile: %s", name), BadRequest)
+	}
+	return profile, nil
+}
+
+// storageProfilesCredentialError returns the first Azure token refresh error
+// of the loaded profiles.
+func storageProfilesCredentialError() error {
+	names := make([]string, 0, len(storageProfiles))
+	for name := range storageProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if client := storageProfiles[name].azure; client != nil {
+			if err := client.lastError(); err != nil {
+				return fmt.Errorf("storage profile %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *StorageProfile) init(name string) error {
+	p.name = name
+
+	switch p.Provider {
+	case StorageProviderS3:
+		config := newS3Config(p.Region, S3Options{Endpoint: p.Endpoint, ForcePathStyle: p.ForcePathStyle})
+		if p.AccessKeyID != "" {
+			config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, p.SessionToken))
+		}
+
+		sess, err := session.NewSessionWithOptions(session.Options{
+			Config:            *config,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return fmt.Errorf("storage profile %s: error creating s3 session: %w", name, err)
+		}
+		p.s3Session = sess
+
+	case StorageProviderAzure:
+		credentials := AzureCredentials{
+			AccountName:      p.AccountName,
+			AccountKey:       p.AccountKey,
+			ConnectionString: p.ConnectionString,
+			TenantID:         p.TenantID,
+			ClientID:         p.ClientID,
+			ClientSecret:     p.ClientSecret,
+		}
+		p.azure = newAzureClient(
+			AzureOptions{Endpoint: p.Endpoint, Environment: p.Environment},
+			func() AzureCredentials { return credentials },
+		)
+
+	case StorageProviderAzureSAS:
+		if p.SASToken == "" {
+			return fmt.Errorf("storage profile %s: missing sasToken", name)
+		}
+
+		u, err := azureAccountServiceURL(
+			AzureOptions{Endpoint: p.Endpoint, Environment: p.Environment},
+			AzureCredentials{AccountName: p.AccountName},
+			p.AccountName,
+		)
+		if err != nil {
+			return fmt.Errorf("storage profile %s: %w", name, err)
+		}
+		p.sasURL = u
+
+	case StorageProviderFS:
+		if p.Root == "" {
+			return fmt.Errorf("storage profile %s: missing root", name)
+		}
+		p.local = &FileSystemStorage{Root: p.Root}
+
+	case StorageProviderMemory:
+		p.local = NewMemoryStorage()
+
+	default:
+		return fmt.Errorf("storage profile %s: unknown provider: %s", name, p.Provider)
+	}
+
+	return nil
+}
+
+// accessProvider returns the provider name checked by the storage allowlists.
+func (p *StorageProfile) accessProvider() string {
+	if p.Provider == StorageProviderAzureSAS {
+		return StorageProviderAzure
+	}
+	return p.Provider
+}
+
+// resolve returns the container and the full key of an object. Requests can
+// only use the container of the profile or one listed in Containers, and
+// keys cannot have dot segments, so KeyPrefix stays a boundary.
+func (p *StorageProfile) resolve(container, key string) (string, string, error) {
+	if container == "" {
+		container = p.Container
+	}
+	if container != p.Container && !p.allowsContainer(container) {
+		return "", "", NewError(fmt.Sprintf("storage profile %s: container not allowed: %s", p.name, container), Forbidden)
+	}
+	if hasDotSegment(key) {
+		return "", "", NewError(fmt.Sprintf("storage profile %s: invalid key: %s", p.name, key), BadRequest)
+	}
+	return container, p.KeyPrefix + key, nil
+}
+
+func (p *StorageProfile) allowsContainer(container string) bool {
+	for _, allowed := range p.Containers {
+		if allowed == container {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRead resolves an object and checks it can be read.
+func (p *StorageProfile) resolveRead(container, key string) (string, string, error) {
+	container, key, err := p.resolve(container, key)
+	if err != nil {
+		return "", "", err
+	}
+	return container, key, CheckStorageRead(p.accessProvider(), container, key)
+}
+
+// resolveWrite resolves an object and checks it can be written.
+func (p *StorageProfile) resolveWrite(container, key string) (string, string, error) {
+	container, key, err := p.resolve(container, key)
+	if err != nil {
+		return "", "", err
+	}
+	return container, key, CheckStorageWrite(p.accessProvider(), container, key)
+}
+
+func (p *StorageProfile) checkRead(container, key string) error {
+	_, _, err := p.resolveRead(container, key)
+	return err
+}
+
+func (p *StorageProfile) checkWrite(container, key string) error {
+	_, _, err := p.resolveWrite(container, key)
+	return err
+}
+
+// Download reads an object, aborting if it exceeds limit bytes.
+func (p *StorageProfile) Download(ctx context.Context, container, key string, limit int) ([]byte, error) {
+	container, key, err := p.resolveRead(container, key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Provider {
+	case StorageProviderS3:
+		return getS3Object(ctx, p.s3Session, container, key, limit)
+	case StorageProviderFS, StorageProviderMemory:
+		return downloadLocalObject(p.local, container, key, limit)
+	case StorageProviderAzure:
+		session, err := p.azure.session(container)
+		if err != nil {
+			return nil, fmt.Errorf("azure: error getting azure session: %w", err)
+		}
+		data, err := downloadAzureBlob(ctx, session.NewBlobURL(key), limit)
+		if err != nil {
+			return nil, fmt.Errorf("azure: %w", err)
+		}
+		return data, nil
+	default:
+		data, err := downloadAzureBlob(ctx, p.sasBlobURL(container, key).BlobURL, limit)
+		if err != nil {
+			return nil, fmt.Errorf("azure_sas: %w", err)
+		}
+		return data, nil
+	}
+}
+
+// Upload writes an object with the given options.
+func (p *StorageProfile) Upload(ctx context.Context, container, key string, data []byte, o UploadOptions) (UploadResult, error) {
+	container, key, err := p.resolveWrite(container, key)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	result := UploadResult{Profile: p.name, Container: container, Key: key}
+
+	switch p.Provider {
+	case StorageProviderS3:
+		result.Provider = ImageSinkTypeS3
+		out, err := s3.New(p.s3Session).PutObjectWithContext(ctx, newS3PutObjectInput(container, key, data, o))
+		if err != nil {
+			return result, fmt.Errorf("failed to upload file, %w", err)
+		}
+		result.ETag = aws.StringValue(out.ETag)
+		result.VersionID = aws.StringValue(out.VersionId)
+
+	case StorageProviderAzure:
+		result.Provider = ImageSinkTypeAzure
+		session, err := p.azure.session(container)
+		if err != nil {
+			return result, fmt.Errorf("azure: error getting azure session: %w", err)
+		}
+		res, err := uploadAzureBlob(ctx, session.NewBlockBlobURL(key), data, o)
+		if err != nil {
+			return result, fmt.Errorf("azure: uploading image failed: %w", err)
+		}
+		result.ETag = string(res.ETag())
+
+	case StorageProviderFS, StorageProviderMemory:
+		result.Provider = ImageSinkType(p.Provider)
+		if err := p.local.UploadImage(data, key, container); err != nil {
+			return result, err
+		}
+
+	default:
+		result.Provider = ImageSinkTypeAzureSAS
+		res, err := uploadAzureBlob(ctx, p.sasBlobURL(container, key), data, o)
+		if err != nil {
+			return result, fmt.Errorf("azure_sas: uploading image failed: %w", err)
+		}
+		result.ETag = string(res.ETag())
+	}
+
+	return result, nil
+}
+
+// DownloadImage implements ImageDownUploader. It reads the whole object
+// without a size limit, so request handlers should call Download instead.
+func (p *StorageProfile) DownloadImage(container, imageKey string) ([]byte, error) {
+	return p.Download(context.Background(), container, imageKey, 0)
+}
+
+// UploadImage implements ImageDownUploader.
+func (p *StorageProfile) UploadImage(data []byte, fileKey, container string) error {
+	_, err := p.Upload(context.Background(), container, fileKey, data, newFileUploadOptions(data, fileKey))
+	return err
+}
+
+// Stat implements ImageDownUploader.
+func (p *StorageProfile) Stat(container, key string) (ObjectInfo, error) {
+	container, fullKey, err := p.resolveRead(container, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	ctx := context.Background()
+
+	var info ObjectInfo
+	if p.local != nil {
+		info, err = p.local.Stat(container, fullKey)
+	} else if p.Provider == StorageProviderS3 {
+		info, err = statS3Object(ctx, p.s3Session, container, fullKey)
+	} else {
+		var containerURL azblob.ContainerURL
+		if containerURL, err = p.azureContainerURL(container); err == nil {
+			info, err = statAzureBlob(ctx, containerURL.NewBlobURL(fullKey), fullKey)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", p.Provider, err)
+		}
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info.Key = key
+	return info, nil
+}
+
+// List implements ImageDownUploader. The keys are relative to KeyPrefix.
+func (p *StorageProfile) List(container, prefix string) ([]ObjectInfo, error) {
+	container, fullPrefix, err := p.resolveRead(container, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+
+	var objects []ObjectInfo
+	if p.local != nil {
+		objects, err = p.local.List(container, fullPrefix)
+	} else if p.Provider == StorageProviderS3 {
+		objects, err = listS3Objects(ctx, p.s3Session, container, fullPrefix)
+	} else {
+		var containerURL azblob.ContainerURL
+		if containerURL, err = p.azureContainerURL(container); err == nil {
+			objects, err = listAzureBlobs(ctx, containerURL, fullPrefix)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", p.Provider, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range objects {
+		objects[i].Key = strings.TrimPrefix(objects[i].Key, p.KeyPrefix)
+	}
+	return objects, nil
+}
+
+// Delete implements ImageDownUploader.
+func (p *StorageProfile) Delete(container, key string) error {
+	container, key, err := p.resolveWrite(container, key)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if p.local != nil {
+		return p.local.Delete(container, key)
+	}
+	if p.Provider == StorageProviderS3 {
+		return deleteS3Object(ctx, p.s3Session, container, key)
+	}
+
+	containerURL, err := p.azureContainerURL(container)
+	if err == nil {
+		err = deleteAzureBlob(ctx, containerURL.NewBlobURL(key))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.Provider, err)
+	}
+	return nil
+}
+
+// Reader implements ImageDownUploader.
+func (p *StorageProfile) Reader(container, key string) (io.ReadCloser, error) {
+	container, key, err := p.resolveRead(container, key)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+
+	if p.local != nil {
+		return p.local.Reader(container, key)
+	}
+	if p.Provider == StorageProviderS3 {
+		return readS3Object(ctx, p.s3Session, container, key)
+	}
+
+	containerURL, err := p.azureContainerURL(container)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Provider, err)
+	}
+	reader, err := readAzureBlob(ctx, containerURL.NewBlobURL(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Provider, err)
+	}
+	return reader, nil
+}
+
+// Writer implements ImageDownUploader.
+func (p *StorageProfile) Writer(container, key string) (ObjectWriter, error) {
+	container, key, err := p.resolveWrite(container, key)
+	if err != nil {
+		return nil, err
+	}
+	if p.local != nil {
+		return p.local.Writer(container, key)
+	}
+	ctx := context.Background()
+	o := newFileUploadOptions(nil, key)
+
+	if p.Provider == StorageProviderS3 {
+		return writeS3Object(ctx, p.s3Session, container, key, o), nil
+	}
+
+	containerURL, err := p.azureContainerURL(container)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Provider, err)
+	}
+	return writeAzureBlob(ctx, containerURL.NewBlockBlobURL(key), o), nil
+}
+
+// downloadLocalObject reads an object of a local storage, aborting if it
+// exceeds limit bytes.
+func downloadLocalObject(storage ImageDownUploader, container, key string, limit int) ([]byte, error) {
+	info, err := storage.Stat(container, key)
+	if err != nil {
+		return nil, err
+	}
+	if exceedsMaxAllowedSize(info.Size, limit) {
+		return nil, ErrImageTooLarge
+	}
+	return storage.DownloadImage(container, key)
+}
+
+// azureContainerURL returns the URL of a container of an Azure profile.
+func (p *StorageProfile) azureContainerURL(container string) (azblob.ContainerURL, error) {
+	if p.Provider == StorageProviderAzure {
+		session, err := p.azure.session(container)
+		if err != nil {
+			return azblob.ContainerURL{}, fmt.Errorf("error getting azure session: %w", err)
+		}
+		return *session, nil
+	}
+
+	u := *p.sasURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + container
+	u.RawQuery = strings.TrimPrefix(p.SASToken, "?")
+
+	return azblob.NewContainerURL(u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{})), nil
+}
+
+func (p *StorageProfile) sasBlobURL(container, key string) azblob.BlockBlobURL {
+	u := *p.sasURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + container + "/" + key
+	u.RawQuery = strings.TrimPrefix(p.SASToken, "?")
+
+	return azblob.NewBlockBlobURL(u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+}
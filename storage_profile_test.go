@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestStorageProfiles(t *testing.T, config string) error {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "storage.json")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadStorageProfiles(path)
+}
+
+func TestLoadStorageProfiles(t *testing.T) {
+	defer func() { storageProfiles = make(map[string]*StorageProfile) }()
+
+	err := loadTestStorageProfiles(t, `{"profiles": {
+		"media": {"provider": "s3", "region": "eu-west-1", "container": "media", "keyPrefix": "images/", "accessKeyId": "foo", "secretAccessKey": "bar"},
+		"assets": {"provider": "azure", "accountName": "foo", "accountKey": "YmFy", "container": "assets"},
+		"shared": {"provider": "azure_sas", "accountName": "foo", "sasToken": "?sv=2019&sig=abc", "container": "shared"}
+	}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := GetStorageProfile("media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media.s3Session == nil {
+		t.Error("S3 profile must have a session")
+	}
+	if container, key, err := media.resolve("", "photo.jpg"); err != nil || container != "media" || key != "images/photo.jpg" {
+		t.Errorf("Invalid object: %s %s %v", container, key, err)
+	}
+
+	assets, _ := GetStorageProfile("assets")
+	if _, err := assets.azure.session("assets"); err != nil {
+		t.Errorf("Cannot create Azure session: %s", err)
+	}
+
+	shared, _ := GetStorageProfile("shared")
+	u := shared.sasBlobURL("shared", "photo.jpg").URL()
+	if s := u.String(); s != "https://foo.blob.core.windows.net/shared/photo.jpg?sv=2019&sig=abc" {
+		t.Errorf("Invalid SAS blob URL: %s", s)
+	}
+
+	if _, err := GetStorageProfile("unknown"); err == nil || err.(Error).Code != BadRequest {
+		t.Errorf("Unknown profile must fail with a bad request: %v", err)
+	}
+}
+
+func TestStorageProfileResolve(t *testing.T) {
+	profile := &StorageProfile{Provider: StorageProviderS3, Container: "media", KeyPrefix: "tenants/a/", Containers: []string{"archive"}, name: "media"}
+
+	if container, key, err := profile.resolve("media", "photo.jpg"); err != nil || container != "media" || key != "tenants/a/photo.jpg" {
+		t.Errorf("Invalid object: %s %s %v", container, key, err)
+	}
+	if container, _, err := profile.resolve("archive", "photo.jpg"); err != nil || container != "archive" {
+		t.Errorf("Allowed container must be used: %s %v", container, err)
+	}
+
+	if _, _, err := profile.resolve("other", "photo.jpg"); err == nil || err.(Error).Code != Forbidden {
+		t.Errorf("Other container must be forbidden: %v", err)
+	}
+	for _, key := range []string{"../b/photo.jpg", "photos/../../b/photo.jpg", "./photo.jpg", "..\\b\\photo.jpg"} {
+		if _, _, err := profile.resolve("", key); err == nil {
+			t.Errorf("Expected error for key: %s", key)
+		}
+	}
+}
+
+func TestLoadStorageProfilesInvalid(t *testing.T) {
+	defer func() { storageProfiles = make(map[string]*StorageProfile) }()
+
+	configs := []string{
+		`{"profiles": {"foo": {"provider": "gcs"}}}`,
+		`{"profiles": {"foo": {"provider": "azure_sas", "accountName": "foo"}}}`,
+		`{"profiles": `,
+	}
+	for _, config := range configs {
+		if err := loadTestStorageProfiles(t, config); err == nil {
+			t.Errorf("Expected error for config: %s", config)
+		}
+	}
+}
+
+func TestStorageProfileAccess(t *testing.T) {
+	storageProfiles = map[string]*StorageProfile{
+		"media": {Provider: StorageProviderS3, Container: "media", KeyPrefix: "images/"},
+	}
+	defer func() { storageProfiles = make(map[string]*StorageProfile) }()
+
+	read, _ := parseStorageRules("s3:media/images/public/")
+	write, _ := parseStorageRules("s3:media/images/tiles/")
+	ConfigureStorageAccess(StorageAccess{Read: read, Write: write})
+	defer ConfigureStorageAccess(StorageAccess{})
+
+	profile, _ := GetStorageProfile("media")
+	if err := profile.checkRead("", "public/photo.jpg"); err != nil {
+		t.Errorf("Read must be allowed: %s", err)
+	}
+	if err := profile.checkRead("", "private/photo.jpg"); err == nil {
+		t.Error("Read must be denied")
+	}
+
+	dzConf := DZFilesConfig{Profile: "media", ImageKey: "public/photo.jpg"}
+	if err := checkDZFilesAccess(dzConf, "tiles/photo"); err != nil {
+		t.Errorf("Deep Zoom upload must be allowed: %s", err)
+	}
+	if err := checkDZFilesAccess(dzConf, "public/photo"); err == nil {
+		t.Error("Deep Zoom upload must be denied")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testStorage checks the behavior shared by the storage implementations.
+func testStorage(t *testing.T, storage ImageDownUploader) {
+	if err := storage.UploadImage([]byte("foo"), "a/1.txt", "bucket"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := storage.Writer("bucket", "a/b/2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat("bucket", "a/b/2.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Object must not be stored until the writer is closed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UploadImage([]byte("baz"), "c.txt", "bucket"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = storage.Writer("bucket", "a/3.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("truncated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat("bucket", "a/3.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Object must not be stored once the writer is aborted: %v", err)
+	}
+
+	info, err := storage.Stat("bucket", "a/b/2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "a/b/2.txt" || info.Size != 3 || info.LastModified.IsZero() {
+		t.Errorf("Invalid object info: %+v", info)
+	}
+
+	r, err := storage.Reader("bucket", "a/b/2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "bar" {
+		t.Errorf("Invalid object data: %q %v", data, err)
+	}
+
+	objects, err := storage.List("bucket", "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "a/1.txt" || objects[1].Key != "a/b/2.txt" {
+		t.Errorf("Invalid objects: %+v", objects)
+	}
+	if objects, _ := storage.List("bucket", "a/b/2"); len(objects) != 1 {
+		t.Errorf("Invalid objects for a key prefix: %+v", objects)
+	}
+	if objects, _ := storage.List("other", ""); len(objects) != 0 {
+		t.Errorf("Invalid objects of another container: %+v", objects)
+	}
+
+	if err := storage.Delete("bucket", "a/1.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete("bucket", "a/1.txt"); err != nil {
+		t.Errorf("Deleting a missing object must not fail: %v", err)
+	}
+	if _, err := storage.DownloadImage("bucket", "a/1.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Expected not found error: %v", err)
+	}
+	if _, err := storage.Reader("bucket", "a/1.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Expected not found error: %v", err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestFileSystemStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &FileSystemStorage{Root: dir}
+	testStorage(t, storage)
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "bucket", "a", ".tmp-*")); len(files) != 0 {
+		t.Errorf("Temporary files must be removed: %v", files)
+	}
+
+	if _, err := storage.DownloadImage("bucket", "../../etc/passwd"); err != ErrInvalidFilePath {
+		t.Errorf("Expected invalid path error: %v", err)
+	}
+	if err := storage.UploadImage([]byte("foo"), "x.txt", "../bucket"); err != ErrInvalidFilePath {
+		t.Errorf("Expected invalid path error: %v", err)
+	}
+}
+
+func TestStorageProfileKeyPrefix(t *testing.T) {
+	profile := &StorageProfile{Provider: StorageProviderMemory, Container: "bucket", KeyPrefix: "images/"}
+	if err := profile.init("memory"); err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, profile)
+
+	if _, err := profile.local.Stat("bucket", "images/c.txt"); err != nil {
+		t.Errorf("Objects must be stored with the key prefix: %v", err)
+	}
+	if objects, _ := profile.List("", ""); len(objects) != 2 || objects[0].Key != "a/b/2.txt" {
+		t.Errorf("Invalid objects of the default container: %+v", objects)
+	}
+}
+
+func TestStorageWriterAbort(t *testing.T) {
+	var stored []byte
+	w := newStorageWriter(func(r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		stored = data
+		return nil
+	})
+	if _, err := w.Write([]byte("truncated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if stored != nil {
+		t.Errorf("The upload must fail once the writer is aborted: %q", stored)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// UploadManifest records the keys of the uploaded objects in an append-only
+// file, so an interrupted upload only sends the missing objects.
+type UploadManifest struct {
+	mu   sync.Mutex
+	file *os.File
+	keys map[string]bool
+}
+
+// OpenUploadManifest opens the manifest file, loading the keys recorded by a
+// previous attempt.
+func OpenUploadManifest(path string) (*UploadManifest, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("upload manifest: error opening file: %w", err)
+	}
+
+	m := &UploadManifest{file: file, keys: make(map[string]bool)}
+
+	// A line interrupted by a crash is not terminated, it is truncated
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		m.keys[line[:len(line)-1]] = true
+		size += int64(len(line))
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("upload manifest: error truncating file: %w", err)
+	}
+
+	return m, nil
+}
+
+// Uploaded reports whether the object is already uploaded.
+func (m *UploadManifest) Uploaded(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys[key]
+}
+
+// Len returns the number of uploaded objects.
+func (m *UploadManifest) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.keys)
+}
+
+// Add records an uploaded object.
+func (m *UploadManifest) Add(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.keys[key] {
+		return nil
+	}
+	if _, err := m.file.WriteString(key + "\n"); err != nil {
+		return fmt.Errorf("upload manifest: error writing key: %w", err)
+	}
+	m.keys[key] = true
+	return nil
+}
+
+// Close closes the manifest file.
+func (m *UploadManifest) Close() error {
+	return m.file.Close()
+}
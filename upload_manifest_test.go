@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "manifest")
+
+	m, err := OpenUploadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"image.dzi", "image_files/0/0_0.jpeg", "image.dzi"} {
+		if err := m.Add(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+
+	// Simulate a write interrupted by a crash
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("image_files/1/0")
+	f.Close()
+
+	m, err = OpenUploadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 2 || !m.Uploaded("image.dzi") || !m.Uploaded("image_files/0/0_0.jpeg") || m.Uploaded("image_files/1/0") {
+		t.Errorf("Invalid manifest keys: %v", m.keys)
+	}
+	if err := m.Add("image_files/1/0_0.jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	buf, _ := ioutil.ReadFile(path)
+	if string(buf) != "image.dzi\nimage_files/0/0_0.jpeg\nimage_files/1/0_0.jpeg\n" {
+		t.Errorf("Invalid manifest file: %q", buf)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	s3CannedACLs = []string{
+		s3.ObjectCannedACLPrivate,
+		s3.ObjectCannedACLPublicRead,
+		s3.ObjectCannedACLPublicReadWrite,
+		s3.ObjectCannedACLAuthenticatedRead,
+		s3.ObjectCannedACLAwsExecRead,
+		s3.ObjectCannedACLBucketOwnerRead,
+		s3.ObjectCannedACLBucketOwnerFullControl,
+	}
+	s3StorageClasses = []string{
+		s3.StorageClassStandard,
+		s3.StorageClassReducedRedundancy,
+		s3.StorageClassStandardIa,
+		s3.StorageClassOnezoneIa,
+		s3.StorageClassIntelligentTiering,
+		s3.StorageClassGlacier,
+		s3.StorageClassDeepArchive,
+	}
+	s3ServerSideEncryptions = []string{
+		s3.ServerSideEncryptionAes256,
+		s3.ServerSideEncryptionAwsKms,
+	}
+	azureAccessTiers = []string{
+		string(azblob.AccessTierHot),
+		string(azblob.AccessTierCool),
+		string(azblob.AccessTierArchive),
+	}
+)
+
+// uploadDefaults holds the configured options applied to every upload.
+var uploadDefaults UploadOptions
+
+// UploadOptions represents the content headers and storage settings of an
+// uploaded object. ACL, storage class, tags and encryption only apply to S3,
+// the access tier only applies to Azure.
+type UploadOptions struct {
+	ContentType        string
+	CacheControl       string
+	ContentDisposition string
+	Metadata           map[string]string
+	ACL                string
+	StorageClass       string
+	Tags               map[string]string
+	SSE                string
+	SSEKMSKeyID        string
+	AccessTier         string
+}
+
+// ConfigureUploads sets the options applied by default to every upload.
+func ConfigureUploads(o UploadOptions) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	uploadDefaults = o
+	return nil
+}
+
+// Merge returns a copy of the options overridden by the non-empty fields of
+// other. Metadata and tags are merged key by key.
+func (o UploadOptions) Merge(other UploadOptions) UploadOptions {
+	override := func(value *string, with string) {
+		if with != "" {
+			*value = with
+		}
+	}
+
+	override(&o.ContentType, other.ContentType)
+	override(&o.CacheControl, other.CacheControl)
+	override(&o.ContentDisposition, other.ContentDisposition)
+	override(&o.ACL, other.ACL)
+	override(&o.StorageClass, other.StorageClass)
+	override(&o.SSE, other.SSE)
+	override(&o.SSEKMSKeyID, other.SSEKMSKeyID)
+	override(&o.AccessTier, other.AccessTier)
+	o.Metadata = mergeStringMaps(o.Metadata, other.Metadata)
+	o.Tags = mergeStringMaps(o.Tags, other.Tags)
+
+	return o
+}
+
+// Validate checks the options against the values accepted by the stores.
+func (o UploadOptions) Validate() error {
+	checks := []struct {
+		name    string
+		value   string
+		allowed []string
+	}{
+		{"acl", o.ACL, s3CannedACLs},
+		{"storageClass", o.StorageClass, s3StorageClasses},
+		{"sse", o.SSE, s3ServerSideEncryptions},
+		{"accessTier", o.AccessTier, azureAccessTiers},
+	}
+
+	for _, check := range checks {
+		if check.value != "" && !containsString(check.allowed, check.value) {
+			return NewError(fmt.Sprintf(
+				"invalid %s: %s. Allowed values are: %s",
+				check.name, check.value, strings.Join(check.allowed, ", "),
+			), BadRequest)
+		}
+	}
+
+	if o.SSEKMSKeyID != "" && o.SSE != "" && o.SSE != s3.ServerSideEncryptionAwsKms {
+		return NewError("invalid sse: sseKmsKeyId requires aws:kms encryption", BadRequest)
+	}
+
+	return nil
+}
+
+// newUploadOptions builds the options of a processed image upload. The content
+// type defaults to the image MIME type, then configured and request options
+// are applied in order. The configured ACL and encryption are a policy, which
+// request options cannot override.
+func newUploadOptions(r *http.Request, image Image) (UploadOptions, error) {
+	params, err := parseUploadOptions(r.URL.Query())
+	if err != nil {
+		return UploadOptions{}, err
+	}
+
+	o := UploadOptions{ContentType: image.Mime}.Merge(uploadDefaults).Merge(params)
+	if uploadDefaults.ACL != "" {
+		o.ACL = uploadDefaults.ACL
+	}
+	if uploadDefaults.SSE != "" || uploadDefaults.SSEKMSKeyID != "" {
+		o.SSE, o.SSEKMSKeyID = uploadDefaults.SSE, uploadDefaults.SSEKMSKeyID
+	}
+	if err := o.Validate(); err != nil {
+		return UploadOptions{}, err
+	}
+
+	return o, nil
+}
+
+// newFileUploadOptions builds the options of a generated file upload, such as
+// Deep Zoom tiles, guessing the content type from the file extension.
+func newFileUploadOptions(data []byte, fileKey string) UploadOptions {
+	contentType := mime.TypeByExtension(path.Ext(fileKey))
+	if contentType == "" && len(data) > 0 {
+		contentType = http.DetectContentType(data)
+	}
+	if contentType == "" {
+		// Streamed uploads do not know the data beforehand
+		contentType = "application/octet-stream"
+	}
+
+	return UploadOptions{ContentType: contentType}.Merge(uploadDefaults)
+}
+
+func parseUploadOptions(query url.Values) (UploadOptions, error) {
+	metadata, err := parseKeyValuePairs(query.Get("metadata"))
+	if err != nil {
+		return UploadOptions{}, NewError("invalid metadata: "+err.Error(), BadRequest)
+	}
+
+	tags, err := parseKeyValuePairs(query.Get("tags"))
+	if err != nil {
+		return UploadOptions{}, NewError("invalid tags: "+err.Error(), BadRequest)
+	}
+
+	return UploadOptions{
+		ContentType:        query.Get("contentType"),
+		CacheControl:       query.Get("cacheControl"),
+		ContentDisposition: query.Get("contentDisposition"),
+		Metadata:           metadata,
+		ACL:                query.Get("acl"),
+		StorageClass:       query.Get("storageClass"),
+		Tags:               tags,
+		SSE:                query.Get("sse"),
+		SSEKMSKeyID:        query.Get("sseKmsKeyId"),
+		AccessTier:         query.Get("accessTier"),
+	}, nil
+}
+
+// parseKeyValuePairs parses a comma separated list of pairs, such as
+// "author:john,source:upload".
+func parseKeyValuePairs(input string) (map[string]string, error) {
+	if strings.TrimSpace(input) == "" {
+		return nil, nil
+	}
+
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(input, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("expected key:value pair, got %q", pair)
+		}
+		pairs[key] = strings.TrimSpace(parts[1])
+	}
+
+	return pairs, nil
+}
+
+// applyS3 sets the options on an S3 put object request.
+func (o UploadOptions) applyS3(input *s3.PutObjectInput) {
+	setString := func(field **string, value string) {
+		if value != "" {
+			*field = aws.String(value)
+		}
+	}
+
+	setString(&input.ContentType, o.ContentType)
+	setString(&input.CacheControl, o.CacheControl)
+	setString(&input.ContentDisposition, o.ContentDisposition)
+	setString(&input.ACL, o.ACL)
+	setString(&input.StorageClass, o.StorageClass)
+	setString(&input.ServerSideEncryption, o.SSE)
+	setString(&input.SSEKMSKeyId, o.SSEKMSKeyID)
+
+	if o.SSEKMSKeyID != "" && o.SSE == "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+	}
+
+	if len(o.Metadata) > 0 {
+		input.Metadata = aws.StringMap(o.Metadata)
+	}
+
+	if len(o.Tags) > 0 {
+		tags := url.Values{}
+		for key, value := range o.Tags {
+			tags.Set(key, value)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+}
+
+// azureHeaders returns the blob HTTP headers and metadata of the options.
+func (o UploadOptions) azureHeaders() (azblob.BlobHTTPHeaders, azblob.Metadata) {
+	headers := azblob.BlobHTTPHeaders{
+		ContentType:        o.ContentType,
+		CacheControl:       o.CacheControl,
+		ContentDisposition: o.ContentDisposition,
+	}
+
+	return headers, azblob.Metadata(o.Metadata)
+}
+
+func mergeStringMaps(base, other map[string]string) map[string]string {
+	if len(other) == 0 {
+		return base
+	}
+
+	merged := make(map[string]string, len(base)+len(other))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range other {
+		merged[key] = value
+	}
+	return merged
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
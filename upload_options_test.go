@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestNewUploadOptions(t *testing.T) {
+	uploadDefaults = UploadOptions{
+		CacheControl: "max-age=60",
+		ACL:          "private",
+		Metadata:     map[string]string{"source": "imaginary", "team": "media"},
+	}
+	defer func() { uploadDefaults = UploadOptions{} }()
+
+	u, _ := url.Parse("http://foo?cacheControl=no-cache&metadata=team:web,author:john&storageClass=STANDARD_IA")
+	o, err := newUploadOptions(&http.Request{URL: u}, Image{Mime: "image/webp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.ContentType != "image/webp" {
+		t.Errorf("Content type must default to the image MIME type: %s", o.ContentType)
+	}
+	if o.CacheControl != "no-cache" || o.ACL != "private" || o.StorageClass != "STANDARD_IA" {
+		t.Errorf("Invalid options: %#v", o)
+	}
+	if o.Metadata["source"] != "imaginary" || o.Metadata["team"] != "web" || o.Metadata["author"] != "john" {
+		t.Errorf("Invalid metadata: %#v", o.Metadata)
+	}
+	if uploadDefaults.Metadata["team"] != "media" {
+		t.Error("Configured metadata must not be modified")
+	}
+}
+
+func TestNewUploadOptionsPolicy(t *testing.T) {
+	uploadDefaults = UploadOptions{ACL: "private", SSE: "aws:kms", SSEKMSKeyID: "configured"}
+	defer func() { uploadDefaults = UploadOptions{} }()
+
+	// The configured ACL and encryption cannot be downgraded by a request
+	for _, query := range []string{"acl=public-read-write&sse=AES256", "sseKmsKeyId=other", "sse=aws:kms&sseKmsKeyId=other"} {
+		u, _ := url.Parse("http://foo?" + query)
+		o, err := newUploadOptions(&http.Request{URL: u}, Image{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.ACL != "private" || o.SSE != "aws:kms" || o.SSEKMSKeyID != "configured" {
+			t.Errorf("Configured options must not be overridden by %s: %#v", query, o)
+		}
+	}
+
+	uploadDefaults = UploadOptions{SSE: "AES256"}
+	u, _ := url.Parse("http://foo?sse=aws:kms&sseKmsKeyId=other&acl=public-read")
+	o, err := newUploadOptions(&http.Request{URL: u}, Image{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.SSE != "AES256" || o.SSEKMSKeyID != "" || o.ACL != "public-read" {
+		t.Errorf("Invalid options: %#v", o)
+	}
+}
+
+func TestNewUploadOptionsInvalid(t *testing.T) {
+	for _, query := range []string{"acl=everyone", "storageClass=FAST", "sse=rot13", "accessTier=Warm", "metadata=foo", "sse=AES256&sseKmsKeyId=key"} {
+		u, _ := url.Parse("http://foo?" + query)
+		if _, err := newUploadOptions(&http.Request{URL: u}, Image{}); err == nil {
+			t.Errorf("Invalid options must fail: %s", query)
+		}
+	}
+}
+
+func TestUploadOptionsApplyS3(t *testing.T) {
+	o := UploadOptions{
+		ContentType:        "image/png",
+		CacheControl:       "max-age=60",
+		ContentDisposition: "inline",
+		Metadata:           map[string]string{"author": "john"},
+		ACL:                "public-read",
+		Tags:               map[string]string{"team": "media", "env": "prod"},
+		SSEKMSKeyID:        "key",
+	}
+
+	input := newS3PutObjectInput("bucket", "key.png", []byte("image"), o)
+	if aws.StringValue(input.ContentType) != "image/png" ||
+		aws.StringValue(input.CacheControl) != "max-age=60" ||
+		aws.StringValue(input.ContentDisposition) != "inline" ||
+		aws.StringValue(input.ACL) != "public-read" {
+		t.Errorf("Invalid headers: %s", input)
+	}
+	if aws.StringValue(input.Metadata["author"]) != "john" {
+		t.Errorf("Invalid metadata: %s", input)
+	}
+	if aws.StringValue(input.Tagging) != "env=prod&team=media" {
+		t.Errorf("Invalid tagging: %s", aws.StringValue(input.Tagging))
+	}
+	if aws.StringValue(input.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms || aws.StringValue(input.SSEKMSKeyId) != "key" {
+		t.Errorf("KMS key must enable SSE-KMS: %s", input)
+	}
+	if input.StorageClass != nil {
+		t.Error("Empty options must not be set")
+	}
+}
+
+func TestUploadOptionsAzureHeaders(t *testing.T) {
+	headers, metadata := UploadOptions{
+		ContentType:  "image/jpeg",
+		CacheControl: "max-age=60",
+		Metadata:     map[string]string{"author": "john"},
+	}.azureHeaders()
+
+	if headers.ContentType != "image/jpeg" || headers.CacheControl != "max-age=60" {
+		t.Errorf("Invalid headers: %#v", headers)
+	}
+	if metadata["author"] != "john" {
+		t.Errorf("Invalid metadata: %#v", metadata)
+	}
+}
+
+func TestNewFileUploadOptions(t *testing.T) {
+	if o := newFileUploadOptions([]byte("image"), "tiles/0/0_0.jpeg"); o.ContentType != "image/jpeg" {
+		t.Errorf("Invalid content type: %s", o.ContentType)
+	}
+	if o := newFileUploadOptions([]byte("pending"), "image.unknown"); o.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("Invalid content type: %s", o.ContentType)
+	}
+}